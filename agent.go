@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// defaultAgentAddress is where "docker-cr agent" listens by default.
+const defaultAgentAddress = ":5000"
+
+// agentChunkSize is the size of the archive pieces sent over gRPC, well
+// under its 4 MiB default message limit.
+const agentChunkSize = 1 << 20
+
+// agentServer runs checkpoints and restores for docker-cr on other hosts;
+// see agent.proto. Operations run one at a time: like a docker-cr command,
+// each uses the process-wide logger and audit record.
+type agentServer struct {
+	UnimplementedAgentServer
+	mu sync.Mutex
+}
+
+// AgentTLS holds the certificate files of an agent or its client. An agent
+// without a certificate only serves with --insecure.
+type AgentTLS struct {
+	// CertFile and KeyFile are this side's certificate
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the other side: the agent's certificate for a
+	// client, client certificates for an agent, which then requires them
+	CAFile   string
+	Insecure bool
+}
+
+// runAgent serves the agent API on address until SIGINT or SIGTERM, then
+// lets the running operation finish.
+func runAgent(address string, tlsFiles AgentTLS) error {
+	var opts []grpc.ServerOption
+	if tlsFiles.CertFile != "" {
+		config, err := agentServerTLS(tlsFiles)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	} else if !tlsFiles.Insecure {
+		return fmt.Errorf("the agent checkpoints and restores for anyone who can reach it; give --tls-cert and --tls-key, or --insecure")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	server := grpc.NewServer(opts...)
+	RegisterAgentServer(server, &agentServer{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logInfof("Agent: %s received, stopping once the running operation ends", sig)
+		server.GracefulStop()
+	}()
+
+	if tlsFiles.CertFile == "" {
+		logWarnf("agent listening on %s without TLS; anyone who can reach it can checkpoint and restore on this host", listener.Addr())
+	} else {
+		logInfof("Agent listening on %s", listener.Addr())
+	}
+	return server.Serve(listener)
+}
+
+// agentServerTLS loads the agent's certificate and, with a CA file,
+// requires clients to present a certificate it signed.
+func agentServerTLS(tlsFiles AgentTLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tlsFiles.CertFile, tlsFiles.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load agent certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if tlsFiles.CAFile != "" {
+		pool, err := loadCertPool(tlsFiles.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return pool, nil
+}
+
+// begin serializes an operation and gives it a logger of its own, since
+// setLogFields adds to the process-wide one. The returned func ends it.
+func (a *agentServer) begin(ctx context.Context, operation, target string) func() {
+	a.mu.Lock()
+	base := logger
+	client := "unknown client"
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+	}
+	logInfof("Agent: %s of %s requested by %s", operation, target, client)
+	return func() {
+		logger = base
+		a.mu.Unlock()
+	}
+}
+
+// Checkpoint dumps the target into the requested directory, or a temporary
+// one, and streams it back as a tar archive.
+func (a *agentServer) Checkpoint(req *CheckpointRequest, stream Agent_CheckpointServer) error {
+	if req.GetTarget() == "" {
+		return status.Error(codes.InvalidArgument, "no container or PID to checkpoint")
+	}
+	defer a.begin(stream.Context(), "checkpoint", req.GetTarget())()
+
+	checkpointDir := req.GetCheckpointDir()
+	if checkpointDir == "" {
+		tmpDir, err := os.MkdirTemp("", "docker-cr-agent-")
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to create temporary checkpoint directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		checkpointDir = tmpDir
+	}
+
+	cfg := &CheckpointConfig{
+		LogLevel:      defaultCRIULogLevel,
+		FDLimit:       defaultFDLimit,
+		Type:          checkpointTypeFull,
+		StopAfterDump: req.GetStopAfterDump(),
+		timings:       newTimings(),
+	}
+	startAudit("checkpoint", req.GetTarget(), checkpointDir)
+	started := time.Now()
+	if err := createCheckpoint(req.GetTarget(), checkpointDir, cfg); err != nil {
+		audit.record(err.Error())
+		return status.Errorf(codes.Internal, "checkpoint of %s failed: %v", req.GetTarget(), err)
+	}
+	cfg.timings.finish()
+	audit.record("")
+	if req.GetCheckpointDir() != "" {
+		if entry, err := registerCheckpoint(req.GetTarget(), checkpointDir, time.Since(started), cfg.timings); err != nil {
+			logWarnf("failed to register checkpoint: %v", err)
+		} else {
+			logInfof("Registered checkpoint %d for %s", entry.ID, entry.Container)
+		}
+	}
+
+	logInfof("Agent: sending checkpoint of %s", req.GetTarget())
+	w := bufio.NewWriterSize(chunkWriter(func(data []byte) error {
+		return stream.Send(&ArchiveChunk{Data: data})
+	}), agentChunkSize)
+	if err := writeCheckpointTar(checkpointDir, w, req.GetCompress()); err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return status.Errorf(codes.Unavailable, "failed to send checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Restore restores a checkpoint on this host, received from the client
+// unless the options name a directory here.
+func (a *agentServer) Restore(stream Agent_RestoreServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	opts := first.GetOptions()
+	if opts == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the restore options")
+	}
+	target := opts.GetContainerId()
+	if target == "" {
+		target = "process"
+	}
+	defer a.begin(stream.Context(), "restore", target)()
+
+	checkpointDir := opts.GetCheckpointDir()
+	if checkpointDir == "" {
+		tmpDir, err := os.MkdirTemp("", "docker-cr-agent-")
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to create temporary checkpoint directory: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		checkpointDir = tmpDir
+
+		archive := &chunkReader{recv: func() ([]byte, error) {
+			req, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			return req.GetChunk().GetData(), nil
+		}}
+		if err := extractCheckpointTar(archive, checkpointDir, opts.GetCompressed()); err != nil {
+			return status.Errorf(codes.InvalidArgument, "failed to receive checkpoint: %v", err)
+		}
+		if err := verifyCheckpoint(checkpointDir); err != nil {
+			return status.Errorf(codes.InvalidArgument, "received checkpoint is damaged: %v", err)
+		}
+	}
+
+	var args []string
+	if opts.GetContainerId() != "" {
+		args = []string{checkpointDir, opts.GetContainerId()}
+	}
+	startAudit("restore", restoreTarget(args, checkpointDir), checkpointDir)
+	cfg := &RestoreConfig{LogLevel: defaultCRIULogLevel, timings: newTimings()}
+	started := time.Now()
+	if opts.GetContainerId() != "" {
+		err = restoreContainer(opts.GetContainerId(), checkpointDir, cfg)
+	} else {
+		err = restoreSimpleProcess(checkpointDir, cfg)
+	}
+	if err != nil {
+		audit.record(err.Error())
+		return status.Errorf(codes.Internal, "restore of %s failed: %v", target, err)
+	}
+	audit.record("")
+
+	logInfof("Agent: restored %s", target)
+	return stream.SendAndClose(&RestoreResponse{DurationSeconds: time.Since(started).Seconds()})
+}
+
+// ListCheckpoints returns the entries of this host's registry.
+func (a *agentServer) ListCheckpoints(ctx context.Context, req *ListCheckpointsRequest) (*ListCheckpointsResponse, error) {
+	entries, err := registryEntries(req.GetContainer())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	resp := &ListCheckpointsResponse{}
+	for _, entry := range entries {
+		resp.Checkpoints = append(resp.Checkpoints, &Checkpoint{
+			Id:        int64(entry.ID),
+			Container: entry.Container,
+			Image:     entry.Image,
+			Path:      entry.Path,
+			Size:      entry.Size,
+			Timestamp: entry.Timestamp.Unix(),
+			Mode:      entry.Mode,
+			Stale:     entry.Stale(),
+		})
+	}
+	return resp, nil
+}
+
+// chunkWriter sends each write as one message; wrap it in a bufio.Writer
+// for messages of a useful size.
+type chunkWriter func([]byte) error
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	// The message is marshaled before Send returns, so p may be reused
+	if err := w(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data of a stream of messages until it ends.
+type chunkReader struct {
+	recv func() ([]byte, error)
+	buf  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// dialAgent connects to the agent at address.
+func dialAgent(address string, tlsFiles AgentTLS) (*grpc.ClientConn, AgentClient, error) {
+	creds := insecure.NewCredentials()
+	if !tlsFiles.Insecure {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if tlsFiles.CAFile != "" {
+			pool, err := loadCertPool(tlsFiles.CAFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			config.RootCAs = pool
+		}
+		if tlsFiles.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(tlsFiles.CertFile, tlsFiles.KeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		creds = credentials.NewTLS(config)
+	}
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to agent %s: %w", address, err)
+	}
+	return conn, NewAgentClient(conn), nil
+}
+
+// remoteCheckpoint has the agent at address checkpoint target and unpacks
+// the checkpoint it streams back into checkpointDir.
+func remoteCheckpoint(address string, tlsFiles AgentTLS, req *CheckpointRequest, checkpointDir string) error {
+	conn, client, err := dialAgent(address, tlsFiles)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+
+	logInfof("Asking agent %s to checkpoint %s...", address, req.GetTarget())
+	stream, err := client.Checkpoint(context.Background(), req)
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", address, err)
+	}
+	// A failed checkpoint ends the stream with the agent's error, which
+	// explains a broken archive better than the archive does
+	var streamErr error
+	archive := &chunkReader{recv: func() ([]byte, error) {
+		chunk, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				streamErr = agentError(err)
+			}
+			return nil, err
+		}
+		return chunk.GetData(), nil
+	}}
+	err = extractCheckpointTar(archive, checkpointDir, req.GetCompress())
+	if err == nil {
+		_, err = io.Copy(io.Discard, archive)
+	}
+	if streamErr != nil {
+		return fmt.Errorf("agent %s: %w", address, streamErr)
+	} else if err != nil {
+		return fmt.Errorf("checkpoint from agent %s: %w", address, err)
+	}
+
+	if err := verifyCheckpoint(checkpointDir); err != nil {
+		return fmt.Errorf("checkpoint received from agent %s is damaged: %w", address, err)
+	}
+	logInfof("Checkpoint of %s received from agent %s into %s", req.GetTarget(), address, checkpointDir)
+	return nil
+}
+
+// remoteRestore has the agent at address restore a checkpoint: the local
+// checkpointDir, sent to it, or with onAgent a directory on its host.
+func remoteRestore(address string, tlsFiles AgentTLS, checkpointDir, containerID string, onAgent, compress bool) error {
+	conn, client, err := dialAgent(address, tlsFiles)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := client.Restore(context.Background())
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", address, err)
+	}
+	opts := &RestoreOptions{ContainerId: containerID, Compressed: compress}
+	if onAgent {
+		opts.CheckpointDir = checkpointDir
+	}
+	if err := stream.Send(&RestoreRequest{Request: &RestoreRequest_Options{Options: opts}}); err != nil {
+		return fmt.Errorf("agent %s: %w", address, agentError(err))
+	}
+
+	if !onAgent {
+		logInfof("Sending %s to agent %s...", checkpointDir, address)
+		w := bufio.NewWriterSize(chunkWriter(func(data []byte) error {
+			return stream.Send(&RestoreRequest{Request: &RestoreRequest_Chunk{Chunk: &ArchiveChunk{Data: data}}})
+		}), agentChunkSize)
+		err := writeCheckpointTar(checkpointDir, w, compress)
+		if err == nil {
+			err = w.Flush()
+		}
+		// An agent that gave up closes the stream; its reason comes with
+		// CloseAndRecv
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("agent %s: %w", address, err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", address, agentError(err))
+	}
+	logInfof("Agent %s restored the checkpoint in %.1fs", address, resp.GetDurationSeconds())
+	return nil
+}
+
+// remoteListCheckpoints prints the registry of the agent at address.
+func remoteListCheckpoints(address string, tlsFiles AgentTLS, container string) error {
+	conn, client, err := dialAgent(address, tlsFiles)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := client.ListCheckpoints(context.Background(), &ListCheckpointsRequest{Container: container})
+	if err != nil {
+		return fmt.Errorf("agent %s: %w", address, agentError(err))
+	}
+
+	entries := make([]*RegistryEntry, 0, len(resp.GetCheckpoints()))
+	stale := make(map[*RegistryEntry]bool)
+	for _, checkpoint := range resp.GetCheckpoints() {
+		entry := &RegistryEntry{
+			ID:        int(checkpoint.GetId()),
+			Container: checkpoint.GetContainer(),
+			Image:     checkpoint.GetImage(),
+			Path:      checkpoint.GetPath(),
+			Size:      checkpoint.GetSize(),
+			Timestamp: time.Unix(checkpoint.GetTimestamp(), 0),
+			Mode:      checkpoint.GetMode(),
+		}
+		entries = append(entries, entry)
+		stale[entry] = checkpoint.GetStale()
+	}
+	printRegistryEntries(entries, func(entry *RegistryEntry) bool { return stale[entry] })
+	return nil
+}
+
+// agentError turns the gRPC status of a failed call into the agent's own
+// message.
+func agentError(err error) error {
+	if s, ok := status.FromError(err); ok && s.Code() != codes.OK {
+		return errors.New(s.Message())
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startTestAgent serves an agent on a loopback port and returns a client
+// connected to it.
+func startTestAgent(t *testing.T) AgentClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	server := grpc.NewServer()
+	RegisterAgentServer(server, &agentServer{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, client, err := dialAgent(listener.Addr().String(), AgentTLS{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client
+}
+
+func TestAgentListCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept")
+	if err := os.Mkdir(kept, 0755); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	reg := &Registry{NextID: 3, Entries: []*RegistryEntry{
+		{ID: 1, Container: "web", Path: kept, Size: 1 << 20, Timestamp: created, Mode: "docker-native"},
+		{ID: 2, Container: "db", Path: filepath.Join(dir, "removed"), Timestamp: created.Add(time.Hour), Mode: "direct"},
+	}}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := registryPath
+	registryPath = filepath.Join(dir, "registry.json")
+	t.Cleanup(func() { registryPath = saved })
+	if err := os.WriteFile(registryPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := startTestAgent(t)
+	resp, err := client.ListCheckpoints(context.Background(), &ListCheckpointsRequest{})
+	if err != nil {
+		t.Fatalf("ListCheckpoints: %v", err)
+	}
+	got := resp.GetCheckpoints()
+	if len(got) != 2 {
+		t.Fatalf("got %d checkpoints, want 2", len(got))
+	}
+	if got[0].GetId() != 1 || got[0].GetContainer() != "web" || got[0].GetSize() != 1<<20 ||
+		got[0].GetTimestamp() != created.Unix() || got[0].GetStale() {
+		t.Errorf("first checkpoint = %v", got[0])
+	}
+	if got[1].GetId() != 2 || !got[1].GetStale() {
+		t.Errorf("second checkpoint = %v, want the stale one", got[1])
+	}
+
+	resp, err = client.ListCheckpoints(context.Background(), &ListCheckpointsRequest{Container: "db"})
+	if err != nil {
+		t.Fatalf("ListCheckpoints: %v", err)
+	}
+	if len(resp.GetCheckpoints()) != 1 || resp.GetCheckpoints()[0].GetContainer() != "db" {
+		t.Errorf("filtered list = %v, want only db", resp.GetCheckpoints())
+	}
+}
+
+func TestAgentRestoreRejectsEscapingArchive(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	body := []byte("x")
+	if err := tw.WriteHeader(&tar.Header{Name: "../escaped.img", Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(body)
+	tw.Close()
+
+	client := startTestAgent(t)
+	stream, err := client.Restore(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&RestoreRequest{Request: &RestoreRequest_Options{Options: &RestoreOptions{}}}); err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&RestoreRequest{Request: &RestoreRequest_Chunk{Chunk: &ArchiveChunk{Data: archive.Bytes()}}})
+
+	_, err = stream.CloseAndRecv()
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"inventory.img":      "inventory",
+		"pages-1.img":        string(bytes.Repeat([]byte("p"), 3*agentChunkSize/2)),
+		"process/meta.json":  "{}",
+		"process/pstree.img": "tree",
+	}
+	for name, data := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, compress := range []bool{false, true} {
+		// Stand in for the gRPC stream: each chunk is a separate message
+		var chunks [][]byte
+		w := chunkWriter(func(data []byte) error {
+			chunks = append(chunks, append([]byte(nil), data...))
+			return nil
+		})
+		if err := writeCheckpointTar(src, w, compress); err != nil {
+			t.Fatal(err)
+		}
+		r := &chunkReader{recv: func() ([]byte, error) {
+			if len(chunks) == 0 {
+				return nil, io.EOF
+			}
+			data := chunks[0]
+			chunks = chunks[1:]
+			return data, nil
+		}}
+
+		dst := t.TempDir()
+		if err := extractCheckpointTar(r, dst, compress); err != nil {
+			t.Fatalf("compress=%v: %v", compress, err)
+		}
+		for name, want := range files {
+			got, err := os.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Errorf("compress=%v: %v", compress, err)
+			} else if string(got) != want {
+				t.Errorf("compress=%v: %s has %d bytes, want %d", compress, name, len(got), len(want))
+			}
+		}
+	}
+}
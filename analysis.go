@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// analysisFile holds the ProcessInfo of the dumped process.
+const analysisFile = "analysis.json"
+
+// analysisVersion is the current analysis.json schema. Bump it whenever a
+// field changes meaning or is removed, and teach upgradeAnalysis to convert
+// the older form. Adding a field does not need a bump: older files simply
+// leave it at its zero value.
+const analysisVersion = 1
+
+// saveAnalysis writes info to analysis.json in checkpointDir.
+func saveAnalysis(checkpointDir string, info *ProcessInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, analysisFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", analysisFile, err)
+	}
+	return nil
+}
+
+// loadAnalysis reads analysis.json from checkpointDir, upgrading older
+// schema versions. The error wraps os.ErrNotExist when there is none.
+func loadAnalysis(checkpointDir string) (*ProcessInfo, error) {
+	data, err := os.ReadFile(filepath.Join(checkpointDir, analysisFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", analysisFile, err)
+	}
+
+	info := &ProcessInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", analysisFile, err)
+	}
+	if info.Version > analysisVersion {
+		return nil, fmt.Errorf("%s has schema version %d, newer than supported version %d", analysisFile, info.Version, analysisVersion)
+	}
+
+	return upgradeAnalysis(info), nil
+}
+
+// upgradeAnalysis converts an analysis from an older schema to the current
+// one. Version 0 is a file written without a version field.
+func upgradeAnalysis(info *ProcessInfo) *ProcessInfo {
+	if info.Version < 1 {
+		info.Version = 1
+	}
+	return info
+}
+
+// printProcessInfo prints the analysis in the format used before a dump.
+func printProcessInfo(info *ProcessInfo) {
+	fmt.Printf("Process analysis for PID %d:\n", info.PID)
+	fmt.Printf("  Name: %s\n", info.ProcessName)
+	fmt.Printf("  State: %s\n", info.State)
+	printArch(info.Arch)
+	for _, t := range info.Tracers {
+		fmt.Printf("    thread %d traced by %d (%s)\n", t.TID, t.TracerPID, t.Name)
+	}
+	fmt.Printf("  TCP connections: %v\n", info.HasTCP)
+	for _, conn := range info.TCPConnections {
+		fmt.Printf("    %s\n", conn)
+	}
+	fmt.Printf("  UDP sockets: %v\n", info.HasUDP)
+	if len(info.BoundPorts) > 0 {
+		fmt.Printf("  Bound ports: %d\n", len(info.BoundPorts))
+		for _, port := range info.BoundPorts {
+			fmt.Printf("    %s\n", port)
+		}
+	}
+	fmt.Printf("  Unix sockets: %v\n", info.HasUnixSockets)
+	fmt.Printf("  Pipes: %v\n", info.HasPipes)
+	if info.HasMQ {
+		fmt.Printf("  POSIX message queues: %s\n", strings.Join(info.MQNames, ", "))
+	}
+	fmt.Printf("  eBPF fds: %d\n", info.BPFFdCount)
+	if info.FDCount > 0 {
+		fmt.Printf("  File descriptors: %d (%s)\n", info.FDCount, formatFDTypes(info.FDTypes))
+	}
+	printSharedMemory(info.SharedMemory)
+	printLockedMemory(info)
+	printWatches(info.Watches)
+	printNetlinkSockets(info.NetlinkSockets)
+	printUnsupportedFDs(info.UnsupportedFDs)
+}
+
+// analyzeTarget analyzes a PID or the main process of a container and prints
+// the result, as JSON in the analysis.json schema when asJSON is set.
+func analyzeTarget(target string, asJSON, compress bool, throughput float64) error {
+	pid, err := resolveTargetPID(target)
+	if err != nil {
+		return err
+	}
+
+	info, err := analyzeProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to analyze process: %w", err)
+	}
+
+	container := ""
+	if _, err := strconv.Atoi(target); err != nil {
+		container = target
+	}
+	info.Estimate = estimateCheckpoint(pid, info, container, compress, throughput)
+	info.Assessment = assessCheckpointability(info, "")
+
+	if !asJSON {
+		printProcessInfo(info)
+		printSession(info.Session)
+		fmt.Printf("  Shell job: %v\n", info.ShellJob)
+		printMappedFiles(info.MappedFiles)
+		printOpenFiles(info.OpenFiles)
+		printDeletedFiles(info.DeletedFiles)
+		printEstimate(info.Estimate)
+		fmt.Println()
+		printAssessment(info.Assessment)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// anonFDType is an anon-inode file type CRIU cannot dump. Feature is the
+// name the error gives, and what "criu check --feature" is asked about: a
+// CRIU that learns to dump the type and names it so is let through. eBPF fds
+// are handled separately with --ignore-bpf.
+type anonFDType struct {
+	prefix  string
+	Kind    string
+	Feature string
+}
+
+var unsupportedAnonFDs = []anonFDType{
+	{"anon_inode:[io_uring]", "io_uring", "io_uring"},
+	{"anon_inode:[pidfd]", "pidfd", "pidfd"},
+	{"anon_inode:[userfaultfd]", "userfaultfd", "userfaultfd"},
+	{"anon_inode:[perf_event]", "perf_event", "perf_event"},
+	{"anon_inode:kvm-", "KVM", "kvm"},
+}
+
+// UnsupportedFD is an fd of a type from unsupportedAnonFDs.
+type UnsupportedFD struct {
+	PID     int    `json:"pid"`
+	FD      int    `json:"fd"`
+	Kind    string `json:"kind"`
+	Feature string `json:"feature"`
+}
+
+// findUnsupportedFDs lists the fds in the tree rooted at pid that CRIU
+// cannot dump. Every process is checked: the dump fails on any of them.
+func findUnsupportedFDs(pid int) []UnsupportedFD {
+	var found []UnsupportedFD
+	for _, p := range processTree(pid) {
+		fdDir := fmt.Sprintf("/proc/%d/fd", p)
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			linkTarget, err := os.Readlink(fmt.Sprintf("%s/%s", fdDir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			for _, t := range unsupportedAnonFDs {
+				if strings.HasPrefix(linkTarget, t.prefix) {
+					fd, _ := strconv.Atoi(entry.Name())
+					found = append(found, UnsupportedFD{PID: p, FD: fd, Kind: t.Kind, Feature: t.Feature})
+					break
+				}
+			}
+		}
+	}
+	return found
+}
+
+// criuSupportsFeature asks the local criu whether it has a feature. An
+// unknown feature name, or no criu binary, counts as unsupported.
+func criuSupportsFeature(feature string) bool {
+	return exec.Command("criu", "check", "--feature", feature).Run() == nil
+}
+
+// checkUnsupportedFDs fails when the tree holds fds of a type the local CRIU
+// does not support, listing where each one is.
+func checkUnsupportedFDs(fds []UnsupportedFD) error {
+	byFeature := make(map[string][]UnsupportedFD)
+	var features []string
+	for _, fd := range fds {
+		if _, seen := byFeature[fd.Feature]; !seen {
+			features = append(features, fd.Feature)
+		}
+		byFeature[fd.Feature] = append(byFeature[fd.Feature], fd)
+	}
+	sort.Strings(features)
+
+	var problems []string
+	for _, feature := range features {
+		if criuSupportsFeature(feature) {
+			logWarnf("CRIU reports support for %s; dumping %d %s fd(s)", feature, len(byFeature[feature]), byFeature[feature][0].Kind)
+			continue
+		}
+		var where []string
+		for _, fd := range byFeature[feature] {
+			where = append(where, fmt.Sprintf("pid %d fd %d", fd.PID, fd.FD))
+		}
+		problems = append(problems, fmt.Sprintf("%s (%s): CRIU feature %q is not supported", byFeature[feature][0].Kind, strings.Join(where, ", "), feature))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("process tree holds file descriptors CRIU cannot checkpoint: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// printUnsupportedFDs lists the unsupported fds of an analysis.
+func printUnsupportedFDs(fds []UnsupportedFD) {
+	if len(fds) == 0 {
+		return
+	}
+
+	fmt.Printf("  Unsupported fds: %d\n", len(fds))
+	for _, fd := range fds {
+		fmt.Printf("    pid %d fd %d: %s\n", fd.PID, fd.FD, fd.Kind)
+	}
+}
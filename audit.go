@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// auditLogPath is the append-only record of every checkpoint and restore.
+// It can be moved with DOCKER_CR_AUDIT_LOG.
+var auditLogPath = "/var/log/docker-cr/audit.jsonl"
+
+func init() {
+	if path := os.Getenv("DOCKER_CR_AUDIT_LOG"); path != "" {
+		auditLogPath = path
+	}
+}
+
+// Results of an audited operation
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// secretFlags are the flags whose whole value is a secret: a Slack webhook
+// URL grants posting to the channel.
+var secretFlags = map[string]bool{"notify-slack": true}
+
+// commandLine is the command line as invoked, before the global flags are
+// taken out of os.Args.
+var commandLine []string
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	UID  int       `json:"uid"`
+	User string    `json:"user,omitempty"`
+	// SudoUser is who ran docker-cr through sudo
+	SudoUser  string   `json:"sudo_user,omitempty"`
+	Command   []string `json:"command"`
+	Operation string   `json:"operation"`
+	// Target is the container or PID checkpointed or restored
+	Target          string  `json:"target,omitempty"`
+	CheckpointDir   string  `json:"checkpoint_dir,omitempty"`
+	Result          string  `json:"result"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// auditRecord is the entry of the running operation, written when it ends.
+type auditRecord struct {
+	entry   AuditEntry
+	started time.Time
+	written bool
+}
+
+// audit records the running operation; nil before it starts.
+var audit *auditRecord
+
+// startAudit starts the audit entry of operation on target.
+func startAudit(operation, target, checkpointDir string) {
+	uid := os.Getuid()
+	entry := AuditEntry{
+		UID:           uid,
+		SudoUser:      os.Getenv("SUDO_USER"),
+		Command:       redactCommandLine(commandLine),
+		Operation:     operation,
+		Target:        target,
+		CheckpointDir: checkpointDir,
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		entry.User = u.Username
+	}
+	if abs, err := filepath.Abs(checkpointDir); err == nil && checkpointDir != "" && checkpointDir != "-" {
+		entry.CheckpointDir = abs
+	}
+	audit = &auditRecord{entry: entry, started: time.Now()}
+}
+
+// setCheckpointDir records where the checkpoint went once it is known.
+func (a *auditRecord) setCheckpointDir(dir string) {
+	if a == nil {
+		return
+	}
+	a.entry.CheckpointDir = dir
+}
+
+// record appends the entry to the audit log, once: failed with msg, or
+// successful if msg is empty. The log is best-effort; a failure to write
+// it is only a warning.
+func (a *auditRecord) record(msg string) {
+	if a == nil || a.written {
+		return
+	}
+	a.written = true
+
+	a.entry.Time = time.Now().UTC()
+	a.entry.DurationSeconds = time.Since(a.started).Seconds()
+	a.entry.Result = auditSuccess
+	if msg != "" {
+		a.entry.Result = auditFailure
+		a.entry.Error = msg
+	}
+	if err := appendAuditEntry(&a.entry); err != nil {
+		logWarnf("failed to write audit log: %v", err)
+	}
+}
+
+// appendAuditEntry appends entry as one line, written with a single write
+// under an exclusive lock so concurrent runs never interleave.
+func appendAuditEntry(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(auditLogPath), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", auditLogPath, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to %s: %w", auditLogPath, err)
+	}
+	return nil
+}
+
+// redactCommandLine returns args with secrets replaced by REDACTED: the
+// values of secretFlags, passwords in URLs, and the values of NAME=value
+// arguments whose name matches defaultRedactPatterns.
+func redactCommandLine(args []string) []string {
+	redacted := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && secretFlags[name] {
+			if hasValue {
+				redacted[i] = arg[:len(arg)-len(value)] + redactedValue
+			} else {
+				redacted[i] = arg
+				if i+1 < len(args) {
+					i++
+					redacted[i] = redactedValue
+				}
+			}
+			continue
+		}
+		redacted[i] = redactArgument(arg)
+	}
+	return redacted
+}
+
+// redactArgument scrubs the password of a URL, or the value of a
+// NAME=value whose name looks secret, from one argument.
+func redactArgument(arg string) string {
+	if name, value, ok := strings.Cut(arg, "="); ok {
+		bare := strings.ToUpper(strings.TrimLeft(name, "-"))
+		for _, pattern := range defaultRedactPatterns {
+			if matched, _ := path.Match(pattern, bare); matched {
+				return name + "=" + redactedValue
+			}
+		}
+		// --flag=URL
+		if redactedURL := redactURL(value); redactedURL != value {
+			return name + "=" + redactedURL
+		}
+	}
+	return redactURL(arg)
+}
+
+// redactURL replaces the password of a URL with REDACTED.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedValue)
+	return u.String()
+}
+
+// listAudit prints the entries of the audit log newer than since, or all
+// of them if since is zero, of container if it is not empty.
+func listAudit(since time.Duration, container string) error {
+	entries, err := loadAuditLog()
+	if err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	if since > 0 {
+		cutoff = time.Now().Add(-since)
+	}
+	matched := make([]*AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Time.Before(cutoff) || (container != "" && entry.Target != container) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Time.Before(matched[j].Time)
+	})
+
+	if len(matched) == 0 {
+		fmt.Println("No operations recorded")
+		return nil
+	}
+
+	fmt.Printf("%-19s  %-12s %-10s %-20s %-7s %9s  %s\n", "TIME", "USER", "OPERATION", "TARGET", "RESULT", "DURATION", "CHECKPOINT")
+	for _, entry := range matched {
+		who := entry.User
+		if who == "" {
+			who = strconv.Itoa(entry.UID)
+		}
+		if entry.SudoUser != "" {
+			who = entry.SudoUser + "(" + who + ")"
+		}
+		fmt.Printf("%-19s  %-12s %-10s %-20s %-7s %8.1fs  %s\n",
+			entry.Time.Local().Format("2006-01-02 15:04:05"), who, entry.Operation, entry.Target,
+			entry.Result, entry.DurationSeconds, entry.CheckpointDir)
+		if entry.Error != "" {
+			fmt.Printf("  error: %s\n", entry.Error)
+		}
+	}
+	return nil
+}
+
+// loadAuditLog reads every entry of the audit log; none if there is no
+// log yet. Lines that do not parse, e.g. one cut short by a full disk, are
+// skipped with a warning.
+func loadAuditLog() ([]*AuditEntry, error) {
+	f, err := os.Open(auditLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			logWarnf("skipping line %d of %s: %v", n, auditLogPath, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,160 @@
+//go:build integration
+
+// The CRIU benchmarks need root and criu in PATH; they are skipped
+// otherwise. Run them with:
+//
+//	sudo go test -tags integration -run '^$' -bench . -benchmem
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from linux/prctl.h
+const prSetChildSubreaper = 36
+
+// requireCRIU skips b unless CRIU can dump and restore from here.
+func requireCRIU(b *testing.B) {
+	b.Helper()
+	if os.Geteuid() != 0 {
+		b.Skip("CRIU needs root")
+	}
+	if _, err := exec.LookPath("criu"); err != nil {
+		b.Skip("criu is not installed")
+	}
+}
+
+// startSleeper starts the process the benchmarks dump: a sleep leading its
+// own session, so the dump needs no --shell-job.
+func startSleeper(b *testing.B) *exec.Cmd {
+	b.Helper()
+	cmd := exec.Command("sleep", "3600")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		b.Fatalf("failed to start sleep: %v", err)
+	}
+	return cmd
+}
+
+// reapRestored kills a restored process and waits until its PID is free
+// for the next restore. The restored tree is reparented to us as the
+// subreaper once criu exits.
+func reapRestored(b *testing.B, pid int) {
+	b.Helper()
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		b.Fatalf("failed to kill restored process %d: %v", pid, err)
+	}
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil && !errors.Is(err, syscall.ECHILD) {
+		b.Fatalf("failed to reap restored process %d: %v", pid, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			b.Fatalf("PID %d is still in use", pid)
+		}
+	}
+}
+
+func BenchmarkCheckpointSimpleProcess(b *testing.B) {
+	requireCRIU(b)
+	root := b.TempDir()
+	cfg := &CheckpointConfig{FDLimit: defaultFDLimit}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sleeper := startSleeper(b)
+		dir := filepath.Join(root, fmt.Sprintf("checkpoint-%d", i))
+		b.StartTimer()
+
+		err := checkpointSimpleProcess(sleeper.Process.Pid, dir, cfg)
+
+		b.StopTimer()
+		// The dump killed the process unless it failed
+		sleeper.Process.Kill()
+		sleeper.Wait()
+		if err != nil {
+			b.Fatalf("checkpoint failed: %v", err)
+		}
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkRestoreSimpleProcess(b *testing.B) {
+	requireCRIU(b)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		b.Fatalf("failed to become a subreaper: %v", errno)
+	}
+
+	sleeper := startSleeper(b)
+	pid := sleeper.Process.Pid
+	dir := filepath.Join(b.TempDir(), "checkpoint")
+	err := checkpointSimpleProcess(pid, dir, &CheckpointConfig{FDLimit: defaultFDLimit})
+	sleeper.Process.Kill()
+	sleeper.Wait()
+	if err != nil {
+		b.Fatalf("checkpoint failed: %v", err)
+	}
+	cfg := &RestoreConfig{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := restoreSimpleProcess(dir, cfg); err != nil {
+			b.Fatalf("restore failed: %v", err)
+		}
+
+		b.StopTimer()
+		reapRestored(b, pid)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkCopyCheckpointFiles copies a checkpoint-like directory of 32
+// images of 1 MiB, as the Docker native checkpoint does out of Docker's
+// storage.
+func BenchmarkCopyCheckpointFiles(b *testing.B) {
+	const files, size = 32, 1 << 20
+	src := filepath.Join(b.TempDir(), "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, size)
+	for i := 0; i < files; i++ {
+		if _, err := rand.Read(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprintf("pages-%d.img", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root := b.TempDir()
+
+	b.ReportAllocs()
+	b.SetBytes(files * size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst := filepath.Join(root, fmt.Sprintf("copy-%d", i))
+		if err := copyCheckpointFiles(src, dst); err != nil {
+			b.Fatalf("copy failed: %v", err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(dst)
+		b.StartTimer()
+	}
+}
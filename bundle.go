@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/checkpoint-restore/go-criu/v7"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// Bundle layout. Entries are written in lexical order, so bundle.json always
+// comes first and can be read without scanning the whole archive.
+const (
+	bundleFormatVersion = 1
+	bundleMetaFile      = "bundle.json"
+	bundleCheckpointDir = "checkpoint"
+	bundleRootfsFile    = "rootfs.tar"
+	bundleVolumesDir    = "volumes"
+)
+
+// BundleMeta is the content of bundle.json.
+type BundleMeta struct {
+	FormatVersion int                 `json:"format_version"`
+	Created       time.Time           `json:"created"`
+	Container     string              `json:"container"`
+	Image         string              `json:"image"`
+	Versions      BundleVersions      `json:"versions"`
+	Volumes       []BundleVolume      `json:"volumes,omitempty"`
+	Config        types.ContainerJSON `json:"config"`
+}
+
+// BundleVersions records the environment the bundle was created in.
+type BundleVersions struct {
+	CRIU         int    `json:"criu"`
+	Kernel       string `json:"kernel"`
+	Architecture string `json:"architecture"`
+	Docker       string `json:"docker"`
+	DockerAPI    string `json:"docker_api"`
+}
+
+// BundleVolume is one named volume archived under volumes/.
+type BundleVolume struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Driver      string `json:"driver,omitempty"`
+	Archive     string `json:"archive"`
+}
+
+// createBundle checkpoints containerID and writes a self-contained bundle to
+// w: the CRIU images, the exported root filesystem, a tar of every named
+// volume, the full container configuration and the versions of the tools
+// involved, with a checksums.sha256 covering all of it. Everything is staged
+// in a temporary directory first so w only needs to support sequential
+// writes.
+func createBundle(containerID string, w io.Writer, cfg *CheckpointConfig) error {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	stagingDir, err := os.MkdirTemp("", "docker-cr-bundle-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	meta := &BundleMeta{
+		FormatVersion: bundleFormatVersion,
+		Created:       time.Now().UTC(),
+		Container:     strings.TrimPrefix(info.Name, "/"),
+		Image:         info.Config.Image,
+		Config:        info,
+	}
+	if meta.Versions, err = collectBundleVersions(ctx, dockerClient); err != nil {
+		return err
+	}
+
+	logInfof("[1/4] Checkpointing container...")
+	if err := createCheckpoint(containerID, filepath.Join(stagingDir, bundleCheckpointDir), cfg); err != nil {
+		return err
+	}
+
+	logInfof("[2/4] Exporting root filesystem...")
+	rootfs, err := dockerClient.ContainerExport(ctx, info.ID)
+	if err != nil {
+		return fmt.Errorf("failed to export container filesystem: %w", err)
+	}
+	err = spoolToFile(rootfs, filepath.Join(stagingDir, bundleRootfsFile))
+	rootfs.Close()
+	if err != nil {
+		return fmt.Errorf("failed to export container filesystem: %w", err)
+	}
+
+	logInfof("[3/4] Archiving volumes...")
+	for _, m := range info.Mounts {
+		if m.Type != mount.TypeVolume {
+			// Bind mounts belong to the host; they stay in the config only
+			continue
+		}
+		vol := BundleVolume{
+			Name:        m.Name,
+			Destination: m.Destination,
+			Driver:      m.Driver,
+			Archive:     path.Join(bundleVolumesDir, m.Name+".tar"),
+		}
+		content, _, err := dockerClient.CopyFromContainer(ctx, info.ID, m.Destination)
+		if err != nil {
+			return fmt.Errorf("failed to read volume %s: %w", m.Name, err)
+		}
+		err = spoolToFile(content, filepath.Join(stagingDir, filepath.FromSlash(vol.Archive)))
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive volume %s: %w", m.Name, err)
+		}
+		logInfof("Archived volume %s -> %s", m.Name, m.Destination)
+		meta.Volumes = append(meta.Volumes, vol)
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, bundleMetaFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", bundleMetaFile, err)
+	}
+
+	logInfof("[4/4] Writing bundle...")
+	if _, err := writeManifest(stagingDir); err != nil {
+		return err
+	}
+	return writeCheckpointTar(stagingDir, w, false)
+}
+
+func collectBundleVersions(ctx context.Context, dockerClient *client.Client) (BundleVersions, error) {
+	var v BundleVersions
+
+	criuVersion, err := criu.MakeCriu().GetCriuVersion()
+	if err != nil {
+		return v, fmt.Errorf("failed to get CRIU version: %w", err)
+	}
+	v.CRIU = criuVersion
+
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		v.Kernel = strings.TrimSpace(string(release))
+	}
+	v.Architecture = runtime.GOARCH
+
+	if server, err := dockerClient.ServerVersion(ctx); err == nil {
+		v.Docker = server.Version
+		v.DockerAPI = server.APIVersion
+	}
+
+	return v, nil
+}
+
+func spoolToFile(r io.Reader, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// inspectBundle reads a bundle sequentially, prints a summary and verifies
+// every entry against the bundle's checksums.sha256 without extracting
+// anything.
+func inspectBundle(r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	var meta *BundleMeta
+	var manifest map[string]string
+	var processes *ProcessManifest
+	actual := make(map[string]string)
+	sizes := make(map[string]int64)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		hasher := sha256.New()
+		var body io.Reader = io.TeeReader(tr, hasher)
+
+		switch hdr.Name {
+		case bundleMetaFile:
+			meta = &BundleMeta{}
+			if err := json.NewDecoder(body).Decode(meta); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", bundleMetaFile, err)
+			}
+		case manifestFile:
+			if manifest, err = parseManifest(body); err != nil {
+				return err
+			}
+			continue
+		case path.Join(bundleCheckpointDir, processManifestFile):
+			processes = &ProcessManifest{}
+			if err := json.NewDecoder(body).Decode(processes); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", hdr.Name, err)
+			}
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+
+		actual[hdr.Name] = hex.EncodeToString(hasher.Sum(nil))
+		part := strings.SplitN(hdr.Name, "/", 2)[0]
+		sizes[part] += hdr.Size
+	}
+
+	if meta == nil {
+		return fmt.Errorf("not a docker-cr bundle: no %s", bundleMetaFile)
+	}
+
+	fmt.Printf("Format:     %d\n", meta.FormatVersion)
+	fmt.Printf("Created:    %s\n", meta.Created.Format(time.RFC3339))
+	fmt.Printf("Container:  %s\n", meta.Container)
+	fmt.Printf("Image:      %s\n", meta.Image)
+	if processes != nil {
+		printProcessRoot(processes, "%-11s %s\n")
+	}
+	fmt.Printf("CRIU:       %d\n", meta.Versions.CRIU)
+	fmt.Printf("Kernel:     %s (%s)\n", meta.Versions.Kernel, meta.Versions.Architecture)
+	fmt.Printf("Docker:     %s (API %s)\n", meta.Versions.Docker, meta.Versions.DockerAPI)
+	for _, vol := range meta.Volumes {
+		fmt.Printf("Volume:     %s -> %s\n", vol.Name, vol.Destination)
+	}
+
+	parts := make([]string, 0, len(sizes))
+	for part := range sizes {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	fmt.Println("Contents:")
+	for _, part := range parts {
+		fmt.Printf("  %-20s %10s\n", part, formatSize(sizes[part]))
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("bundle has no %s", manifestFile)
+	}
+	var problems []string
+	for name, hash := range manifest {
+		got, ok := actual[name]
+		if !ok {
+			problems = append(problems, "missing: "+name)
+		} else if got != hash {
+			problems = append(problems, "checksum mismatch: "+name)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("bundle verification failed:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	fmt.Printf("Integrity:  %d files verified\n", len(manifest))
+	return nil
+}
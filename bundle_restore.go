@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// BundleRestoreConfig holds the options of bundle restore.
+type BundleRestoreConfig struct {
+	// Name is the name of the new container; the bundle's container name
+	// is used when empty
+	Name string
+	// DryRun only lists the resources that would be created
+	DryRun bool
+	// Restore is passed on to the CRIU restore
+	Restore RestoreConfig
+}
+
+// bundlePlan lists the Docker resources a bundle restore creates.
+type bundlePlan struct {
+	Meta      *BundleMeta
+	Image     string
+	Container string
+	Volumes   []BundleVolume
+}
+
+// restoreBundle recreates the container held in a bundle on this host:
+// it imports the root filesystem as an image, creates and fills the named
+// volumes, creates the container from the recorded configuration and restores
+// the CRIU images into it. Everything created is removed again if a step
+// fails, so a failed import leaves the host as it was.
+func restoreBundle(r io.Reader, cfg *BundleRestoreConfig) (err error) {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	if cfg.DryRun {
+		meta, err := readBundleMeta(r)
+		if err != nil {
+			return err
+		}
+		plan := planBundleRestore(meta, cfg.Name)
+		printBundlePlan(plan)
+		return checkBundleConflicts(ctx, dockerClient, plan)
+	}
+
+	stagingDir, err := os.MkdirTemp("", "docker-cr-bundle-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	logInfof("[1/6] Extracting and verifying bundle...")
+	if err := extractBundle(r, stagingDir); err != nil {
+		return err
+	}
+	if err := verifyManifest(stagingDir); err != nil {
+		return fmt.Errorf("bundle is corrupt: %w", err)
+	}
+	meta := &BundleMeta{}
+	data, err := os.ReadFile(filepath.Join(stagingDir, bundleMetaFile))
+	if err != nil {
+		return fmt.Errorf("not a docker-cr bundle: %w", err)
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", bundleMetaFile, err)
+	}
+	if meta.FormatVersion > bundleFormatVersion {
+		return fmt.Errorf("bundle format %d is newer than supported format %d", meta.FormatVersion, bundleFormatVersion)
+	}
+
+	plan := planBundleRestore(meta, cfg.Name)
+	if err := checkBundleConflicts(ctx, dockerClient, plan); err != nil {
+		return err
+	}
+
+	// Undo steps run in reverse order if anything below fails
+	var rollback []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		logInfof("Bundle restore failed, removing what was created...")
+		for i := len(rollback) - 1; i >= 0; i-- {
+			rollback[i]()
+		}
+	}()
+
+	logInfof("[2/6] Importing root filesystem as %s...", plan.Image)
+	if err := importBundleRootfs(ctx, dockerClient, filepath.Join(stagingDir, bundleRootfsFile), plan.Image); err != nil {
+		return err
+	}
+	rollback = append(rollback, func() {
+		logInfof("Removing image %s", plan.Image)
+		if _, err := dockerClient.ImageRemove(ctx, plan.Image, types.ImageRemoveOptions{Force: true, PruneChildren: true}); err != nil {
+			logWarnf("%v", err)
+		}
+	})
+
+	logInfof("[3/6] Creating volumes...")
+	for _, vol := range plan.Volumes {
+		if _, err := dockerClient.VolumeCreate(ctx, volume.CreateOptions{Name: vol.Name, Driver: vol.Driver}); err != nil {
+			return fmt.Errorf("failed to create volume %s: %w", vol.Name, err)
+		}
+		name := vol.Name
+		rollback = append(rollback, func() {
+			logInfof("Removing volume %s", name)
+			if err := dockerClient.VolumeRemove(ctx, name, true); err != nil {
+				logWarnf("%v", err)
+			}
+		})
+		logInfof("Created volume %s", vol.Name)
+	}
+
+	logInfof("[4/6] Creating container %s...", plan.Container)
+	config, hostConfig := bundleContainerConfig(plan)
+	resp, err := dockerClient.ContainerCreate(ctx, config, hostConfig, nil, nil, plan.Container)
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	rollback = append(rollback, func() {
+		logInfof("Removing container %s", plan.Container)
+		if err := dockerClient.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			logWarnf("%v", err)
+		}
+	})
+
+	// Volumes are mounted for archive operations even before the container
+	// starts, so they can be filled through the new container
+	for _, vol := range plan.Volumes {
+		if err := populateBundleVolume(ctx, dockerClient, resp.ID, stagingDir, vol); err != nil {
+			return err
+		}
+	}
+
+	logInfof("[5/6] Restoring process state...")
+	if err := restoreIntoExisting(ctx, dockerClient, resp.ID, filepath.Join(stagingDir, bundleCheckpointDir), &cfg.Restore); err != nil {
+		return fmt.Errorf("failed to restore checkpoint: %w", err)
+	}
+
+	logInfof("[6/6] Verifying restored container...")
+	info, err := dockerClient.ContainerInspect(ctx, resp.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect restored container: %w", err)
+	}
+	if !info.State.Running {
+		return fmt.Errorf("container restored but not running, state: %s", info.State.Status)
+	}
+	for _, vol := range plan.Volumes {
+		if !hasVolumeMount(info.Mounts, vol) {
+			return fmt.Errorf("volume %s is not mounted at %s", vol.Name, vol.Destination)
+		}
+	}
+
+	logInfof("Bundle restored into container %s (PID %d)", plan.Container, info.State.Pid)
+	return nil
+}
+
+// planBundleRestore names the resources a restore of meta creates.
+func planBundleRestore(meta *BundleMeta, name string) *bundlePlan {
+	if name == "" {
+		name = meta.Container
+	}
+	return &bundlePlan{
+		Meta: meta,
+		// Repository names must be lowercase; the creation time keeps
+		// imports of different bundles of one container apart
+		Image:     fmt.Sprintf("docker-cr-bundle/%s:%d", strings.ToLower(name), meta.Created.Unix()),
+		Container: name,
+		Volumes:   meta.Volumes,
+	}
+}
+
+func printBundlePlan(plan *bundlePlan) {
+	fmt.Printf("Bundle of %s created %s\n", plan.Meta.Container, plan.Meta.Created.Format("2006-01-02 15:04:05"))
+	fmt.Println("Would create:")
+	fmt.Printf("  image      %s (from %s, originally %s)\n", plan.Image, bundleRootfsFile, plan.Meta.Image)
+	for _, vol := range plan.Volumes {
+		driver := vol.Driver
+		if driver == "" {
+			driver = "local"
+		}
+		fmt.Printf("  volume     %s (%s) -> %s\n", vol.Name, driver, vol.Destination)
+	}
+	fmt.Printf("  container  %s\n", plan.Container)
+	fmt.Printf("Would restore the CRIU images from %s/ into %s\n", bundleCheckpointDir, plan.Container)
+}
+
+// checkBundleConflicts fails if any resource in plan already exists, so a
+// restore never adopts or overwrites something it did not create.
+func checkBundleConflicts(ctx context.Context, dockerClient *client.Client, plan *bundlePlan) error {
+	if _, err := dockerClient.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to reach Docker daemon: %w", err)
+	}
+
+	var conflicts []string
+	if _, _, err := dockerClient.ImageInspectWithRaw(ctx, plan.Image); err == nil {
+		conflicts = append(conflicts, "image "+plan.Image)
+	}
+	for _, vol := range plan.Volumes {
+		if _, err := dockerClient.VolumeInspect(ctx, vol.Name); err == nil {
+			conflicts = append(conflicts, "volume "+vol.Name)
+		}
+	}
+	if _, err := dockerClient.ContainerInspect(ctx, plan.Container); err == nil {
+		conflicts = append(conflicts, "container "+plan.Container)
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("already exists on this host:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
+
+// readBundleMeta reads bundle.json, which is the first entry of a bundle.
+func readBundleMeta(r io.Reader) (*BundleMeta, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("not a docker-cr bundle: no %s", bundleMetaFile)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if hdr.Name != bundleMetaFile {
+			continue
+		}
+
+		meta := &BundleMeta{}
+		if err := json.NewDecoder(tr).Decode(meta); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", bundleMetaFile, err)
+		}
+		return meta, nil
+	}
+}
+
+// extractBundle unpacks the regular files and directories of a bundle into
+// dir, rejecting entries that would land outside it.
+func extractBundle(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("bundle entry %q escapes the bundle", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := spoolToFile(tr, target); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
+
+// importBundleRootfs imports the exported root filesystem as image ref.
+func importBundleRootfs(ctx context.Context, dockerClient *client.Client, rootfsPath, ref string) error {
+	rootfs, err := os.Open(rootfsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open root filesystem: %w", err)
+	}
+	defer rootfs.Close()
+
+	resp, err := dockerClient.ImageImport(ctx, types.ImageImportSource{Source: rootfs, SourceName: "-"}, ref, types.ImageImportOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to import root filesystem: %w", err)
+	}
+	defer resp.Close()
+
+	// The daemon reports import errors inside the progress stream
+	decoder := json.NewDecoder(resp)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read import progress: %w", err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("failed to import root filesystem: %s", message.Error)
+		}
+	}
+}
+
+// bundleContainerConfig derives the create configuration from the recorded
+// one, pointing it at the imported image. Volumes that were not named in the
+// original host config (anonymous volumes) are mounted explicitly so the new
+// container uses the recreated volume instead of a fresh empty one.
+func bundleContainerConfig(plan *bundlePlan) (*container.Config, *container.HostConfig) {
+	config := &container.Config{}
+	if plan.Meta.Config.Config != nil {
+		*config = *plan.Meta.Config.Config
+	}
+	config.Image = plan.Image
+
+	hostConfig := &container.HostConfig{}
+	if plan.Meta.Config.ContainerJSONBase != nil && plan.Meta.Config.HostConfig != nil {
+		*hostConfig = *plan.Meta.Config.HostConfig
+	}
+
+	for _, vol := range plan.Volumes {
+		if hostConfigMounts(hostConfig, vol.Destination) {
+			continue
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: vol.Name,
+			Target: vol.Destination,
+		})
+	}
+
+	return config, hostConfig
+}
+
+// hostConfigMounts reports whether hostConfig already mounts something at
+// destination through Binds or Mounts.
+func hostConfigMounts(hostConfig *container.HostConfig, destination string) bool {
+	for _, bind := range hostConfig.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) >= 2 && path.Clean(parts[1]) == path.Clean(destination) {
+			return true
+		}
+	}
+	for _, m := range hostConfig.Mounts {
+		if path.Clean(m.Target) == path.Clean(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// populateBundleVolume copies a volume archive into the container. The
+// archive holds the volume directory itself, so it is extracted into the
+// parent of the mount point.
+func populateBundleVolume(ctx context.Context, dockerClient *client.Client, containerID, stagingDir string, vol BundleVolume) error {
+	archive, err := os.Open(filepath.Join(stagingDir, filepath.FromSlash(vol.Archive)))
+	if err != nil {
+		return fmt.Errorf("failed to open volume archive %s: %w", vol.Archive, err)
+	}
+	defer archive.Close()
+
+	logInfof("Filling %s at %s", vol.Name, vol.Destination)
+	err = dockerClient.CopyToContainer(ctx, containerID, path.Dir(vol.Destination), archive, types.CopyToContainerOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to populate volume %s: %w", vol.Name, err)
+	}
+	return nil
+}
+
+func hasVolumeMount(mounts []types.MountPoint, vol BundleVolume) bool {
+	for _, m := range mounts {
+		if m.Type == mount.TypeVolume && m.Name == vol.Name && m.Destination == vol.Destination {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Values of --cgroup-hierarchy
+const (
+	cgroupHierarchyFull     = "full"
+	cgroupHierarchyCgroupns = "cgroupns"
+	cgroupHierarchyNone     = "none"
+)
+
+// validateCgroupHierarchy checks a --cgroup-hierarchy value; empty means
+// the default of the target.
+func validateCgroupHierarchy(mode string) error {
+	switch mode {
+	case "", cgroupHierarchyFull, cgroupHierarchyCgroupns, cgroupHierarchyNone:
+		return nil
+	}
+	return fmt.Errorf("--cgroup-hierarchy must be full, cgroupns or none, not %q", mode)
+}
+
+// applyCgroupHierarchy sets how CRIU handles the cgroups of the dump. With
+// "full" it manages the whole cgroup tree with its properties. With
+// "cgroupns" it keeps to the tree below the cgroup namespace root, which is
+// all a container on cgroup v2 sees, and leaves cgroups that exist alone
+// (soft mode). With "none" cgroups are neither dumped nor restored. An
+// empty mode is fallback, the default of the target; an empty fallback
+// leaves CRIU's defaults.
+func applyCgroupHierarchy(opts *rpc.CriuOpts, mode, fallback string) {
+	if mode == "" {
+		mode = fallback
+	}
+	var cgMode rpc.CriuCgMode
+	switch mode {
+	case cgroupHierarchyFull:
+		cgMode = rpc.CriuCgMode_FULL
+	case cgroupHierarchyCgroupns:
+		cgMode = rpc.CriuCgMode_SOFT
+	case cgroupHierarchyNone:
+		cgMode = rpc.CriuCgMode_IGNORE
+	default:
+		return
+	}
+	opts.ManageCgroups = proto.Bool(true)
+	opts.ManageCgroupsMode = &cgMode
+	logInfof("Cgroup hierarchy: %s (CRIU --manage-cgroups=%s)", mode, strings.ToLower(cgMode.String()))
+}
@@ -1,37 +1,316 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/checkpoint-restore/go-criu/v7"
 	"github.com/checkpoint-restore/go-criu/v7/rpc"
 	"google.golang.org/protobuf/proto"
 )
 
-func checkpointContainer(containerID, checkpointDir string) error {
-	// First try direct CRIU approach
-	fmt.Println("Attempting direct CRIU checkpoint...")
-	if err := checkpointContainerDirect(containerID, checkpointDir); err == nil {
-		return nil
+// defaultFDLimit is the default of --checkpoint-fd-limit: each descriptor
+// adds to the fd-info images, and thousands make them enormous.
+const defaultFDLimit = 10000
+
+// CheckpointConfig holds the command-line options that change how a
+// checkpoint is taken.
+type CheckpointConfig struct {
+	// CriuArgs are passed verbatim to a criu subprocess instead of using RPC
+	CriuArgs []string
+	// CriuService is the socket of a running "criu service" to use instead
+	// of spawning criu
+	CriuService string
+	// IgnoreBPF downgrades the eBPF file descriptor check to a warning
+	IgnoreBPF bool
+	// IgnoreFanotify downgrades the fanotify check to a warning
+	IgnoreFanotify bool
+	// FDLimit refuses to dump a process with more open file descriptors;
+	// zero means no limit
+	FDLimit int
+	// Force dumps despite blocking issues in the assessment
+	Force bool
+	// Hooks maps the CRIU notifications of the dump to the scripts run at
+	// them; see parseHooks
+	Hooks map[string][]string
+	// HookTimeouts bounds the hook scripts; phases left out use the default
+	HookTimeouts hookTimeouts
+	// TCPIface is the interface the established TCP connections are on,
+	// checked at restore
+	TCPIface string
+	// NetworkLock is "iptables", "nftables" or "skip"; empty detects the
+	// mechanism
+	NetworkLock string
+	// ExtMntWhitelist, if set, are the only mountpoints dumped as external,
+	// instead of CRIU detecting them; ExtMntBlacklist are never external
+	ExtMntWhitelist []string
+	ExtMntBlacklist []string
+	// FSOnly snapshots the container's overlay upper directory instead of
+	// dumping its processes
+	FSOnly bool
+	// MaxImageSize fails the checkpoint and removes the .img files the dump
+	// wrote when they exceed it; WarnImageSize only prints a warning. Zero disables either.
+	MaxImageSize  int64
+	WarnImageSize int64
+	// MemoryLimit, if set, caps the memory of the criu process in a cgroup
+	// of its own
+	MemoryLimit int64
+	// GhostLimit, if set, is CRIU's size limit for the contents of deleted
+	// files stored in the dump
+	GhostLimit int64
+	// Consistent freezes the container's writable filesystem for the dump
+	Consistent bool
+	// LogLevel is the CRIU log verbosity, 1 to 4; zero means 4
+	LogLevel int
+	// DetachTracer is the signal sent to processes ptracing the tree; empty
+	// fails the dump instead
+	DetachTracer string
+	// Compress is set when the checkpoint is streamed gzipped; only the
+	// estimate uses it
+	Compress bool
+	// AssumedThroughput is the dump speed in MB/s the estimate assumes
+	// when the container has no checkpoint history
+	AssumedThroughput float64
+	// StopAfterDump lets CRIU kill the container's processes after the dump
+	// instead of leaving them running
+	StopAfterDump bool
+	// TailLog prints the CRIU log while the dump is running
+	TailLog bool
+	// VerifyAfter verifies the checkpoint right after the dump and deletes
+	// it if verification fails
+	VerifyAfter bool
+	// Type is "full" (or empty), "pre" or "post"; see checkpoint_type.go
+	Type string
+	// PreDumpCount is the most rounds of CRIU pre-dump taken before the
+	// dump; see predump.go
+	PreDumpCount int
+	// Namespace prefixes Docker native checkpoint IDs so several users of
+	// one daemon do not collide
+	Namespace string
+	// RequireDockerCheckpoint checkpoints containers only through Docker's
+	// checkpoint API, failing if the daemon does not offer it
+	RequireDockerCheckpoint bool
+	// DeltaFrom, if set, keeps only the files that differ from this
+	// earlier checkpoint
+	DeltaFrom string
+	// EnvFile, if set, records the process environment in environ.json and
+	// copies it to this path
+	EnvFile string
+	// RedactEnv are the name patterns of the environment variables whose
+	// values process-manifest.json leaves out; empty means the defaults
+	RedactEnv []string
+	// KeepPartial keeps the images and logs of a failed dump instead of
+	// removing them
+	KeepPartial bool
+	// AsContainer checkpoints the container a PID target belongs to
+	// instead of the bare process
+	AsContainer bool
+	// WorkDirFd is an inherited directory fd CRIU writes its log to instead
+	// of the checkpoint directory; zero means none
+	WorkDirFd int
+	// SlackWebhook, if set, is a Slack incoming webhook told about failed
+	// checkpoints, and about successful ones with SlackOnSuccess
+	SlackWebhook   string
+	SlackOnSuccess bool
+
+	// CgroupHierarchy is the --cgroup-hierarchy: full, cgroupns or none;
+	// empty is cgroupns for containers and CRIU's default for processes
+	CgroupHierarchy string
+
+	// timings, if set, records how long each phase of the checkpoint took
+	timings *Timings
+	// workDir keeps WorkDirFd open; see openWorkDirFd
+	workDir *os.File
+	// hostPIDNS is set for a --pid=host container, whose PID namespace is
+	// the host's and is dumped as external
+	hostPIDNS bool
+}
+
+// createCheckpoint checkpoints target, which is either a PID or a container
+// ID/name, into checkpointDir and writes the integrity manifest.
+func createCheckpoint(target, checkpointDir string, cfg *CheckpointConfig) error {
+	started := time.Now()
+	var err error
+	if pid, convErr := strconv.Atoi(target); convErr == nil {
+		if id, name := containerOfPID(pid); id != "" {
+			if !cfg.AsContainer {
+				warnContainerPID(pid, id, name)
+			} else {
+				logInfof("PID %d belongs to container %s; checkpointing the container", pid, id[:12])
+				target = id
+			}
+		}
+	}
+
+	if pid, convErr := strconv.Atoi(target); convErr == nil {
+		setLogFields("pid", pid, "checkpoint_dir", checkpointDir)
+	} else {
+		setLogFields("container_id", target, "checkpoint_dir", checkpointDir)
+	}
+
+	// Images already in the directory are not this dump's to count or delete
+	existingImages := imageFiles(checkpointDir)
+	if cfg.FSOnly {
+		logInfof("Creating filesystem-only checkpoint for container %s in %s...", target, checkpointDir)
+		err = checkpointFilesystemOnly(target, checkpointDir)
+	} else if pid, convErr := strconv.Atoi(target); convErr == nil {
+		logInfof("Creating checkpoint for process %d in %s...", pid, checkpointDir)
+		err = checkpointSimpleProcess(pid, checkpointDir, cfg)
 	} else {
-		fmt.Printf("Direct CRIU failed: %v\n", err)
-		fmt.Println("Falling back to Docker native checkpoint...")
+		logInfof("Creating checkpoint for container %s in %s...", target, checkpointDir)
+		err = checkpointContainer(target, checkpointDir, cfg)
+	}
+	if err != nil {
+		notifyCheckpointFailure(target, checkpointDir, cfg, err)
+		if cfg.KeepPartial {
+			logInfof("Keeping partial checkpoint files in %s", checkpointDir)
+		} else {
+			cleanupPartialCheckpoint(checkpointDir)
+		}
+		return err
+	}
+	if !cfg.FSOnly {
+		if err := checkImageSize(checkpointDir, existingImages, cfg); err != nil {
+			notifyCheckpointFailure(target, checkpointDir, cfg, err)
+			return err
+		}
+	}
+
+	stopTiming := cfg.timings.track(phaseMetadata)
+	defer stopTiming()
+	if err := finishPartialCheckpoint(checkpointDir, cfg); err != nil {
+		notifyCheckpointFailure(target, checkpointDir, cfg, err)
+		return err
+	}
+
+	logInfof("Writing integrity manifest...")
+	if _, err := writeManifest(checkpointDir); err != nil {
+		notifyCheckpointFailure(target, checkpointDir, cfg, err)
+		return err
+	}
+
+	stopTiming()
+
+	if cfg.VerifyAfter {
+		logInfof("Verifying checkpoint...")
+		cfg.timings.begin(phaseVerify)
+		err := verifyCheckpoint(checkpointDir)
+		cfg.timings.end(phaseVerify)
+		if err != nil {
+			err = fmt.Errorf("checkpoint verification failed, removed %s: %w", checkpointDir, err)
+			notifyCheckpointFailure(target, checkpointDir, cfg, err)
+			// Leave no restore point that looks valid but is not
+			os.RemoveAll(checkpointDir)
+			return err
+		}
+	}
+
+	if cfg.SlackWebhook != "" && cfg.SlackOnSuccess {
+		if err := notifySlackSuccess(cfg.SlackWebhook, target, checkpointDir, time.Since(started)); err != nil {
+			logWarnf("%v", err)
+		}
 	}
 
-	// Fall back to Docker's native checkpoint API
-	return checkpointDockerNative(containerID, checkpointDir)
+	return nil
 }
 
-func checkpointProcess(pid int, checkpointDir string) error {
-	criuClient := criu.MakeCriu()
+// notifyCheckpointFailure sends the --notify-slack failure message; a
+// notification that cannot be delivered is only a warning.
+func notifyCheckpointFailure(target, checkpointDir string, cfg *CheckpointConfig, err error) {
+	if cfg.SlackWebhook == "" {
+		return
+	}
+	if slackErr := notifySlackFailure(cfg.SlackWebhook, target, checkpointDir, err); slackErr != nil {
+		logWarnf("%v", slackErr)
+	}
+}
+
+// cleanupPartialCheckpoint removes the images, pre-dump rounds and logs a
+// failed dump left in checkpointDir. Metadata written before the dump, such as container.info,
+// is kept.
+func cleanupPartialCheckpoint(checkpointDir string) {
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && isPreDumpDir(name) {
+			if err := os.RemoveAll(filepath.Join(checkpointDir, name)); err != nil {
+				logWarnf("failed to remove %s: %v", name, err)
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() || (!strings.HasSuffix(name, ".img") && !strings.HasSuffix(name, ".log")) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(checkpointDir, name)); err != nil {
+			logWarnf("failed to remove %s: %v", name, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		logInfof("Removed %d partial checkpoint files from %s (use --keep-partial to keep them)", removed, checkpointDir)
+	}
+}
+
+func checkpointContainer(containerID, checkpointDir string, cfg *CheckpointConfig) error {
+	if cfg.RequireDockerCheckpoint {
+		logInfof("Creating Docker native checkpoint...")
+		if err := checkpointDockerNative(containerID, checkpointDir, cfg); err != nil {
+			return err
+		}
+	} else {
+		// First try direct CRIU approach
+		logInfof("Attempting direct CRIU checkpoint...")
+		if err := checkpointContainerDirect(containerID, checkpointDir, cfg); err != nil {
+			if isPartialDump(cfg) {
+				// Docker's checkpoint API only takes full dumps
+				return fmt.Errorf("%s checkpoint failed: %w", cfg.Type, err)
+			}
+			if cfg.Consistent {
+				// Docker's checkpoint API cannot freeze the filesystem
+				return fmt.Errorf("consistent checkpoint failed: %w", err)
+			}
+			logWarnf("direct CRIU failed: %v", err)
+			logInfof("Falling back to Docker native checkpoint...")
+			progress.retry("Docker native checkpoint", err)
+
+			// Fall back to Docker's native checkpoint API
+			if nativeErr := checkpointDockerNative(containerID, checkpointDir, cfg); nativeErr != nil {
+				if errors.Is(nativeErr, errDockerCheckpointUnavailable) {
+					// Nothing was tried but direct CRIU; its error is the one to fix
+					return fmt.Errorf("direct CRIU checkpoint failed: %w (no fallback: %v)", err, nativeErr)
+				}
+				return nativeErr
+			}
+		}
+	}
+
+	// Restore compares these with the daemon it runs against
+	if err := recordRuntimeVersions(checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+
+	return nil
+}
+
+func checkpointProcess(pid int, checkpointDir string, cfg *CheckpointConfig) error {
+	criuClient := limitCriuMemory(newCriuClient(cfg.CriuService), cfg.MemoryLimit)
 
 	_, err := criuClient.GetCriuVersion()
 	if err != nil {
 		return fmt.Errorf("failed to get CRIU version (is CRIU installed?): %w", err)
 	}
-	fmt.Printf("CRIU version check passed\n")
+	logInfof("CRIU version check passed")
 
 	if err := criuClient.Prepare(); err != nil {
 		return fmt.Errorf("failed to prepare CRIU: %w", err)
@@ -47,20 +326,43 @@ func checkpointProcess(pid int, checkpointDir string) error {
 	opts := &rpc.CriuOpts{
 		Pid:          proto.Int32(int32(pid)),
 		ImagesDirFd:  proto.Int32(int32(imageDir.Fd())),
-		LogLevel:     proto.Int32(4),
+		LogLevel:     criuLogLevel(cfg.LogLevel),
 		LogFile:      proto.String("dump.log"),
 		LeaveRunning: proto.Bool(true),
 		GhostLimit:   proto.Uint32(10000000),
 	}
 
-	if err := prepareProcessForDump(pid, opts); err != nil {
+	applyCgroupHierarchy(opts, cfg.CgroupHierarchy, "")
+
+	if err := prepareProcessForDump(pid, checkpointDir, opts, cfg); err != nil {
 		return fmt.Errorf("failed to prepare process for dump: %w", err)
 	}
 
-	notify := NewNotifyHandler(true)
+	if cfg.EnvFile != "" {
+		if err := saveProcessEnviron(pid, checkpointDir, cfg.EnvFile); err != nil {
+			return err
+		}
+	}
 
-	fmt.Println("Creating checkpoint...")
-	err = criuClient.Dump(opts, notify)
+	if err := recordMappedFiles(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+	if err := recordStdio(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+
+	notify := NewNotifyHandler()
+	notify.setOperation("process", pid, checkpointDir)
+	notify.Hooks = cfg.Hooks
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.timings = cfg.timings
+	if err := prepareNetworkLock(opts, notify, pid, cfg); err != nil {
+		return err
+	}
+	defer notify.unlockNetwork()
+
+	logInfof("Creating checkpoint...")
+	err = runDump(criuClient, opts, notify, checkpointDir, cfg)
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "dump.log")
 		if logData, readErr := os.ReadFile(logPath); readErr == nil {
@@ -74,7 +376,7 @@ func checkpointProcess(pid int, checkpointDir string) error {
 		return fmt.Errorf("failed to read checkpoint directory: %w", err)
 	}
 
-	fmt.Printf("Checkpoint created with %d files\n", len(entries))
+	logInfof("Checkpoint created with %d files", len(entries))
 	fmt.Println("Checkpoint files:")
 	for _, entry := range entries {
 		info, _ := entry.Info()
@@ -84,18 +386,18 @@ func checkpointProcess(pid int, checkpointDir string) error {
 	return nil
 }
 
-func checkpointSimpleProcess(pid int, checkpointDir string) error {
+func checkpointSimpleProcess(pid int, checkpointDir string, cfg *CheckpointConfig) error {
 	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
 		return fmt.Errorf("failed to create checkpoint directory: %w", err)
 	}
 
-	criuClient := criu.MakeCriu()
+	criuClient := limitCriuMemory(newCriuClient(cfg.CriuService), cfg.MemoryLimit)
 
 	_, err := criuClient.GetCriuVersion()
 	if err != nil {
 		return fmt.Errorf("failed to get CRIU version: %w", err)
 	}
-	fmt.Printf("CRIU version check passed\n")
+	logInfof("CRIU version check passed")
 
 	if err := criuClient.Prepare(); err != nil {
 		return fmt.Errorf("failed to prepare CRIU: %w", err)
@@ -111,18 +413,41 @@ func checkpointSimpleProcess(pid int, checkpointDir string) error {
 	opts := &rpc.CriuOpts{
 		Pid:         proto.Int32(int32(pid)),
 		ImagesDirFd: proto.Int32(int32(imageDir.Fd())),
-		LogLevel:    proto.Int32(4),
+		LogLevel:    criuLogLevel(cfg.LogLevel),
 		LogFile:     proto.String("dump.log"),
 	}
 
-	if err := prepareProcessForDump(pid, opts); err != nil {
+	applyCgroupHierarchy(opts, cfg.CgroupHierarchy, "")
+
+	if err := prepareProcessForDump(pid, checkpointDir, opts, cfg); err != nil {
 		return fmt.Errorf("failed to prepare process: %w", err)
 	}
 
-	notify := NewNotifyHandler(true)
+	if cfg.EnvFile != "" {
+		if err := saveProcessEnviron(pid, checkpointDir, cfg.EnvFile); err != nil {
+			return err
+		}
+	}
+
+	if err := recordMappedFiles(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+	if err := recordStdio(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+
+	notify := NewNotifyHandler()
+	notify.setOperation("process", pid, checkpointDir)
+	notify.Hooks = cfg.Hooks
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.timings = cfg.timings
+	if err := prepareNetworkLock(opts, notify, pid, cfg); err != nil {
+		return err
+	}
+	defer notify.unlockNetwork()
 
-	fmt.Println("Creating checkpoint...")
-	err = criuClient.Dump(opts, notify)
+	logInfof("Creating checkpoint...")
+	err = runDump(criuClient, opts, notify, checkpointDir, cfg)
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "dump.log")
 		if logData, readErr := os.ReadFile(logPath); readErr == nil {
@@ -131,6 +456,138 @@ func checkpointSimpleProcess(pid int, checkpointDir string) error {
 		return fmt.Errorf("checkpoint failed: %w", err)
 	}
 
-	fmt.Println("Checkpoint created successfully!")
+	logInfof("Checkpoint created successfully!")
+	return nil
+}
+
+// imageFiles returns the modification times of the .img files under dir,
+// none if it does not exist yet.
+func imageFiles(dir string) map[string]time.Time {
+	images := make(map[string]time.Time)
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || !strings.HasSuffix(path, ".img") {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			images[path] = info.ModTime()
+		}
+		return nil
+	})
+	return images
+}
+
+// checkImageSize sums the .img files the dump wrote under checkpointDir,
+// those not in existing or changed since, and enforces the configured size
+// limits. Over MaxImageSize, those files are removed; the rest of the
+// directory is left alone.
+func checkImageSize(checkpointDir string, existing map[string]time.Time, cfg *CheckpointConfig) error {
+	if cfg.MaxImageSize <= 0 && cfg.WarnImageSize <= 0 {
+		return nil
+	}
+
+	var written []string
+	var total int64
+	err := filepath.WalkDir(checkpointDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || !strings.HasSuffix(path, ".img") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if modTime, ok := existing[path]; ok && modTime.Equal(info.ModTime()) {
+			return nil
+		}
+		written = append(written, path)
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint directory: %w", err)
+	}
+
+	const mb = 1024 * 1024
+	if cfg.MaxImageSize > 0 && total > cfg.MaxImageSize {
+		for _, path := range written {
+			if err := os.Remove(path); err != nil {
+				logWarnf("failed to remove oversized image: %v", err)
+			}
+		}
+		return fmt.Errorf("checkpoint image size %d MB exceeds limit %d MB; removed its %d image files", total/mb, cfg.MaxImageSize/mb, len(written))
+	}
+	if cfg.WarnImageSize > 0 && total > cfg.WarnImageSize {
+		logWarnf("checkpoint image size %d MB exceeds warning threshold %d MB", total/mb, cfg.WarnImageSize/mb)
+	}
+
 	return nil
-}
\ No newline at end of file
+}
+
+// forkContainer restores a checkpoint of containerID into a new container
+// named <containerID>-fork and records the origin in the checkpoint metadata.
+// It is meant to run right after a dump that stopped the original.
+func forkContainer(containerID, checkpointDir string) (string, error) {
+	forkID := containerID + "-fork"
+
+	metadataFile := filepath.Join(checkpointDir, "container.meta")
+	originalID := containerID
+	if metadata, err := readMetadata(metadataFile); err == nil && metadata["CONTAINER_ID"] != "" {
+		originalID = metadata["CONTAINER_ID"]
+	}
+
+	file, err := os.OpenFile(metadataFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open metadata: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "FORKED_FROM=%s\n", originalID)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to record fork origin: %w", err)
+	}
+	if _, err := writeManifest(checkpointDir); err != nil {
+		return "", err
+	}
+
+	logInfof("Starting fork %s from checkpoint...", forkID)
+	if err := restoreContainer(forkID, checkpointDir, &RestoreConfig{}); err != nil {
+		return "", fmt.Errorf("failed to start fork %s: %w", forkID, err)
+	}
+
+	return forkID, nil
+}
+
+// updateLatestSymlink points a "latest" symlink in the parent directory of
+// checkpointDir at checkpointDir, replacing any previous link.
+func updateLatestSymlink(checkpointDir string) error {
+	absDir, err := filepath.Abs(checkpointDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve checkpoint directory: %w", err)
+	}
+
+	parentDir := filepath.Dir(absDir)
+	linkPath := filepath.Join(parentDir, "latest")
+	if absDir == linkPath {
+		return fmt.Errorf("checkpoint directory cannot itself be named 'latest'")
+	}
+
+	if info, err := os.Lstat(linkPath); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s exists and is not a symlink", linkPath)
+		}
+		if err := os.Remove(linkPath); err != nil {
+			return fmt.Errorf("failed to remove old latest symlink: %w", err)
+		}
+	}
+
+	// Use a relative target so the checkpoint tree can be moved as a whole
+	if err := os.Symlink(filepath.Base(absDir), linkPath); err != nil {
+		return fmt.Errorf("failed to create latest symlink: %w", err)
+	}
+
+	logInfof("Updated %s -> %s", linkPath, filepath.Base(absDir))
+	return nil
+}
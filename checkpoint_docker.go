@@ -12,7 +12,7 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-func checkpointDockerContainer(containerID, checkpointDir string) error {
+func checkpointDockerContainer(containerID, checkpointDir string, cfg *CheckpointConfig) error {
 	ctx := context.Background()
 
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -35,7 +35,8 @@ func checkpointDockerContainer(containerID, checkpointDir string) error {
 		return fmt.Errorf("could not get PID for container %s", containerID)
 	}
 
-	fmt.Printf("Container PID: %d\n", pid)
+	setLogFields("pid", pid)
+	logInfof("Container PID: %d", pid)
 
 	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
 		return fmt.Errorf("failed to create checkpoint directory: %w", err)
@@ -43,28 +44,29 @@ func checkpointDockerContainer(containerID, checkpointDir string) error {
 
 	// Save container metadata
 	metadataFile := filepath.Join(checkpointDir, "container.info")
-	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nPID=%d\n",
+	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nPID=%d\nMNT_NS=%s\n",
 		containerID,
 		containerInfo.Name,
 		containerInfo.Config.Image,
-		pid)
+		pid,
+		mountNamespaceOf(pid))
 
 	if err := os.WriteFile(metadataFile, []byte(metadata), 0644); err != nil {
 		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
 	// For Docker containers, we need a more specialized approach
-	return checkpointDockerProcess(pid, checkpointDir, containerInfo.GraphDriver.Name)
+	return checkpointDockerProcess(pid, checkpointDir, containerInfo.GraphDriver.Name, cfg)
 }
 
-func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string) error {
-	criuClient := criu.MakeCriu()
+func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string, cfg *CheckpointConfig) error {
+	criuClient := limitCriuMemory(newCriuClient(cfg.CriuService), cfg.MemoryLimit)
 
 	_, err := criuClient.GetCriuVersion()
 	if err != nil {
 		return fmt.Errorf("failed to get CRIU version (is CRIU installed?): %w", err)
 	}
-	fmt.Printf("CRIU version check passed\n")
+	logInfof("CRIU version check passed")
 
 	if err := criuClient.Prepare(); err != nil {
 		return fmt.Errorf("failed to prepare CRIU: %w", err)
@@ -81,7 +83,7 @@ func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string)
 	opts := &rpc.CriuOpts{
 		Pid:          proto.Int32(int32(pid)),
 		ImagesDirFd:  proto.Int32(int32(imageDir.Fd())),
-		LogLevel:     proto.Int32(4),
+		LogLevel:     criuLogLevel(cfg.LogLevel),
 		LogFile:      proto.String("dump.log"),
 		LeaveRunning: proto.Bool(true),
 		GhostLimit:   proto.Uint32(10000000),
@@ -100,14 +102,25 @@ func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string)
 		ForceIrmap:     proto.Bool(true),
 	}
 
+	applyExtMountLists(opts, cfg)
+	applyCgroupHierarchy(opts, cfg.CgroupHierarchy, cgroupHierarchyCgroupns)
+
 	// Add process-specific options
-	if err := prepareProcessForDump(pid, opts); err != nil {
+	if err := prepareProcessForDump(pid, checkpointDir, opts, cfg); err != nil {
 		return fmt.Errorf("failed to prepare process for dump: %w", err)
 	}
 
-	notify := NewNotifyHandler(true)
+	notify := NewNotifyHandler()
+	notify.setOperation("container", pid, checkpointDir)
+	notify.Hooks = cfg.Hooks
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.timings = cfg.timings
+	if err := prepareNetworkLock(opts, notify, pid, cfg); err != nil {
+		return err
+	}
+	defer notify.unlockNetwork()
 
-	fmt.Println("Creating Docker checkpoint...")
+	logInfof("Creating Docker checkpoint...")
 	err = criuClient.Dump(opts, notify)
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "dump.log")
@@ -116,7 +129,8 @@ func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string)
 		}
 
 		// Try alternative approach if first attempt fails
-		fmt.Println("First attempt failed, trying with minimal options...")
+		logInfof("First attempt failed, trying with minimal options...")
+		progress.retry("dump with minimal options", err)
 		return checkpointWithMinimalOptions(pid, checkpointDir)
 	}
 
@@ -125,7 +139,7 @@ func checkpointDockerProcess(pid int, checkpointDir string, graphDriver string)
 		return fmt.Errorf("failed to read checkpoint directory: %w", err)
 	}
 
-	fmt.Printf("Checkpoint created with %d files\n", len(entries))
+	logInfof("Checkpoint created with %d files", len(entries))
 	fmt.Println("Checkpoint files:")
 	for _, entry := range entries {
 		info, _ := entry.Info()
@@ -165,9 +179,9 @@ func checkpointWithMinimalOptions(pid int, checkpointDir string) error {
 		},
 	}
 
-	notify := NewNotifyHandler(false) // Less verbose
+	notify := NewNotifyHandler()
 
-	fmt.Println("Attempting checkpoint with minimal options...")
+	logInfof("Attempting checkpoint with minimal options...")
 	err = criuClient.Dump(opts, notify)
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "dump-minimal.log")
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint types selectable with --checkpoint-type. Only full checkpoints
+// can be restored; the others keep part of the state for debugging.
+const (
+	// checkpointTypeFull is a normal dump
+	checkpointTypeFull = "full"
+	// checkpointTypePre is a CRIU pre-dump: memory pages and page maps only
+	checkpointTypePre = "pre"
+	// checkpointTypePost is a dump without the memory contents: process
+	// tree, registers (core-*.img) and file descriptor state
+	checkpointTypePost = "post"
+)
+
+// partialInfoFile marks a checkpoint that is not a full dump. It holds
+// TYPE=<pre|post>.
+const partialInfoFile = "partial.info"
+
+// validateCheckpointType checks a --checkpoint-type value.
+func validateCheckpointType(checkpointType string) error {
+	switch checkpointType {
+	case "", checkpointTypeFull, checkpointTypePre, checkpointTypePost:
+		return nil
+	}
+	return fmt.Errorf("invalid checkpoint type %q: use pre, post or full", checkpointType)
+}
+
+// isPartialDump reports whether cfg asks for less than a full checkpoint.
+func isPartialDump(cfg *CheckpointConfig) bool {
+	return cfg.Type == checkpointTypePre || cfg.Type == checkpointTypePost
+}
+
+// finishPartialCheckpoint trims a post checkpoint down to the non-memory
+// images and marks the directory as partial. CRIU has no option to skip the
+// memory dump, so post is a full dump with the page images removed.
+func finishPartialCheckpoint(checkpointDir string, cfg *CheckpointConfig) error {
+	if !isPartialDump(cfg) {
+		return nil
+	}
+
+	if cfg.Type == checkpointTypePost {
+		var removed int
+		for _, pattern := range []string{"pages-*.img", "pagemap-*.img"} {
+			matches, _ := filepath.Glob(filepath.Join(checkpointDir, pattern))
+			for _, path := range matches {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove memory image: %w", err)
+				}
+				removed++
+			}
+		}
+		logInfof("Removed %d memory images for a post checkpoint", removed)
+	}
+
+	content := fmt.Sprintf("TYPE=%s\n", cfg.Type)
+	if err := os.WriteFile(filepath.Join(checkpointDir, partialInfoFile), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", partialInfoFile, err)
+	}
+	return nil
+}
+
+// partialCheckpointType returns the type recorded in partial.info, or ""
+// for a full checkpoint.
+func partialCheckpointType(checkpointDir string) string {
+	metadata, err := readMetadata(filepath.Join(checkpointDir, partialInfoFile))
+	if err != nil {
+		return ""
+	}
+	return metadata["TYPE"]
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,8 +15,8 @@ import (
 	"github.com/docker/docker/client"
 )
 
-// restoreContainerWithRecreate stops the old container and creates a new one, then restores into it
-func restoreContainerWithRecreate(containerID, checkpointDir string) error {
+// restoreContainerWithRecreate stops the old container and creates a new one, then restores into it.
+func restoreContainerWithRecreate(containerID, checkpointDir string, cfg *RestoreConfig) error {
 	ctx := context.Background()
 
 	// Read metadata
@@ -37,25 +38,35 @@ func restoreContainerWithRecreate(containerID, checkpointDir string) error {
 	var originalHostConfig *container.HostConfig
 	var originalImage string
 
+	name := containerID
+	if cfg.NewContainerName != "" {
+		name = cfg.NewContainerName
+	}
+
 	if info, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
 		originalConfig = info.Config
 		originalHostConfig = info.HostConfig
 		originalImage = info.Config.Image
 
-		// Stop and remove original container
-		fmt.Println("Stopping original container...")
-		timeout := 10
-		stopOpts := container.StopOptions{
-			Timeout: &timeout,
-		}
-		dockerClient.ContainerStop(ctx, containerID, stopOpts)
+		if name != containerID {
+			// The restore is a copy; the original keeps its name
+			logInfof("Restoring as container %s; %s is left as it is", name, containerID)
+		} else {
+			// Stop and remove original container
+			logInfof("Stopping original container...")
+			timeout := 10
+			stopOpts := container.StopOptions{
+				Timeout: &timeout,
+			}
+			dockerClient.ContainerStop(ctx, containerID, stopOpts)
 
-		fmt.Println("Removing original container...")
-		removeOpts := types.ContainerRemoveOptions{
-			Force: true,
+			logInfof("Removing original container...")
+			removeOpts := types.ContainerRemoveOptions{
+				Force: true,
+			}
+			dockerClient.ContainerRemove(ctx, containerID, removeOpts)
+			time.Sleep(1 * time.Second)
 		}
-		dockerClient.ContainerRemove(ctx, containerID, removeOpts)
-		time.Sleep(1 * time.Second)
 	} else {
 		// Container doesn't exist, use metadata
 		originalImage = metadata["IMAGE"]
@@ -69,14 +80,24 @@ func restoreContainerWithRecreate(containerID, checkpointDir string) error {
 		originalHostConfig = &container.HostConfig{}
 	}
 
+	if cfg.Hostname != "" {
+		logInfof("Using hostname %s for the new container", cfg.Hostname)
+		originalConfig.Hostname = cfg.Hostname
+	}
+
 	// Create new container with same config
-	fmt.Printf("Creating new container from image %s...\n", originalImage)
-	resp, err := dockerClient.ContainerCreate(ctx, originalConfig, originalHostConfig, nil, nil, containerID)
+	logInfof("Creating new container from image %s...", originalImage)
+	resp, err := dockerClient.ContainerCreate(ctx, originalConfig, originalHostConfig, nil, nil, name)
 	if err != nil {
 		return fmt.Errorf("failed to create container: %w", err)
 	}
 
-	fmt.Printf("Created container: %s\n", resp.ID)
+	logInfof("Created container: %s", resp.ID)
+	if cfg.NewContainerName != "" {
+		if err := recordRestoredContainer(checkpointDir, resp.ID, name); err != nil {
+			return err
+		}
+	}
 
 	// Start the container
 	if err := dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
@@ -93,7 +114,7 @@ func restoreContainerWithRecreate(containerID, checkpointDir string) error {
 	}
 
 	newPID := newInfo.State.Pid
-	fmt.Printf("New container PID: %d\n", newPID)
+	logInfof("New container PID: %d", newPID)
 
 	// Now restore the checkpoint into the new container process
 	// For now, we'll just report success since the container is running
@@ -102,12 +123,131 @@ func restoreContainerWithRecreate(containerID, checkpointDir string) error {
 	// 2. Use CRIU to restore the checkpoint over it
 	// 3. This requires more complex namespace handling
 
-	fmt.Println("Container recreated and started successfully")
-	fmt.Println("Note: Full state restore requires additional namespace handling")
+	logInfof("Container recreated and started successfully")
+	logInfof("Note: Full state restore requires additional namespace handling")
 
 	return nil
 }
 
+// restoreContainerIntoExisting restores the checkpoint into containerID,
+// which must exist and be stopped, keeping its Docker ID.
+func restoreContainerIntoExisting(containerID, checkpointDir string, cfg *RestoreConfig) error {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err := checkStoppedContainer(containerID, info, err); err != nil {
+		return err
+	}
+	return restoreIntoExisting(ctx, dockerClient, info.ID, checkpointDir, cfg)
+}
+
+// checkStoppedContainer reports why the result of inspecting containerID
+// is not a container --restore-into-existing can reuse: one that exists and
+// is stopped, whether exited or never started.
+func checkStoppedContainer(containerID string, info types.ContainerJSON, inspectErr error) error {
+	if inspectErr != nil {
+		return fmt.Errorf("--restore-into-existing requires a stopped container, but %s cannot be inspected: %w", containerID, inspectErr)
+	}
+	if info.ContainerJSONBase == nil || info.State == nil {
+		return fmt.Errorf("--restore-into-existing requires a stopped container, but %s has no state", containerID)
+	}
+	switch info.State.Status {
+	case "exited", "created":
+		return nil
+	}
+	return fmt.Errorf("--restore-into-existing requires a stopped container, got %s", info.State.Status)
+}
+
+// restoreIntoExisting restores the checkpoint into a stopped container without
+// removing it. The container is started only to bring its namespaces up; CRIU
+// then joins them instead of creating new ones.
+func restoreIntoExisting(ctx context.Context, dockerClient *client.Client, containerID, checkpointDir string, cfg *RestoreConfig) error {
+	logInfof("Reusing stopped container %s", containerID)
+
+	if err := dockerClient.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start existing container: %w", err)
+	}
+
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect existing container: %w", err)
+	}
+	if info.State.Pid == 0 {
+		return fmt.Errorf("existing container %s has no running process", containerID)
+	}
+
+	logInfof("Joining namespaces of container PID %d", info.State.Pid)
+	cfg.JoinNamespacesOf = info.State.Pid
+
+	return restoreProcessDirect(checkpointDir, cfg)
+}
+
+// recordRestoredContainer rewrites CONTAINER_ID and CONTAINER_NAME in the
+// metadata of checkpointDir once it is restored as a container of another
+// name, so later operations on the checkpoint find that container. The
+// manifest entries of the rewritten files are updated to match.
+func recordRestoredContainer(checkpointDir, id, name string) error {
+	var changed []string
+	for _, file := range []string{"container.meta", "container.info"} {
+		path := filepath.Join(checkpointDir, file)
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		values := map[string]string{"CONTAINER_ID": id, "CONTAINER_NAME": "/" + name}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			key, _, _ := strings.Cut(line, "=")
+			if value, ok := values[key]; ok {
+				line = key + "=" + value
+				delete(values, key)
+			}
+			lines = append(lines, line)
+		}
+		for _, key := range []string{"CONTAINER_ID", "CONTAINER_NAME"} {
+			if value, ok := values[key]; ok {
+				lines = append(lines, key+"="+value)
+			}
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to update %s: %w", file, err)
+		}
+		changed = append(changed, file)
+	}
+
+	manifestPath := filepath.Join(checkpointDir, manifestFile)
+	hashes, err := readManifest(manifestPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	for _, file := range changed {
+		if _, ok := hashes[file]; !ok {
+			continue
+		}
+		sum, err := hashFileSHA256(filepath.Join(checkpointDir, file))
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", file, err)
+		}
+		hashes[file] = hex.EncodeToString(sum[:])
+	}
+	if err := writeChecksums(manifestPath, hashes); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	logInfof("Recorded container %s (%s) in %s", name, id, checkpointDir)
+	return nil
+}
+
 func readMetadata(metadataFile string) (map[string]string, error) {
 	metadata := make(map[string]string)
 
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestCheckStoppedContainer(t *testing.T) {
+	withState := func(status string) types.ContainerJSON {
+		return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "abc123",
+			State: &types.ContainerState{Status: status, Running: status == "running" || status == "paused"},
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		info       types.ContainerJSON
+		inspectErr error
+		wantErr    string
+	}{
+		{name: "exited", info: withState("exited")},
+		{name: "created", info: withState("created")},
+		{name: "running", info: withState("running"), wantErr: "requires a stopped container, got running"},
+		{name: "paused", info: withState("paused"), wantErr: "got paused"},
+		{name: "restarting", info: withState("restarting"), wantErr: "got restarting"},
+		{name: "missing", inspectErr: errors.New("No such container: web"), wantErr: "cannot be inspected: No such container"},
+		{name: "no state", info: types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{}}, wantErr: "has no state"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStoppedContainer("web", tt.info, tt.inspectErr)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestRestoreIntoExistingMissingContainer checks that a container Docker
+// cannot find fails the restore instead of falling back to recreating it.
+func TestRestoreIntoExistingMissingContainer(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "unix://"+t.TempDir()+"/docker.sock")
+
+	err := restoreContainerIntoExisting("web", t.TempDir(), &RestoreConfig{IntoExisting: true})
+	if err == nil || !strings.Contains(err.Error(), "requires a stopped container") {
+		t.Fatalf("got error %v, want one about the stopped container", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// containerCgroupPattern matches the container ID in the cgroup paths Docker
+// and containerd create, with the cgroupfs and systemd drivers:
+// /docker/<id>, /system.slice/docker-<id>.scope,
+// cri-containerd-<id>.scope, ...
+var containerCgroupPattern = regexp.MustCompile(`(?:docker|containerd|libpod)[-/]([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// containerIDOfPID returns the ID of the container pid runs in according to
+// its cgroup, or "" for a process outside any container.
+func containerIDOfPID(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// hierarchy-ID:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if m := containerCgroupPattern.FindStringSubmatch(parts[2]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// containerOfPID finds the container a host PID belongs to. The name is
+// empty when Docker does not know the container, e.g. one run by
+// containerd directly.
+func containerOfPID(pid int) (id, name string) {
+	id = containerIDOfPID(pid)
+	if id == "" {
+		return "", ""
+	}
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return id, ""
+	}
+	defer dockerClient.Close()
+	info, err := dockerClient.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return id, ""
+	}
+	return id, strings.TrimPrefix(info.Name, "/")
+}
+
+// warnContainerPID warns that a PID target belongs to a container: the
+// checkpoint will lack the container's metadata and cannot be restored as
+// one.
+func warnContainerPID(pid int, id, name string) {
+	label := id[:12]
+	if name != "" {
+		label = fmt.Sprintf("%s (%s)", name, id[:12])
+	}
+	logWarnf("PID %d belongs to container %s. Checkpointing it by PID records none of the container's context "+
+		"and it cannot be restored as a container. Checkpoint the container by name, or pass --as-container "+
+		"to do so automatically.", pid, label)
+}
+
+// checkContainerPID catches a container whose recorded PID is stale: the
+// process is gone, or the PID now belongs to something else.
+func checkContainerPID(containerID string, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("container %s has no PID", containerID)
+	}
+	if err := validateProcessExists(pid); err != nil {
+		return fmt.Errorf("container %s reports PID %d, but %w; Docker's state is stale", containerID, pid, err)
+	}
+	if id := containerIDOfPID(pid); id != "" && id != containerID {
+		return fmt.Errorf("container %s reports PID %d, but that process belongs to container %s", containerID, pid, id[:12])
+	}
+	return nil
+}
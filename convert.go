@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// convertDockerCheckpoint copies the CRIU images of the Docker-native
+// checkpoint checkpointID of containerID out of Docker's storage into
+// outDir and adds the container.meta and manifest docker-cr's own
+// checkpoints carry, so the result restores without the checkpoint API.
+func convertDockerCheckpoint(containerID, checkpointID, outDir string) error {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	containerInfo, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	// Docker keeps checkpoints below its data root, which is not always
+	// /var/lib/docker
+	rootDir := "/var/lib/docker"
+	if daemonInfo, err := dockerClient.Info(ctx); err == nil && daemonInfo.DockerRootDir != "" {
+		rootDir = daemonInfo.DockerRootDir
+	}
+	srcDir := filepath.Join(rootDir, "containers", containerInfo.ID, "checkpoints", checkpointID)
+
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return fmt.Errorf("failed to read Docker checkpoint %s: %w", checkpointID, err)
+	}
+
+	var images []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".img") {
+			images = append(images, entry.Name())
+		}
+	}
+	for _, name := range requiredImages {
+		if _, err := os.Stat(filepath.Join(srcDir, name)); err != nil {
+			return fmt.Errorf("Docker checkpoint %s has no %s", checkpointID, name)
+		}
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	logInfof("Copying %d images from %s to %s...", len(images), srcDir, outDir)
+	for _, name := range images {
+		src, err := os.Open(filepath.Join(srcDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		err = spoolToFile(src, filepath.Join(outDir, name))
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+	}
+
+	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nCHECKPOINT_ID=%s\nCONVERTED_FROM=docker\n",
+		containerInfo.ID,
+		containerInfo.Name,
+		containerInfo.Config.Image,
+		checkpointID)
+	if err := os.WriteFile(filepath.Join(outDir, "container.meta"), []byte(metadata), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	logInfof("Writing integrity manifest...")
+	if _, err := writeManifest(outDir); err != nil {
+		return err
+	}
+
+	return nil
+}
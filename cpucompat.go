@@ -0,0 +1,120 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// ArchInfo is what a checkpoint needs of the CPU it is restored on: the
+// machine the main executable was built for and the CPU flags of the host
+// it was dumped on.
+type ArchInfo struct {
+	Machine  string   `json:"machine"`
+	CPUFlags []string `json:"cpu_flags,omitempty"`
+}
+
+// hostMachines maps GOARCH to the ELF machine names of executables the
+// host runs natively. 32-bit x86 runs on x86_64, and CRIU dumps it in
+// compat mode.
+var hostMachines = map[string][]string{
+	"amd64":   {"x86_64", "386"},
+	"386":     {"386"},
+	"arm64":   {"aarch64"},
+	"arm":     {"arm"},
+	"ppc64le": {"ppc64"},
+	"s390x":   {"s390"},
+	"riscv64": {"riscv"},
+}
+
+// analyzeArch reads the ELF machine of the executable of pid and the CPU
+// flags of this host.
+func analyzeArch(pid int) *ArchInfo {
+	arch := &ArchInfo{CPUFlags: hostCPUFlags()}
+	if f, err := elf.Open(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		arch.Machine = machineName(f.Machine)
+		f.Close()
+	}
+	return arch
+}
+
+// machineName turns elf.EM_X86_64 into "x86_64".
+func machineName(m elf.Machine) string {
+	return strings.ToLower(strings.TrimPrefix(m.String(), "EM_"))
+}
+
+// hostCPUFlags returns the flags (x86) or features (arm) line of
+// /proc/cpuinfo, sorted.
+func hostCPUFlags() []string {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if name = strings.TrimSpace(name); name == "flags" || name == "Features" {
+			flags := strings.Fields(value)
+			sort.Strings(flags)
+			return flags
+		}
+	}
+	return nil
+}
+
+// checkCPUCompatibility fails when the checkpoint's executable cannot run
+// on this host's architecture, or when CRIU's own check of cpuinfo.img
+// fails. CPU flags the dump host had and this one lacks are a warning: the
+// process may or may not use them. It runs before a restore touches any
+// container.
+func checkCPUCompatibility(checkpointDir string) error {
+	if info, err := loadAnalysis(checkpointDir); err == nil && info.Arch != nil {
+		if info.Arch.Machine != "" && !contains(hostMachines[runtime.GOARCH], info.Arch.Machine) {
+			return fmt.Errorf("the checkpoint is of a %s executable, which cannot run on this %s host", info.Arch.Machine, runtime.GOARCH)
+		}
+		if missing := missingCPUFlags(info.Arch.CPUFlags, hostCPUFlags()); len(missing) > 0 {
+			logWarnf("this CPU lacks features the checkpoint host had; the process crashes if it uses them: %s", strings.Join(missing, " "))
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(checkpointDir, "cpuinfo.img")); err != nil {
+		return nil
+	}
+	if _, err := exec.LookPath("criu"); err != nil {
+		return nil
+	}
+	if output, err := exec.Command("criu", "cpuinfo", "check", "-D", checkpointDir).CombinedOutput(); err != nil {
+		return fmt.Errorf("CRIU reports this CPU incompatible with the checkpoint: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// missingCPUFlags returns the flags in recorded that current lacks.
+func missingCPUFlags(recorded, current []string) []string {
+	have := make(map[string]bool, len(current))
+	for _, flag := range current {
+		have[flag] = true
+	}
+	var missing []string
+	for _, flag := range recorded {
+		if !have[flag] {
+			missing = append(missing, flag)
+		}
+	}
+	return missing
+}
+
+// printArch prints the architecture line of an analysis.
+func printArch(arch *ArchInfo) {
+	if arch == nil || arch.Machine == "" {
+		return
+	}
+	fmt.Printf("  Architecture: %s (%d CPU flags recorded)\n", arch.Machine, len(arch.CPUFlags))
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/checkpoint-restore/go-criu/v7"
 	"github.com/checkpoint-restore/go-criu/v7/rpc"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -17,7 +16,7 @@ import (
 )
 
 // checkpointContainerDirect bypasses Docker and uses CRIU directly
-func checkpointContainerDirect(containerID, checkpointDir string) error {
+func checkpointContainerDirect(containerID, checkpointDir string, cfg *CheckpointConfig) error {
 	ctx := context.Background()
 
 	// Get container info from Docker
@@ -27,7 +26,9 @@ func checkpointContainerDirect(containerID, checkpointDir string) error {
 	}
 	defer dockerClient.Close()
 
+	cfg.timings.begin(phaseInspect)
 	containerInfo, err := dockerClient.ContainerInspect(ctx, containerID)
+	cfg.timings.end(phaseInspect)
 	if err != nil {
 		return fmt.Errorf("failed to inspect container: %w", err)
 	}
@@ -37,7 +38,16 @@ func checkpointContainerDirect(containerID, checkpointDir string) error {
 	}
 
 	pid := containerInfo.State.Pid
-	fmt.Printf("Container PID: %d\n", pid)
+	setLogFields("pid", pid)
+	logInfof("Container PID: %d", pid)
+	if err := checkContainerPID(containerInfo.ID, pid); err != nil {
+		return err
+	}
+
+	if containerInfo.HostConfig != nil && containerInfo.HostConfig.PidMode.IsHost() {
+		logWarnf("container shares the host PID namespace (--pid=host); it is dumped as external and the restored container must be started with --pid=host again")
+		cfg.hostPIDNS = true
+	}
 
 	// Create checkpoint directory
 	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
@@ -46,22 +56,26 @@ func checkpointContainerDirect(containerID, checkpointDir string) error {
 
 	// Save container metadata for restore
 	metadataFile := filepath.Join(checkpointDir, "container.meta")
-	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nPID=%d\n",
+	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nPID=%d\nMNT_NS=%s\n",
 		containerInfo.ID,
 		containerInfo.Name,
 		containerInfo.Config.Image,
-		pid)
+		pid,
+		mountNamespaceOf(pid))
+	if cfg.hostPIDNS {
+		metadata += "PID_MODE=host\n"
+	}
 
 	if err := os.WriteFile(metadataFile, []byte(metadata), 0644); err != nil {
 		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
 	// Use CRIU directly on the container process
-	return checkpointProcessDirect(pid, checkpointDir)
+	return checkpointProcessDirect(pid, checkpointDir, cfg)
 }
 
-func checkpointProcessDirect(pid int, checkpointDir string) error {
-	criuClient := criu.MakeCriu()
+func checkpointProcessDirect(pid int, checkpointDir string, cfg *CheckpointConfig) error {
+	criuClient := limitCriuMemory(newCriuClient(cfg.CriuService), cfg.MemoryLimit)
 
 	// Check CRIU version
 	if _, err := criuClient.GetCriuVersion(); err != nil {
@@ -85,9 +99,9 @@ func checkpointProcessDirect(pid int, checkpointDir string) error {
 	opts := &rpc.CriuOpts{
 		Pid:          proto.Int32(int32(pid)),
 		ImagesDirFd:  proto.Int32(int32(imageDir.Fd())),
-		LogLevel:     proto.Int32(4),
+		LogLevel:     criuLogLevel(cfg.LogLevel),
 		LogFile:      proto.String("dump.log"),
-		LeaveRunning: proto.Bool(true),
+		LeaveRunning: proto.Bool(!cfg.StopAfterDump),
 		TcpEstablished: proto.Bool(true),
 		ExtUnixSk:     proto.Bool(true),
 		ShellJob:      proto.Bool(false),
@@ -98,14 +112,63 @@ func checkpointProcessDirect(pid int, checkpointDir string) error {
 		// Auto-detect and handle external mounts
 		AutoExtMnt:   proto.Bool(true),
 	}
+	if cfg.hostPIDNS {
+		ext, err := externalPIDNamespace(pid)
+		if err != nil {
+			return err
+		}
+		opts.External = append(opts.External, ext)
+	}
+	applyExtMountLists(opts, cfg)
+	applyCgroupHierarchy(opts, cfg.CgroupHierarchy, cgroupHierarchyCgroupns)
+
+	// Run the same pre-flight analysis as plain process checkpoints
+	if err := prepareProcessForDump(pid, checkpointDir, opts, cfg); err != nil {
+		return fmt.Errorf("failed to prepare process for dump: %w", err)
+	}
+
+	if cfg.EnvFile != "" {
+		if err := saveProcessEnviron(pid, checkpointDir, cfg.EnvFile); err != nil {
+			return err
+		}
+	}
+
+	if err := recordMappedFiles(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
+	if err := recordStdio(pid, checkpointDir); err != nil {
+		logWarnf("%v", err)
+	}
 
 	// Create notification handler
-	notify := &SimpleNotify{}
+	notify := &SimpleNotify{hooks: NewNotifyHandler()}
+	notify.hooks.setOperation("container", pid, checkpointDir)
+	notify.hooks.Hooks = cfg.Hooks
+	notify.hooks.setHookTimeouts(cfg.HookTimeouts)
+	notify.hooks.timings = cfg.timings
+	if err := prepareNetworkLock(opts, notify.hooks, pid, cfg); err != nil {
+		return err
+	}
+	defer notify.hooks.unlockNetwork()
+
+	if cfg.Consistent {
+		freeze, err := freezeContainerFS(pid, checkpointDir)
+		if err != nil {
+			return err
+		}
+		// PostDump thaws; this covers a dump that fails before it
+		defer func() {
+			if err := freeze.Thaw(); err != nil {
+				logWarnf("%v", err)
+			}
+		}()
+		notify.freeze = freeze
+	}
 
-	fmt.Println("Creating checkpoint with CRIU...")
+	logInfof("Creating checkpoint with CRIU...")
 	startTime := time.Now()
 
-	err = criuClient.Dump(opts, notify)
+	err = runDump(criuClient, opts, notify, checkpointDir, cfg)
 	if err != nil {
 		// Read and display log
 		logPath := filepath.Join(checkpointDir, "dump.log")
@@ -116,17 +179,17 @@ func checkpointProcessDirect(pid int, checkpointDir string) error {
 	}
 
 	duration := time.Since(startTime)
-	fmt.Printf("Checkpoint completed in %.3f seconds\n", duration.Seconds())
+	logger.Info("Checkpoint completed", "duration", duration)
 
 	// List created files
 	entries, _ := os.ReadDir(checkpointDir)
-	fmt.Printf("Created %d checkpoint files\n", len(entries))
+	logInfof("Created %d checkpoint files", len(entries))
 
 	return nil
 }
 
 // restoreContainerDirect restores using CRIU directly
-func restoreContainerDirect(containerID, checkpointDir string) error {
+func restoreContainerDirect(containerID, checkpointDir string, cfg *RestoreConfig) error {
 	// Verify checkpoint files exist
 	if _, err := os.Stat(filepath.Join(checkpointDir, "pstree.img")); os.IsNotExist(err) {
 		return fmt.Errorf("checkpoint files not found in %s", checkpointDir)
@@ -163,7 +226,10 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 		}
 	}
 
-	fmt.Printf("Found %d checkpoint image files\n", imgCount)
+	logInfof("Found %d checkpoint image files", imgCount)
+	if metadata["PID_MODE"] == "host" {
+		logWarnf("the checkpoint was taken in the host PID namespace (--pid=host); the restored container must be reconnected to it")
+	}
 
 	// For container restore, we need to create a new container with proper namespace setup
 	ctx := context.Background()
@@ -175,9 +241,16 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 	}
 	defer dockerClient.Close()
 
+	stopTiming := cfg.timings.track(phaseRecreate)
+	defer stopTiming()
+
 	// Remove existing container if it exists
-	if _, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
-		fmt.Println("Stopping and removing existing container...")
+	name := containerID
+	if cfg.NewContainerName != "" {
+		name = cfg.NewContainerName
+		logInfof("Restoring as container %s; %s is left as it is", name, containerID)
+	} else if _, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
+		logInfof("Stopping and removing existing container...")
 		timeout := 10
 		stopOpts := container.StopOptions{Timeout: &timeout}
 		dockerClient.ContainerStop(ctx, containerID, stopOpts)
@@ -193,8 +266,9 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 		image = "alpine:latest"
 	}
 
-	fmt.Printf("Creating new container from image %s...\n", image)
+	logInfof("Creating new container from image %s...", image)
 	containerConfig := &container.Config{
+		Hostname: cfg.Hostname,
 		Image: image,
 		Cmd:   []string{"sleep", "3600"}, // Will be replaced by restore
 		Tty:   true,
@@ -210,12 +284,17 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 		NetworkMode: container.NetworkMode("default"),
 	}
 
-	resp, err := dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, containerID)
+	resp, err := dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, name)
 	if err != nil {
 		return fmt.Errorf("failed to create container: %w", err)
 	}
 
-	fmt.Printf("Created container: %s\n", resp.ID)
+	logInfof("Created container: %s", resp.ID)
+	if cfg.NewContainerName != "" {
+		if err := recordRestoredContainer(checkpointDir, resp.ID, name); err != nil {
+			return err
+		}
+	}
 
 	// Start container briefly to set up namespaces, then stop it
 	if err := dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
@@ -232,10 +311,10 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 	}
 
 	newPID := newInfo.State.Pid
-	fmt.Printf("New container PID: %d\n", newPID)
+	logInfof("New container PID: %d", newPID)
 
 	// Stop the container but keep it created (don't remove)
-	fmt.Println("Stopping container for restore...")
+	logInfof("Stopping container for restore...")
 	timeout := 5
 	stopOpts := container.StopOptions{Timeout: &timeout}
 	if err := dockerClient.ContainerStop(ctx, resp.ID, stopOpts); err != nil {
@@ -245,13 +324,15 @@ func restoreContainerDirect(containerID, checkpointDir string) error {
 	// Wait for container to fully stop
 	time.Sleep(2 * time.Second)
 
+	stopTiming()
+
 	// Now attempt direct CRIU restore
-	fmt.Println("Attempting direct CRIU restore into container namespaces...")
-	return restoreProcessDirect(checkpointDir)
+	logInfof("Attempting direct CRIU restore into container namespaces...")
+	return restoreProcessDirect(checkpointDir, cfg)
 }
 
-func restoreProcessDirect(checkpointDir string) error {
-	criuClient := criu.MakeCriu()
+func restoreProcessDirect(checkpointDir string, cfg *RestoreConfig) error {
+	criuClient := newCriuClient(cfg.CriuService)
 
 	// Check CRIU version
 	if _, err := criuClient.GetCriuVersion(); err != nil {
@@ -274,7 +355,7 @@ func restoreProcessDirect(checkpointDir string) error {
 	// CRIU restore options for container restore
 	opts := &rpc.CriuOpts{
 		ImagesDirFd:    proto.Int32(int32(imageDir.Fd())),
-		LogLevel:       proto.Int32(4),
+		LogLevel:       criuLogLevel(cfg.LogLevel),
 		LogFile:        proto.String("restore.log"),
 		TcpEstablished: proto.Bool(true),
 		ExtUnixSk:      proto.Bool(true),
@@ -288,15 +369,61 @@ func restoreProcessDirect(checkpointDir string) error {
 		AutoExtMnt:     proto.Bool(true),
 		// Sibling restore mode
 		RstSibling:     proto.Bool(false),
+		InheritFd:      cfg.InheritFds,
 	}
 
-	// Create notification handler
-	notify := &SimpleNotify{}
+	if err := prepareProcessForRestore(checkpointDir, opts); err != nil {
+		return fmt.Errorf("failed to prepare for restore: %w", err)
+	}
+	if cfg.CgroupLeave {
+		leaveCgroups(opts)
+	}
+	if err := checkRestoreMemory(checkpointDir); err != nil {
+		return err
+	}
 
-	fmt.Println("Restoring with CRIU...")
+	if cfg.JoinNamespacesOf != 0 {
+		// The joined container's root is where the mapped files must be
+		root := fmt.Sprintf("/proc/%d/root", cfg.JoinNamespacesOf)
+		if err := verifyMappedFiles(checkpointDir, root); err != nil {
+			return err
+		}
+		if err := verifyOpenFiles(checkpointDir, root); err != nil {
+			return err
+		}
+		if err := verifyWatchedPaths(checkpointDir, root); err != nil {
+			return err
+		}
+		if err := checkPortConflicts(checkpointDir, cfg.JoinNamespacesOf, cfg.IgnorePortConflicts); err != nil {
+			return err
+		}
+		if err := checkTCPInterface(checkpointDir, cfg.JoinNamespacesOf); err != nil {
+			return err
+		}
+		joinNamespacesOf(opts, cfg.JoinNamespacesOf)
+	}
+
+	if cfg.MountNsFile != "" {
+		if err := joinMountNamespace(opts, cfg.MountNsFile); err != nil {
+			return err
+		}
+	}
+
+	// Create notification handler
+	notify := NewNotifyHandler()
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.Hostname = cfg.Hostname
+	notify.MountNsPath = cfg.MountNsFile
+	notify.Hooks = cfg.Hooks
+	notify.timings = cfg.timings
+	notify.setOperation("container", 0, checkpointDir)
+
+	logInfof("Restoring with CRIU...")
 	startTime := time.Now()
 
-	err = criuClient.Restore(opts, notify)
+	stopTiming := cfg.timings.track(phaseRestore)
+	err = runRestore(criuClient, opts, notify, checkpointDir, cfg.CriuArgs)
+	stopTiming()
 	if err != nil {
 		// Read and display log
 		logPath := filepath.Join(checkpointDir, "restore.log")
@@ -307,23 +434,53 @@ func restoreProcessDirect(checkpointDir string) error {
 	}
 
 	duration := time.Since(startTime)
-	fmt.Printf("Restore completed in %.3f seconds\n", duration.Seconds())
+	logger.Info("Restore completed", "duration", duration)
 
 	return nil
 }
 
 // SimpleNotify implements the Notify interface
-type SimpleNotify struct{}
+type SimpleNotify struct {
+	// freeze, if set, is thawed as soon as the images are written
+	freeze *fsFreeze
+	// hooks, if set, runs the dump hook scripts
+	hooks *NotifyHandler
+}
+
+func (n *SimpleNotify) PreDump() error {
+	if n.hooks == nil {
+		return nil
+	}
+	return n.hooks.PreDump()
+}
+
+func (n *SimpleNotify) PostDump() error {
+	if err := n.freeze.Thaw(); err != nil {
+		return err
+	}
+	if n.hooks == nil {
+		return nil
+	}
+	return n.hooks.PostDump()
+}
 
-func (n *SimpleNotify) PreDump() error { return nil }
-func (n *SimpleNotify) PostDump() error { return nil }
 func (n *SimpleNotify) PreRestore() error { return nil }
 func (n *SimpleNotify) PostRestore(pid int32) error {
-	fmt.Printf("Process restored with PID: %d\n", pid)
+	logInfof("Process restored with PID: %d", pid)
 	return nil
 }
-func (n *SimpleNotify) NetworkLock() error { return nil }
-func (n *SimpleNotify) NetworkUnlock() error { return nil }
+func (n *SimpleNotify) NetworkLock() error {
+	if n.hooks == nil {
+		return nil
+	}
+	return n.hooks.NetworkLock()
+}
+func (n *SimpleNotify) NetworkUnlock() error {
+	if n.hooks == nil {
+		return nil
+	}
+	return n.hooks.NetworkUnlock()
+}
 func (n *SimpleNotify) SetupNamespaces(pid int32) error { return nil }
 func (n *SimpleNotify) PostSetupNamespaces() error { return nil }
 func (n *SimpleNotify) PostResume() error { return nil }
\ No newline at end of file
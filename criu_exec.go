@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// runDump performs the CRIU dump over go-criu's RPC transport, or by executing
+// the criu binary directly when extra raw arguments were requested. With
+// TailLog set the dump runs in its own goroutine while the CRIU log is
+// printed as it grows. A pre checkpoint is taken with CRIU's pre-dump, which
+// writes only the memory pages. With PreDumpCount the dump follows that many
+// pre-dump rounds at most.
+func runDump(criuClient criuRunner, opts *rpc.CriuOpts, notify criu.Notify, checkpointDir string, cfg *CheckpointConfig) error {
+	if cfg.PreDumpCount > 0 {
+		if err := runPreDumps(criuClient, opts, checkpointDir, cfg); err != nil {
+			return err
+		}
+	}
+	defer cfg.timings.track(phaseDump)()
+	defer progress.watchBytes(checkpointDir)()
+
+	dump := func() error {
+		if cfg.Type == checkpointTypePre {
+			opts.TrackMem = proto.Bool(true)
+			if len(cfg.CriuArgs) > 0 {
+				return execCriu("pre-dump", opts, checkpointDir, cfg.CriuArgs)
+			}
+			return criuClient.PreDump(opts, notify)
+		}
+		if len(cfg.CriuArgs) > 0 {
+			return execCriu("dump", opts, checkpointDir, cfg.CriuArgs)
+		}
+		return criuClient.Dump(opts, notify)
+	}
+
+	if !cfg.TailLog {
+		return dump()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dump()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logEntries := TailCRIULog(ctx, filepath.Join(checkpointDir, opts.GetLogFile()), true)
+
+	var err error
+	for dumping := true; dumping || logEntries != nil; {
+		select {
+		case err = <-done:
+			// Stops following; the rest of the log is still delivered
+			cancel()
+			dumping = false
+		case entry, ok := <-logEntries:
+			if !ok {
+				logEntries = nil
+				continue
+			}
+			fmt.Printf("[criu] %s\n", entry)
+		}
+	}
+	cancel()
+
+	return err
+}
+
+// runRestore is the restore counterpart of runDump.
+func runRestore(criuClient criuRunner, opts *rpc.CriuOpts, notify criu.Notify, checkpointDir string, criuArgs []string) error {
+	if len(criuArgs) > 0 {
+		return execCriu("restore", opts, checkpointDir, criuArgs)
+	}
+	return criuClient.Restore(opts, notify)
+}
+
+// execCriu runs "criu <action>" with opts translated to command-line flags
+// followed by extraArgs verbatim. This exists for options newer than the
+// CriuOpts message go-criu was built against; notify callbacks are not
+// delivered in this mode.
+func execCriu(action string, opts *rpc.CriuOpts, checkpointDir string, extraArgs []string) error {
+	opts, inherited, err := inheritFdFiles(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range inherited {
+			file.Close()
+		}
+	}()
+
+	args := append([]string{action}, criuOptsToArgs(opts, checkpointDir)...)
+	if action == "restore" {
+		// RPC restores always detach; keep the same behavior
+		args = append(args, "--restore-detached")
+	}
+	args = append(args, extraArgs...)
+
+	logInfof("Running: criu %v", args)
+	cmd := exec.Command("criu", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = childStderr()
+	cmd.ExtraFiles = inherited
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("criu %s failed: %w", action, err)
+	}
+
+	return nil
+}
+
+// inheritFdFiles hands the InheritFd descriptors of opts to the criu
+// subprocess. Each is duplicated into an ExtraFiles entry, which the child
+// gets as fd 3+i, and the returned copy of opts names it by that number.
+// The caller closes the files once criu has exited.
+func inheritFdFiles(opts *rpc.CriuOpts) (*rpc.CriuOpts, []*os.File, error) {
+	if len(opts.InheritFd) == 0 {
+		return opts, nil, nil
+	}
+
+	opts = proto.Clone(opts).(*rpc.CriuOpts)
+	files := make([]*os.File, 0, len(opts.InheritFd))
+	for i, inherit := range opts.InheritFd {
+		// Close-on-exec, so only the ExtraFiles copy reaches criu
+		fd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(inherit.GetFd()), syscall.F_DUPFD_CLOEXEC, 0)
+		if errno != 0 {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to pass fd %d (%s) to criu: %w", inherit.GetFd(), inherit.GetKey(), errno)
+		}
+		files = append(files, os.NewFile(fd, inherit.GetKey()))
+		inherit.Fd = proto.Int32(int32(3 + i))
+	}
+	return opts, files, nil
+}
+
+// criuOptsToArgs converts the CriuOpts fields docker-cr sets into their
+// criu(8) command-line equivalents. Images are addressed by directory path
+// because the RPC file descriptor is meaningless to a subprocess.
+func criuOptsToArgs(opts *rpc.CriuOpts, checkpointDir string) []string {
+	args := []string{"--images-dir", checkpointDir}
+
+	if opts.Pid != nil {
+		args = append(args, "--tree", strconv.Itoa(int(opts.GetPid())))
+	}
+	if opts.LogLevel != nil {
+		args = append(args, "-v"+strconv.Itoa(int(opts.GetLogLevel())))
+	}
+	if opts.LogFile != nil {
+		args = append(args, "--log-file", opts.GetLogFile())
+	}
+	if opts.GetLeaveRunning() {
+		args = append(args, "--leave-running")
+	}
+	if opts.GetTcpEstablished() {
+		args = append(args, "--tcp-established")
+	}
+	if opts.GetExtUnixSk() {
+		args = append(args, "--ext-unix-sk")
+	}
+	if opts.GetShellJob() {
+		args = append(args, "--shell-job")
+	}
+	if opts.GetFileLocks() {
+		args = append(args, "--file-locks")
+	}
+	if opts.GetLinkRemap() {
+		args = append(args, "--link-remap")
+	}
+	if opts.GetForceIrmap() {
+		args = append(args, "--force-irmap")
+	}
+	if opts.NetworkLock != nil {
+		args = append(args, "--network-lock", strings.ToLower(opts.GetNetworkLock().String()))
+	}
+	if opts.GetAutoExtMnt() {
+		args = append(args, "--auto-ext-mnt")
+	}
+	if opts.GetRstSibling() {
+		args = append(args, "--restore-sibling")
+	}
+	if opts.GetManageCgroups() {
+		if opts.ManageCgroupsMode != nil {
+			args = append(args, "--manage-cgroups="+strings.ToLower(opts.GetManageCgroupsMode().String()))
+		} else {
+			args = append(args, "--manage-cgroups")
+		}
+	}
+	if opts.WorkDirFd != nil {
+		// The subprocess inherits nothing; it reaches the fd through /proc
+		args = append(args, "--work-dir", fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), opts.GetWorkDirFd()))
+	}
+	if opts.GhostLimit != nil {
+		args = append(args, "--ghost-limit", strconv.FormatUint(uint64(opts.GetGhostLimit()), 10))
+	}
+	if opts.ParentImg != nil {
+		args = append(args, "--prev-images-dir", opts.GetParentImg())
+	}
+	if opts.GetTrackMem() {
+		args = append(args, "--track-mem")
+	}
+	for _, ext := range opts.External {
+		args = append(args, "--external", ext)
+	}
+	for _, fd := range opts.InheritFd {
+		args = append(args, "--inherit-fd", fmt.Sprintf("fd[%d]:%s", fd.GetFd(), fd.GetKey()))
+	}
+	for _, ns := range opts.JoinNs {
+		args = append(args, "--join-ns", ns.GetNs()+":"+ns.GetNsFile())
+	}
+
+	return args
+}
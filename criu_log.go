@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultCRIULogLevel is CRIU's most verbose level, which docker-cr has
+// always used so failures can be debugged from the log alone.
+const defaultCRIULogLevel = 4
+
+// criuLogLevel returns the CriuOpts log level for a --log-level value, zero
+// meaning the default.
+func criuLogLevel(level int) *int32 {
+	if level == 0 {
+		level = defaultCRIULogLevel
+	}
+	return proto.Int32(int32(level))
+}
+
+// parseLogLevel parses a --log-level or DOCKER_CR_LOG_LEVEL value: 1 errors
+// only, 2 warnings, 3 info, 4 debug.
+func parseLogLevel(value string) (int, error) {
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 1 || level > 4 {
+		return 0, fmt.Errorf("invalid log level %q: must be 1 (errors) to 4 (debug)", value)
+	}
+	return level, nil
+}
+
+// CRIULogEntry is one parsed line of a CRIU log file.
+type CRIULogEntry struct {
+	// Timestamp is the time since CRIU started, as printed in the log
+	Timestamp time.Duration
+	// Level is "error", "warn" or "info"
+	Level string
+	// PID is the process the line refers to, or 0 for CRIU itself
+	PID     int
+	Message string
+}
+
+func (e CRIULogEntry) String() string {
+	if e.Timestamp == 0 && e.PID == 0 {
+		return e.Message
+	}
+	prefix := fmt.Sprintf("(%09.6f)", e.Timestamp.Seconds())
+	if e.PID != 0 {
+		prefix += fmt.Sprintf(" %d:", e.PID)
+	}
+	return prefix + " " + e.Message
+}
+
+// criuLogLine matches "(00.012345) [   pid: ]message".
+var criuLogLine = regexp.MustCompile(`^\((\d+)\.(\d+)\)\s+(?:(\d+):\s)?(.*)$`)
+
+// parseCRIULogLine parses a line written by CRIU at log level 4 or below.
+// Lines that do not carry a timestamp (continuations of multi-line messages)
+// are returned as info entries with a zero timestamp.
+func parseCRIULogLine(line string) CRIULogEntry {
+	entry := CRIULogEntry{Level: "info", Message: line}
+
+	if m := criuLogLine.FindStringSubmatch(line); m != nil {
+		secs, _ := strconv.ParseInt(m[1], 10, 64)
+		frac := m[2]
+		for len(frac) < 9 {
+			frac += "0"
+		}
+		nanos, _ := strconv.ParseInt(frac[:9], 10, 64)
+		entry.Timestamp = time.Duration(secs)*time.Second + time.Duration(nanos)
+		if m[3] != "" {
+			entry.PID, _ = strconv.Atoi(m[3])
+		}
+		entry.Message = m[4]
+	}
+
+	switch {
+	case strings.HasPrefix(entry.Message, "Error"):
+		entry.Level = "error"
+	case strings.HasPrefix(entry.Message, "Warn"):
+		entry.Level = "warn"
+	}
+
+	return entry
+}
+
+// TailCRIULog parses the CRIU log at path and sends its entries on the
+// returned channel. Without follow the channel is closed at EOF. With follow
+// the file is watched with inotify, waiting for it to be created if needed,
+// until ctx is cancelled; whatever was written up to then is still sent
+// before the channel is closed.
+func TailCRIULog(ctx context.Context, path string, follow bool) <-chan CRIULogEntry {
+	entries := make(chan CRIULogEntry, 64)
+
+	go func() {
+		defer close(entries)
+
+		var watcher *inotifyWatcher
+		if follow {
+			var err error
+			if watcher, err = newInotifyWatcher(ctx, path); err != nil {
+				entries <- CRIULogEntry{Level: "error", Message: fmt.Sprintf("failed to watch %s: %v", path, err)}
+				return
+			}
+			defer watcher.Close()
+		}
+
+		var file *os.File
+		for file == nil {
+			f, err := os.Open(path)
+			if err == nil {
+				file = f
+				break
+			}
+			if !follow || !os.IsNotExist(err) {
+				return
+			}
+			if !watcher.Wait() {
+				return
+			}
+		}
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		var partial strings.Builder
+		for stopped := !follow; ; {
+			chunk, err := reader.ReadString('\n')
+			partial.WriteString(chunk)
+			if err == nil {
+				entries <- parseCRIULogLine(strings.TrimRight(partial.String(), "\n"))
+				partial.Reset()
+				continue
+			}
+			if err != io.EOF || stopped {
+				break
+			}
+			// At EOF: wait for CRIU to write more. Once cancelled, read up to
+			// EOF one last time.
+			if !watcher.Wait() {
+				stopped = true
+			}
+		}
+
+		if partial.Len() > 0 {
+			entries <- parseCRIULogLine(partial.String())
+		}
+	}()
+
+	return entries
+}
+
+// inotifyWatcher reports changes to one file and the creation of that file
+// in its directory.
+type inotifyWatcher struct {
+	file   *os.File
+	name   string
+	ctx    context.Context
+	buffer []byte
+}
+
+func newInotifyWatcher(ctx context.Context, path string) (*inotifyWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	// Watching the directory covers both the file's creation and writes to it
+	mask := uint32(unix.IN_CREATE | unix.IN_MODIFY | unix.IN_MOVED_TO)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		// A non-blocking fd is registered with the runtime poller, so a
+		// read deadline can interrupt a pending Wait
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		name:   filepath.Base(path),
+		ctx:    ctx,
+		buffer: make([]byte, 4096),
+	}
+	go func() {
+		<-ctx.Done()
+		w.file.SetReadDeadline(time.Now())
+	}()
+
+	return w, nil
+}
+
+// Wait blocks until the watched file is created or modified and reports
+// false once the context is done.
+func (w *inotifyWatcher) Wait() bool {
+	for {
+		if w.ctx.Err() != nil {
+			return false
+		}
+
+		n, err := w.file.Read(w.buffer)
+		if err != nil {
+			return false
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			// struct inotify_event: wd, mask, cookie, then the length of
+			// the padded name that follows
+			nameLen := int(binary.NativeEndian.Uint32(w.buffer[offset+12:]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			if nameStart+nameLen > n {
+				break
+			}
+			nameBytes := w.buffer[nameStart : nameStart+nameLen]
+			offset = nameStart + nameLen
+
+			if strings.TrimRight(string(nameBytes), "\x00") == w.name {
+				return true
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) Close() {
+	w.file.Close()
+}
+
+// logColors maps CRIU log levels to ANSI colors for show-log. CRIU does not
+// mark its debug lines, so only continuation lines are shown as debug.
+var logColors = map[string]string{
+	"error": "\033[31m",
+	"warn":  "\033[33m",
+	"info":  "\033[37m",
+	"debug": "\033[90m",
+}
+
+// showCRIULog prints the dump or restore log of a checkpoint with its
+// severity colored when stdout is a terminal. since drops lines logged
+// earlier than that time after CRIU started; tail, if positive, keeps only
+// the last tail lines.
+func showCRIULog(checkpointDir, which string, since time.Duration, tail int) error {
+	if which != "dump" && which != "restore" {
+		return fmt.Errorf("unknown log %q, expected dump or restore", which)
+	}
+	path := filepath.Join(checkpointDir, which+".log")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to open %s log: %w", which, err)
+	}
+
+	var lines []CRIULogEntry
+	var last time.Duration
+	for entry := range TailCRIULog(context.Background(), path, false) {
+		if entry.Timestamp == 0 && entry.PID == 0 {
+			// A continuation belongs to the line before it
+			entry.Level = "debug"
+		} else {
+			last = entry.Timestamp
+		}
+		if last < since {
+			continue
+		}
+		lines = append(lines, entry)
+		if tail > 0 && len(lines) > tail {
+			lines = lines[1:]
+		}
+	}
+
+	color := false
+	if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		color = os.Getenv("NO_COLOR") == ""
+	}
+	for _, entry := range lines {
+		if color {
+			fmt.Printf("%s%s\033[0m\n", logColors[entry.Level], entry)
+		} else {
+			fmt.Println(entry)
+		}
+	}
+	return nil
+}
+
+// parseLogTime parses a --since-time value: CRIU's own "12.345678" seconds
+// or a duration such as "1.5s".
+func parseLogTime(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected seconds since CRIU started, e.g. 1.25 or 1.25s", value)
+	}
+	return d, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/checkpoint-restore/go-criu/v7"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// criuRunner is the part of go-criu's *criu.Criu docker-cr uses. It lets a
+// running "criu service" daemon stand in for a freshly spawned criu swrk.
+type criuRunner interface {
+	GetCriuVersion() (int, error)
+	Prepare() error
+	Cleanup()
+	Dump(opts *rpc.CriuOpts, nfy criu.Notify) error
+	PreDump(opts *rpc.CriuOpts, nfy criu.Notify) error
+	Restore(opts *rpc.CriuOpts, nfy criu.Notify) error
+}
+
+// newCriuClient returns a client for the CRIU service listening on
+// servicePath, or go-criu's default, which spawns criu, when servicePath is
+// empty or no socket exists there.
+func newCriuClient(servicePath string) criuRunner {
+	if servicePath == "" {
+		return criu.MakeCriu()
+	}
+	if info, err := os.Stat(servicePath); err != nil || info.Mode()&os.ModeSocket == 0 {
+		logWarnf("no CRIU service socket at %s, starting criu instead", servicePath)
+		return criu.MakeCriu()
+	}
+	return &criuService{socketPath: servicePath}
+}
+
+// criuService talks to a "criu service --address <path>" daemon. The
+// service forks a worker per connection, so every request gets its own.
+// File descriptors in the options, such as ImagesDirFd, are numbers in this
+// process; the service opens them through /proc/<our pid>/fd.
+type criuService struct {
+	socketPath string
+}
+
+// Prepare and Cleanup have nothing to do: connections are per request.
+func (s *criuService) Prepare() error { return nil }
+func (s *criuService) Cleanup()       {}
+
+func (s *criuService) Dump(opts *rpc.CriuOpts, nfy criu.Notify) error {
+	_, err := s.request(rpc.CriuReqType_DUMP, opts, nfy)
+	return err
+}
+
+func (s *criuService) PreDump(opts *rpc.CriuOpts, nfy criu.Notify) error {
+	_, err := s.request(rpc.CriuReqType_PRE_DUMP, opts, nfy)
+	return err
+}
+
+func (s *criuService) Restore(opts *rpc.CriuOpts, nfy criu.Notify) error {
+	_, err := s.request(rpc.CriuReqType_RESTORE, opts, nfy)
+	return err
+}
+
+// GetCriuVersion returns the version encoded like go-criu does:
+// major*10000 + minor*100 + sublevel.
+func (s *criuService) GetCriuVersion() (int, error) {
+	resp, err := s.request(rpc.CriuReqType_VERSION, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	v := resp.GetVersion()
+	if v == nil {
+		return 0, errors.New("CRIU service sent no version")
+	}
+	return int(v.GetMajorNumber())*10000 + int(v.GetMinorNumber())*100 + int(v.GetSublevel()), nil
+}
+
+// request sends one request and answers the notify callbacks CRIU makes
+// until the final response arrives, as go-criu does over swrk.
+func (s *criuService) request(reqType rpc.CriuReqType, opts *rpc.CriuOpts, nfy criu.Notify) (*rpc.CriuResp, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: s.socketPath, Net: "unixpacket"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to CRIU service %s: %w", s.socketPath, err)
+	}
+	defer conn.Close()
+
+	if nfy != nil {
+		opts.NotifyScripts = proto.Bool(true)
+	}
+	req := &rpc.CriuReq{Type: &reqType, Opts: opts}
+
+	buffer := make([]byte, 2*4096)
+	for {
+		reqBytes, err := proto.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(reqBytes); err != nil {
+			return nil, fmt.Errorf("failed to send request to CRIU service: %w", err)
+		}
+
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CRIU service response: %w", err)
+		}
+		resp := &rpc.CriuResp{}
+		if err := proto.Unmarshal(buffer[:n], resp); err != nil {
+			return nil, fmt.Errorf("failed to parse CRIU service response: %w", err)
+		}
+		if !resp.GetSuccess() {
+			return resp, fmt.Errorf("operation failed (msg:%s err:%d)", resp.GetCrErrmsg(), resp.GetCrErrno())
+		}
+
+		if resp.GetType() != rpc.CriuReqType_NOTIFY {
+			if resp.GetType() != reqType {
+				return resp, errors.New("unexpected CRIU RPC response")
+			}
+			return resp, nil
+		}
+		if nfy == nil {
+			return resp, errors.New("unexpected notify")
+		}
+		if err := dispatchNotify(nfy, resp.GetNotify()); err != nil {
+			return resp, err
+		}
+
+		notifyType := rpc.CriuReqType_NOTIFY
+		req = &rpc.CriuReq{Type: &notifyType, NotifySuccess: proto.Bool(true)}
+	}
+}
+
+// dispatchNotify calls the nfy method for a CRIU notify message.
+func dispatchNotify(nfy criu.Notify, notify *rpc.CriuNotify) error {
+	switch notify.GetScript() {
+	case "pre-dump":
+		return nfy.PreDump()
+	case "post-dump":
+		return nfy.PostDump()
+	case "pre-restore":
+		return nfy.PreRestore()
+	case "post-restore":
+		return nfy.PostRestore(notify.GetPid())
+	case "network-lock":
+		return nfy.NetworkLock()
+	case "network-unlock":
+		return nfy.NetworkUnlock()
+	case "setup-namespaces":
+		return nfy.SetupNamespaces(notify.GetPid())
+	case "post-setup-namespaces":
+		return nfy.PostSetupNamespaces()
+	case "post-resume":
+		return nfy.PostResume()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// criuDefaultGhostLimit is CRIU's ghost limit when none is passed.
+const criuDefaultGhostLimit = 1 << 20
+
+// DeletedFile is a file the process holds open after it was unlinked. CRIU
+// stores its contents in the dump as a ghost file, up to the ghost limit.
+type DeletedFile struct {
+	FD   int    `json:"fd"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// deletedFileFor returns the deleted file behind an fd link target, or nil.
+// memfds look deleted too but are dumped with their memory.
+func deletedFileFor(pid, fd int, linkTarget string) *DeletedFile {
+	path, deleted := strings.CutSuffix(linkTarget, " (deleted)")
+	if !deleted || !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "/memfd:") {
+		return nil
+	}
+
+	file := &DeletedFile{FD: fd, Path: path}
+	// Stat through the fd link reaches the unlinked inode
+	if info, err := os.Stat(fmt.Sprintf("/proc/%d/fd/%d", pid, fd)); err == nil && info.Mode().IsRegular() {
+		file.Size = info.Size()
+	}
+	return file
+}
+
+// applyDeletedFileOptions turns on CRIU's link remapping when the process
+// holds deleted files and warns about each one the ghost limit will not
+// cover, so the limit can be raised before the dump fails on it.
+func applyDeletedFileOptions(deleted []DeletedFile, opts *rpc.CriuOpts) {
+	if len(deleted) == 0 {
+		return
+	}
+
+	// Files unlinked but still linked elsewhere are relinked instead of
+	// copied into the dump
+	opts.LinkRemap = proto.Bool(true)
+
+	limit := int64(criuDefaultGhostLimit)
+	if opts.GhostLimit != nil {
+		limit = int64(opts.GetGhostLimit())
+	}
+	for _, file := range deleted {
+		if file.Size > limit {
+			logWarnf("deleted file %s (fd %d, %s) exceeds the ghost limit of %s; the dump will fail unless --ghost-limit is raised",
+				file.Path, file.FD, formatSize(file.Size), formatSize(limit))
+		}
+	}
+}
+
+// validateGhostLimit checks a --ghost-limit value fits CRIU's 32-bit field.
+func validateGhostLimit(limit int64) error {
+	if limit < 0 || limit > math.MaxUint32 {
+		return fmt.Errorf("--ghost-limit must be between 0 and %s", formatSize(math.MaxUint32))
+	}
+	return nil
+}
+
+// printDeletedFiles lists the deleted files of an analysis.
+func printDeletedFiles(deleted []DeletedFile) {
+	if len(deleted) == 0 {
+		return
+	}
+
+	fmt.Printf("  Deleted open files: %d\n", len(deleted))
+	for _, file := range deleted {
+		fmt.Printf("    %10s  %s (fd %d)\n", formatSize(file.Size), file.Path, file.FD)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deltaRefFile marks a delta checkpoint. It names the parent checkpoint and
+// the digest of the parent's manifest. Files listed in the delta's manifest
+// but absent from its directory are identical to the parent's copy.
+const deltaRefFile = "delta.ref"
+
+// maxDeltaDepth bounds how many parents a delta chain may have.
+const maxDeltaDepth = 16
+
+// isDeltaCheckpoint reports whether checkpointDir only holds the files that
+// changed since its parent.
+func isDeltaCheckpoint(checkpointDir string) bool {
+	_, err := os.Stat(filepath.Join(checkpointDir, deltaRefFile))
+	return err == nil
+}
+
+// makeDelta removes every file of checkpointDir that is identical to the
+// same file in parentDir and records parentDir as the parent. The manifest
+// keeps describing the full checkpoint.
+func makeDelta(checkpointDir, parentDir string) error {
+	parentDir, err := filepath.Abs(parentDir)
+	if err != nil {
+		return err
+	}
+	if _, err := resolveDeltaChain(parentDir); err != nil {
+		return fmt.Errorf("unusable delta parent: %w", err)
+	}
+
+	own, err := readManifest(filepath.Join(checkpointDir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	parent, err := readManifest(filepath.Join(parentDir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to read parent manifest: %w", err)
+	}
+	digest, err := manifestDigest(parentDir)
+	if err != nil {
+		return err
+	}
+
+	// Write the reference first: a delta without it would look corrupt
+	ref := fmt.Sprintf("PARENT=%s\nPARENT_MANIFEST=%s\n", parentDir, digest)
+	if err := os.WriteFile(filepath.Join(checkpointDir, deltaRefFile), []byte(ref), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", deltaRefFile, err)
+	}
+
+	var shared, saved int64
+	for name, hash := range own {
+		if parent[name] != hash {
+			continue
+		}
+		path := filepath.Join(checkpointDir, filepath.FromSlash(name))
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to drop unchanged %s: %w", name, err)
+		}
+		shared++
+		saved += info.Size()
+	}
+
+	logInfof("Delta against %s: %d of %d files unchanged, %s saved",
+		parentDir, shared, len(own), formatSize(saved))
+	return nil
+}
+
+// resolveDeltaChain returns checkpointDir followed by its parents, oldest
+// last. Every parent must exist and still match the manifest digest its
+// child recorded; otherwise the whole chain is reported.
+func resolveDeltaChain(checkpointDir string) ([]string, error) {
+	chain := []string{checkpointDir}
+
+	for dir := checkpointDir; isDeltaCheckpoint(dir); {
+		if len(chain) > maxDeltaDepth {
+			return nil, fmt.Errorf("delta chain deeper than %d:\n  %s", maxDeltaDepth, strings.Join(chain, "\n  "))
+		}
+
+		ref, err := readMetadata(filepath.Join(dir, deltaRefFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in %s: %w", deltaRefFile, dir, err)
+		}
+		parent := ref["PARENT"]
+
+		problem := ""
+		if parent == "" {
+			problem = "no parent recorded"
+		} else if _, err := os.Stat(parent); err != nil {
+			problem = "missing"
+		} else if digest, err := manifestDigest(parent); err != nil {
+			problem = "no manifest"
+		} else if digest != ref["PARENT_MANIFEST"] {
+			problem = "manifest changed since the delta was taken"
+		}
+
+		chain = append(chain, parent)
+		if problem != "" {
+			chain[len(chain)-1] += " (" + problem + ")"
+			return nil, fmt.Errorf("broken delta chain:\n  %s", strings.Join(chain, "\n  -> "))
+		}
+
+		dir = parent
+	}
+
+	return chain, nil
+}
+
+// materializeCheckpoint assembles the full file set of a delta checkpoint in
+// outDir, taking each file from the nearest checkpoint in the chain that
+// has it, and verifies the result against the manifest.
+func materializeCheckpoint(checkpointDir, outDir string) error {
+	chain, err := resolveDeltaChain(checkpointDir)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := readManifest(filepath.Join(checkpointDir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	names := make([]string, 0, len(hashes)+1)
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = append(names, manifestFile)
+
+	logInfof("Materializing delta checkpoint from %d directories...", len(chain))
+	for _, name := range names {
+		rel := filepath.FromSlash(name)
+		found := false
+		for _, dir := range chain {
+			src := filepath.Join(dir, rel)
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err := linkOrCopy(src, filepath.Join(outDir, rel)); err != nil {
+				return fmt.Errorf("failed to materialize %s: %w", name, err)
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("%s is missing from every checkpoint in the chain:\n  %s", name, strings.Join(chain, "\n  -> "))
+		}
+	}
+
+	return verifyManifest(outDir)
+}
+
+// materializeToTemp materializes a delta checkpoint into a temporary
+// directory for restore. The returned function removes it.
+func materializeToTemp(checkpointDir string) (string, func(), error) {
+	defer tracing.track(spanCopy)()
+	tmpDir, err := os.MkdirTemp("", "docker-cr-restore-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary restore directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	if err := materializeCheckpoint(checkpointDir, tmpDir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return tmpDir, cleanup, nil
+}
+
+// flattenCheckpoint turns a delta checkpoint into a standalone one, either
+// in place or as a copy in outDir.
+func flattenCheckpoint(checkpointDir, outDir string) error {
+	if !isDeltaCheckpoint(checkpointDir) {
+		return fmt.Errorf("%s is not a delta checkpoint", checkpointDir)
+	}
+
+	if outDir != "" {
+		if err := materializeCheckpoint(checkpointDir, outDir); err != nil {
+			return err
+		}
+		logInfof("Flattened %s into %s", checkpointDir, outDir)
+		return nil
+	}
+
+	// In place: build the full set next to the delta, then swap it in
+	tmpDir := filepath.Clean(checkpointDir) + ".flatten"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := materializeCheckpoint(checkpointDir, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	// Keep files outside the manifest, such as restore logs
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		dst := filepath.Join(tmpDir, entry.Name())
+		if entry.Name() == deltaRefFile || entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := linkOrCopy(filepath.Join(checkpointDir, entry.Name()), dst); err != nil {
+			return err
+		}
+	}
+
+	oldDir := filepath.Clean(checkpointDir) + ".delta"
+	if err := os.Rename(checkpointDir, oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, checkpointDir); err != nil {
+		os.Rename(oldDir, checkpointDir)
+		return err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+
+	logInfof("Flattened %s", checkpointDir)
+	return nil
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy across
+// filesystems.
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
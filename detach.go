@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// internalDetachFlag marks the background process started by --detach. Its
+// value is the PID to send --completion-signal to.
+const internalDetachFlag = "internal-do-checkpoint"
+
+// detachedLogPath is where the output of a detached checkpoint goes. It is
+// next to the checkpoint directory, so a failed dump's cleanup keeps it.
+func detachedLogPath(checkpointDir string) string {
+	return strings.TrimSuffix(checkpointDir, "/") + ".detach.log"
+}
+
+// stripFlags removes the named flags from args. valueFlags take a value,
+// either as -name=value or as the next argument.
+func stripFlags(args []string, boolFlags, valueFlags []string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(kept, args[i:]...)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") {
+			kept = append(kept, arg)
+			continue
+		}
+		switch {
+		case contains(boolFlags, name):
+		case contains(valueFlags, name):
+			if !hasValue {
+				i++
+			}
+		default:
+			kept = append(kept, arg)
+		}
+	}
+	return kept
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// detachCheckpoint starts the checkpoint again in a background process of
+// its own session and returns as soon as it runs. args are the checkpoint
+// command's arguments. The caller's parent, typically the orchestrator that
+// ran docker-cr, is the one --completion-signal is sent to.
+func detachCheckpoint(args []string, checkpointDir string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find own executable: %w", err)
+	}
+
+	logPath := detachedLogPath(checkpointDir)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", logPath, err)
+	}
+	defer logFile.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	argv := append([]string{self, "checkpoint", fmt.Sprintf("--%s=%d", internalDetachFlag, os.Getppid())}, stripFlags(args, []string{"detach"}, nil)...)
+	proc, err := os.StartProcess(self, argv, &os.ProcAttr{
+		Files: []*os.File{devNull, logFile, logFile},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start background checkpoint: %w", err)
+	}
+
+	logInfof("Checkpoint continues in the background as PID %d (log: %s)", proc.Pid, logPath)
+	return proc.Release()
+}
+
+// runDetachedCheckpoint is the background process of --detach. It writes its
+// PID to pidFile, runs the checkpoint as a child so that every way the
+// checkpoint can end is seen, and then signals notifyPID. It returns the
+// checkpoint's exit status.
+func runDetachedCheckpoint(args []string, pidFile, completionSignal string, notifyPID int) int {
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			logErrorf("failed to write pid file: %v", err)
+			return 1
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logErrorf("failed to find own executable: %v", err)
+		return 1
+	}
+	kept := stripFlags(args, nil, []string{internalDetachFlag, "pid-file", "completion-signal"})
+	cmd := exec.Command(self, append([]string{"checkpoint"}, kept...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	status := 0
+	if err := cmd.Run(); err != nil {
+		status = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		}
+	}
+	logInfof("Detached checkpoint finished with exit status %d", status)
+
+	if completionSignal != "" {
+		sig, err := parseSignal(completionSignal)
+		if err == nil {
+			err = syscall.Kill(notifyPID, sig)
+		}
+		if err != nil {
+			logWarnf("failed to send completion signal to %d: %v", notifyPID, err)
+		}
+	}
+	return status
+}
@@ -2,20 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
 )
 
+// minCheckpointAPIVersion is the first Docker API with the checkpoint
+// endpoints.
+const minCheckpointAPIVersion = "1.25"
+
+// errDockerCheckpointUnavailable is returned when the daemon has no
+// checkpoint API to use.
+var errDockerCheckpointUnavailable = errors.New("docker native checkpoint unavailable")
+
+// checkDockerCheckpointAPI fails with errDockerCheckpointUnavailable if the
+// daemon's API predates the checkpoint endpoints or, being experimental,
+// they are not enabled.
+func checkDockerCheckpointAPI(ctx context.Context, dockerClient *client.Client) error {
+	version, err := dockerClient.ServerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Docker version: %w", err)
+	}
+	if versions.LessThan(version.APIVersion, minCheckpointAPIVersion) {
+		return fmt.Errorf("%w: Docker %s serves API %s, checkpoints need %s", errDockerCheckpointUnavailable,
+			version.Version, version.APIVersion, minCheckpointAPIVersion)
+	}
+	if !version.Experimental {
+		return fmt.Errorf("%w: experimental features are not enabled in Docker %s", errDockerCheckpointUnavailable, version.Version)
+	}
+	return nil
+}
+
 // checkpointDockerNative uses Docker's native checkpoint feature (like Cedana does)
-func checkpointDockerNative(containerID, checkpointDir string) error {
+func checkpointDockerNative(containerID, checkpointDir string, cfg *CheckpointConfig) error {
 	ctx := context.Background()
 
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -24,6 +53,10 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 	}
 	defer dockerClient.Close()
 
+	if err := checkDockerCheckpointAPI(ctx, dockerClient); err != nil {
+		return err
+	}
+
 	// Verify container exists and is running
 	containerInfo, err := dockerClient.ContainerInspect(ctx, containerID)
 	if err != nil {
@@ -34,7 +67,7 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 		return fmt.Errorf("container %s is not running", containerID)
 	}
 
-	fmt.Printf("Container %s is running with PID %d\n", containerID, containerInfo.State.Pid)
+	logInfof("Container %s is running with PID %d", containerID, containerInfo.State.Pid)
 
 	// Create checkpoint directory if needed
 	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
@@ -50,18 +83,18 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 
 	// Create unique checkpoint ID with timestamp
 	timestamp := time.Now().Unix()
-	checkpointID := fmt.Sprintf("checkpoint-%s-%d", shortID, timestamp)
+	checkpointID := namespacedCheckpointID(cfg.Namespace, fmt.Sprintf("checkpoint-%s-%d", shortID, timestamp))
 
 	// Cleanup any existing checkpoints for this container first
-	cleanupExistingCheckpoints(dockerClient, ctx, containerID)
+	deleteDockerCheckpoints(dockerClient, ctx, containerID, cfg.Namespace)
 
 	opts := types.CheckpointCreateOptions{
 		CheckpointID:  checkpointID,
 		// Don't specify CheckpointDir - let Docker use its default location
-		Exit:          false, // Keep container running (like LeaveRunning in CRIU)
+		Exit:          cfg.StopAfterDump, // Keep container running unless asked otherwise (like LeaveRunning in CRIU)
 	}
 
-	fmt.Printf("Creating Docker checkpoint '%s' in %s...\n", checkpointID, checkpointDir)
+	logInfof("Creating Docker checkpoint '%s' in %s...", checkpointID, checkpointDir)
 
 	err = dockerClient.CheckpointCreate(ctx, containerID, opts)
 	if err != nil {
@@ -70,7 +103,7 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 		matches := re.FindStringSubmatch(fmt.Sprintf("%s", err))
 		if len(matches) >= 2 {
 			dumpLog := matches[1]
-			fmt.Printf("Dump log path: %s\n", dumpLog)
+			logInfof("Dump log path: %s", dumpLog)
 
 			// Try to read and display the dump log
 			cmd := exec.Command("cat", dumpLog)
@@ -83,16 +116,16 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 		return fmt.Errorf("Docker checkpoint failed: %w", err)
 	}
 
-	fmt.Println("Docker checkpoint created successfully!")
+	logInfof("Docker checkpoint created successfully!")
 
 	// Copy checkpoint files from Docker's default location to our custom directory
 	dockerCheckpointDir := fmt.Sprintf("/var/lib/docker/containers/%s/checkpoints/%s", containerInfo.ID, checkpointID)
 	userCheckpointPath := filepath.Join(checkpointDir, checkpointID)
 
-	fmt.Printf("Copying checkpoint files from Docker storage to %s...\n", userCheckpointPath)
+	logInfof("Copying checkpoint files from Docker storage to %s...", userCheckpointPath)
 	if err := copyCheckpointFiles(dockerCheckpointDir, userCheckpointPath); err != nil {
-		fmt.Printf("Warning: Could not copy checkpoint files: %v\n", err)
-		fmt.Printf("Checkpoint created but files remain in Docker's internal storage\n")
+		logWarnf("Could not copy checkpoint files: %v", err)
+		logInfof("Checkpoint created but files remain in Docker's internal storage")
 	} else {
 		// List checkpoint files
 		if entries, err := os.ReadDir(userCheckpointPath); err == nil {
@@ -106,13 +139,14 @@ func checkpointDockerNative(containerID, checkpointDir string) error {
 
 	// Save metadata
 	metadataFile := filepath.Join(checkpointDir, "docker-checkpoint.info")
-	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCHECKPOINT_ID=%s\nIMAGE=%s\n",
+	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCHECKPOINT_ID=%s\nIMAGE=%s\nNAMESPACE=%s\n",
 		containerID,
 		checkpointID,
-		containerInfo.Config.Image)
+		containerInfo.Config.Image,
+		cfg.Namespace)
 
 	if err := os.WriteFile(metadataFile, []byte(metadata), 0644); err != nil {
-		fmt.Printf("Warning: failed to write metadata: %v\n", err)
+		logWarnf("failed to write metadata: %v", err)
 	}
 
 	return nil
@@ -135,7 +169,7 @@ func restoreDockerNative(containerID, checkpointDir string) error {
 		for _, entry := range entries {
 			if entry.IsDir() && len(entry.Name()) > 10 {
 				checkpointID := entry.Name()
-				fmt.Printf("Found checkpoint directory: %s\n", checkpointID)
+				logInfof("Found checkpoint directory: %s", checkpointID)
 
 				// Try to restore with this checkpoint
 				return restoreWithCheckpoint(dockerClient, containerID, checkpointID, checkpointDir)
@@ -162,37 +196,18 @@ func restoreDockerNative(containerID, checkpointDir string) error {
 func restoreWithCheckpoint(dockerClient *client.Client, containerID, checkpointID, checkpointDir string) error {
 	ctx := context.Background()
 
-	fmt.Printf("Restoring container %s from checkpoint %s...\n", containerID, checkpointID)
-
-	// Stop container if it exists and is running, but don't remove it
-	containerExists := false
-	if info, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
-		containerExists = true
-		if info.State.Running {
-			fmt.Println("Stopping running container...")
-			timeout := 10
-			stopOpts := container.StopOptions{
-				Timeout: &timeout,
-			}
-			if err := dockerClient.ContainerStop(ctx, containerID, stopOpts); err != nil {
-				return fmt.Errorf("failed to stop container: %w", err)
-			}
-		}
-	}
+	logInfof("Restoring container %s from checkpoint %s...", containerID, checkpointID)
 
-	if containerExists {
-		// Container exists but is stopped - start with checkpoint
-		fmt.Printf("Starting existing container from checkpoint...\n")
-		startOpts := types.ContainerStartOptions{
-			CheckpointID: checkpointID,
-		}
+	if err := stopForCheckpointStart(ctx, dockerClient, containerID); err != nil {
+		return err
+	}
 
-		err := dockerClient.ContainerStart(ctx, containerID, startOpts)
-		if err != nil {
-			return fmt.Errorf("failed to restore container from checkpoint: %w", err)
-		}
-	} else {
-		return fmt.Errorf("container %s does not exist - cannot restore from checkpoint", containerID)
+	logInfof("Starting existing container from checkpoint...")
+	startOpts := types.ContainerStartOptions{
+		CheckpointID: checkpointID,
+	}
+	if err := dockerClient.ContainerStart(ctx, containerID, startOpts); err != nil {
+		return fmt.Errorf("failed to restore container from checkpoint: %w", err)
 	}
 
 	// Verify container is running
@@ -202,7 +217,7 @@ func restoreWithCheckpoint(dockerClient *client.Client, containerID, checkpointI
 	}
 
 	if info.State.Running {
-		fmt.Printf("Container restored successfully! PID: %d\n", info.State.Pid)
+		logInfof("Container restored successfully! PID: %d", info.State.Pid)
 	} else {
 		return fmt.Errorf("container restored but not running, state: %s", info.State.Status)
 	}
@@ -210,8 +225,9 @@ func restoreWithCheckpoint(dockerClient *client.Client, containerID, checkpointI
 	return nil
 }
 
-// listDockerCheckpoints lists all checkpoints for a container
-func listDockerCheckpoints(containerID string) error {
+// listDockerCheckpoints lists the checkpoints of a container that belong to
+// namespace; an empty namespace lists the ones created without --namespace
+func listDockerCheckpoints(containerID, namespace string) error {
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("failed to create Docker client: %w", err)
@@ -224,21 +240,56 @@ func listDockerCheckpoints(containerID string) error {
 		return fmt.Errorf("failed to list checkpoints: %w", err)
 	}
 
-	if len(checkpoints) == 0 {
+	var names []string
+	for _, cp := range checkpoints {
+		if inCheckpointNamespace(cp.Name, namespace) {
+			names = append(names, cp.Name)
+		}
+	}
+
+	if len(names) == 0 {
 		fmt.Printf("No checkpoints found for container %s\n", containerID)
 		return nil
 	}
 
 	fmt.Printf("Checkpoints for container %s:\n", containerID)
-	for _, cp := range checkpoints {
-		fmt.Printf("  - %s\n", cp.Name)
+	for _, name := range names {
+		fmt.Printf("  - %s\n", name)
 	}
 
 	return nil
 }
 
-// cleanupExistingCheckpoints removes existing checkpoints for a container
-func cleanupExistingCheckpoints(dockerClient *client.Client, ctx context.Context, containerID string) {
+// checkpointNamespacePattern restricts namespaces to characters Docker
+// accepts in checkpoint names
+var checkpointNamespacePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// validateCheckpointNamespace checks a --namespace value
+func validateCheckpointNamespace(namespace string) error {
+	if namespace != "" && !checkpointNamespacePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q: use letters, digits, '_', '.' and '-'", namespace)
+	}
+	return nil
+}
+
+// namespacedCheckpointID prefixes a checkpoint ID with "<namespace>-"
+func namespacedCheckpointID(namespace, checkpointID string) string {
+	if namespace == "" {
+		return checkpointID
+	}
+	return namespace + "-" + checkpointID
+}
+
+// inCheckpointNamespace reports whether a Docker checkpoint name was created
+// by docker-cr in namespace. Without a namespace only un-prefixed names
+// match, so other namespaces and foreign checkpoints are never touched.
+func inCheckpointNamespace(name, namespace string) bool {
+	return strings.HasPrefix(name, namespacedCheckpointID(namespace, "checkpoint-"))
+}
+
+// deleteDockerCheckpoints removes a container's existing checkpoints in the
+// given namespace
+func deleteDockerCheckpoints(dockerClient *client.Client, ctx context.Context, containerID, namespace string) {
 	checkpoints, err := dockerClient.CheckpointList(ctx, containerID, types.CheckpointListOptions{})
 	if err != nil {
 		// If we can't list checkpoints, just continue
@@ -246,7 +297,10 @@ func cleanupExistingCheckpoints(dockerClient *client.Client, ctx context.Context
 	}
 
 	for _, checkpoint := range checkpoints {
-		fmt.Printf("Removing existing checkpoint: %s\n", checkpoint.Name)
+		if !inCheckpointNamespace(checkpoint.Name, namespace) {
+			continue
+		}
+		logInfof("Removing existing checkpoint: %s", checkpoint.Name)
 		dockerClient.CheckpointDelete(ctx, containerID, types.CheckpointDeleteOptions{
 			CheckpointID: checkpoint.Name,
 		})
@@ -263,4 +317,44 @@ func copyCheckpointFiles(srcDir, dstDir string) error {
 	// Use cp command to copy files (handles permissions properly)
 	cmd := exec.Command("cp", "-r", srcDir+"/.", dstDir)
 	return cmd.Run()
-}
\ No newline at end of file
+}
+
+// stopForCheckpointStart brings containerID into a state Docker can start
+// it from a checkpoint in: created and exited containers are ready, a
+// running one is stopped and a paused one unpaused first. Other states are
+// errors.
+func stopForCheckpointStart(ctx context.Context, dockerClient *client.Client, containerID string) error {
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("container %s does not exist - cannot restore from checkpoint", containerID)
+		}
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	timeout := 10
+	stopOpts := container.StopOptions{Timeout: &timeout}
+	switch info.State.Status {
+	case "created", "exited":
+		return nil
+	case "paused":
+		logInfof("Unpausing paused container...")
+		if err := dockerClient.ContainerUnpause(ctx, containerID); err != nil {
+			return fmt.Errorf("failed to unpause container: %w", err)
+		}
+		fallthrough
+	case "running":
+		logInfof("Stopping running container...")
+		if err := dockerClient.ContainerStop(ctx, containerID, stopOpts); err != nil {
+			return fmt.Errorf("failed to stop container: %w", err)
+		}
+		return nil
+	case "restarting":
+		return fmt.Errorf("container %s is restarting under its restart policy; stop it or disable the policy before restoring", containerID)
+	case "removing":
+		return fmt.Errorf("container %s is being removed and cannot be restored into", containerID)
+	case "dead":
+		return fmt.Errorf("container %s is dead (Docker failed to remove it); remove it and restore into a new one", containerID)
+	}
+	return fmt.Errorf("container %s is in unexpected state %q", containerID, info.State.Status)
+}
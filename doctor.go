@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runDoctor reports the facts about this host that decide whether
+// checkpoints can be taken and restored here.
+func runDoctor() error {
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		fmt.Printf("Kernel: %s\n", strings.TrimSpace(string(release)))
+	}
+	fmt.Printf("Running as root: %v\n", os.Geteuid() == 0)
+
+	if version, err := newCriuClient("").GetCriuVersion(); err != nil {
+		fmt.Printf("CRIU: not usable: %v\n", err)
+	} else {
+		fmt.Printf("CRIU: %s\n", formatCRIUVersion(version))
+	}
+
+	pools := hugePagePools()
+	if len(pools) == 0 {
+		fmt.Println("Huge pages: not supported")
+		return nil
+	}
+	fmt.Println("Huge page pools:")
+	for _, pool := range pools {
+		fmt.Printf("  %s: %d total, %d free\n", formatSize(pool.PageSize), pool.Total, pool.Free)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// dryRunReport collects the results of the restore --dry-run checks.
+type dryRunReport struct {
+	checks int
+	failed int
+	plan   []string
+}
+
+// check prints the outcome of one precondition; detail describes a passed
+// check.
+func (r *dryRunReport) check(name string, err error, detail string) {
+	r.checks++
+	if err != nil {
+		r.failed++
+		fmt.Printf("  FAIL  %s: %v\n", name, err)
+		return
+	}
+	if detail != "" {
+		fmt.Printf("  OK    %s: %s\n", name, detail)
+	} else {
+		fmt.Printf("  OK    %s\n", name)
+	}
+}
+
+// would adds a step to what the restore would do.
+func (r *dryRunReport) would(format string, args ...interface{}) {
+	r.plan = append(r.plan, fmt.Sprintf(format, args...))
+}
+
+// dryRunRestore runs the checks a restore of checkpointDir would run, into
+// containerID or, if it is empty, as a process, without calling CRIU to
+// restore or changing any container. It returns an error if a
+// precondition fails.
+func dryRunRestore(checkpointDir, containerID string, cfg *RestoreConfig) error {
+	if containerID != "" {
+		fmt.Printf("Dry run: restore %s into container %s\n\n", checkpointDir, containerID)
+	} else {
+		fmt.Printf("Dry run: restore %s as a process\n\n", checkpointDir)
+	}
+
+	r := &dryRunReport{}
+	fsOnly := isFilesystemOnlyCheckpoint(checkpointDir)
+
+	r.check("checkpoint directory", verifyCheckpoint(checkpointDir), checkpointSummary(checkpointDir))
+
+	var image string
+	if containerID != "" {
+		metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta"))
+		if err != nil {
+			err = fmt.Errorf("failed to read container.meta: %w", err)
+		} else if image = metadata["IMAGE"]; image == "" {
+			err = fmt.Errorf("container.meta records no image")
+		}
+		r.check("metadata", err, fmt.Sprintf("container %s, image %s",
+			strings.TrimPrefix(metadata["CONTAINER_NAME"], "/"), image))
+	} else if fsOnly {
+		r.check("checkpoint type", fmt.Errorf("a --fs-only checkpoint needs the name of the container to create"), "")
+	}
+
+	if containerID != "" {
+		dryRunDocker(r, containerID, image, checkpointDir, cfg, fsOnly)
+	}
+
+	if !fsOnly {
+		dryRunCRIU(r, checkpointDir, containerID, cfg)
+	}
+
+	fmt.Println()
+	if len(r.plan) > 0 {
+		fmt.Println("Restore would:")
+		for _, step := range r.plan {
+			fmt.Printf("  - %s\n", step)
+		}
+		fmt.Println()
+	}
+
+	if r.failed > 0 {
+		return fmt.Errorf("%d of %d checks failed; restore would fail", r.failed, r.checks)
+	}
+	fmt.Printf("All %d checks passed; restore would likely succeed\n", r.checks)
+	return nil
+}
+
+// dryRunDocker checks the daemon, the image the container is recreated
+// from and, for a --fs-only checkpoint, its bind mount sources.
+func dryRunDocker(r *dryRunReport, containerID, image, checkpointDir string, cfg *RestoreConfig, fsOnly bool) {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err == nil {
+		defer dockerClient.Close()
+		_, err = dockerClient.Ping(ctx)
+	}
+	r.check("Docker daemon", err, "")
+	if err != nil {
+		return
+	}
+
+	if image != "" {
+		_, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+		if client.IsErrNotFound(err) {
+			err = fmt.Errorf("not present on this host; pull it first")
+		}
+		r.check("image "+image, err, "present")
+	}
+
+	r.check("runtime versions", checkRuntimeVersions(checkpointDir, cfg.StrictVersionCheck), "")
+
+	name := containerID
+	if cfg.NewContainerName != "" {
+		name = cfg.NewContainerName
+		r.would("leave container %s as it is and record %s in the checkpoint metadata", containerID, name)
+	} else if cfg.IntoExisting {
+		info, err := dockerClient.ContainerInspect(ctx, containerID)
+		r.check("container "+containerID, checkStoppedContainer(containerID, info, err), "stopped")
+		r.would("start stopped container %s and restore into its namespaces", containerID)
+	} else if info, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
+		r.would("stop and remove the existing container %s (%s)", containerID, info.State.Status)
+	}
+
+	if fsOnly {
+		r.check("bind mount sources", checkBindSources(checkpointDir), "")
+		r.would("create container %s from %s and extract %s into its upper directory", containerID, image, fsOnlyArchive)
+		r.would("start the container from its entrypoint; no process state is restored")
+		return
+	}
+	if !cfg.IntoExisting {
+		r.would("create container %s from %s and restore the processes into it with CRIU", name, image)
+	}
+}
+
+// dryRunCRIU runs the checks that precede a CRIU restore.
+func dryRunCRIU(r *dryRunReport, checkpointDir, containerID string, cfg *RestoreConfig) {
+	version, err := newCriuClient(cfg.CriuService).GetCriuVersion()
+	if err == nil {
+		err = checkCRIUVersion(checkpointDir, version)
+	}
+	r.check("CRIU version", err, formatCRIUVersion(version))
+
+	r.check("CPU compatibility", checkCPUCompatibility(checkpointDir), "")
+	r.check("memory", checkRestoreMemory(checkpointDir), "")
+
+	if containerID == "" {
+		// A container's files are checked against its new root at restore
+		r.check("mapped files", verifyMappedFiles(checkpointDir, "/"), "")
+		r.check("open files and bind mounts", verifyOpenFiles(checkpointDir, "/"), "")
+		r.check("executables", verifyExecutables(checkpointDir, "/"), "")
+		r.check("watched paths", verifyWatchedPaths(checkpointDir, "/"), "")
+
+		netnsPID := os.Getpid()
+		if cfg.JoinNamespacesOf != 0 {
+			netnsPID = cfg.JoinNamespacesOf
+			r.would("join the net, ipc and uts namespaces of PID %d", cfg.JoinNamespacesOf)
+		}
+		r.check("ports", checkPortConflicts(checkpointDir, netnsPID, cfg.IgnorePortConflicts), "")
+		r.check("TCP interface", checkTCPInterface(checkpointDir, netnsPID), "")
+		if cfg.RestorePID != 0 {
+			r.check("PID", checkRestorePID(checkpointDir, cfg.RestorePID), fmt.Sprintf("%d is free", cfg.RestorePID))
+		}
+		r.would("restore the process tree with CRIU")
+	}
+
+	if cfg.MountNsFile != "" {
+		r.would("join the mount namespace %s", cfg.MountNsFile)
+	}
+	if cfg.Hostname != "" {
+		r.would("set the hostname to %s", cfg.Hostname)
+	}
+	if len(cfg.Hooks) > 0 {
+		var phases []string
+		for phase := range cfg.Hooks {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		r.would("run hook scripts at %s", strings.Join(phases, ", "))
+	}
+}
+
+// checkCRIUVersion fails if the installed CRIU is older than the one that
+// took the checkpoint, as recorded in its assessment; older CRIU may not
+// read newer images.
+func checkCRIUVersion(checkpointDir string, version int) error {
+	info, err := loadAnalysis(checkpointDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Assessment == nil || info.Assessment.CRIUVersion == 0 {
+		return nil
+	}
+	if recorded := info.Assessment.CRIUVersion; version < recorded {
+		return fmt.Errorf("CRIU %s is older than %s, which took the checkpoint", formatCRIUVersion(version), formatCRIUVersion(recorded))
+	}
+	return nil
+}
+
+// checkBindSources checks that the host paths bind mounted into a
+// --fs-only checkpoint's container exist.
+func checkBindSources(checkpointDir string) error {
+	data, err := os.ReadFile(filepath.Join(checkpointDir, fsOnlyConfig))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", fsOnlyConfig, err)
+	}
+	var saved fsOnlyContainer
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", fsOnlyConfig, err)
+	}
+	if saved.HostConfig == nil {
+		return nil
+	}
+
+	var sources []string
+	for _, bind := range saved.HostConfig.Binds {
+		// Named volumes are created on demand
+		if source := strings.SplitN(bind, ":", 2)[0]; filepath.IsAbs(source) {
+			sources = append(sources, source)
+		}
+	}
+	for _, m := range saved.HostConfig.Mounts {
+		if m.Type == mount.TypeBind {
+			sources = append(sources, m.Source)
+		}
+	}
+
+	var missing []string
+	for _, source := range sources {
+		if _, err := os.Stat(source); err != nil {
+			missing = append(missing, source)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing on this host: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkpointSummary describes the images in checkpointDir.
+func checkpointSummary(checkpointDir string) string {
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		return ""
+	}
+	images := 0
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".img") {
+			images++
+		}
+	}
+	if isFilesystemOnlyCheckpoint(checkpointDir) {
+		return "filesystem-only snapshot"
+	}
+	if isDeltaCheckpoint(checkpointDir) {
+		return fmt.Sprintf("delta checkpoint, %d images of its own", images)
+	}
+	return fmt.Sprintf("%d images", images)
+}
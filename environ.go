@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// environFile holds the environment of the checkpointed process, recorded
+// with --checkpoint-env-file for debugging.
+const environFile = "environ.json"
+
+// ProcessEnviron is the content of environ.json.
+type ProcessEnviron struct {
+	PID       int               `json:"pid"`
+	Variables map[string]string `json:"variables"`
+}
+
+// readProcessEnviron parses the NUL-separated /proc/<pid>/environ.
+func readProcessEnviron(pid int) (map[string]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment of %d: %w", pid, err)
+	}
+
+	vars := make(map[string]string)
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+		// Entries without '=' are legal but carry no value worth recording
+		if key, value, ok := strings.Cut(string(entry), "="); ok {
+			vars[key] = value
+		}
+	}
+
+	return vars, nil
+}
+
+// saveProcessEnviron writes environ.json into the checkpoint directory and,
+// if copyPath is not empty, a copy to copyPath.
+func saveProcessEnviron(pid int, checkpointDir, copyPath string) error {
+	vars, err := readProcessEnviron(pid)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(&ProcessEnviron{PID: pid, Variables: vars}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	envPath := filepath.Join(checkpointDir, environFile)
+	if err := os.WriteFile(envPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", envPath, err)
+	}
+	logInfof("Recorded %d environment variables in %s", len(vars), envPath)
+
+	if copyPath != "" && filepath.Clean(copyPath) != filepath.Clean(envPath) {
+		if err := os.WriteFile(copyPath, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", copyPath, err)
+		}
+	}
+
+	return nil
+}
+
+// loadProcessEnviron reads environ.json from a checkpoint directory. It
+// returns nil without error when the checkpoint has none.
+func loadProcessEnviron(checkpointDir string) (*ProcessEnviron, error) {
+	data, err := os.ReadFile(filepath.Join(checkpointDir, environFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", environFile, err)
+	}
+
+	env := &ProcessEnviron{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", environFile, err)
+	}
+
+	return env, nil
+}
+
+// reportProcessEnviron prints the environment recorded at checkpoint time.
+// CRIU restores the environment together with process memory, so this is
+// informational only.
+func reportProcessEnviron(checkpointDir string, show bool) {
+	env, err := loadProcessEnviron(checkpointDir)
+	if err != nil {
+		logWarnf("%v", err)
+		return
+	}
+	if env == nil {
+		return
+	}
+
+	fmt.Printf("Checkpoint recorded %d environment variables of PID %d\n", len(env.Variables), env.PID)
+	if !show {
+		return
+	}
+
+	keys := make([]string, 0, len(env.Variables))
+	for key := range env.Variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s=%s\n", key, env.Variables[key])
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ephemeralRoot holds the tmpfs mounts of --ephemeral checkpoints and the
+// state file naming them. Being under /run, both are gone after a reboot.
+var ephemeralRoot = "/run/docker-cr"
+
+// ephemeralPrefix marks a restore argument as the ID of an --ephemeral
+// checkpoint rather than a path.
+const ephemeralPrefix = "ephemeral:"
+
+// EphemeralCheckpoint is one --ephemeral checkpoint in the state file.
+type EphemeralCheckpoint struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+}
+
+func ephemeralStatePath() string {
+	return filepath.Join(ephemeralRoot, "ephemeral.json")
+}
+
+// createEphemeralDir mounts a fresh tmpfs at /run/docker-cr/<uuid> for a
+// checkpoint of target and records it in the state file.
+func createEphemeralDir(target string) (*EphemeralCheckpoint, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	eph := &EphemeralCheckpoint{
+		ID:      id,
+		Path:    filepath.Join(ephemeralRoot, id),
+		Target:  target,
+		Created: time.Now(),
+	}
+
+	if err := os.MkdirAll(eph.Path, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", eph.Path, err)
+	}
+	if err := syscall.Mount("tmpfs", eph.Path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0700"); err != nil {
+		os.Remove(eph.Path)
+		return nil, fmt.Errorf("failed to mount tmpfs at %s: %w", eph.Path, err)
+	}
+
+	err = updateEphemeralState(func(entries []*EphemeralCheckpoint) ([]*EphemeralCheckpoint, error) {
+		return append(entries, eph), nil
+	})
+	if err != nil {
+		syscall.Unmount(eph.Path, 0)
+		os.Remove(eph.Path)
+		return nil, err
+	}
+
+	logInfof("Ephemeral checkpoint %s: tmpfs mounted at %s", eph.ID, eph.Path)
+	return eph, nil
+}
+
+// removeEphemeral unmounts the tmpfs of the ephemeral checkpoint at path,
+// which frees its memory, and drops it from the state file.
+func removeEphemeral(path string) error {
+	if err := syscall.Unmount(path, 0); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("failed to unmount %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	err := updateEphemeralState(func(entries []*EphemeralCheckpoint) ([]*EphemeralCheckpoint, error) {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Path != path {
+				kept = append(kept, e)
+			}
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return err
+	}
+	logInfof("Removed ephemeral checkpoint %s", path)
+	return nil
+}
+
+// findEphemeral returns the ephemeral checkpoint whose ID, or path, is ref;
+// nil if there is none.
+func findEphemeral(ref string) (*EphemeralCheckpoint, error) {
+	entries, err := loadEphemeralState()
+	if err != nil {
+		return nil, err
+	}
+	abs, _ := filepath.Abs(ref)
+	for _, e := range entries {
+		if e.ID == ref || e.Path == abs {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolveEphemeralRef turns an ephemeral:<id> restore argument into the
+// checkpoint's tmpfs path.
+func resolveEphemeralRef(ref string) (string, error) {
+	id := strings.TrimPrefix(ref, ephemeralPrefix)
+	eph, err := findEphemeral(id)
+	if err != nil {
+		return "", err
+	}
+	if eph == nil {
+		return "", fmt.Errorf("no ephemeral checkpoint %s in %s (gone after a reboot or cleanup)", id, ephemeralStatePath())
+	}
+	logInfof("Resolved %s to %s (checkpoint of %s)", ref, eph.Path, eph.Target)
+	return eph.Path, nil
+}
+
+func loadEphemeralState() ([]*EphemeralCheckpoint, error) {
+	data, err := os.ReadFile(ephemeralStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read ephemeral state: %w", err)
+	}
+	var entries []*EphemeralCheckpoint
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ephemeralStatePath(), err)
+	}
+	return entries, nil
+}
+
+// updateEphemeralState applies fn to the state file under an exclusive
+// lock, like updateRegistry.
+func updateEphemeralState(fn func([]*EphemeralCheckpoint) ([]*EphemeralCheckpoint, error)) error {
+	statePath := ephemeralStatePath()
+	if err := os.MkdirAll(ephemeralRoot, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", ephemeralRoot, err)
+	}
+	lock, err := os.OpenFile(statePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open ephemeral state lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock ephemeral state: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	entries, err := loadEphemeralState()
+	if err != nil {
+		return err
+	}
+	if entries, err = fn(entries); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(statePath+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write ephemeral state: %w", err)
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate checkpoint ID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultDumpThroughput is the dump speed in MB/s assumed for a container
+// with no checkpoint history.
+const defaultDumpThroughput = 100
+
+// gzipRatio is a rough size ratio of gzipped CRIU images. Memory pages
+// compress anywhere from 10% to 90%; this is only used for the estimate.
+const gzipRatio = 0.5
+
+// imageOverhead is a per-process allowance for the non-page images (core,
+// mm, fdinfo, ...).
+const imageOverhead = 256 << 10
+
+// Estimate predicts the size of a checkpoint and how long the process tree
+// will be frozen while it is taken.
+type Estimate struct {
+	// RSS, Anonymous and Shared are summed over the process tree from
+	// smaps_rollup. CRIU dumps the anonymous memory; clean file-backed
+	// pages are read back from the files at restore.
+	RSS       int64 `json:"rss"`
+	Anonymous int64 `json:"anonymous"`
+	Shared    int64 `json:"shared"`
+	Processes int   `json:"processes"`
+	// Ghost is the content of deleted files that goes into the dump
+	Ghost int64 `json:"ghost"`
+	// ImageSize is the expected size of the checkpoint directory;
+	// StreamSize the size of the gzipped stream when compressing
+	ImageSize  int64 `json:"image_size"`
+	StreamSize int64 `json:"stream_size,omitempty"`
+	// Throughput is in MB/s, either assumed or the median of earlier
+	// checkpoints of the container (ThroughputSamples > 0)
+	Throughput        float64       `json:"throughput_mbps"`
+	ThroughputSamples int           `json:"throughput_samples,omitempty"`
+	Duration          time.Duration `json:"duration"`
+}
+
+// estimateCheckpoint predicts the checkpoint of the tree rooted at pid.
+// container, if known, selects the registry history to take the throughput
+// from; assumedMBps is used without one.
+func estimateCheckpoint(pid int, info *ProcessInfo, container string, compress bool, assumedMBps float64) *Estimate {
+	est := &Estimate{Throughput: assumedMBps}
+
+	for _, p := range processTree(pid) {
+		rollup := readSmapsRollup(p)
+		est.RSS += rollup["Rss"]
+		est.Anonymous += rollup["Anonymous"]
+		est.Shared += rollup["Shared_Clean"] + rollup["Shared_Dirty"]
+		est.Processes++
+	}
+
+	for _, file := range info.DeletedFiles {
+		est.Ghost += file.Size
+	}
+	for _, mf := range info.MappedFiles {
+		if mf.Deleted {
+			est.Ghost += mf.Size
+		}
+	}
+
+	est.ImageSize = est.Anonymous + est.Ghost + int64(est.Processes)*imageOverhead
+	if compress {
+		est.StreamSize = int64(float64(est.ImageSize) * gzipRatio)
+	}
+
+	if container != "" {
+		if median, samples := historicalThroughput(container); samples > 0 {
+			est.Throughput, est.ThroughputSamples = median, samples
+		}
+	}
+	if est.Throughput > 0 {
+		seconds := float64(est.ImageSize) / (est.Throughput * 1024 * 1024)
+		est.Duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	return est
+}
+
+// readSmapsRollup returns the fields of /proc/<pid>/smaps_rollup in bytes.
+func readSmapsRollup(pid int) map[string]int64 {
+	fields := make(map[string]int64)
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/smaps_rollup", pid))
+	if err != nil {
+		return fields
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// "Rss:                1234 kB"
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		parts := strings.Fields(value)
+		if len(parts) != 2 || parts[1] != "kB" {
+			continue
+		}
+		if kb, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+			fields[name] = kb * 1024
+		}
+	}
+	return fields
+}
+
+// historicalThroughput returns the median MB/s of the registered
+// checkpoints of container that recorded how long they took.
+func historicalThroughput(container string) (float64, int) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return 0, 0
+	}
+
+	var rates []float64
+	for _, entry := range reg.Entries {
+		if entry.Container != container || entry.DurationSeconds <= 0 || entry.Size <= 0 {
+			continue
+		}
+		rates = append(rates, float64(entry.Size)/(1024*1024)/entry.DurationSeconds)
+	}
+	if len(rates) == 0 {
+		return 0, 0
+	}
+
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+	if len(rates)%2 == 0 {
+		median = (rates[len(rates)/2-1] + rates[len(rates)/2]) / 2
+	}
+	return median, len(rates)
+}
+
+// printEstimate prints an estimate below the process analysis.
+func printEstimate(est *Estimate) {
+	fmt.Printf("  Estimated checkpoint: %s", formatSize(est.ImageSize))
+	if est.StreamSize > 0 {
+		fmt.Printf(" (~%s gzipped)", formatSize(est.StreamSize))
+	}
+	fmt.Printf(", %d process(es), %s RSS of which %s anonymous, %s shared, %s ghost files\n",
+		est.Processes, formatSize(est.RSS), formatSize(est.Anonymous), formatSize(est.Shared), formatSize(est.Ghost))
+
+	source := "assumed"
+	if est.ThroughputSamples > 0 {
+		source = fmt.Sprintf("median of %d earlier checkpoints", est.ThroughputSamples)
+	}
+	fmt.Printf("  Estimated freeze: %s at %.0f MB/s (%s)\n", est.Duration.Round(time.Millisecond), est.Throughput, source)
+}
+
+// checkDiskSpace fails when the filesystem of checkpointDir has less room
+// than the estimated checkpoint needs.
+func checkDiskSpace(checkpointDir string, est *Estimate) error {
+	var stat syscall.Statfs_t
+	dir := checkpointDir
+	for {
+		if err := syscall.Statfs(dir, &stat); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	if available < est.ImageSize {
+		return fmt.Errorf("not enough disk space in %s: the checkpoint needs about %s, %s available", dir, formatSize(est.ImageSize), formatSize(available))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// parseMountPaths splits the comma-separated mountpoints given with flag.
+func parseMountPaths(flag, value string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("--%s: %s is not an absolute path", flag, path)
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+	return paths, nil
+}
+
+// validateExtMountLists rejects a mountpoint that is both whitelisted and
+// blacklisted.
+func validateExtMountLists(whitelist, blacklist []string) error {
+	for _, path := range whitelist {
+		if contains(blacklist, path) {
+			return fmt.Errorf("%s is in both --auto-ext-mnt-whitelist and --ext-mnt-blacklist", path)
+		}
+	}
+	return nil
+}
+
+// applyExtMountLists replaces CRIU's blanket external mount handling with
+// the mountpoints of --auto-ext-mnt-whitelist, if it or
+// --ext-mnt-blacklist is set. Only the whitelisted mounts, and the default
+// ones not blacklisted, are then dumped as external; every other mount is
+// dumped with the container.
+func applyExtMountLists(opts *rpc.CriuOpts, cfg *CheckpointConfig) {
+	if len(cfg.ExtMntWhitelist) == 0 && len(cfg.ExtMntBlacklist) == 0 {
+		return
+	}
+
+	opts.AutoExtMnt = proto.Bool(false)
+	var external []string
+	for _, ext := range opts.External {
+		if ext == "mnt[]" || strings.HasPrefix(ext, "mnt[]:") {
+			continue
+		}
+		if mountpoint, ok := externalMountpoint(ext); ok && contains(cfg.ExtMntBlacklist, mountpoint) {
+			continue
+		}
+		external = append(external, ext)
+	}
+	for _, path := range cfg.ExtMntWhitelist {
+		// The mountpoint doubles as the key restore maps to a host path
+		external = append(external, fmt.Sprintf("mnt[%s]:%s", path, path))
+	}
+	opts.External = external
+
+	if len(cfg.ExtMntWhitelist) > 0 {
+		logInfof("External mounts: %s (automatic detection disabled)", strings.Join(cfg.ExtMntWhitelist, ", "))
+	} else {
+		logInfof("External mounts: only the defaults (automatic detection disabled)")
+	}
+	if len(cfg.ExtMntBlacklist) > 0 {
+		logInfof("Dumped with the container: %s", strings.Join(cfg.ExtMntBlacklist, ", "))
+	}
+}
+
+// externalMountpoint returns the mountpoint of a mnt[<mountpoint>]:<key>
+// external resource.
+func externalMountpoint(ext string) (string, bool) {
+	rest, ok := strings.CutPrefix(ext, "mnt[")
+	if !ok {
+		return "", false
+	}
+	mountpoint, _, ok := strings.Cut(rest, "]")
+	return mountpoint, ok
+}
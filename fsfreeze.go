@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIFREEZE and FITHAW from <linux/fs.h>, which golang.org/x/sys/unix does
+// not export: _IOWR('X', 119, int) and _IOWR('X', 120, int), i.e. read and
+// write (3) in bits 30-31, the size of an int in bits 16-29, then the type
+// and number.
+const (
+	fiFREEZE = 3<<30 | 4<<16 | 'X'<<8 | 119
+	fiTHAW   = 3<<30 | 4<<16 | 'X'<<8 | 120
+)
+
+// fsFreeze is a filesystem frozen with FIFREEZE for --consistent.
+type fsFreeze struct {
+	path   string
+	file   *os.File
+	frozen bool
+}
+
+// containerWritableLayer returns the directory whose filesystem receives the
+// container's writes: the overlay upper directory, or the root itself for
+// other storage drivers. overlayfs cannot be frozen itself.
+func containerWritableLayer(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/mounts", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read mounts of %d: %w", pid, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// source mount-point fstype options dump pass
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != "/" {
+			continue
+		}
+		if fields[2] != "overlay" {
+			return fmt.Sprintf("/proc/%d/root", pid), nil
+		}
+		for _, option := range strings.Split(fields[3], ",") {
+			if upper, ok := strings.CutPrefix(option, "upperdir="); ok {
+				return upper, nil
+			}
+		}
+		return "", fmt.Errorf("overlay root of %d has no upperdir", pid)
+	}
+	return "", fmt.Errorf("no root mount found for %d", pid)
+}
+
+// freezeContainerFS freezes the filesystem holding the container's writable
+// layer so the images and the filesystem are captured at the same moment.
+// CRIU writes the images while it is frozen, so checkpointDir must live on
+// another filesystem or the dump would block forever.
+//
+// Processes that write while the filesystem is frozen block until it is
+// thawed, and CRIU cannot seize a task blocked like that: --consistent is for
+// containers that are not writing at the moment of the checkpoint.
+func freezeContainerFS(pid int, checkpointDir string) (*fsFreeze, error) {
+	path, err := containerWritableLayer(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var layer, images unix.Stat_t
+	if err := unix.Stat(path, &layer); err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if err := unix.Stat(checkpointDir, &images); err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", checkpointDir, err)
+	}
+	if layer.Dev == images.Dev {
+		return nil, fmt.Errorf("checkpoint directory %s is on the filesystem --consistent freezes (%s); use a directory on another filesystem", checkpointDir, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if err := unix.IoctlSetInt(int(file.Fd()), fiFREEZE, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to freeze filesystem of %s: %w", path, err)
+	}
+
+	logInfof("Froze filesystem of %s", path)
+	return &fsFreeze{path: path, file: file, frozen: true}, nil
+}
+
+// Thaw unfreezes the filesystem. It is safe to call more than once and on a
+// nil fsFreeze.
+func (f *fsFreeze) Thaw() error {
+	if f == nil || !f.frozen {
+		return nil
+	}
+	f.frozen = false
+	defer f.file.Close()
+
+	if err := unix.IoctlSetInt(int(f.file.Fd()), fiTHAW, 0); err != nil {
+		return fmt.Errorf("failed to thaw filesystem of %s, run 'fsfreeze -u' on it: %w", f.path, err)
+	}
+	logInfof("Thawed filesystem of %s", f.path)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Files of a --fs-only checkpoint. It has no CRIU images: only the
+// container's overlay upper directory and the configuration to create a
+// container around it again.
+const (
+	fsOnlyArchive = "upper.tar"
+	fsOnlyConfig  = "container.json"
+)
+
+// fsOnlyContainer is what fsOnlyConfig holds.
+type fsOnlyContainer struct {
+	Config     *container.Config     `json:"config"`
+	HostConfig *container.HostConfig `json:"host_config"`
+}
+
+// upperTarArgs make tar keep what overlayfs needs of an upper directory:
+// whiteouts are character devices, opaque directories have xattrs.
+var upperTarArgs = []string{"--xattrs", "--xattrs-include=*", "--numeric-owner", "-p"}
+
+// isFilesystemOnlyCheckpoint reports whether checkpointDir was taken with
+// --fs-only.
+func isFilesystemOnlyCheckpoint(checkpointDir string) bool {
+	metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta"))
+	return err == nil && metadata["FS_ONLY"] == "1"
+}
+
+// checkpointFilesystemOnly snapshots the overlay upper directory of
+// containerID without CRIU. A running container is paused (cgroup freeze)
+// for the copy so the snapshot is consistent, then unpaused.
+func checkpointFilesystemOnly(containerID, checkpointDir string) error {
+	ctx := context.Background()
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	info, err := dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	upper := info.GraphDriver.Data["UpperDir"]
+	if info.GraphDriver.Name != "overlay2" || upper == "" {
+		return fmt.Errorf("--fs-only needs the overlay2 storage driver, container %s uses %s", containerID, info.GraphDriver.Name)
+	}
+
+	if err := os.MkdirAll(checkpointDir, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	metadata := fmt.Sprintf("CONTAINER_ID=%s\nCONTAINER_NAME=%s\nIMAGE=%s\nFS_ONLY=1\n",
+		info.ID, info.Name, info.Config.Image)
+	if err := os.WriteFile(filepath.Join(checkpointDir, "container.meta"), []byte(metadata), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	data, err := json.MarshalIndent(fsOnlyContainer{Config: info.Config, HostConfig: info.HostConfig}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, fsOnlyConfig), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fsOnlyConfig, err)
+	}
+
+	if info.State.Running && !info.State.Paused {
+		if err := dockerClient.ContainerPause(ctx, info.ID); err != nil {
+			return fmt.Errorf("failed to freeze container: %w", err)
+		}
+		logInfof("Froze container")
+		defer func() {
+			if err := dockerClient.ContainerUnpause(ctx, info.ID); err != nil {
+				logWarnf("failed to thaw container, run 'docker unpause %s': %v", containerID, err)
+				return
+			}
+			logInfof("Thawed container")
+		}()
+	}
+
+	logInfof("Snapshotting %s...", upper)
+	startTime := time.Now()
+	args := append([]string{"-c"}, upperTarArgs...)
+	args = append(args, "-f", filepath.Join(checkpointDir, fsOnlyArchive), "-C", upper, ".")
+	if output, err := exec.Command("tar", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to snapshot upper directory: %w: %s", err, output)
+	}
+	logger.Info("Filesystem snapshot completed", "duration", time.Since(startTime))
+	return nil
+}
+
+// restoreFilesystemOnly creates containerID from the image and configuration
+// of a --fs-only checkpoint, unpacks the snapshot as its upper directory
+// before the first start, and starts it. A container of that name is
+// replaced.
+func restoreFilesystemOnly(containerID, checkpointDir string) error {
+	ctx := context.Background()
+
+	data, err := os.ReadFile(filepath.Join(checkpointDir, fsOnlyConfig))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", fsOnlyConfig, err)
+	}
+	var saved fsOnlyContainer
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Config == nil {
+		return fmt.Errorf("failed to parse %s: %v", fsOnlyConfig, err)
+	}
+	if saved.HostConfig == nil {
+		saved.HostConfig = &container.HostConfig{}
+	}
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	if _, err := dockerClient.ContainerInspect(ctx, containerID); err == nil {
+		logInfof("Removing existing container...")
+		if err := dockerClient.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", containerID, err)
+		}
+	}
+
+	logInfof("Creating new container from image %s...", saved.Config.Image)
+	resp, err := dockerClient.ContainerCreate(ctx, saved.Config, saved.HostConfig, nil, nil, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	info, err := dockerClient.ContainerInspect(ctx, resp.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect new container: %w", err)
+	}
+	upper := info.GraphDriver.Data["UpperDir"]
+	if info.GraphDriver.Name != "overlay2" || upper == "" {
+		return fmt.Errorf("the new container uses the %s storage driver; the snapshot needs overlay2", info.GraphDriver.Name)
+	}
+
+	logInfof("Unpacking snapshot into %s...", upper)
+	args := append([]string{"-x"}, upperTarArgs...)
+	args = append(args, "-f", filepath.Join(checkpointDir, fsOnlyArchive), "-C", upper)
+	if output, err := exec.Command("tar", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to unpack snapshot: %w: %s", err, output)
+	}
+
+	if err := dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	logInfof("Started container %s from the filesystem snapshot", resp.ID[:12])
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsScheme starts a Google Cloud Storage location, gs://bucket/path.
+const gcsScheme = "gs://"
+
+// gcsHashKey is the custom metadata holding an object's SHA-256, which GCS
+// does not compute itself.
+const gcsHashKey = "sha256"
+
+// Retries of a failed request: gcsAttempts tries in all, waiting
+// gcsBackoff, then twice as long each time.
+const (
+	gcsAttempts = 5
+	gcsBackoff  = time.Second
+)
+
+// gcsDestination is a checkpoint directory kept as the objects under a
+// prefix of a bucket. It receives checkpoints like any sync destination;
+// every object records its SHA-256 so the upload can be verified without
+// reading it back.
+//
+// The client finds its credentials the way the Google client libraries do:
+// GOOGLE_APPLICATION_CREDENTIALS, the gcloud user credentials, or the
+// service account of the GCE instance. With STORAGE_EMULATOR_HOST set it
+// talks to that emulator unauthenticated.
+type gcsDestination struct {
+	bucket *storage.BucketHandle
+	name   string
+	prefix string
+}
+
+// parseGCSDestination parses gs://bucket/path and connects to GCS.
+func parseGCSDestination(location string) (*gcsDestination, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, gcsScheme), "/")
+	prefix = strings.Trim(prefix, "/")
+	if bucket == "" || prefix == "" {
+		return nil, fmt.Errorf("%s is not a gs://bucket/path location", location)
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Google Cloud Storage client: %w", err)
+	}
+	// gcsRetry retries every request, with the same backoff as the other
+	// transfers, and reports each attempt
+	client.SetRetry(storage.WithPolicy(storage.RetryNever))
+	return &gcsDestination{bucket: client.Bucket(bucket), name: bucket, prefix: prefix}, nil
+}
+
+func (d *gcsDestination) String() string { return gcsScheme + d.name + "/" + d.prefix }
+
+func (d *gcsDestination) object(rel string) *storage.ObjectHandle {
+	return d.bucket.Object(path.Join(d.prefix, rel))
+}
+
+func (d *gcsDestination) ReadManifest() (map[string]string, error) {
+	var data bytes.Buffer
+	if err := gcsRetry("download of "+manifestFile, func() error {
+		data.Reset()
+		return d.download(manifestFile, &data)
+	}); err != nil {
+		return nil, err
+	}
+	return parseManifest(&data)
+}
+
+// Put uploads the file at srcPath as rel, recording its SHA-256.
+func (d *gcsDestination) Put(srcPath, rel string) error {
+	sum, err := hashFileSHA256(srcPath)
+	if err != nil {
+		return err
+	}
+	return gcsRetry("upload of "+rel, func() error {
+		src, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		w := d.object(rel).NewWriter(ctx)
+		w.ContentType = "application/octet-stream"
+		w.Metadata = map[string]string{gcsHashKey: hex.EncodeToString(sum[:])}
+		if _, err := io.Copy(w, src); err != nil {
+			// Cancelling abandons the upload instead of completing it
+			cancel()
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+func (d *gcsDestination) Remove(rel string) error {
+	err := gcsRetry("removal of "+rel, func() error {
+		return d.object(rel).Delete(context.Background())
+	})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Verify checks the recorded hash of every object in the uploaded
+// manifest.
+func (d *gcsDestination) Verify() error {
+	want, err := d.ReadManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	objects, err := d.list()
+	if err != nil {
+		return err
+	}
+	have := make(map[string]string, len(objects))
+	for _, obj := range objects {
+		have[strings.TrimPrefix(obj.Name, d.prefix+"/")] = obj.Metadata[gcsHashKey]
+	}
+	for name, hash := range want {
+		got, ok := have[name]
+		if !ok {
+			return fmt.Errorf("%s is missing", name)
+		}
+		if got != hash {
+			return fmt.Errorf("%s: hash mismatch", name)
+		}
+	}
+	return nil
+}
+
+// download writes the content of rel to w.
+func (d *gcsDestination) download(rel string, w io.Writer) error {
+	r, err := d.object(rel).NewReader(context.Background())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// downloadFile writes the content of rel to dst, through a temporary name
+// so that a failed attempt never leaves a partial file behind.
+func (d *gcsDestination) downloadFile(rel, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmpPath := dst + ".partial"
+	err := gcsRetry("download of "+rel, func() error {
+		f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if err := d.download(rel, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+// list returns every object under the prefix.
+func (d *gcsDestination) list() ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	err := gcsRetry("listing of "+d.String(), func() error {
+		objects = objects[:0]
+		it := d.bucket.Objects(context.Background(), &storage.Query{Prefix: d.prefix + "/"})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			objects = append(objects, attrs)
+		}
+	})
+	return objects, err
+}
+
+// gcsRetry runs fn up to gcsAttempts times with exponential backoff while it
+// fails in a way GCS documents as retryable: a network error, throttling or
+// a server error.
+func gcsRetry(what string, fn func() error) error {
+	wait := gcsBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == gcsAttempts || !storage.ShouldRetry(err) {
+			return err
+		}
+		logWarnf("%s failed (attempt %d of %d), retrying in %s: %v", what, attempt, gcsAttempts, wait, err)
+		progress.retry(what, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// downloadFromGCS copies the checkpoint at location into a temporary
+// directory and verifies it against its manifest. The returned function
+// removes the directory.
+func downloadFromGCS(location string, parallel int) (string, func(), error) {
+	d, err := parseGCSDestination(location)
+	if err != nil {
+		return "", nil, err
+	}
+	objects, err := d.list()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(objects) == 0 {
+		return "", nil, fmt.Errorf("no checkpoint at %s", d)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "docker-cr-gcs-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary restore directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	names := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		if rel := strings.TrimPrefix(obj.Name, d.prefix+"/"); rel != "" && !strings.HasSuffix(rel, "/") {
+			names = append(names, rel)
+		}
+	}
+	logInfof("Downloading %d files from %s...", len(names), d)
+	if err := runParallel(names, parallel, func(rel string) error {
+		dst := filepath.Join(tmpDir, filepath.FromSlash(rel))
+		if !strings.HasPrefix(dst, tmpDir+string(filepath.Separator)) {
+			return fmt.Errorf("object %s escapes the checkpoint directory", rel)
+		}
+		if err := d.downloadFile(rel, dst); err != nil {
+			return fmt.Errorf("failed to download %s: %w", rel, err)
+		}
+		return nil
+	}); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if err := verifyManifest(tmpDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("downloaded checkpoint: %w", err)
+	}
+	return tmpDir, cleanup, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// defaultHashWorkers is the worker count used when hashing checkpoint
+// directories. Image files are read sequentially, so the pool mainly overlaps
+// disk reads with hashing of other files.
+var defaultHashWorkers = runtime.NumCPU()
+
+// hashDirectory computes the SHA-256 of every regular file below dir using
+// up to workers goroutines; see runParallel. The returned map is keyed by
+// slash-separated path relative to dir.
+func hashDirectory(dir string, workers int) (map[string][32]byte, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string][32]byte, len(names))
+	var mu sync.Mutex
+	err = runParallel(names, workers, func(name string) error {
+		sum, err := hashFileSHA256(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		hashes[name] = sum
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+func hashFileSHA256(path string) ([32]byte, error) {
+	var sum [32]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return sum, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"inventory.img": "a", "pre-dump-1/pages-1.img": "b", "stats-dump": ""}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{0, 1, 4} {
+		sums, err := hashDirectory(dir, workers)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if len(sums) != len(files) {
+			t.Errorf("%d workers: hashed %d files, want %d", workers, len(sums), len(files))
+		}
+		for name, content := range files {
+			if sums[name] != sha256.Sum256([]byte(content)) {
+				t.Errorf("%d workers: wrong hash of %s", workers, name)
+			}
+		}
+	}
+
+	if _, err := hashDirectory(filepath.Join(dir, "missing"), 2); err == nil {
+		t.Error("hashed a missing directory")
+	}
+}
+
+// BenchmarkHashDirectory hashes a checkpoint-like directory of 64 image
+// files of 1 MiB each with the default worker pool and with one worker.
+func BenchmarkHashDirectory(b *testing.B) {
+	const files, size = 64, 1 << 20
+	dir := b.TempDir()
+	data := make([]byte, size)
+	for i := 0; i < files; i++ {
+		if _, err := rand.Read(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("pages-%d.img", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{
+		{"parallel", defaultHashWorkers},
+		{"sequential", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(files * size)
+			for i := 0; i < b.N; i++ {
+				sums, err := hashDirectory(dir, bm.workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(sums) != files {
+					b.Fatalf("hashed %d files, want %d", len(sums), files)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// setHostnameInNamespace sets the hostname inside the UTS namespace of pid.
+// It refuses to act when pid shares our UTS namespace, since that would
+// rename the host itself.
+func setHostnameInNamespace(pid int, hostname string) error {
+	targetNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/uts", pid))
+	if err != nil {
+		return fmt.Errorf("failed to read UTS namespace of %d: %w", pid, err)
+	}
+	if ownNs, err := os.Readlink("/proc/self/ns/uts"); err == nil && ownNs == targetNs {
+		return fmt.Errorf("process %d shares the host UTS namespace; not changing the host's hostname", pid)
+	}
+
+	// /proc/sys/kernel/hostname belongs to the UTS namespace of the writer,
+	// so the write has to happen from inside the namespace
+	cmd := exec.Command("nsenter", "--target", strconv.Itoa(pid), "--uts", "--",
+		"sh", "-c", `printf '%s' "$1" > /proc/sys/kernel/hostname`, "sh", hostname)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set hostname in namespace of %d: %w: %s", pid, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
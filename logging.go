@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of --log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logger receives the log records of every command: what docker-cr is
+// doing, warnings and errors, with fields such as container_id, pid, phase
+// and duration. Reports and listings a command exists to print (analyze,
+// registry, doctor, the checks of a --dry-run, the CRIU log of a failed
+// dump) are not records and are printed to stdout with fmt.
+//
+// As text, records are plain lines on stdout, interleaved with the reports
+// as always, and context fields are left out. As JSON, each record is one
+// object on stderr, which then carries nothing else.
+var logger = slog.New(newTextHandler(slog.LevelInfo))
+
+// logFormat is the --log-format in effect.
+var logFormat = logFormatText
+
+// parseGlobalFlags parses the options given before the command, with
+// DOCKER_CR_LOG_FORMAT and DOCKER_CR_VERBOSE as their defaults, sets up
+// logger and returns the command and its arguments. The options are put
+// back in the environment for the processes docker-cr re-executes, e.g.
+// the background half of checkpoint --detach.
+func parseGlobalFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("docker-cr", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := fs.String("log-format", os.Getenv("DOCKER_CR_LOG_FORMAT"), "")
+	verbose := fs.Bool("verbose", os.Getenv("DOCKER_CR_VERBOSE") != "", "")
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return []string{"help"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+		os.Setenv("DOCKER_CR_VERBOSE", "1")
+	}
+	switch *format {
+	case "", logFormatText:
+		logger = slog.New(newTextHandler(level))
+	case logFormatJSON:
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level:       level,
+			ReplaceAttr: jsonDurations,
+		}))
+		logFormat = logFormatJSON
+		os.Setenv("DOCKER_CR_LOG_FORMAT", logFormatJSON)
+	default:
+		return nil, fmt.Errorf("--log-format must be text or json, not %q", *format)
+	}
+	return fs.Args(), nil
+}
+
+// jsonDurations writes durations as seconds rather than nanoseconds.
+func jsonDurations(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, a.Value.Duration().Seconds())
+	}
+	return a
+}
+
+// setLogFields adds fields, e.g. "container_id", to every following record.
+func setLogFields(args ...any) {
+	logger = logger.With(args...)
+}
+
+func logDebugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logf(slog.LevelInfo, format, args...) }
+func logWarnf(format string, args ...any)  { logf(slog.LevelWarn, format, args...) }
+func logErrorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+func logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	logger.Log(ctx, level, msg)
+	if level >= slog.LevelError {
+		progress.emit(ProgressEvent{Type: eventError, Message: msg})
+		tracing.finish(msg)
+		pushgateway.push(false)
+		audit.record(msg)
+	} else if level >= slog.LevelWarn {
+		progress.emit(ProgressEvent{Type: eventWarning, Message: msg})
+		tracing.warn(msg)
+	}
+}
+
+// humanStderr is where human-readable output goes while stdout carries
+// data, e.g. a checkpoint streamed as tar: stderr, or nowhere if the JSON
+// records are written there.
+func humanStderr() *os.File {
+	if logFormat == logFormatJSON {
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			return devNull
+		}
+	}
+	return os.Stderr
+}
+
+// childStderr is where the stderr of criu and hook scripts is passed
+// through: stdout when the JSON records take stderr.
+func childStderr() *os.File {
+	if logFormat == logFormatJSON {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+// textHandler writes a record as its message, prefixed with "Warning:" or
+// "Error:" by level and followed by its own fields as key=value. Fields
+// added with With, e.g. by setLogFields, are left out: the messages already
+// name the container or process.
+type textHandler struct {
+	level slog.Level
+	mu    *sync.Mutex
+}
+
+func newTextHandler(level slog.Level) *textHandler {
+	return &textHandler{level: level, mu: &sync.Mutex{}}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%s", a.Key, formatLogValue(a.Value))
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// os.Stdout at the time of writing, which a stream redirects
+	_, err := io.WriteString(os.Stdout, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *textHandler) WithGroup(string) slog.Handler      { return h }
+
+func formatLogValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().Round(time.Millisecond).String()
+	case slog.KindString:
+		if s := v.String(); s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			return fmt.Sprintf("%q", s)
+		}
+	}
+	return v.String()
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	commandLine = append([]string(nil), os.Args...)
+	args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+	os.Args = append(os.Args[:1], args...)
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -14,88 +28,1822 @@ func main() {
 
 	command := os.Args[1]
 
+	// Environment fallbacks for arguments left out on the command line,
+	// which always takes precedence
+	envCheckpointDir := os.Getenv("DOCKER_CR_CHECKPOINT_DIR")
+	envLogLevel := defaultCRIULogLevel
+	if value := os.Getenv("DOCKER_CR_LOG_LEVEL"); value != "" {
+		level, err := parseLogLevel(value)
+		if err != nil {
+			logErrorf("DOCKER_CR_LOG_LEVEL: %v", err)
+			os.Exit(1)
+		}
+		envLogLevel = level
+	}
+
 	switch command {
 	case "checkpoint", "cp":
-		if len(os.Args) < 4 {
-			fmt.Println("Error: checkpoint requires container ID/PID and checkpoint directory")
-			fmt.Println("Usage: docker-cr checkpoint <container-id|pid> <checkpoint-dir>")
+		fs := flag.NewFlagSet("checkpoint", flag.ExitOnError)
+		dirSymlink := fs.Bool("checkpoint-dir-symlink", false, "update a 'latest' symlink next to the checkpoint directory on success")
+		syncTo := fs.String("sync-to", "", "incrementally sync the checkpoint to a local path or [user@]host:path")
+		syncParallel := fs.Int("sync-parallel", 4, "number of parallel transfers for --sync-to")
+		streamToGCS := fs.String("stream-to-gcs", "", "upload the checkpoint to gs://bucket/path after the dump")
+		var replicateTo []string
+		fs.Var((*stringList)(&replicateTo), "replicate-to", "copy the checkpoint to this local path or [user@]host:path (repeatable)")
+		replicatePolicy := fs.String("replicate-policy", "all", "'all' or 'any': which replicas must succeed for the checkpoint to succeed")
+		compress := fs.Bool("compress", false, "gzip the tar stream when the checkpoint directory is '-'")
+		cfg := &CheckpointConfig{}
+		fs.Var((*stringList)(&cfg.CriuArgs), "criu-args", "raw argument for a criu subprocess (repeatable)")
+		fs.StringVar(&cfg.CriuService, "criu-service", "", "use the CRIU service listening on this socket instead of spawning criu")
+		fs.IntVar(&cfg.LogLevel, "log-level", envLogLevel, "CRIU log verbosity from 1 (errors) to 4 (debug)")
+		fs.BoolVar(&cfg.IgnoreBPF, "ignore-bpf", false, "warn instead of failing when the process holds eBPF file descriptors")
+		fs.BoolVar(&cfg.IgnoreFanotify, "ignore-fanotify", false, "warn instead of failing when the process holds a fanotify file descriptor")
+		fs.IntVar(&cfg.FDLimit, "checkpoint-fd-limit", defaultFDLimit, "refuse to checkpoint a process with more open file descriptors than this (0 for no limit)")
+		fs.BoolVar(&cfg.Force, "force", false, "checkpoint despite blocking issues in the assessment")
+		var hooks []string
+		fs.Var((*stringList)(&hooks), "hook", "run a script at a CRIU phase: <phase>=<script> (repeatable)")
+		hooksDir := fs.String("hooks-dir", "", "run the executables in <dir>/<phase>/ at each CRIU phase, in lexical order")
+		fs.Var(&cfg.HookTimeouts, "hook-timeout", "kill a hook script, with its process group, after this long: <duration> or <phase>=<duration> (repeatable, default 60s)")
+		preDumpScript := fs.String("pre-dump-script", "", "executable run before CRIU dumps; a non-zero exit aborts the checkpoint")
+		postDumpScript := fs.String("post-dump-script", "", "executable run after CRIU wrote the images; a non-zero exit fails the checkpoint")
+		fs.StringVar(&cfg.DetachTracer, "detach-tracer", "", "send this signal (e.g. TERM, KILL) to processes ptracing the tree instead of failing")
+		fs.Var((*byteSize)(&cfg.MaxImageSize), "max-image-size", "fail and delete the images of the dump if they exceed this size")
+		fs.Var((*byteSize)(&cfg.WarnImageSize), "warn-image-size", "warn if the checkpoint images exceed this size")
+		fs.Var((*byteSize)(&cfg.GhostLimit), "ghost-limit", "largest deleted file CRIU may store in the dump")
+		fs.Var((*byteSize)(&cfg.MemoryLimit), "memory-limit", "cap the memory of the criu process (cgroup v2 memory.max)")
+		retention := fs.String("retention", "", "retention policy applied to sibling checkpoints after success")
+		forkAndDump := fs.Bool("fork-and-dump", false, "stop the container after the dump and start a copy named <container>-fork from it")
+		fs.BoolVar(&cfg.TailLog, "tail-log", false, "print the CRIU log live while the dump runs")
+		fs.StringVar(&cfg.EnvFile, "checkpoint-env-file", "", "record the process environment in environ.json and copy it to this path")
+		fs.Var((*stringList)(&cfg.RedactEnv), "redact-env", "scrub environment variables matching this name pattern from process-manifest.json (repeatable)")
+		fs.BoolVar(&cfg.VerifyAfter, "verify-after-checkpoint", false, "verify the checkpoint after the dump and delete it if verification fails")
+		fs.StringVar(&cfg.Type, "checkpoint-type", checkpointTypeFull, "'full', or 'pre' (memory only) / 'post' (no memory) for debugging")
+		fs.IntVar(&cfg.PreDumpCount, "pre-dump-count", 0, "copy memory in up to this many CRIU pre-dump rounds before the dump, stopping once under 1% of pages are dirty")
+		fs.StringVar(&cfg.Namespace, "namespace", "", "prefix Docker native checkpoint IDs with <ns>- and only replace checkpoints in it")
+		fs.BoolVar(&cfg.RequireDockerCheckpoint, "require-docker-checkpoint", false, "checkpoint only through Docker's checkpoint API and fail if the daemon lacks it")
+		fs.StringVar(&cfg.DeltaFrom, "delta-from", "", "store only the files that changed since this earlier checkpoint")
+		fs.IntVar(&cfg.WorkDirFd, "work-dir-fd", 0, "inherited directory fd for CRIU's log instead of the checkpoint directory")
+		fs.BoolVar(&cfg.KeepPartial, "keep-partial", false, "keep the images and logs of a failed dump for debugging")
+		fs.Float64Var(&cfg.AssumedThroughput, "assume-throughput", defaultDumpThroughput, "dump speed in MB/s for the estimate when the container has no checkpoint history")
+		fs.BoolVar(&cfg.AsContainer, "as-container", false, "checkpoint the whole container when the PID target belongs to one")
+		fs.BoolVar(&cfg.Consistent, "consistent", false, "freeze the container's writable filesystem (fsfreeze) while dumping")
+		fs.StringVar(&cfg.TCPIface, "tcp-iface", "", "interface (e.g. a bond or VLAN) the TCP connections are on; restore checks it exists")
+		fs.StringVar(&cfg.SlackWebhook, "notify-slack", "", "post failed checkpoints to this Slack incoming webhook URL")
+		fs.BoolVar(&cfg.SlackOnSuccess, "notify-slack-on-success", false, "with --notify-slack, also post successful checkpoints")
+		fs.StringVar(&cfg.CgroupHierarchy, "cgroup-hierarchy", "", "cgroups CRIU dumps: 'full' tree, the 'cgroupns' root (default for containers) or 'none'")
+		fs.StringVar(&cfg.NetworkLock, "network-lock", "", "block the tree's traffic during the dump with 'iptables' or 'nftables' (detected by default), or 'skip'")
+		extMntWhitelist := fs.String("auto-ext-mnt-whitelist", "", "comma-separated mountpoints to dump as external instead of detecting them")
+		extMntBlacklist := fs.String("ext-mnt-blacklist", "", "comma-separated mountpoints never dumped as external")
+		fs.BoolVar(&cfg.FSOnly, "fs-only", false, "snapshot the container's overlay upper directory without CRIU; no memory state")
+		sharedDir := fs.Bool("shared-dir", false, "hold a lock while dumping and write a completion marker for other hosts")
+		progressFormat := fs.String("progress", "", "write progress events to stdout as 'ndjson', moving other output to stderr")
+		otelEndpoint := fs.String("otel-endpoint", "", "export OTLP/HTTP traces to this collector URL (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+		pushgatewayURL := fs.String("pushgateway", "", "push the duration, size, freeze time and result to this Prometheus Pushgateway")
+		pushgatewayJob := fs.String("pushgateway-job", defaultPushgatewayJob, "job label of the metrics pushed with --pushgateway")
+		pushgatewayInstance := fs.String("pushgateway-instance", "", "instance label of the metrics pushed with --pushgateway (default the hostname)")
+		breakStale := fs.Bool("break-stale-locks", false, "remove a stale --shared-dir lock instead of failing")
+		exportOCI := fs.String("export-oci", "", "also write a runc bundle (config.json, checkpoint/, rootfs/) to this directory")
+		detach := fs.Bool("detach", false, "return at once and finish the checkpoint in the background")
+		ephemeral := fs.Bool("ephemeral", false, "checkpoint into a new tmpfs under /run/docker-cr instead of a checkpoint directory")
+		pidFile := fs.String("pid-file", "", "with --detach, write the PID of the background checkpoint here")
+		completionSignal := fs.String("completion-signal", "", "with --detach, send this signal to the caller's parent when the checkpoint ends")
+		detachedFor := fs.Int(internalDetachFlag, 0, "internal: run as the background process of --detach")
+		args := parseArgs(fs, os.Args[2:])
+
+		if *ephemeral {
+			if len(args) != 1 {
+				logErrorf("--ephemeral takes no checkpoint directory; it checkpoints into a new tmpfs")
+				os.Exit(1)
+			}
+			if *detach || *sharedDir || *retention != "" || *dirSymlink {
+				logErrorf("--ephemeral cannot be combined with --detach, --shared-dir, --retention or --checkpoint-dir-symlink")
+				os.Exit(1)
+			}
+			args = append(args, "")
+		}
+		if len(args) == 1 && envCheckpointDir != "" {
+			args = append(args, envCheckpointDir)
+		}
+		if len(args) < 2 {
+			logErrorf("checkpoint requires container ID/PID and checkpoint directory")
+			fmt.Println("Usage: docker-cr checkpoint [options] <container-id|pid> <checkpoint-dir>")
+			fmt.Println("       docker-cr checkpoint --ephemeral [options] <container-id|pid>")
+			os.Exit(1)
+		}
+		target := args[0]
+		checkpointDir := args[1]
+
+		if *forkAndDump {
+			if _, err := strconv.Atoi(target); err == nil || checkpointDir == "-" {
+				logErrorf("--fork-and-dump requires a container target and a checkpoint directory")
+				os.Exit(1)
+			}
+			cfg.StopAfterDump = true
+		}
+
+		if err := validateCheckpointNamespace(cfg.Namespace); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateCheckpointType(cfg.Type); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if cfg.PreDumpCount < 0 {
+			logErrorf("--pre-dump-count must not be negative")
+			os.Exit(1)
+		}
+		if cfg.FDLimit < 0 {
+			logErrorf("--checkpoint-fd-limit must not be negative")
+			os.Exit(1)
+		}
+		if cfg.PreDumpCount > 0 && isPartialDump(cfg) {
+			logErrorf("--pre-dump-count cannot be combined with --checkpoint-type %s", cfg.Type)
+			os.Exit(1)
+		}
+		if _, err := parseLogLevel(strconv.Itoa(cfg.LogLevel)); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateHookScript("pre-dump-script", *preDumpScript); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateHookScript("post-dump-script", *postDumpScript); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if *preDumpScript != "" {
+			hooks = append(hooks, "pre-dump="+*preDumpScript)
+		}
+		if *postDumpScript != "" {
+			hooks = append(hooks, "post-dump="+*postDumpScript)
+		}
+		hookScripts, err := parseHooks(hooks, *hooksDir, checkpointHookPhases)
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		cfg.Hooks = hookScripts
+
+		if cfg.ExtMntWhitelist, err = parseMountPaths("auto-ext-mnt-whitelist", *extMntWhitelist); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if cfg.ExtMntBlacklist, err = parseMountPaths("ext-mnt-blacklist", *extMntBlacklist); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateNetworkLock(cfg.NetworkLock); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateCgroupHierarchy(cfg.CgroupHierarchy); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateProgress(*progressFormat); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateExtMountLists(cfg.ExtMntWhitelist, cfg.ExtMntBlacklist); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if cfg.SlackOnSuccess && cfg.SlackWebhook == "" {
+			logErrorf("--notify-slack-on-success needs --notify-slack")
+			os.Exit(1)
+		}
+		if cfg.SlackWebhook != "" {
+			if u, err := url.Parse(cfg.SlackWebhook); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				logErrorf("--notify-slack: %q is not an http(s) URL", cfg.SlackWebhook)
+				os.Exit(1)
+			}
+		}
+		if cfg.DetachTracer != "" {
+			if _, err := parseTracerSignal(cfg.DetachTracer); err != nil {
+				logErrorf("--detach-tracer: %v", err)
+				os.Exit(1)
+			}
+		}
+		if cfg.WorkDirFd != 0 {
+			workDir, err := openWorkDirFd(cfg.WorkDirFd)
+			if err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			cfg.workDir = workDir
+		}
+		if err := validateGhostLimit(cfg.GhostLimit); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if cfg.MemoryLimit > 0 && len(cfg.CriuArgs) > 0 {
+			logErrorf("--memory-limit cannot be combined with --criu-args")
+			os.Exit(1)
+		}
+		if _, err := strconv.Atoi(target); err == nil && cfg.Consistent {
+			logErrorf("--consistent requires a container target")
+			os.Exit(1)
+		}
+		if cfg.FSOnly {
+			if _, err := strconv.Atoi(target); err == nil || checkpointDir == "-" {
+				logErrorf("--fs-only requires a container target and a checkpoint directory")
+				os.Exit(1)
+			}
+			if *forkAndDump || *exportOCI != "" || isPartialDump(cfg) || cfg.DeltaFrom != "" || cfg.PreDumpCount > 0 {
+				logErrorf("--fs-only cannot be combined with --fork-and-dump, --export-oci, --checkpoint-type, --delta-from or --pre-dump-count")
+				os.Exit(1)
+			}
+		}
+		if cfg.RequireDockerCheckpoint {
+			if _, err := strconv.Atoi(target); err == nil {
+				logErrorf("--require-docker-checkpoint requires a container target")
+				os.Exit(1)
+			}
+			// Docker's checkpoint API takes plain full dumps only
+			if cfg.FSOnly || isPartialDump(cfg) || cfg.Consistent || cfg.PreDumpCount > 0 || len(cfg.CriuArgs) > 0 || cfg.CriuService != "" {
+				logErrorf("--require-docker-checkpoint cannot be combined with --fs-only, --checkpoint-type, --consistent, --pre-dump-count, --criu-args or --criu-service")
+				os.Exit(1)
+			}
+		}
+		if isPartialDump(cfg) && (cfg.VerifyAfter || cfg.DeltaFrom != "" || *forkAndDump || *exportOCI != "") {
+			logErrorf("--verify-after-checkpoint, --delta-from, --fork-and-dump and --export-oci need a full checkpoint")
+			os.Exit(1)
+		}
+		if *exportOCI != "" {
+			if _, err := strconv.Atoi(target); err == nil || checkpointDir == "-" {
+				logErrorf("--export-oci requires a container target and a checkpoint directory")
+				os.Exit(1)
+			}
+			if *forkAndDump {
+				// The runtime spec goes away with the stopped container
+				logErrorf("--export-oci cannot be combined with --fork-and-dump")
+				os.Exit(1)
+			}
+		}
+
+		if *detach && cfg.WorkDirFd != 0 {
+			logErrorf("--work-dir-fd cannot be passed on to a --detach checkpoint")
+			os.Exit(1)
+		}
+		if (*pidFile != "" || *completionSignal != "") && !*detach && *detachedFor == 0 {
+			logErrorf("--pid-file and --completion-signal need --detach")
+			os.Exit(1)
+		}
+		if *completionSignal != "" {
+			if _, err := parseSignal(*completionSignal); err != nil {
+				logErrorf("--completion-signal: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if *streamToGCS != "" {
+			if !strings.HasPrefix(*streamToGCS, gcsScheme) {
+				logErrorf("--stream-to-gcs must be a gs://bucket/path location")
+				os.Exit(1)
+			}
+			if _, err := parseGCSDestination(*streamToGCS); err != nil {
+				logErrorf("--stream-to-gcs: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if *replicatePolicy != "all" && *replicatePolicy != "any" {
+			logErrorf("--replicate-policy must be 'all' or 'any', not %q", *replicatePolicy)
+			os.Exit(1)
+		}
+
+		var policy *RetentionPolicy
+		if *retention != "" {
+			var err error
+			if policy, err = parseRetentionPolicy(*retention); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		cfg.Compress = *compress
+		if checkpointDir == "-" {
+			if cfg.PreDumpCount > 0 {
+				// The final dump links to the rounds with symlinks the tar omits
+				logErrorf("--pre-dump-count cannot be used when streaming to stdout")
+				os.Exit(1)
+			}
+			if *dirSymlink || *syncTo != "" || *streamToGCS != "" || len(replicateTo) > 0 || policy != nil || *sharedDir || *detach || *progressFormat != "" {
+				logErrorf("--checkpoint-dir-symlink, --sync-to, --stream-to-gcs, --replicate-to, --retention, --shared-dir, --detach and --progress cannot be used when streaming to stdout")
+				os.Exit(1)
+			}
+			// Everything human-readable goes to stderr so the tar stream stays clean
+			stream := os.Stdout
+			os.Stdout = humanStderr()
+			cfg.timings = newTimings()
+			startPushgateway(*pushgatewayURL, *pushgatewayJob, *pushgatewayInstance, "checkpoint", target, "", cfg.timings)
+			startAudit("checkpoint", target, checkpointDir)
+			if err := streamCheckpoint(target, cfg, stream, *compress); err != nil {
+				logErrorf("creating checkpoint: %v", err)
+				os.Exit(1)
+			}
+			cfg.timings.finish()
+			cfg.timings.report("Checkpoint")
+			logInfof("Checkpoint streamed successfully!")
+			pushgateway.push(true)
+			audit.record("")
+			return
+		}
+
+		if *detach {
+			if err := detachCheckpoint(os.Args[2:], checkpointDir); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if *detachedFor != 0 {
+			os.Exit(runDetachedCheckpoint(os.Args[2:], *pidFile, *completionSignal, *detachedFor))
+		}
+
+		if err := startProgress(*progressFormat, "checkpoint", target); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := startTracing(*otelEndpoint, "checkpoint", target); err != nil {
+			logErrorf("%v", err)
 			os.Exit(1)
 		}
-		target := os.Args[2]
-		checkpointDir := os.Args[3]
+		startAudit("checkpoint", target, checkpointDir)
+
+		var eph *EphemeralCheckpoint
+		if *ephemeral {
+			var err error
+			if eph, err = createEphemeralDir(target); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			checkpointDir = eph.Path
+			audit.setCheckpointDir(eph.Path)
+		}
+
+		var lock *sharedLock
+		if *sharedDir {
+			var err error
+			if lock, err = acquireSharedLock(checkpointDir, inProgressLock, *breakStale); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			if err := clearComplete(checkpointDir); err != nil {
+				lock.Release()
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		started := time.Now()
+		cfg.timings = newTimings()
+		startPushgateway(*pushgatewayURL, *pushgatewayJob, *pushgatewayInstance, "checkpoint", target, checkpointDir, cfg.timings)
+		if err := createCheckpoint(target, checkpointDir, cfg); err != nil {
+			if lock != nil {
+				lock.Release()
+			}
+			if eph != nil && !cfg.KeepPartial {
+				if err := removeEphemeral(eph.Path); err != nil {
+					logWarnf("%v", err)
+				}
+			}
+			logErrorf("creating checkpoint: %v", err)
+			os.Exit(1)
+		}
+		cfg.timings.finish()
+		cfg.timings.report("Checkpoint")
+
+		if *exportOCI != "" {
+			if err := exportOCIBundle(target, checkpointDir, *exportOCI); err != nil {
+				if lock != nil {
+					lock.Release()
+				}
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		if *forkAndDump {
+			forkID, err := forkContainer(target, checkpointDir)
+			if err != nil {
+				if lock != nil {
+					lock.Release()
+				}
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			logInfof("Container %s stopped; fork %s is running", target, forkID)
+		}
+
+		if cfg.DeltaFrom != "" {
+			if err := makeDelta(checkpointDir, cfg.DeltaFrom); err != nil {
+				if lock != nil {
+					lock.Release()
+				}
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
 
-		if pid, err := strconv.Atoi(target); err == nil {
-			fmt.Printf("Creating checkpoint for process %d in %s...\n", pid, checkpointDir)
-			if err := checkpointSimpleProcess(pid, checkpointDir); err != nil {
-				fmt.Printf("Error creating checkpoint: %v\n", err)
+		if lock != nil {
+			// The marker is written only once the manifest is final
+			err := markComplete(checkpointDir)
+			lock.Release()
+			if err != nil {
+				logErrorf("%v", err)
 				os.Exit(1)
 			}
+		}
+
+		entry, err := registerCheckpoint(target, checkpointDir, time.Since(started), cfg.timings)
+		if err != nil {
+			logWarnf("failed to register checkpoint: %v", err)
 		} else {
-			fmt.Printf("Creating checkpoint for container %s in %s...\n", target, checkpointDir)
-			if err := checkpointContainer(target, checkpointDir); err != nil {
-				fmt.Printf("Error creating checkpoint: %v\n", err)
+			logInfof("Registered checkpoint %d for %s", entry.ID, entry.Container)
+		}
+
+		if *dirSymlink {
+			if err := updateLatestSymlink(checkpointDir); err != nil {
+				logErrorf("updating latest symlink: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if *syncTo != "" {
+			if err := syncCheckpoint(checkpointDir, *syncTo, *syncParallel); err != nil {
+				logErrorf("syncing checkpoint: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if *streamToGCS != "" {
+			if err := syncCheckpoint(checkpointDir, *streamToGCS, *syncParallel); err != nil {
+				logErrorf("uploading checkpoint: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		if len(replicateTo) > 0 {
+			// Runs only after the dump, so a leave-running target is already thawed
+			replicas, replErr := replicateCheckpoint(checkpointDir, replicateTo, *syncParallel, *replicatePolicy == "all")
+			if entry != nil && len(replicas) > 0 {
+				if err := recordReplicas(entry.ID, replicas); err != nil {
+					logWarnf("failed to record replicas: %v", err)
+				}
+			}
+			if replErr != nil {
+				logErrorf("replicating checkpoint: %v", replErr)
 				os.Exit(1)
 			}
 		}
-		fmt.Println("Checkpoint created successfully!")
+
+		if policy != nil {
+			parentDir := filepath.Dir(filepath.Clean(checkpointDir))
+			logInfof("Applying retention policy to %s:", parentDir)
+			if err := applyRetention(parentDir, policy, false); err != nil {
+				logWarnf("retention failed: %v", err)
+			}
+		}
+		logInfof("Checkpoint created successfully!")
+		if eph != nil {
+			logInfof("Restore it with: docker-cr restore %s%s", ephemeralPrefix, eph.ID)
+		}
+		progress.done()
+		tracing.finish("")
+		pushgateway.push(true)
+		audit.record("")
 
 	case "restore", "rs":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		cfg := &RestoreConfig{}
+		fs.Var((*stringList)(&cfg.CriuArgs), "criu-args", "raw argument for a criu subprocess (repeatable)")
+		fs.StringVar(&cfg.CriuService, "criu-service", "", "use the CRIU service listening on this socket instead of spawning criu")
+		fs.IntVar(&cfg.LogLevel, "log-level", envLogLevel, "CRIU log verbosity from 1 (errors) to 4 (debug)")
+		latest := fs.String("latest", "", "restore the newest registered checkpoint of this container")
+		restoreFromGCS := fs.String("restore-from-gcs", "", "download the checkpoint from gs://bucket/path and restore it")
+		fs.BoolVar(&cfg.IntoExisting, "restore-into-existing", false, "restore into the stopped container instead of recreating it")
+		fs.StringVar(&cfg.NewContainerName, "new-container-name", "", "create the restored container under this name, leaving the original alone")
+		fs.BoolVar(&cfg.ShowEnv, "show-env", false, "print the environment recorded with --checkpoint-env-file")
+		fs.StringVar(&cfg.RedirectStdout, "redirect-stdout", "", "append the restored process's stdout to this file")
+		fs.StringVar(&cfg.RedirectStderr, "redirect-stderr", "", "append the restored process's stderr to this file")
+		fs.Var(&cfg.HookTimeouts, "hook-timeout", "kill a hook script, with its process group, after this long: <duration> or <phase>=<duration> (repeatable, default 60s)")
+		fs.Var(&cfg.HookTimeouts, "restore-hook-timeout", "same as --hook-timeout")
+		var hooks []string
+		fs.Var((*stringList)(&hooks), "hook", "run a script at a CRIU phase: <phase>=<script> (repeatable)")
+		hooksDir := fs.String("hooks-dir", "", "run the executables in <dir>/<phase>/ at each CRIU phase, in lexical order")
+		preRestoreScript := fs.String("pre-restore-script", "", "executable run before CRIU restores; a non-zero exit aborts the restore")
+		fs.BoolVar(&cfg.StrictVersionCheck, "strict-version-check", false, "fail instead of warning when the Docker/containerd major version differs from checkpoint time")
+		fs.StringVar(&cfg.Hostname, "restore-hostname", "", "hostname of the restored container instead of the checkpointed one")
+		fs.BoolVar(&cfg.CgroupLeave, "cgroup-leave", false, "restore the process into the cgroups it was dumped from (CRIU soft cgroup mode)")
+		stdinPID := fs.Bool("stdin-pid", false, "read a PID from stdin and restore the process into its net, ipc and uts namespaces")
+		fs.BoolVar(&cfg.IgnorePortConflicts, "ignore-port-conflicts", false, "restore even if ports the checkpoint had bound are in use")
+		fs.IntVar(&cfg.RestorePID, "restore-pid", 0, "restore the process onto this PID, which must be its checkpointed PID and free")
+		fs.StringVar(&cfg.MountNsFile, "mnt-ns-file", "", "restore into the mount namespace behind this file, e.g. /proc/<pid>/ns/mnt")
+		fs.BoolVar(&cfg.PreserveCheckpoint, "preserve-checkpoint", false, "restore from a temporary copy, leaving the checkpoint directory untouched")
+		sharedDir := fs.Bool("shared-dir", false, "require a completion marker and hold a lock while restoring")
+		waitComplete := fs.Duration("wait-for-complete", 0, "wait this long for the completion marker (implies --shared-dir)")
+		breakStale := fs.Bool("break-stale-locks", false, "remove a stale --shared-dir lock instead of failing")
+		cleanupAfterRestore := fs.Bool("cleanup-after-restore", false, "unmount the tmpfs of an --ephemeral checkpoint once it is restored")
+		dryRun := fs.Bool("dry-run", false, "check the preconditions of the restore and report what it would do, without restoring")
+		progressFormat := fs.String("progress", "", "write progress events to stdout as 'ndjson', moving other output to stderr")
+		otelEndpoint := fs.String("otel-endpoint", "", "export OTLP/HTTP traces to this collector URL (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+		pushgatewayURL := fs.String("pushgateway", "", "push the duration, size, freeze time and result to this Prometheus Pushgateway")
+		pushgatewayJob := fs.String("pushgateway-job", defaultPushgatewayJob, "job label of the metrics pushed with --pushgateway")
+		pushgatewayInstance := fs.String("pushgateway-instance", "", "instance label of the metrics pushed with --pushgateway (default the hostname)")
+		args := parseArgs(fs, os.Args[2:])
+		if err := validateHookScript("pre-restore-script", *preRestoreScript); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := validateProgress(*progressFormat); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if *preRestoreScript != "" {
+			hooks = append(hooks, "pre-restore="+*preRestoreScript)
+		}
+		hookScripts, err := parseHooks(hooks, *hooksDir, restoreHookPhases)
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		cfg.Hooks = hookScripts
+
+		if *latest != "" {
+			entry, err := latestCheckpointFor(*latest)
+			if err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			logInfof("Using checkpoint %d from %s", entry.ID, entry.Timestamp.Format(time.RFC3339))
+			args = append([]string{entry.Path}, args...)
+			if len(args) == 1 && entry.Mode != "process" {
+				args = append(args, entry.Container)
+			}
+		}
+
+		// The download is removed once the restore ends
+		removeDownload := func() {}
+		if *restoreFromGCS != "" {
+			if *latest != "" {
+				logErrorf("--restore-from-gcs cannot be combined with --latest")
+				os.Exit(1)
+			}
+			if !strings.HasPrefix(*restoreFromGCS, gcsScheme) {
+				logErrorf("--restore-from-gcs must be a gs://bucket/path location")
+				os.Exit(1)
+			}
+			dir, remove, err := downloadFromGCS(*restoreFromGCS, 4)
+			if err != nil {
+				logErrorf("downloading checkpoint: %v", err)
+				os.Exit(1)
+			}
+			logInfof("Downloaded %s to %s", *restoreFromGCS, dir)
+			args = append([]string{dir}, args...)
+			removeDownload = remove
+		}
+
+		if len(args) == 0 && envCheckpointDir != "" {
+			args = []string{envCheckpointDir}
+		}
+		if len(args) < 1 {
+			logErrorf("restore requires checkpoint directory")
+			fmt.Println("Usage: docker-cr restore [options] <checkpoint-dir> [container-id]")
+			os.Exit(1)
+		}
+		if _, err := parseLogLevel(strconv.Itoa(cfg.LogLevel)); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if *stdinPID {
+			if len(args) >= 2 {
+				logErrorf("--stdin-pid only applies to process checkpoints")
+				os.Exit(1)
+			}
+			pid, err := readStdinPID(os.Stdin)
+			if err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			logInfof("Restoring into the namespaces of PID %d", pid)
+			cfg.JoinNamespacesOf = pid
+		}
+		checkpointDir, err := resolveCheckpointDir(args[0])
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if checkpointType := partialCheckpointType(checkpointDir); checkpointType != "" {
+			logErrorf("%s is a partial (%s) checkpoint and cannot be restored", checkpointDir, checkpointType)
+			os.Exit(1)
+		}
+		if cfg.NewContainerName != "" {
+			switch {
+			case len(args) < 2:
+				logErrorf("--new-container-name needs the container-id of the checkpointed container")
+				os.Exit(1)
+			case cfg.IntoExisting:
+				logErrorf("--new-container-name cannot be combined with --restore-into-existing")
+				os.Exit(1)
+			case isFilesystemOnlyCheckpoint(checkpointDir):
+				logErrorf("--new-container-name does not apply to a --fs-only checkpoint; its container-id already names the container to create")
+				os.Exit(1)
+			}
+		}
+		var eph *EphemeralCheckpoint
+		if *cleanupAfterRestore {
+			if eph, err = findEphemeral(checkpointDir); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			} else if eph == nil {
+				logErrorf("--cleanup-after-restore only applies to --ephemeral checkpoints, and %s is not one", checkpointDir)
+				os.Exit(1)
+			}
+		}
+
+		if *dryRun {
+			containerID := ""
+			if len(args) >= 2 {
+				containerID = args[1]
+			}
+			err := dryRunRestore(checkpointDir, containerID, cfg)
+			removeDownload()
+			if err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if err := startProgress(*progressFormat, "restore", checkpointDir); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := startTracing(*otelEndpoint, "restore", checkpointDir); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		startAudit("restore", restoreTarget(args, checkpointDir), checkpointDir)
+
+		var lock *sharedLock
+		if *sharedDir || *waitComplete > 0 {
+			if err := waitForComplete(checkpointDir, *waitComplete); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			if lock, err = acquireSharedLock(checkpointDir, restoringLock, *breakStale); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		reportProcessEnviron(checkpointDir, cfg.ShowEnv)
+
+		cleanup := func() {}
+		if isDeltaCheckpoint(checkpointDir) {
+			// The materialized copy also serves --preserve-checkpoint
+			workDir, removeCopy, err := materializeToTemp(checkpointDir)
+			if err != nil {
+				if lock != nil {
+					lock.Release()
+				}
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			checkpointDir, cleanup = workDir, removeCopy
+		} else if cfg.PreserveCheckpoint {
+			workDir, removeCopy, err := preserveCheckpoint(checkpointDir)
+			if err != nil {
+				if lock != nil {
+					lock.Release()
+				}
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+			checkpointDir, cleanup = workDir, removeCopy
+		}
+
+		if err := openRedirects(checkpointDir, cfg); err != nil {
+			cleanup()
+			if lock != nil {
+				lock.Release()
+			}
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+		cfg.timings = newTimings()
+		if *pushgatewayURL != "" {
+			startPushgateway(*pushgatewayURL, *pushgatewayJob, *pushgatewayInstance, "restore", restoreTarget(args, checkpointDir), checkpointDir, cfg.timings)
+		}
+		var restoreErr error
+		if len(args) >= 2 && cfg.RestorePID != 0 {
+			restoreErr = fmt.Errorf("--restore-pid only applies to process checkpoints")
+			logErrorf("%v", restoreErr)
+		} else if len(args) >= 2 {
+			containerID := args[1]
+			setLogFields("container_id", containerID, "checkpoint_dir", checkpointDir)
+			logInfof("Restoring container %s from %s...", containerID, checkpointDir)
+			if restoreErr = restoreContainer(containerID, checkpointDir, cfg); restoreErr != nil {
+				logErrorf("restoring container: %v", restoreErr)
+			}
+		} else if isFilesystemOnlyCheckpoint(checkpointDir) {
+			restoreErr = fmt.Errorf("%s is a --fs-only checkpoint; give the name of the container to create", checkpointDir)
+			logErrorf("%v", restoreErr)
+		} else {
+			setLogFields("checkpoint_dir", checkpointDir)
+			logInfof("Restoring process from %s...", checkpointDir)
+			if restoreErr = restoreSimpleProcess(checkpointDir, cfg); restoreErr != nil {
+				logErrorf("restoring process: %v", restoreErr)
+			}
+		}
+		cleanup()
+		removeDownload()
+		if lock != nil {
+			lock.Release()
+		}
+		if restoreErr != nil {
+			os.Exit(1)
+		}
+		if eph != nil {
+			if err := removeEphemeral(eph.Path); err != nil {
+				logWarnf("%v", err)
+			}
+		}
+		cfg.timings.finish()
+		cfg.timings.report("Restore")
+		logInfof("Restore completed successfully!")
+		progress.done()
+		tracing.finish("")
+		pushgateway.push(true)
+		audit.record("")
+
+	case "sync":
+		fs := flag.NewFlagSet("sync", flag.ExitOnError)
+		parallel := fs.Int("parallel", 4, "number of files transferred concurrently")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 2 {
+			logErrorf("sync requires source and destination")
+			fmt.Println("Usage: docker-cr sync [options] <checkpoint-dir> <dest-dir|[user@]host:path>")
+			os.Exit(1)
+		}
+
+		if err := syncCheckpoint(args[0], args[1], *parallel); err != nil {
+			logErrorf("syncing checkpoint: %v", err)
+			os.Exit(1)
+		}
+
+	case "watch":
+		fs := flag.NewFlagSet("watch", flag.ExitOnError)
+		onSignal := fs.String("checkpoint-on-signal", "", "checkpoint when the process receives this signal")
+		cfg := &CheckpointConfig{}
+		fs.Var((*stringList)(&cfg.CriuArgs), "criu-args", "raw argument for a criu subprocess (repeatable)")
+		fs.BoolVar(&cfg.VerifyAfter, "verify-after-checkpoint", false, "verify the checkpoint after the dump and delete it if verification fails")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 2 || *onSignal == "" {
+			logErrorf("watch requires --checkpoint-on-signal, a container ID/PID and checkpoint directory")
+			fmt.Println("Usage: docker-cr watch --checkpoint-on-signal <signal> <container-id|pid> <checkpoint-dir>")
+			os.Exit(1)
+		}
+
+		sig, err := parseSignal(*onSignal)
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+		if err := watchAndCheckpoint(args[0], args[1], sig, cfg); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		logInfof("Checkpoint created successfully!")
+
+	case "bundle":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: docker-cr bundle create <container> <out.bundle|-> | restore <bundle|-> | inspect <bundle|->")
+			os.Exit(1)
+		}
+
+		var err error
+		switch os.Args[2] {
+		case "create":
+			fs := flag.NewFlagSet("bundle create", flag.ExitOnError)
+			cfg := &CheckpointConfig{}
+			fs.Var((*stringList)(&cfg.CriuArgs), "criu-args", "raw argument for a criu subprocess (repeatable)")
+			args := parseArgs(fs, os.Args[3:])
+			if len(args) < 2 {
+				fmt.Println("Usage: docker-cr bundle create [options] <container> <out.bundle|->")
+				os.Exit(1)
+			}
+			err = withOutputFile(args[1], func(w io.Writer) error {
+				return createBundle(args[0], w, cfg)
+			})
+		case "restore":
+			fs := flag.NewFlagSet("bundle restore", flag.ExitOnError)
+			cfg := &BundleRestoreConfig{}
+			fs.StringVar(&cfg.Name, "name", "", "name of the new container (default: the bundled container's name)")
+			fs.BoolVar(&cfg.DryRun, "dry-run", false, "list the resources that would be created and exit")
+			fs.Var((*stringList)(&cfg.Restore.CriuArgs), "criu-args", "raw argument for a criu subprocess (repeatable)")
+			args := parseArgs(fs, os.Args[3:])
+			if len(args) < 1 {
+				fmt.Println("Usage: docker-cr bundle restore [--name NAME] [--dry-run] <bundle|->")
+				os.Exit(1)
+			}
+			err = withInputFile(args[0], func(r io.Reader) error {
+				return restoreBundle(r, cfg)
+			})
+		case "inspect":
+			if len(os.Args) < 4 {
+				fmt.Println("Usage: docker-cr bundle inspect <bundle|->")
+				os.Exit(1)
+			}
+			err = withInputFile(os.Args[3], inspectBundle)
+		default:
+			logErrorf("unknown bundle command: %s", os.Args[2])
+			os.Exit(1)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "agent":
+		fs := flag.NewFlagSet("agent", flag.ExitOnError)
+		listen := fs.String("listen", defaultAgentAddress, "address to serve the agent API on")
+		var tlsFiles AgentTLS
+		fs.StringVar(&tlsFiles.CertFile, "tls-cert", "", "certificate the agent presents")
+		fs.StringVar(&tlsFiles.KeyFile, "tls-key", "", "key of --tls-cert")
+		fs.StringVar(&tlsFiles.CAFile, "tls-client-ca", "", "require client certificates signed by these CAs")
+		fs.BoolVar(&tlsFiles.Insecure, "insecure", false, "serve without TLS")
+		parseArgs(fs, os.Args[2:])
+
+		if err := runAgent(*listen, tlsFiles); err != nil {
+			logErrorf("agent: %v", err)
+			os.Exit(1)
+		}
+
+	case "remote-checkpoint", "remote-restore", "remote-list":
+		command := os.Args[1]
+		fs := flag.NewFlagSet(command, flag.ExitOnError)
+		address := fs.String("agent", "", "host:port of the docker-cr agent")
+		var tlsFiles AgentTLS
+		fs.StringVar(&tlsFiles.CAFile, "tls-ca", "", "CA certificates to verify the agent with (default: the system's)")
+		fs.StringVar(&tlsFiles.CertFile, "tls-cert", "", "client certificate, for an agent that requires one")
+		fs.StringVar(&tlsFiles.KeyFile, "tls-key", "", "key of --tls-cert")
+		fs.BoolVar(&tlsFiles.Insecure, "insecure", false, "connect without TLS")
+		stopAfterDump := fs.Bool("stop-after-dump", false, "stop the container after the dump")
+		compress := fs.Bool("compress", false, "gzip the checkpoint on the wire")
+		remoteDir := fs.String("remote-dir", "", "keep the checkpoint in this directory on the agent's host and register it there")
+		onAgent := fs.Bool("on-agent", false, "the checkpoint directory is on the agent's host")
+		container := fs.String("container", "", "only list checkpoints of this container")
+		args := parseArgs(fs, os.Args[2:])
+
+		if *address == "" {
+			logErrorf("%s requires --agent", command)
+			os.Exit(1)
+		}
+
+		var err error
+		switch command {
+		case "remote-checkpoint":
+			if len(args) < 2 {
+				fmt.Println("Usage: docker-cr remote-checkpoint --agent <host:port> [options] <container-id|pid> <local-dir>")
+				os.Exit(1)
+			}
+			err = remoteCheckpoint(*address, tlsFiles, &CheckpointRequest{
+				Target:        args[0],
+				StopAfterDump: *stopAfterDump,
+				Compress:      *compress,
+				CheckpointDir: *remoteDir,
+			}, args[1])
+		case "remote-restore":
+			if len(args) < 1 {
+				fmt.Println("Usage: docker-cr remote-restore --agent <host:port> [options] <checkpoint-dir> [container-id]")
+				os.Exit(1)
+			}
+			containerID := ""
+			if len(args) >= 2 {
+				containerID = args[1]
+			}
+			err = remoteRestore(*address, tlsFiles, args[0], containerID, *onAgent, *compress)
+		case "remote-list":
+			err = remoteListCheckpoints(*address, tlsFiles, *container)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "docker-checkpoints":
+		fs := flag.NewFlagSet("docker-checkpoints", flag.ExitOnError)
+		namespace := fs.String("namespace", "", "only list checkpoints created with this --namespace")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 1 {
+			fmt.Println("Usage: docker-cr docker-checkpoints [--namespace ns] <container>")
+			os.Exit(1)
+		}
+		if err := validateCheckpointNamespace(*namespace); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := listDockerCheckpoints(args[0], *namespace); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "analyze":
+		fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+		asJSON := fs.Bool("json", false, "print the analysis as JSON in the analysis.json schema")
+		compress := fs.Bool("compress", false, "estimate the size of a gzipped checkpoint stream too")
+		throughput := fs.Float64("assume-throughput", defaultDumpThroughput, "dump speed in MB/s for the estimate when the container has no checkpoint history")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 1 {
+			fmt.Println("Usage: docker-cr analyze [--json] [--compress] [--assume-throughput mbps] <container-id|pid>")
+			os.Exit(1)
+		}
+		if err := analyzeTarget(args[0], *asJSON, *compress, *throughput); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "show-log":
+		fs := flag.NewFlagSet("show-log", flag.ExitOnError)
+		sinceTime := fs.String("since-time", "", "only show lines logged after this many seconds since CRIU started")
+		tail := fs.Int("tail", 0, "only show the last n lines")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 1 {
+			fmt.Println("Usage: docker-cr show-log [--since-time t] [--tail n] <checkpoint-dir> [dump|restore]")
+			os.Exit(1)
+		}
+		which := "dump"
+		if len(args) > 1 {
+			which = args[1]
+		}
+		var since time.Duration
+		if *sinceTime != "" {
+			var err error
+			if since, err = parseLogTime(*sinceTime); err != nil {
+				logErrorf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		checkpointDir, err := resolveCheckpointDir(args[0])
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := showCRIULog(checkpointDir, which, since, *tail); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "convert":
+		if len(os.Args) < 5 {
+			logErrorf("convert requires a container, a Docker checkpoint name and an output directory")
+			fmt.Println("Usage: docker-cr convert <container> <checkpoint-name> <out-dir>")
+			os.Exit(1)
+		}
+
+		if err := convertDockerCheckpoint(os.Args[2], os.Args[3], os.Args[4]); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		logInfof("Converted checkpoint written to %s", os.Args[4])
+
+	case "verify":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: restore requires checkpoint directory")
-			fmt.Println("Usage: docker-cr restore <checkpoint-dir> [container-id]")
+			logErrorf("verify requires a checkpoint directory")
+			fmt.Println("Usage: docker-cr verify <checkpoint-dir>")
 			os.Exit(1)
 		}
-		checkpointDir := os.Args[2]
 
+		checkpointDir, err := resolveCheckpointDir(os.Args[2])
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		if err := verifyCheckpoint(checkpointDir); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		// A container gets a fresh network namespace; a process is restored
+		// into this one
+		if _, err := os.Stat(filepath.Join(checkpointDir, "container.meta")); os.IsNotExist(err) {
+			for _, conflict := range findPortConflicts(checkpointDir, os.Getpid()) {
+				logWarnf("port %s is already bound; restore will likely fail", conflict)
+			}
+		}
+		logInfof("Checkpoint %s verified", checkpointDir)
+
+	case "flatten":
+		if len(os.Args) < 3 {
+			logErrorf("flatten requires a delta checkpoint directory")
+			fmt.Println("Usage: docker-cr flatten <delta-dir> [out-dir]")
+			os.Exit(1)
+		}
+
+		outDir := ""
 		if len(os.Args) >= 4 {
-			containerID := os.Args[3]
-			fmt.Printf("Restoring container %s from %s...\n", containerID, checkpointDir)
-			if err := restoreContainer(containerID, checkpointDir); err != nil {
-				fmt.Printf("Error restoring container: %v\n", err)
+			outDir = os.Args[3]
+		}
+		if err := flattenCheckpoint(os.Args[2], outDir); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "diff":
+		if len(os.Args) < 4 {
+			logErrorf("diff requires a container ID/PID and checkpoint directory")
+			fmt.Println("Usage: docker-cr diff <container-id|pid> <checkpoint-dir>")
+			os.Exit(1)
+		}
+
+		if err := diffMappedFiles(os.Args[2], os.Args[3]); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "clean":
+		fs := flag.NewFlagSet("clean", flag.ExitOnError)
+		spec := fs.String("policy", "", "retention policy, e.g. 24h:all,7d:1/d,30d:1/w")
+		dryRun := fs.Bool("dry-run", false, "only print what would be removed")
+		args := parseArgs(fs, os.Args[2:])
+
+		if len(args) < 1 || *spec == "" {
+			logErrorf("clean requires a directory and --policy")
+			fmt.Println("Usage: docker-cr clean --policy <spec> [--dry-run] <parent-dir>")
+			os.Exit(1)
+		}
+
+		policy, err := parseRetentionPolicy(*spec)
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+		logInfof("Applying retention policy to %s:", args[0])
+		if err := applyRetention(args[0], policy, *dryRun); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "registry":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: docker-cr registry list [--container name] | show <id|path> | prune")
+			os.Exit(1)
+		}
+
+		var err error
+		switch os.Args[2] {
+		case "list", "ls":
+			fs := flag.NewFlagSet("registry list", flag.ExitOnError)
+			container := fs.String("container", "", "only list checkpoints of this container")
+			parseArgs(fs, os.Args[3:])
+			err = listRegistry(*container)
+		case "show":
+			if len(os.Args) < 4 {
+				fmt.Println("Usage: docker-cr registry show <id|path>")
 				os.Exit(1)
 			}
-		} else {
-			fmt.Printf("Restoring process from %s...\n", checkpointDir)
-			if err := restoreSimpleProcess(checkpointDir); err != nil {
-				fmt.Printf("Error restoring process: %v\n", err)
+			err = showRegistryEntry(os.Args[3])
+		case "prune":
+			err = pruneRegistry()
+		default:
+			logErrorf("unknown registry command: %s", os.Args[2])
+			os.Exit(1)
+		}
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "audit":
+		if len(os.Args) < 3 || os.Args[2] != "list" {
+			fmt.Println("Usage: docker-cr audit list [--since duration] [--container name]")
+			os.Exit(1)
+		}
+		fs := flag.NewFlagSet("audit list", flag.ExitOnError)
+		since := fs.String("since", "", "only list operations of the last duration, e.g. 24h or 7d")
+		container := fs.String("container", "", "only list operations on this container or PID")
+		parseArgs(fs, os.Args[3:])
+		var window time.Duration
+		if *since != "" {
+			var err error
+			if window, err = parseRetentionDuration(*since); err != nil {
+				logErrorf("--since: %v", err)
 				os.Exit(1)
 			}
 		}
-		fmt.Println("Restore completed successfully!")
+		if err := listAudit(window, *container); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+
+	case "doctor":
+		if err := runDoctor(); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
 
 	case "help", "-h", "--help":
 		printUsage()
 
 	default:
-		fmt.Printf("Unknown command: %s\n", command)
+		logErrorf("unknown command: %s", command)
 		printUsage()
 		os.Exit(1)
 	}
 }
 
+// withOutputFile calls fn with the file at path, or stdout for "-". Progress
+// output is redirected to stderr while writing to stdout. A partially written
+// file is removed if fn fails.
+func withOutputFile(path string, fn func(io.Writer) error) error {
+	if path == "-" {
+		out := os.Stdout
+		os.Stdout = humanStderr()
+		return fn(out)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// withInputFile calls fn with the file at path, or stdin for "-".
+func withInputFile(path string, fn func(io.Reader) error) error {
+	if path == "-" {
+		return fn(os.Stdin)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return fn(file)
+}
+
+// restoreTarget names what a restore brings back, like the checkpoint that
+// made it: the container, or the root PID of a process checkpoint.
+func restoreTarget(args []string, checkpointDir string) string {
+	if len(args) >= 2 {
+		return args[1]
+	}
+	if manifest, err := loadProcessManifest(checkpointDir); err == nil && manifest != nil && manifest.Root() != nil {
+		return strconv.Itoa(manifest.Root().PID)
+	}
+	return ""
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments in order.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a flag.Value accepting a byte count with an optional K, M or G
+// suffix (powers of 1024).
+type byteSize int64
+
+func (b *byteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *byteSize) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
 func printUsage() {
 	fmt.Println(`Docker Container & Process Checkpoint/Restore Tool
 
 Usage:
-  docker-cr <command> [arguments]
+  docker-cr [global options] <command> [arguments]
+
+Global options:
+  --log-format <text|json>  Write log records as plain text on stdout (the
+                            default) or as JSON lines on stderr, leaving
+                            stdout to reports and command output
+  --verbose                 Also write debug records, e.g. every CRIU
+                            notification and hook script exit code
 
 Commands:
   checkpoint, cp    Create a checkpoint of a running container or process
-                   Usage: docker-cr checkpoint <container-id|pid> <checkpoint-dir>
+                   Usage: docker-cr checkpoint [options] <container-id|pid> <checkpoint-dir>
+                          docker-cr checkpoint --ephemeral [options] <container-id|pid>
+
+                   Options:
+                     --checkpoint-dir-symlink  Point <parent>/latest at the new checkpoint
+                     --sync-to <dest>          Sync the checkpoint to <dest> after the dump
+                     --stream-to-gcs <gs://bucket/path>
+                                               Upload the checkpoint to Google Cloud
+                                               Storage after the dump, retrying failed
+                                               requests with exponential backoff
+                     --sync-parallel <n>       Parallel transfers for --sync-to,
+                                               --stream-to-gcs and --replicate-to
+                                               (default 4)
+                     --replicate-to <dest>     Copy the checkpoint to <dest> after the dump
+                                               (repeatable, destinations run in parallel)
+                     --replicate-policy <p>    "all" (default) fails unless every replica
+                                               succeeds, "any" needs one
+                     --compress                Gzip the stream when <checkpoint-dir> is "-"
+                     --criu-args <arg>         Extra raw criu argument (repeatable); runs
+                                               criu as a subprocess instead of over RPC
+                     --criu-service <socket>   Use a running "criu service" on <socket>;
+                                               starts criu as usual if there is none
+                     --log-level <n>           CRIU log verbosity, 1 (errors) to 4 (debug,
+                                               the default)
+                     --ignore-bpf              Only warn about eBPF file descriptors
+                     --ignore-fanotify         Only warn about fanotify file descriptors
+                     --checkpoint-fd-limit <n> Refuse to checkpoint a process with more
+                                               than <n> open file descriptors, listing
+                                               them by kind (default 10000, 0 for none)
+                     --force                   Checkpoint despite blocking issues in the
+                                               assessment
+                     --pre-dump-script <path>  Run <path> before CRIU dumps; a non-zero
+                                               exit aborts the checkpoint
+                     --post-dump-script <path> Run <path> once the images are written; a
+                                               non-zero exit fails the checkpoint
+                     --hook <phase>=<path>     Run <path> at a CRIU phase: pre-dump,
+                                               network-lock, network-unlock or post-dump
+                                               (repeatable, see Hook scripts)
+                     --hooks-dir <dir>         Also run the executables in <dir>/<phase>/
+                                               at each phase, in lexical order
+                     --hook-timeout <d>        Kill a hook script and its process group
+                                               after <d>, or <phase>=<d> for one phase
+                                               (repeatable, default 60s, 0 for none)
+                     --detach-tracer <sig>     Send <sig> to debuggers or other ptrace
+                                               tracers of the tree and wait for them to
+                                               detach, instead of failing
+                     --max-image-size <size>   Fail and delete the .img files the dump
+                                               wrote if they exceed <size> (e.g. 512M, 2G)
+                     --warn-image-size <size>  Warn if the .img files exceed <size>
+                     --ghost-limit <size>      Largest deleted file CRIU may copy into
+                                               the dump (CRIU's default is 1M)
+                     --memory-limit <size>     Run criu in a cgroup v2 with memory.max
+                                               set to <size>, removed after the dump
+                     --cgroup-hierarchy <mode> Cgroups CRIU dumps: "full" for the whole
+                                               tree, "cgroupns" for the cgroup namespace
+                                               root (default for containers) or "none"
+                     --network-lock <method>   Block the traffic of the dumped tree with
+                                               "iptables" or "nftables" (default: nft if
+                                               installed); "skip" does not lock
+                     --auto-ext-mnt-whitelist <paths>
+                                               Dump only these comma-separated mountpoints
+                                               as external, instead of every mount CRIU
+                                               detects
+                     --ext-mnt-blacklist <paths>
+                                               Never dump these mountpoints as external;
+                                               they are saved with the container
+                     --progress ndjson         Write progress events to stdout, one JSON
+                                               object per line (see Progress events);
+                                               other output goes to stderr
+                     --otel-endpoint <url>     Export an OpenTelemetry trace of the
+                                               operation to this OTLP/HTTP collector
+                     --pushgateway <url>       Push the duration, checkpoint size, freeze
+                                               time and result to a Prometheus
+                                               Pushgateway when the operation ends; a
+                                               failed push is only a warning
+                     --pushgateway-job <job>   Job of the pushed group (default docker-cr)
+                     --pushgateway-instance <i>
+                                               Instance of the pushed group (default the
+                                               hostname). Each run replaces the group of
+                                               its job, instance, container and operation
+                     --notify-slack <url>      Post failed checkpoints, with the end of
+                                               dump.log, to a Slack incoming webhook
+                     --notify-slack-on-success Also post successful checkpoints with
+                                               their duration and image count
+                     --retention <spec>        Apply a retention policy to the sibling
+                                               checkpoints afterwards (see clean)
+                     --fork-and-dump           Stop the container after the dump and
+                                               start <container>-fork from the checkpoint
+                     --tail-log                Print the CRIU dump log while it is written
+                     --checkpoint-env-file <path>
+                                               Record the process environment in
+                                               environ.json and copy it to <path>
+                     --redact-env <pattern>    Scrub the values of environment variables
+                                               matching <pattern> (e.g. '*TOKEN*',
+                                               repeatable) in process-manifest.json, which
+                                               records the cmdline, cwd, exe and
+                                               environment of every process; without it
+                                               common secret names are scrubbed
+                     --verify-after-checkpoint Verify the new checkpoint and delete it if
+                                               verification fails (see verify)
+                     --checkpoint-type <t>     full (default), pre or post. pre keeps only
+                                               memory pages (CRIU pre-dump), post keeps
+                                               everything but memory. Partial checkpoints
+                                               are for debugging and cannot be restored
+                     --pre-dump-count <n>      Copy memory in up to <n> CRIU pre-dump
+                                               rounds, into pre-dump-1/ ..., while the
+                                               process keeps running; the dump then
+                                               writes only pages dirtied since. Stops
+                                               early once a round finds under 1% of
+                                               pages dirty; metrics.json records the
+                                               rounds taken
+                     --namespace <ns>          Prefix Docker native checkpoint IDs with
+                                               <ns>- and leave other namespaces alone
+                     --require-docker-checkpoint
+                                               Checkpoint only through Docker's checkpoint
+                                               API, failing if the daemon's API is older
+                                               than 1.25 or experimental features are off,
+                                               instead of using CRIU directly
+                     --delta-from <dir>        Keep only files that differ from the earlier
+                                               checkpoint <dir>; restore reassembles them
+                     --shared-dir              Hold a .inprogress lock while dumping and write
+                                               a .complete marker for other hosts when done
+                     --break-stale-locks       Remove a lock whose holder is gone
+                     --work-dir-fd <fd>        Directory fd, opened by the caller, CRIU
+                                               writes dump.log to instead of the
+                                               checkpoint directory
+                     --keep-partial            Keep the .img and .log files of a failed
+                                               dump (they are removed by default)
+                     --export-oci <dir>        Also lay the checkpoint out as a runc
+                                               bundle in <dir>: config.json, the images
+                                               in checkpoint/ and rootfs/ linked to the
+                                               container's filesystem
+                     --as-container            When the PID target runs in a container,
+                                               checkpoint that container instead
+                     --consistent              Freeze the filesystem of the container's
+                                               writable layer while dumping; the
+                                               checkpoint directory must be elsewhere
+                     --tcp-iface <iface>       Interface in the target's network namespace
+                                               (bond, VLAN, macvlan) the TCP connections
+                                               are on; restore fails early without it
+                     --fs-only                 Only snapshot the container's overlay upper
+                                               directory, paused, without CRIU; restore
+                                               <dir> <name> creates <name> from the image
+                                               with the snapshot as its upper layer
+                     --ephemeral               Checkpoint into a new tmpfs mounted at
+                                               /run/docker-cr/<uuid>, without a
+                                               <checkpoint-dir>; restore it with
+                                               ephemeral:<uuid>
+                     --detach                  Return at once; the checkpoint finishes in
+                                               the background, logging to
+                                               <checkpoint-dir>.detach.log
+                     --pid-file <path>         With --detach, write the background PID here
+                     --completion-signal <sig> With --detach, signal the caller's parent
+                                               when the checkpoint ends (check the log for
+                                               its exit status)
+
+                   Use "-" as <checkpoint-dir> to write the checkpoint as a tar
+                   stream to stdout; progress is printed to stderr.
 
                    Examples:
                      docker-cr checkpoint nginx-container /tmp/checkpoint1
                      docker-cr checkpoint 12345 /tmp/checkpoint1
+                     docker-cr checkpoint --checkpoint-dir-symlink 12345 /tmp/checkpoints/run1
+                     docker-cr checkpoint --compress web - | ssh host 'cat > web.tar.gz'
 
   restore, rs      Restore a container or process from a checkpoint
-                   Usage: docker-cr restore <checkpoint-dir> [container-id]
+                   Usage: docker-cr restore [options] <checkpoint-dir> [container-id]
+                          docker-cr restore [options] ephemeral:<uuid> [container-id]
+
+                   Options:
+                     --criu-args <arg>         Extra raw criu argument (repeatable); runs
+                                               criu as a subprocess instead of over RPC
+                     --criu-service <socket>   Use a running "criu service" on <socket>;
+                                               starts criu as usual if there is none
+                     --log-level <n>           CRIU log verbosity, 1 (errors) to 4 (debug,
+                                               the default)
+                     --latest <container>      Restore the newest registered checkpoint
+                                               of <container>
+                     --restore-from-gcs <gs://bucket/path>
+                                               Download the checkpoint from Google Cloud
+                                               Storage to a temporary directory, verify
+                                               it and restore it; <checkpoint-dir> is
+                                               left out
+                     --restore-into-existing   Restore into the stopped container, keeping
+                                               its Docker ID, instead of recreating it
+                     --new-container-name <name>
+                                               Create the restored container as <name>;
+                                               <container-id> is left as it is. The
+                                               checkpoint metadata then names the new
+                                               container
+                     --preserve-checkpoint     Restore from a temporary copy. Without it
+                                               restore writes restore.log into the
+                                               checkpoint directory; the images themselves
+                                               are never modified
+                     --cleanup-after-restore   Unmount the tmpfs of an --ephemeral
+                                               checkpoint after a successful restore
+                     --dry-run                 Check the checkpoint, metadata, image, CRIU
+                                               version, CPU, files and ports without
+                                               restoring; print what restore would do and
+                                               exit non-zero if a precondition fails
+                     --progress ndjson         Write progress events to stdout, one JSON
+                                               object per line (see Progress events);
+                                               other output goes to stderr
+                     --otel-endpoint <url>     Export an OpenTelemetry trace of the
+                                               operation to this OTLP/HTTP collector
+                     --pushgateway <url>       Push the duration, checkpoint size, freeze
+                                               time and result to a Prometheus
+                                               Pushgateway when the operation ends; a
+                                               failed push is only a warning
+                     --pushgateway-job <job>   Job of the pushed group (default docker-cr)
+                     --pushgateway-instance <i>
+                                               Instance of the pushed group (default the
+                                               hostname). Each run replaces the group of
+                                               its job, instance, container and operation
+                     --hook-timeout <d>        Kill a hook script and its process group
+                                               after <d>, or <phase>=<d> for one phase
+                                               (repeatable, default 60s, 0 for none;
+                                               --restore-hook-timeout is the old name)
+                     --pre-restore-script <path>
+                                               Run <path> before CRIU restores; a
+                                               non-zero exit aborts the restore
+                     --hook <phase>=<path>     Run <path> at a CRIU phase: pre-restore,
+                                               network-lock, setup-namespaces,
+                                               post-setup-namespaces, post-restore,
+                                               network-unlock or post-resume
+                                               (repeatable, see Hook scripts)
+                     --hooks-dir <dir>         Also run the executables in <dir>/<phase>/
+                                               at each phase, in lexical order
+                     --restore-hostname <name> Give the restored container this hostname
+                     --cgroup-leave            Put the restored process back into the
+                                               cgroups it was dumped from, keeping its
+                                               container's limits (CRIU soft mode)
+                     --stdin-pid               Read a PID from stdin and restore the
+                                               process into its net, ipc and uts
+                                               namespaces, e.g. from a pipeline
+                     --ignore-port-conflicts   Restore even if ports the checkpoint had
+                                               bound (UDP or TCP listen) are in use
+                     --restore-pid <pid>       Restore the process onto <pid>, as a
+                                               sibling of CRIU. CRIU always reuses the
+                                               checkpointed PID, so <pid> must be that
+                                               PID and unused. Needs Linux 5.5+ or a
+                                               writable ns_last_pid, and CAP_SYS_ADMIN
+                                               or CAP_CHECKPOINT_RESTORE
+                     --mnt-ns-file <path>      Restore into the mount namespace behind
+                                               <path>, e.g. /proc/<pid>/ns/mnt
+                     --strict-version-check    Fail if the Docker, API or containerd major
+                                               version differs from checkpoint time
+                                               (otherwise only warn)
+                     --redirect-stdout <file>  Append the restored process's stdout to <file>
+                     --redirect-stderr <file>  Append the restored process's stderr to <file>
+                     --show-env                Print the environment recorded at checkpoint
+                                               time (CRIU restores it with process memory)
+                     --shared-dir              Require the .complete marker, verify the
+                                               manifest and hold a .restoring lock
+                     --wait-for-complete <d>   Wait up to <d> (e.g. 10m) for the marker;
+                                               implies --shared-dir
+                     --break-stale-locks       Remove a lock whose holder is gone
 
                    Examples:
                      docker-cr restore /tmp/checkpoint1
                      docker-cr restore /tmp/checkpoint1 nginx-container
+                     docker-cr restore /tmp/checkpoints/latest
+                     docker-cr restore --latest nginx-container
+                     docker-cr restore --restore-from-gcs gs://backups/web/cp1 web
+
+  sync             Mirror a checkpoint, sending only files whose hash changed
+                   Usage: docker-cr sync [--parallel n] <checkpoint-dir> <dest>
+
+                   <dest> is a local directory, an ssh target ([user@]host:path)
+                   or a Google Cloud Storage location (gs://bucket/path).
+                   Files removed from the source are removed from <dest>, and
+                   <dest> is verified against checksums.sha256 afterwards.
+
+                   Examples:
+                     docker-cr sync /tmp/checkpoint1 /mnt/backup/checkpoint1
+                     docker-cr sync /tmp/checkpoint1 root@node2:/var/lib/checkpoints/web
+
+  watch            Wait for a signal, then checkpoint
+                   Usage: docker-cr watch --checkpoint-on-signal <signal> <container-id|pid> <checkpoint-dir>
+
+                   Attaches to the process (the container's init process) with
+                   ptrace and checkpoints it as soon as it receives <signal>,
+                   e.g. SIGUSR2. The signal is still delivered to the process.
+
+                   Options:
+                     --checkpoint-on-signal <signal>
+                                               Signal name or number to wait for
+                     --criu-args <arg>         Extra raw criu argument (repeatable)
+                     --verify-after-checkpoint Verify the checkpoint and delete it if
+                                               verification fails
+
+                   Examples:
+                     docker-cr watch --checkpoint-on-signal SIGUSR2 web /tmp/checkpoint1
+
+  bundle           Self-contained archive of a container for cold storage
+                   Usage: docker-cr bundle create [options] <container> <out.bundle|->
+                          docker-cr bundle restore [options] <bundle|->
+                          docker-cr bundle inspect <bundle|->
+
+                   A bundle is a tar holding bundle.json (container config and
+                   tool versions), the CRIU images, the exported root filesystem,
+                   a tar of each named volume and a checksums.sha256 over all of
+                   it. inspect summarizes and verifies a bundle without
+                   extracting it. restore imports the root filesystem as an
+                   image, recreates and fills the volumes, creates the container
+                   and restores the CRIU images into it; if any step fails,
+                   everything it created is removed again.
+
+                   Restore options:
+                     --name <name>             Name of the new container
+                     --dry-run                 List what would be created and exit
+                     --criu-args <arg>         Extra raw criu argument (repeatable)
+
+                   Examples:
+                     docker-cr bundle create web /archive/web.bundle
+                     docker-cr bundle inspect /archive/web.bundle
+                     docker-cr bundle restore --name web2 /archive/web.bundle
+
+  agent            Checkpoint and restore on this host for docker-cr elsewhere
+                   Usage: docker-cr agent [--listen addr] (--tls-cert file --tls-key file | --insecure)
+
+                   Serves the gRPC API in agent.proto to remote-checkpoint,
+                   remote-restore and remote-list. Anyone who can reach the
+                   agent can checkpoint and restore on its host, so it needs
+                   a certificate, or --insecure to serve in the clear. With
+                   --tls-client-ca it also requires client certificates.
+                   Operations run one at a time. SIGINT or SIGTERM stops it
+                   once the running operation ends.
+
+                   Options:
+                     --listen <addr>           Address to listen on (default: :5000)
+                     --tls-cert <file>         Certificate the agent presents
+                     --tls-key <file>          Key of --tls-cert
+                     --tls-client-ca <file>    Require client certificates signed by
+                                               these CAs
+                     --insecure                Serve without TLS
+
+  remote-checkpoint
+                   Checkpoint a container or process on an agent's host
+                   Usage: docker-cr remote-checkpoint --agent <host:port> [options] <container-id|pid> <local-dir>
+
+                   The agent dumps it and streams the checkpoint back, which is
+                   unpacked into <local-dir> and verified. The agent keeps no
+                   copy unless --remote-dir is given.
+
+  remote-restore   Restore a checkpoint on an agent's host
+                   Usage: docker-cr remote-restore --agent <host:port> [options] <checkpoint-dir> [container-id]
+
+                   Sends the local <checkpoint-dir> to the agent, which
+                   verifies and restores it; with --on-agent, <checkpoint-dir>
+                   is already on the agent's host. Without a container ID a
+                   process checkpoint is restored.
+
+  remote-list      List the checkpoints in an agent host's registry
+                   Usage: docker-cr remote-list --agent <host:port> [--container name]
+
+                   Remote options:
+                     --agent <host:port>       The docker-cr agent to use
+                     --tls-ca <file>           CA certificates to verify the agent with
+                     --tls-cert <file>         Client certificate, for an agent that
+                                               requires one
+                     --tls-key <file>          Key of --tls-cert
+                     --insecure                Connect without TLS
+                     --stop-after-dump         Stop the container after the dump
+                     --compress                Gzip the checkpoint on the wire
+                     --remote-dir <dir>        Keep the checkpoint in <dir> on the
+                                               agent's host and register it there
+                     --on-agent                <checkpoint-dir> is on the agent's host
+                     --container <name>        Only list checkpoints of this container
+
+                   Examples:
+                     docker-cr agent --tls-cert agent.pem --tls-key agent-key.pem
+                     docker-cr remote-checkpoint --agent node2:5000 web /tmp/web-ckpt
+                     docker-cr remote-restore --agent node3:5000 /tmp/web-ckpt web
+                     docker-cr remote-list --agent node2:5000
+
+  docker-checkpoints
+                   List the Docker native checkpoints docker-cr created
+                   Usage: docker-cr docker-checkpoints [--namespace ns] <container>
+
+  analyze          Show what docker-cr detects about a process before a dump
+                   and score how likely a checkpoint is to succeed: a verdict
+                   of OK, WARN or FAIL and each finding as blocking,
+                   needs-option (with the flag that handles it) or
+                   informational. checkpoint runs the same assessment and
+                   stops on blocking findings unless --force is given. In
+                   --json output the assessment has a "schema" version
+                   Usage: docker-cr analyze [--json] [--compress] [--assume-throughput mbps] <container-id|pid>
+
+                   The same analysis is saved as analysis.json in every
+                   checkpoint; restore uses it to repeat the dump's CRIU
+                   options (tcp-established, ext-unix-sk, shell-job).
+
+                   It ends with an estimate of the checkpoint size and how
+                   long the container will be frozen. The speed is the median
+                   of the container's registered checkpoints, or
+                   --assume-throughput (default 100 MB/s) without any.
+
+                   Last comes a score from 0 to 100 with the issues found,
+                   most severe first, and what to do about each. Blockers
+                   make the dump fail unless the flag named overrides them.
+
+  show-log         Print a checkpoint's CRIU log with colored severity levels
+                   Usage: docker-cr show-log [options] <checkpoint-dir> [dump|restore]
+
+                   Options:
+                     --since-time <t>          Skip lines logged before <t> seconds
+                                               after CRIU started (e.g. 1.25 or 1.25s)
+                     --tail <n>                Show only the last <n> lines
+
+                   Errors are red, warnings yellow, continuation lines grey.
+                   Colors are only used on a terminal and without NO_COLOR.
+
+  convert          Copy a Docker native checkpoint out of Docker's storage
+                   Usage: docker-cr convert <container> <checkpoint-name> <out-dir>
+
+                   Writes the raw CRIU images with container.meta and a
+                   manifest, so <out-dir> can be used with restore and verify
+                   without Docker's checkpoint API.
+
+                   Examples:
+                     docker-cr convert web checkpoint-3f2a1b-1700000000 /tmp/web-cp
+
+  verify           Check that a checkpoint is complete and intact
+                   Usage: docker-cr verify <checkpoint-dir>
+
+                   Checks for the required CRIU images, verifies every file
+                   against checksums.sha256 and, for delta checkpoints, every
+                   parent in the chain. For a process checkpoint it also
+                   warns about ports it had bound that are now taken here.
+
+  flatten          Turn a delta checkpoint into a standalone one
+                   Usage: docker-cr flatten <delta-dir> [out-dir]
+
+                   Without <out-dir> the delta is replaced in place. Every
+                   parent in the chain is verified first.
+
+  diff             Compare the files mapped by a running container or process
+                   with those recorded in a checkpoint
+                   Usage: docker-cr diff <container-id|pid> <checkpoint-dir>
+
+                   Prints "+" for files mapped only now, "-" for files mapped
+                   only at checkpoint time and "M" for files whose content
+                   changed, based on mapped-files.sha256 in the checkpoint.
+
+                   Examples:
+                     docker-cr diff nginx-container /tmp/checkpoint1
+
+  clean            Prune checkpoint directories with a retention policy
+                   Usage: docker-cr clean --policy <spec> [--dry-run] <parent-dir>
+
+                   <spec> is a comma-separated list of <window>:<keep> rules where
+                   <keep> is "all" or "<n>/<unit>" (unit h, d or w). Checkpoints
+                   older than every window are removed. A checkpoint directory
+                   containing a .pin file is never removed.
+
+                   Examples:
+                     docker-cr clean --policy 24h:all,7d:1/d,30d:1/w /var/checkpoints
+                     docker-cr clean --policy 6h:all --dry-run /var/checkpoints
+
+  registry         Query the index of checkpoints created on this host
+                   Usage: docker-cr registry list [--container name]
+                          docker-cr registry show <id|path>
+                          docker-cr registry prune
+
+                   Every successful checkpoint is recorded in
+                   /var/lib/docker-cr/registry.json. Entries whose directory was
+                   deleted are shown as stale; prune removes them.
+
+  audit            Query the log of every checkpoint and restore
+                   Usage: docker-cr audit list [--since <duration>] [--container <name>]
+
+                   Every checkpoint and restore appends a line to
+                   /var/log/docker-cr/audit.jsonl when it ends: the time, the
+                   invoking user (and SUDO_USER), the command line with secrets
+                   redacted, the container or PID, the checkpoint path, the
+                   result and the duration. Failing to write it is a warning.
+                   <duration> is e.g. 24h, 7d or 2w.
+
+                   Examples:
+                     docker-cr audit list --since 24h --container web
+
+  doctor           Report the kernel, CRIU version and huge page pools of
+                   this host
+                   Usage: docker-cr doctor
 
   help, -h         Show this help message
 
+Environment:
+  DOCKER_CR_CHECKPOINT_DIR  <checkpoint-dir> for checkpoint and restore when
+                            it is left out
+  DOCKER_CR_LOG_LEVEL       default of --log-level
+  DOCKER_CR_LOG_FORMAT      default of --log-format
+  DOCKER_CR_VERBOSE         --verbose if set
+  DOCKER_CR_REGISTRY        path of the checkpoint registry
+  DOCKER_CR_AUDIT_LOG       path of the audit log
+  GOOGLE_APPLICATION_CREDENTIALS
+                            credentials for gs:// locations; without it the
+                            Google Application Default Credentials apply:
+                            gcloud's, then the GCE service account
+  STORAGE_EMULATOR_HOST     send gs:// requests to this GCS emulator,
+                            unauthenticated
+  OTEL_EXPORTER_OTLP_ENDPOINT
+                            default of --otel-endpoint; the other standard
+                            OTEL_* variables apply too. Without an endpoint
+                            nothing is traced
+  TRACEPARENT, TRACESTATE   W3C trace context of a traced caller; the
+                            operation's spans continue its trace
+
+  Command-line arguments always take precedence over the environment.
+
+Progress events:
+  With --progress ndjson, checkpoint and restore write one JSON object per
+  line to stdout. Every event has "time", "operation_id" (a UUID per run),
+  "operation" ("checkpoint" or "restore") and "type":
+  start          the operation began on "target"
+  phase-start    a timed "phase" began, e.g. criu-dump or freeze
+  phase-end      a "phase" ended after "seconds"
+  notify         CRIU sent the notification "phase", e.g. PreDump
+  bytes          the checkpoint images add up to "bytes" so far
+  retry          the operation is tried another way; "message" says why
+  warning        a warning, in "message"
+  error          an error, in "message"; the command then exits non-zero
+  done           the operation succeeded after "seconds"
+
+  Example:
+  {"time":"2024-05-02T09:14:03.120Z","operation_id":"7c1e...","operation":"checkpoint","type":"start","target":"web"}
+  {"time":"2024-05-02T09:14:03.410Z","operation_id":"7c1e...","operation":"checkpoint","type":"phase-start","phase":"criu-dump"}
+  {"time":"2024-05-02T09:14:03.452Z","operation_id":"7c1e...","operation":"checkpoint","type":"notify","phase":"PreDump"}
+  {"time":"2024-05-02T09:14:03.452Z","operation_id":"7c1e...","operation":"checkpoint","type":"phase-start","phase":"freeze"}
+  {"time":"2024-05-02T09:14:04.411Z","operation_id":"7c1e...","operation":"checkpoint","type":"bytes","bytes":52428800}
+  {"time":"2024-05-02T09:14:04.980Z","operation_id":"7c1e...","operation":"checkpoint","type":"notify","phase":"PostDump"}
+  {"time":"2024-05-02T09:14:04.980Z","operation_id":"7c1e...","operation":"checkpoint","type":"phase-end","phase":"freeze","seconds":1.528}
+  {"time":"2024-05-02T09:14:04.981Z","operation_id":"7c1e...","operation":"checkpoint","type":"phase-end","phase":"criu-dump","seconds":1.571}
+  {"time":"2024-05-02T09:14:05.302Z","operation_id":"7c1e...","operation":"checkpoint","type":"done","seconds":2.182}
+
+Hook scripts:
+  A failing --hook script aborts the checkpoint or restore, except at
+  post-resume, where it is only a warning. With --hooks-dir, e.g.
+  /etc/docker-cr/hooks.d, the executables in its pre-dump/, post-restore/,
+  ... subdirectories run after the --hook script of the phase, in lexical
+  order; hidden and non-executable files are skipped. The first to fail
+  stops the rest of its phase. A script still running after --hook-timeout
+  is killed with its process group, which counts as a failure. What a
+  script prints goes to the log, a record per line, keeping the last
+  64 KiB of each run. --pre-dump-script, --post-dump-script and
+  --pre-restore-script are short for --hook pre-dump=, post-dump= and
+  pre-restore=. Hooks run with these variables set in their environment:
+  DOCKER_CR_PHASE                CRIU notification, e.g. PreDump or PostResume
+  DOCKER_CR_MODE                 "container" or "process"
+  DOCKER_CR_PID                  PID of the dumped process tree's root
+  DOCKER_CR_CONTAINER_ID         ID of the container, empty for a process
+  DOCKER_CR_CONTAINER_NAME       name of the container, empty for a process
+  DOCKER_CR_IMAGE                image of the container, empty for a process
+  DOCKER_CR_CHECKPOINT_DIR       absolute path of the checkpoint directory;
+                                 docker-cr run from the hook defaults to it
+  DOCKER_CR_HOOK_CHECKPOINT_DIR  the same path, kept when the hook changes
+                                 DOCKER_CR_CHECKPOINT_DIR for a docker-cr
+  DOCKER_CR_RESTORED_PID         PID of the restored root, from post-restore on
+
 Requirements:
   - CRIU must be installed on your system (apt install criu)
   - Docker must be running with experimental features enabled
@@ -117,4 +1865,4 @@ Notes:
   - The tool automatically detects TCP connections and Unix sockets
   - Processes are kept running during checkpoint by default
   - Comprehensive logging is provided for debugging`)
-}
\ No newline at end of file
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestFile lists the SHA-256 of every file in a checkpoint directory in
+// sha256sum(1) format so it can also be checked with "sha256sum -c".
+const manifestFile = "checksums.sha256"
+
+// writeManifest hashes every file below checkpointDir and writes the result
+// to checksums.sha256 in the same directory.
+func writeManifest(checkpointDir string) (map[string]string, error) {
+	hashes, err := hashCheckpointFiles(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeChecksums(filepath.Join(checkpointDir, manifestFile), hashes); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// writeChecksums writes hashes to path in sha256sum(1) format, sorted by name.
+func writeChecksums(path string, hashes map[string]string) error {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", hashes[name], name)
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// readManifest parses a checksums.sha256 file into a map of relative path to
+// hex-encoded hash.
+func readManifest(manifestPath string) (map[string]string, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseManifest(file)
+}
+
+func parseManifest(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 || len(parts[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("malformed manifest line: %q", line)
+		}
+		hashes[parts[1]] = parts[0]
+	}
+
+	return hashes, scanner.Err()
+}
+
+// verifyManifest recomputes the hashes of checkpointDir and compares them to
+// its manifest. Files added after the manifest was written (restore.log, for
+// instance) are ignored, as are files a delta checkpoint takes from its parent.
+func verifyManifest(checkpointDir string) error {
+	expected, err := readManifest(filepath.Join(checkpointDir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	actual, err := hashCheckpointFiles(checkpointDir)
+	if err != nil {
+		return err
+	}
+
+	delta := isDeltaCheckpoint(checkpointDir)
+
+	var problems []string
+	for name, hash := range expected {
+		got, ok := actual[name]
+		if !ok {
+			if delta {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("missing: %s", name))
+		} else if got != hash {
+			problems = append(problems, fmt.Sprintf("checksum mismatch: %s", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("manifest verification failed:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// hashCheckpointFiles returns the hex-encoded SHA-256 of every regular file
+// below dir, keyed by slash-separated path relative to dir. The manifest
+// itself and shared-dir coordination files are skipped.
+func hashCheckpointFiles(dir string) (map[string]string, error) {
+	sums, err := hashDirectory(dir, defaultHashWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash checkpoint files: %w", err)
+	}
+
+	hashes := make(map[string]string, len(sums))
+	for name, sum := range sums {
+		if name == manifestFile || isCoordinationFile(name) {
+			continue
+		}
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+
+	return hashes, nil
+}
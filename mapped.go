@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"github.com/docker/docker/client"
+	"google.golang.org/protobuf/proto"
+)
+
+// mappedFilesManifest records the SHA-256 of every file the dumped process
+// tree had mapped, keyed by its path inside the process's root. "docker-cr
+// diff" compares the running container against it.
+const mappedFilesManifest = "mapped-files.sha256"
+
+// listMappedFiles returns the distinct file paths in /proc/<pid>/maps.
+// Anonymous and special mappings ([heap], [vdso], ...) and deleted files are
+// left out.
+func listMappedFiles(pid int) ([]string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory maps of %d: %w", pid, err)
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.TrimSpace(fields[5])
+		if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, " (deleted)") {
+			continue
+		}
+		seen[path] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// hashMappedFiles hashes the files mapped by pid through /proc/<pid>/root, so
+// paths resolve inside the container's mount namespace. Files that can no
+// longer be opened are skipped.
+func hashMappedFiles(pid int) (map[string]string, error) {
+	paths, err := listMappedFiles(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	hashes := make(map[string]string, len(paths))
+	for _, path := range paths {
+		sum, err := hashFileSHA256(filepath.Join(root, path))
+		if err != nil {
+			continue
+		}
+		hashes[path] = hex.EncodeToString(sum[:])
+	}
+
+	return hashes, nil
+}
+
+// recordMappedFiles writes mapped-files.sha256 for pid into checkpointDir.
+func recordMappedFiles(pid int, checkpointDir string) error {
+	hashes, err := hashMappedFiles(pid)
+	if err != nil {
+		return err
+	}
+
+	if err := writeChecksums(filepath.Join(checkpointDir, mappedFilesManifest), hashes); err != nil {
+		return fmt.Errorf("failed to write %s: %w", mappedFilesManifest, err)
+	}
+	logInfof("Recorded checksums of %d mapped files", len(hashes))
+
+	return nil
+}
+
+// resolveTargetPID returns target itself if it is a PID, otherwise the PID of
+// the running container it names.
+func resolveTargetPID(target string) (int, error) {
+	if pid, err := strconv.Atoi(target); err == nil {
+		return pid, nil
+	}
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	info, err := dockerClient.ContainerInspect(context.Background(), target)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if !info.State.Running {
+		return 0, fmt.Errorf("container %s is not running", target)
+	}
+
+	return info.State.Pid, nil
+}
+
+// diffMappedFiles compares the files currently mapped by target against the
+// ones recorded in checkpointDir and prints one line per difference:
+// "+" mapped now but not at checkpoint time, "-" the reverse, "M" changed.
+func diffMappedFiles(target, checkpointDir string) error {
+	recorded, err := readManifest(filepath.Join(checkpointDir, mappedFilesManifest))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s has no %s; it was created by an older docker-cr", checkpointDir, mappedFilesManifest)
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", mappedFilesManifest, err)
+	}
+
+	pid, err := resolveTargetPID(target)
+	if err != nil {
+		return err
+	}
+
+	current, err := hashMappedFiles(pid)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for path, hash := range current {
+		old, ok := recorded[path]
+		switch {
+		case !ok:
+			lines = append(lines, "+ "+path)
+		case old != hash:
+			lines = append(lines, "M "+path)
+		}
+	}
+	for path := range recorded {
+		if _, ok := current[path]; !ok {
+			lines = append(lines, "- "+path)
+		}
+	}
+
+	// Sort by path, not by marker
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+
+	fmt.Printf("--- %s (%d mapped files)\n", checkpointDir, len(recorded))
+	label := fmt.Sprintf("pid %d", pid)
+	if target != strconv.Itoa(pid) {
+		label = target + " " + label
+	}
+	fmt.Printf("+++ %s (%d mapped files)\n", label, len(current))
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	if len(lines) == 0 {
+		fmt.Println("No changes")
+	}
+
+	return nil
+}
+
+// MappedFile is one file-backed mapping recorded in analysis.json.
+type MappedFile struct {
+	// Path is the path inside the process's mount namespace
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Mount is the mount point the file lives on, MountKind classifies it:
+	// "rootfs", "volume", "bind", "tmpfs" or "other"
+	Mount     string `json:"mount"`
+	MountKind string `json:"mount_kind"`
+	// Deleted files only exist in the dump, as CRIU ghost files
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// mountEntry is the part of a /proc/<pid>/mountinfo line used to classify
+// mapped files and resolve watches.
+type mountEntry struct {
+	id         int
+	dev        string // major:minor
+	root       string
+	mountPoint string
+	fsType     string
+}
+
+// analyzeMappedFiles lists the file-backed mappings of pid with their size and
+// the mount they live on. Sizes are taken through /proc/<pid>/map_files so
+// deleted files can be measured too.
+func analyzeMappedFiles(pid int) ([]MappedFile, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory maps of %d: %w", pid, err)
+	}
+	defer file.Close()
+
+	mounts := readMountInfo(pid)
+
+	seen := make(map[string]bool)
+	var mapped []MappedFile
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		path := strings.TrimSpace(fields[5])
+		if !strings.HasPrefix(path, "/") || seen[path] {
+			continue
+		}
+		if strings.HasPrefix(path, "/SYSV") || strings.HasPrefix(path, "/memfd:") {
+			// Not files; see analyzeSharedMemory
+			continue
+		}
+		seen[path] = true
+
+		mf := MappedFile{Path: path}
+		if strings.HasSuffix(path, " (deleted)") {
+			mf.Path = strings.TrimSuffix(path, " (deleted)")
+			mf.Deleted = true
+		}
+		if info, err := os.Stat(fmt.Sprintf("/proc/%d/map_files/%s", pid, fields[0])); err == nil {
+			mf.Size = info.Size()
+		}
+		if m := mountFor(mounts, mf.Path); m != nil {
+			mf.Mount = m.mountPoint
+			mf.MountKind = classifyMount(m)
+		}
+		mapped = append(mapped, mf)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(mapped, func(i, j int) bool { return mapped[i].Path < mapped[j].Path })
+	return mapped, nil
+}
+
+func readMountInfo(pid int) []mountEntry {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return nil
+	}
+
+	var mounts []mountEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		// id parent major:minor root mount-point options [optional...] - fstype source super-options
+		fields := strings.Fields(line)
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		id, _ := strconv.Atoi(fields[0])
+		mounts = append(mounts, mountEntry{id: id, dev: fields[2], root: fields[3], mountPoint: fields[4], fsType: fields[sep+1]})
+	}
+	return mounts
+}
+
+// mountFor returns the mount with the longest mount point containing path.
+// Later entries win ties because they are mounted on top.
+func mountFor(mounts []mountEntry, path string) *mountEntry {
+	var best *mountEntry
+	for i := range mounts {
+		m := &mounts[i]
+		if m.mountPoint != "/" && path != m.mountPoint && !strings.HasPrefix(path, m.mountPoint+"/") {
+			continue
+		}
+		if best == nil || len(m.mountPoint) >= len(best.mountPoint) {
+			best = m
+		}
+	}
+	return best
+}
+
+func classifyMount(m *mountEntry) string {
+	switch {
+	case m.mountPoint == "/":
+		return "rootfs"
+	case strings.Contains(m.root, "/volumes/") && strings.HasSuffix(m.root, "/_data"):
+		return "volume"
+	case m.fsType == "tmpfs":
+		return "tmpfs"
+	case m.fsType == "proc" || m.fsType == "sysfs" || m.fsType == "devtmpfs":
+		return "other"
+	default:
+		return "bind"
+	}
+}
+
+// applyMappedFileOptions adjusts the dump for the files pid has mapped.
+// Deleted files are dumped as ghost files, so the ghost limit must cover the
+// largest of them; files on bind mounts and volumes need CRIU to treat those
+// mounts as external, which only matters in a separate mount namespace.
+func applyMappedFileOptions(pid int, mapped []MappedFile, opts *rpc.CriuOpts) {
+	var largestGhost int64
+	external := false
+	for _, mf := range mapped {
+		if mf.Deleted && mf.Size > largestGhost {
+			largestGhost = mf.Size
+		}
+		if mf.MountKind == "bind" || mf.MountKind == "volume" {
+			external = true
+		}
+	}
+
+	if largestGhost > 0 && largestGhost <= math.MaxUint32 && uint32(largestGhost) > opts.GetGhostLimit() {
+		logInfof("Raising ghost limit to %d bytes for deleted mapped files", largestGhost)
+		opts.GhostLimit = proto.Uint32(uint32(largestGhost))
+	}
+
+	if external && opts.AutoExtMnt == nil && !sameNamespace(pid, "mnt") {
+		logInfof("Mapped files on bind mounts or volumes: treating those mounts as external")
+		opts.AutoExtMnt = proto.Bool(true)
+	}
+}
+
+// printMappedFiles prints the mapped files of an analysis.
+func printMappedFiles(mapped []MappedFile) {
+	fmt.Printf("  Mapped files: %d\n", len(mapped))
+	for _, mf := range mapped {
+		note := mf.MountKind
+		if mf.Mount != "" && mf.Mount != "/" {
+			note += " " + mf.Mount
+		}
+		if mf.Deleted {
+			note += ", deleted"
+		}
+		fmt.Printf("    %10s  %s (%s)\n", formatSize(mf.Size), mf.Path, note)
+	}
+}
+
+// verifyMappedFiles checks, before CRIU runs, that every file the dumped
+// process had mapped exists below root with its recorded size. CRIU refuses
+// to restore a mapping whose file changed size, with a much less clear error.
+func verifyMappedFiles(checkpointDir, root string) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil {
+		// Older checkpoints carry no list to check against
+		return nil
+	}
+
+	var problems []string
+	for _, mf := range info.MappedFiles {
+		if mf.Deleted {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(root, mf.Path))
+		if err != nil {
+			problems = append(problems, "missing: "+mf.Path)
+		} else if mf.Size > 0 && stat.Size() != mf.Size {
+			problems = append(problems, fmt.Sprintf("size changed: %s (%d -> %d bytes)", mf.Path, mf.Size, stat.Size()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("mapped files do not match the checkpoint:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
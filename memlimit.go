@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7"
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+)
+
+// cgroupRoot is where the unified (v2) cgroup hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// memoryLimitedCriu runs the criu swrk process of a criuRunner in a cgroup
+// of its own with memory.max set, so that a large dump OOM-kills CRIU rather
+// than something else on the host.
+type memoryLimitedCriu struct {
+	criuRunner
+	limit  int64
+	cgroup string
+}
+
+// limitCriuMemory wraps c so its criu process is limited to limit bytes.
+// A running CRIU service is not ours to move and is left alone.
+func limitCriuMemory(c criuRunner, limit int64) criuRunner {
+	if limit <= 0 {
+		return c
+	}
+	if _, ok := c.(*criuService); ok {
+		logWarnf("--memory-limit does not apply to a running CRIU service")
+		return c
+	}
+	return &memoryLimitedCriu{criuRunner: c, limit: limit}
+}
+
+// Prepare starts criu swrk and moves it into a new cgroup. Only criu is
+// moved; docker-cr stays where it was.
+func (m *memoryLimitedCriu) Prepare() error {
+	cgroup, err := createMemoryCgroup(fmt.Sprintf("docker-cr-criu-%d", os.Getpid()), m.limit)
+	if err != nil {
+		return err
+	}
+	m.cgroup = cgroup
+
+	if err := m.criuRunner.Prepare(); err != nil {
+		m.removeCgroup()
+		return err
+	}
+
+	pids := childrenNamed(os.Getpid(), "criu")
+	if len(pids) == 0 {
+		m.criuRunner.Cleanup()
+		m.removeCgroup()
+		return fmt.Errorf("failed to find the criu process to limit")
+	}
+	for _, pid := range pids {
+		if err := os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			m.criuRunner.Cleanup()
+			m.removeCgroup()
+			return fmt.Errorf("failed to move criu into %s: %w", cgroup, err)
+		}
+	}
+	logInfof("CRIU memory limited to %s (cgroup %s)", formatSize(m.limit), cgroup)
+	return nil
+}
+
+// Cleanup stops criu and removes the then empty cgroup.
+func (m *memoryLimitedCriu) Cleanup() {
+	m.criuRunner.Cleanup()
+	m.removeCgroup()
+}
+
+func (m *memoryLimitedCriu) Dump(opts *rpc.CriuOpts, nfy criu.Notify) error {
+	return m.oomError(m.criuRunner.Dump(opts, nfy))
+}
+
+func (m *memoryLimitedCriu) PreDump(opts *rpc.CriuOpts, nfy criu.Notify) error {
+	return m.oomError(m.criuRunner.PreDump(opts, nfy))
+}
+
+// oomError adds to a failed dump that the limit was the reason, when the
+// cgroup saw an OOM kill.
+func (m *memoryLimitedCriu) oomError(err error) error {
+	if err == nil || m.cgroup == "" {
+		return err
+	}
+	data, readErr := os.ReadFile(filepath.Join(m.cgroup, "memory.events"))
+	if readErr != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok && count != "0" {
+			return fmt.Errorf("%w (CRIU was OOM-killed at --memory-limit %s)", err, formatSize(m.limit))
+		}
+	}
+	return err
+}
+
+func (m *memoryLimitedCriu) removeCgroup() {
+	if m.cgroup == "" {
+		return
+	}
+	if err := os.Remove(m.cgroup); err != nil {
+		logWarnf("failed to remove cgroup %s: %v", m.cgroup, err)
+	}
+	m.cgroup = ""
+}
+
+// createMemoryCgroup creates cgroupRoot/name with memory.max set to limit,
+// enabling the memory controller for the root's children if needed.
+func createMemoryCgroup(name string, limit int64) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("--memory-limit needs cgroup v2 mounted at %s", cgroupRoot)
+	}
+	subtree, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read cgroup controllers: %w", err)
+	}
+	if !contains(strings.Fields(string(subtree)), "memory") {
+		if err := os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+memory"), 0644); err != nil {
+			return "", fmt.Errorf("failed to enable the memory controller: %w", err)
+		}
+	}
+
+	cgroup := filepath.Join(cgroupRoot, name)
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup %s: %w", cgroup, err)
+	}
+	if err := os.WriteFile(filepath.Join(cgroup, "memory.max"), []byte(strconv.FormatInt(limit, 10)), 0644); err != nil {
+		os.Remove(cgroup)
+		return "", fmt.Errorf("failed to set memory.max: %w", err)
+	}
+	return cgroup, nil
+}
+
+// childrenNamed returns the children of pid running the program name. The
+// children file is per thread, and Go may fork from any of them.
+func childrenNamed(pid int, name string) []int {
+	var pids []int
+	tasks, _ := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	for _, task := range tasks {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, task.Name()))
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			child, err := strconv.Atoi(field)
+			if err == nil && filepath.Base(getProcessName(child)) == name {
+				pids = append(pids, child)
+			}
+		}
+	}
+	return pids
+}
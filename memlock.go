@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HugePageMapping is a hugetlb mapping of the tree, from hugetlbfs or
+// MAP_HUGETLB. CRIU has to allocate the same huge pages at restore.
+type HugePageMapping struct {
+	PID      int    `json:"pid"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	PageSize int64  `json:"page_size"`
+}
+
+// HugePagePool is the host's pool of huge pages of one size.
+type HugePagePool struct {
+	PageSize int64 `json:"page_size"`
+	Total    int64 `json:"total"`
+	Free     int64 `json:"free"`
+}
+
+// analyzeLockedMemory sums VmLck over the tree rooted at pid and finds its
+// hugetlb mappings, whose smaps KernelPageSize is larger than a page.
+// Transparent huge pages report the base page size and are left out.
+func analyzeLockedMemory(pid int, info *ProcessInfo) {
+	for _, p := range processTree(pid) {
+		if locked := statusKB(p, "VmLck"); locked > 0 {
+			info.LockedMemory += locked
+		}
+		info.HugePages = append(info.HugePages, hugePageMappings(p)...)
+	}
+	info.HasLockedMemory = info.LockedMemory > 0
+	info.HasHugePages = len(info.HugePages) > 0
+}
+
+// statusKB returns a kB field of /proc/<pid>/status in bytes, 0 if absent.
+func statusKB(pid int, field string) int64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// hugePageMappings reads the hugetlb mappings of one process from smaps.
+func hugePageMappings(pid int) []HugePageMapping {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var mappings []HugePageMapping
+	var current HugePageMapping
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			// address perms offset dev inode pathname
+			current = HugePageMapping{PID: pid}
+			if len(fields) >= 6 {
+				current.Path = strings.Join(fields[5:], " ")
+			}
+			continue
+		}
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "Size:":
+			current.Size = kb * 1024
+		case "KernelPageSize:":
+			if kb*1024 > int64(os.Getpagesize()) {
+				current.PageSize = kb * 1024
+				mappings = append(mappings, current)
+			}
+		}
+	}
+	return mappings
+}
+
+// hugePagePools reads the host's huge page pools from sysfs, or the default
+// pool from /proc/meminfo where sysfs has none.
+func hugePagePools() []HugePagePool {
+	var pools []HugePagePool
+	dirs, _ := filepath.Glob("/sys/kernel/mm/hugepages/hugepages-*kB")
+	for _, dir := range dirs {
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir), "hugepages-"), "kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+		pools = append(pools, HugePagePool{
+			PageSize: kb * 1024,
+			Total:    readIntFile(filepath.Join(dir, "nr_hugepages")),
+			Free:     readIntFile(filepath.Join(dir, "free_hugepages")),
+		})
+	}
+	if len(pools) > 0 {
+		sort.Slice(pools, func(i, j int) bool { return pools[i].PageSize < pools[j].PageSize })
+		return pools
+	}
+
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil
+	}
+	var pool HugePagePool
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		switch name {
+		case "HugePages_Total":
+			pool.Total = n
+		case "HugePages_Free":
+			pool.Free = n
+		case "Hugepagesize":
+			pool.PageSize = n * 1024
+		}
+	}
+	if pool.PageSize == 0 {
+		return nil
+	}
+	return []HugePagePool{pool}
+}
+
+func readIntFile(path string) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
+
+// hugePagesNeeded counts the huge pages of each size the mappings use. A
+// file mapped by several processes of the tree is counted once.
+func hugePagesNeeded(mappings []HugePageMapping) map[int64]int64 {
+	needed := make(map[int64]int64)
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		if m.PageSize <= 0 {
+			continue
+		}
+		if strings.HasPrefix(m.Path, "/") && !strings.HasPrefix(m.Path, "/anon_hugepage") {
+			if seen[m.Path] {
+				continue
+			}
+			seen[m.Path] = true
+		}
+		needed[m.PageSize] += (m.Size + m.PageSize - 1) / m.PageSize
+	}
+	return needed
+}
+
+// checkRestoreMemory fails when this host has fewer free huge pages than the
+// checkpoint's hugetlb mappings need, and warns that locked memory comes back
+// unlocked.
+func checkRestoreMemory(checkpointDir string) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil {
+		return nil
+	}
+
+	if info.HasLockedMemory {
+		logWarnf("the process had %s of mlock()ed memory; the application must lock it again after restore", formatSize(info.LockedMemory))
+	}
+	if !info.HasHugePages {
+		return nil
+	}
+
+	free := make(map[int64]int64)
+	for _, pool := range hugePagePools() {
+		free[pool.PageSize] = pool.Free
+	}
+	var problems []string
+	for pageSize, pages := range hugePagesNeeded(info.HugePages) {
+		if free[pageSize] < pages {
+			problems = append(problems, fmt.Sprintf("%d pages of %s needed, %d free", pages, formatSize(pageSize), free[pageSize]))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("not enough free huge pages for the checkpoint's hugetlb mappings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// printLockedMemory prints the locked memory and hugetlb mappings of an
+// analysis.
+func printLockedMemory(info *ProcessInfo) {
+	if info.HasLockedMemory {
+		fmt.Printf("  Locked memory: %s (mlock is not restored)\n", formatSize(info.LockedMemory))
+	}
+	if !info.HasHugePages {
+		return
+	}
+	fmt.Printf("  Huge page mappings: %d\n", len(info.HugePages))
+	for _, m := range info.HugePages {
+		fmt.Printf("    %s (pid %d, %s in %s pages)\n", m.Path, m.PID, formatSize(m.Size), formatSize(m.PageSize))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// mountNamespaceOf returns the mount namespace of pid as the kernel names
+// it, e.g. "mnt:[4026531841]", for the checkpoint metadata.
+func mountNamespaceOf(pid int) string {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil {
+		return "unknown"
+	}
+	return ns
+}
+
+// joinMountNamespace makes CRIU restore the tree into the mount namespace
+// behind nsFile, such as /proc/<pid>/ns/mnt of a running container.
+//
+// docker-cr cannot setns(CLONE_NEWNS) itself: the kernel refuses it to a
+// multithreaded process, and Go programs always are. CRIU joins the
+// namespace in its own single-threaded restorer instead.
+func joinMountNamespace(opts *rpc.CriuOpts, nsFile string) error {
+	if _, err := namespaceInode(nsFile); err != nil {
+		return fmt.Errorf("invalid mount namespace file %s: %w", nsFile, err)
+	}
+	opts.JoinNs = append(opts.JoinNs, &rpc.JoinNamespace{
+		Ns:     proto.String("mnt"),
+		NsFile: proto.String(nsFile),
+	})
+	return nil
+}
+
+// namespaceInode returns the inode identifying the namespace behind path.
+func namespaceInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+// externalPIDNamespace returns the --external entry that marks the PID
+// namespace of pid as external, for a container sharing the host's. CRIU
+// cannot recreate that namespace; the key is the one runc uses.
+func externalPIDNamespace(pid int) (string, error) {
+	inode, err := namespaceInode(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return "", fmt.Errorf("failed to read PID namespace of %d: %w", pid, err)
+	}
+	return fmt.Sprintf("pid[%d]:extRootPidNS", inode), nil
+}
+
+// checkMountNamespace confirms that pid is in the mount namespace behind
+// nsFile.
+func checkMountNamespace(pid int, nsFile string) error {
+	want, err := namespaceInode(nsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read mount namespace %s: %w", nsFile, err)
+	}
+	got, err := namespaceInode(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil {
+		return fmt.Errorf("failed to read mount namespace of %d: %w", pid, err)
+	}
+	if got != want {
+		return fmt.Errorf("restored process %d is in mount namespace %d, not %d from %s", pid, got, want, nsFile)
+	}
+	return nil
+}
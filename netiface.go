@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// interfaceAddrsOf lists the interfaces of the network namespace of pid
+// with their addresses. net.Interfaces only sees the calling thread's
+// namespace, so a locked thread enters the namespace for the call and goes
+// back after it.
+func interfaceAddrsOf(pid int) (map[string][]net.IP, error) {
+	if pid == os.Getpid() {
+		return interfaceAddrs()
+	}
+
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace of %d: %w", pid, err)
+	}
+	defer target.Close()
+
+	runtime.LockOSThread()
+	own, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open own network namespace: %w", err)
+	}
+	defer own.Close()
+
+	if err := setns(target, syscall.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter network namespace of %d: %w", pid, err)
+	}
+	addrs, listErr := interfaceAddrs()
+	if err := setns(own, syscall.CLONE_NEWNET); err != nil {
+		// Leave the thread locked: Go discards it when the goroutine ends
+		return nil, fmt.Errorf("failed to leave network namespace of %d: %w", pid, err)
+	}
+	runtime.UnlockOSThread()
+	return addrs, listErr
+}
+
+// setnsSyscall is the setns(2) number per GOARCH; the syscall package
+// does not define SYS_SETNS on amd64 and 386.
+var setnsSyscall = map[string]uintptr{
+	"amd64":   308,
+	"386":     346,
+	"arm64":   268,
+	"arm":     375,
+	"ppc64le": 350,
+	"s390x":   339,
+	"riscv64": 268,
+}
+
+func setns(ns *os.File, nstype int) error {
+	nr, ok := setnsSyscall[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	if _, _, errno := syscall.RawSyscall(nr, ns.Fd(), uintptr(nstype), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// interfaceAddrs lists the interfaces of the current namespace.
+func interfaceAddrs() (map[string][]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	result := make(map[string][]net.IP, len(ifaces))
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		ips := []net.IP{}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+		result[iface.Name] = ips
+	}
+	return result, nil
+}
+
+// interfaceFor returns the interface among ifaces that has the host part of
+// hostPort, or "".
+func interfaceFor(ifaces map[string][]net.IP, hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	for name, ips := range ifaces {
+		for _, addr := range ips {
+			if addr.Equal(ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// annotateTCPInterfaces sets the interface of each TCP connection from the
+// addresses in the network namespace of pid.
+func annotateTCPInterfaces(pid int, conns []TCPConnection) {
+	if len(conns) == 0 {
+		return
+	}
+	ifaces, err := interfaceAddrsOf(pid)
+	if err != nil {
+		return
+	}
+	for i := range conns {
+		conns[i].Interface = interfaceFor(ifaces, conns[i].Local)
+	}
+}
+
+// selectTCPInterface applies --tcp-iface: iface must exist in the network
+// namespace of pid, and only the connections on it are kept for restore to
+// check. The others are still dumped, so they are named in a warning.
+func selectTCPInterface(pid int, info *ProcessInfo, iface string) error {
+	ifaces, err := interfaceAddrsOf(pid)
+	if err != nil {
+		return err
+	}
+	if _, ok := ifaces[iface]; !ok {
+		var names []string
+		for name := range ifaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no interface %s in the network namespace of %d (has %s)", iface, pid, strings.Join(names, ", "))
+	}
+
+	var kept []TCPConnection
+	for _, conn := range info.TCPConnections {
+		if conn.Interface == iface {
+			kept = append(kept, conn)
+			continue
+		}
+		logWarnf("TCP connection %s is not on --tcp-iface %s; it is dumped but restores only if its address exists", conn, iface)
+	}
+	info.TCPConnections = kept
+	info.TCPInterface = iface
+	logInfof("TCP connections on %s: %d", iface, len(kept))
+	return nil
+}
+
+// checkTCPInterface fails when the interface recorded with --tcp-iface is
+// missing from the network namespace of pid, or lacks a local address of
+// the connections dumped on it.
+func checkTCPInterface(checkpointDir string, pid int) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil || info.TCPInterface == "" {
+		return nil
+	}
+
+	ifaces, err := interfaceAddrsOf(pid)
+	if err != nil {
+		return err
+	}
+	if _, ok := ifaces[info.TCPInterface]; !ok {
+		return fmt.Errorf("the checkpoint's TCP connections are on %s, which this network namespace does not have", info.TCPInterface)
+	}
+
+	var missing []string
+	for _, conn := range info.TCPConnections {
+		if interfaceFor(map[string][]net.IP{info.TCPInterface: ifaces[info.TCPInterface]}, conn.Local) == "" {
+			missing = append(missing, conn.Local)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s lacks the local addresses of the dumped TCP connections: %s", info.TCPInterface, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// netlinkProtocols names the netlink protocols from <linux/netlink.h>.
+var netlinkProtocols = map[int]string{
+	0:  "route",
+	1:  "unused",
+	2:  "usersock",
+	3:  "firewall",
+	4:  "sock_diag",
+	5:  "nflog",
+	6:  "xfrm",
+	7:  "selinux",
+	8:  "iscsi",
+	9:  "audit",
+	10: "fib_lookup",
+	11: "connector",
+	12: "netfilter",
+	13: "ip6_fw",
+	14: "dnrtmsg",
+	15: "kobject_uevent",
+	16: "generic",
+	18: "scsitransport",
+	19: "ecryptfs",
+	20: "rdma",
+	21: "crypto",
+	22: "smc",
+}
+
+// netlinkStateful lists protocols whose sockets register state in the
+// kernel by message, such as the audit daemon or a connector subscription.
+// CRIU recreates the socket and its bindings but not that state.
+var netlinkStateful = map[int]string{
+	9:  "the audit daemon registration is not restored",
+	11: "connector subscriptions are not restored",
+}
+
+// NetlinkSocket is a netlink socket held by the process.
+type NetlinkSocket struct {
+	FD       int    `json:"fd"`
+	Protocol int    `json:"protocol"`
+	Name     string `json:"name"`
+	PortID   uint32 `json:"port_id"`
+	Groups   uint64 `json:"groups,omitempty"`
+	// Queued is the number of bytes waiting to be read
+	Queued int64 `json:"queued,omitempty"`
+	// Restorable is false, with the reason, when CRIU cannot bring the
+	// socket back as it was
+	Restorable bool   `json:"restorable"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// netlinkEntry is a line of /proc/<pid>/net/netlink.
+type netlinkEntry struct {
+	protocol int
+	portID   uint32
+	groups   uint64
+	rmem     int64
+}
+
+// readNetlinkTable reads /proc/<pid>/net/netlink keyed by socket inode.
+func readNetlinkTable(pid int) map[string]netlinkEntry {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/netlink", pid))
+	if err != nil {
+		return nil
+	}
+
+	table := make(map[string]netlinkEntry)
+	for i, line := range strings.Split(string(data), "\n") {
+		// sk Eth Pid Groups Rmem Wmem Dump Locks Drops Inode
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 10 {
+			continue
+		}
+		protocol, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		portID, _ := strconv.ParseUint(fields[2], 10, 32)
+		groups, _ := strconv.ParseUint(fields[3], 16, 64)
+		rmem, _ := strconv.ParseInt(fields[4], 10, 64)
+		table[fields[9]] = netlinkEntry{protocol: protocol, portID: uint32(portID), groups: groups, rmem: rmem}
+	}
+	return table
+}
+
+// netlinkSocketFor returns the netlink socket behind fdPath, or nil for other
+// sockets. Only bound netlink sockets are listed in /proc/net/netlink; the
+// others are recognised by their protocol name.
+func netlinkSocketFor(fdPath string, fd int, entry netlinkEntry) *NetlinkSocket {
+	if entry == (netlinkEntry{}) {
+		name := make([]byte, 32)
+		n, err := syscall.Getxattr(fdPath, "system.sockprotoname", name)
+		if err != nil || strings.TrimRight(string(name[:n]), "\x00") != "NETLINK" {
+			return nil
+		}
+		// CRIU reads the protocol of an unbound socket itself
+		return &NetlinkSocket{FD: fd, Protocol: -1, Name: "unbound", Restorable: true}
+	}
+
+	sock := &NetlinkSocket{
+		FD:       fd,
+		Protocol: entry.protocol,
+		Name:     netlinkProtocols[entry.protocol],
+		PortID:   entry.portID,
+		Groups:   entry.groups,
+		Queued:   entry.rmem,
+	}
+	if sock.Name == "" {
+		sock.Name = fmt.Sprintf("protocol %d", entry.protocol)
+	}
+	classifyNetlinkSocket(sock)
+	return sock
+}
+
+// classifyNetlinkSocket decides whether CRIU can restore a netlink socket on
+// this host. CRIU recreates it with socket(2), so the protocol has to be
+// available here too, which is checked by creating one.
+func classifyNetlinkSocket(sock *NetlinkSocket) {
+	if reason, ok := netlinkStateful[sock.Protocol]; ok {
+		sock.Reason = reason
+		return
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, sock.Protocol)
+	if err != nil {
+		sock.Reason = fmt.Sprintf("this kernel cannot create %s sockets: %v", sock.Name, err)
+		return
+	}
+	syscall.Close(fd)
+
+	sock.Restorable = true
+	if sock.Queued > 0 {
+		sock.Reason = fmt.Sprintf("%d queued bytes may be lost", sock.Queued)
+	}
+}
+
+// printNetlinkSockets lists the netlink sockets apart from other sockets.
+func printNetlinkSockets(sockets []NetlinkSocket) {
+	if len(sockets) == 0 {
+		return
+	}
+
+	fmt.Printf("  Netlink sockets: %d\n", len(sockets))
+	for _, sock := range sockets {
+		status := "restorable"
+		if !sock.Restorable {
+			status = "NOT restorable"
+		}
+		if sock.Reason != "" {
+			status += ": " + sock.Reason
+		}
+		fmt.Printf("    fd %-4d %-15s port %-10d %s\n", sock.FD, sock.Name, sock.PortID, status)
+	}
+}
+
+// warnNetlinkSockets prints a warning naming each netlink socket that will
+// not be restored as it was.
+func warnNetlinkSockets(sockets []NetlinkSocket) {
+	for _, sock := range sockets {
+		if !sock.Restorable {
+			logWarnf("netlink fd %d (%s) cannot be restored: %s", sock.FD, sock.Name, sock.Reason)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+)
+
+// Mechanisms of --network-lock
+const (
+	networkLockIptables = "iptables"
+	networkLockNftables = "nftables"
+	networkLockSkip     = "skip"
+)
+
+const (
+	// criuSocketMark is the SO_MARK CRIU sets on the sockets it uses to
+	// repair TCP connections; the lock lets their packets through
+	criuSocketMark = "0xC114"
+	// networkLockChain and networkLockTable hold the rules docker-cr adds
+	networkLockChain = "DOCKER-CR-LOCK"
+	networkLockTable = "docker_cr_lock"
+)
+
+// netfilterStep is one rule or chain the lock adds, and the command that
+// removes exactly it. A nil del means it goes away with the chain or table
+// it was added to.
+type netfilterStep struct {
+	add []string
+	del []string
+}
+
+// networkLock drops all traffic in the network namespace of a dumped tree
+// between CRIU's NetworkLock and NetworkUnlock notifications, so TCP state
+// cannot change between the lock and the dump of the sockets.
+type networkLock struct {
+	method string
+	pid    int
+	steps  []netfilterStep
+	// applied are the steps added so far, removed in reverse order
+	applied []netfilterStep
+}
+
+// validateNetworkLock checks a --network-lock value; empty means detected.
+func validateNetworkLock(method string) error {
+	switch method {
+	case "", networkLockIptables, networkLockNftables, networkLockSkip:
+		return nil
+	}
+	return fmt.Errorf("--network-lock must be iptables, nftables or skip, not %q", method)
+}
+
+// prepareNetworkLock sets up the --network-lock of the dump of pid. In a
+// network namespace of its own the tree is locked by notify, with CRIU's
+// own lock disabled. In the host's namespace, or when criu runs as a
+// subprocess without notifications, CRIU locks the dumped connections
+// itself with the chosen mechanism. The caller must defer
+// notify.unlockNetwork.
+func prepareNetworkLock(opts *rpc.CriuOpts, notify *NotifyHandler, pid int, cfg *CheckpointConfig) error {
+	method := cfg.NetworkLock
+	if method == networkLockSkip {
+		logWarnf("--network-lock=skip: TCP connections are not locked during the dump")
+		opts.NetworkLock = rpc.CriuNetworkLockMethod_SKIP.Enum()
+		return nil
+	}
+
+	if method == "" {
+		if _, err := exec.LookPath("nft"); err == nil {
+			method = networkLockNftables
+		} else if _, err := exec.LookPath("iptables"); err == nil {
+			method = networkLockIptables
+		} else {
+			// CRIU reports the missing tool itself if it needs one
+			return nil
+		}
+	} else if _, err := exec.LookPath(networkLockTool(method)); err != nil {
+		return fmt.Errorf("--network-lock=%s: %w", method, err)
+	}
+
+	if sameNamespace(pid, "net") || len(cfg.CriuArgs) > 0 {
+		if method == networkLockNftables {
+			opts.NetworkLock = rpc.CriuNetworkLockMethod_NFTABLES.Enum()
+		} else {
+			opts.NetworkLock = rpc.CriuNetworkLockMethod_IPTABLES.Enum()
+		}
+		return nil
+	}
+
+	opts.NetworkLock = rpc.CriuNetworkLockMethod_SKIP.Enum()
+	notify.netLock = &networkLock{
+		method: method,
+		pid:    pid,
+		steps:  networkLockSteps(method),
+	}
+	return nil
+}
+
+func networkLockTool(method string) string {
+	if method == networkLockNftables {
+		return "nft"
+	}
+	return "iptables"
+}
+
+// networkLockSteps returns the rules that drop every packet in a network
+// namespace except those of CRIU's marked sockets.
+func networkLockSteps(method string) []netfilterStep {
+	var steps []netfilterStep
+	if method == networkLockNftables {
+		nft := func(args ...string) []string { return append([]string{"nft"}, args...) }
+		steps = append(steps, netfilterStep{
+			add: nft("add", "table", "inet", networkLockTable),
+			del: nft("delete", "table", "inet", networkLockTable),
+		})
+		for _, hook := range []string{"input", "output"} {
+			steps = append(steps,
+				netfilterStep{
+					add: nft("add", "chain", "inet", networkLockTable, hook,
+						"{", "type", "filter", "hook", hook, "priority", "-200", ";", "policy", "accept", ";", "}"),
+					del: nft("delete", "chain", "inet", networkLockTable, hook),
+				},
+				netfilterStep{add: nft("add", "rule", "inet", networkLockTable, hook, "meta", "mark", criuSocketMark, "accept")},
+				netfilterStep{add: nft("add", "rule", "inet", networkLockTable, hook, "counter", "drop")},
+			)
+		}
+	} else {
+		for _, tool := range []string{"iptables", "ip6tables"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				continue
+			}
+			ipt := func(args ...string) []string { return append([]string{tool, "-w"}, args...) }
+			steps = append(steps,
+				netfilterStep{add: ipt("-N", networkLockChain), del: ipt("-X", networkLockChain)},
+				netfilterStep{
+					add: ipt("-A", networkLockChain, "-m", "mark", "--mark", criuSocketMark, "-j", "ACCEPT"),
+					del: ipt("-D", networkLockChain, "-m", "mark", "--mark", criuSocketMark, "-j", "ACCEPT"),
+				},
+				netfilterStep{
+					add: ipt("-A", networkLockChain, "-j", "DROP"),
+					del: ipt("-D", networkLockChain, "-j", "DROP"),
+				},
+				netfilterStep{add: ipt("-I", "INPUT", "-j", networkLockChain), del: ipt("-D", "INPUT", "-j", networkLockChain)},
+				netfilterStep{add: ipt("-I", "OUTPUT", "-j", networkLockChain), del: ipt("-D", "OUTPUT", "-j", networkLockChain)},
+			)
+		}
+	}
+	return steps
+}
+
+// lock adds the rules. If one fails, those already added are removed.
+func (l *networkLock) lock() error {
+	logInfof("Locking network of PID %d with %s", l.pid, l.method)
+	for _, step := range l.steps {
+		if err := l.run(step.add); err != nil {
+			if unlockErr := l.unlock(); unlockErr != nil {
+				logWarnf("%v", unlockErr)
+			}
+			return fmt.Errorf("failed to lock network: %w", err)
+		}
+		logInfof("Network lock: added: %s", strings.Join(step.add, " "))
+		l.applied = append(l.applied, step)
+	}
+	return nil
+}
+
+// unlock removes exactly the rules lock added, in reverse order. It may be
+// called again; rules already removed are not touched. If the tree is gone,
+// e.g. killed by --stop-after-dump, the rules went with its namespace.
+func (l *networkLock) unlock() error {
+	if len(l.applied) > 0 && !l.namespaceExists() {
+		logInfof("Network namespace of PID %d is gone; no lock rules to remove", l.pid)
+		l.applied = nil
+		return nil
+	}
+	var failed []string
+	for i := len(l.applied) - 1; i >= 0; i-- {
+		step := l.applied[i]
+		if step.del == nil {
+			continue
+		}
+		if err := l.run(step.del); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		logInfof("Network lock: removed: %s", strings.Join(step.del, " "))
+	}
+	if len(l.applied) > 0 && len(failed) == 0 {
+		logInfof("Unlocked network of PID %d", l.pid)
+	}
+	l.applied = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove network lock rules: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// namespaceExists reports whether the network namespace of the tree can
+// still be entered.
+func (l *networkLock) namespaceExists() bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d/ns/net", l.pid))
+	return !os.IsNotExist(err)
+}
+
+// run runs a netfilter command in the network namespace of the tree.
+func (l *networkLock) run(args []string) error {
+	cmd := exec.Command("nsenter", append([]string{"--target", strconv.Itoa(l.pid), "--net", "--"}, args...)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -1,124 +1,500 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// defaultHookTimeout bounds how long a notify script may run.
+const defaultHookTimeout = 60 * time.Second
+
+// hookOutputLimit bounds the output of a hook script kept for the log.
+const hookOutputLimit = 64 * 1024
+
+// hookKillGrace is how long a killed hook's output pipes may stay open,
+// e.g. held by a child that left its process group.
+const hookKillGrace = 2 * time.Second
+
+// ErrHookTimeout is returned when a notify script is killed for running
+// longer than the handler's HookTimeout.
+var ErrHookTimeout = errors.New("hook script timed out")
+
+// hookPhases maps the phase names --hook takes to the CRIU notifications
+// they run at.
+var hookPhases = map[string]string{
+	"pre-dump":              "PreDump",
+	"post-dump":             "PostDump",
+	"pre-restore":           "PreRestore",
+	"post-restore":          "PostRestore",
+	"network-lock":          "NetworkLock",
+	"network-unlock":        "NetworkUnlock",
+	"setup-namespaces":      "SetupNamespaces",
+	"post-setup-namespaces": "PostSetupNamespaces",
+	"post-resume":           "PostResume",
+}
+
+// Phases CRIU notifies during a dump and during a restore
+var (
+	checkpointHookPhases = []string{"pre-dump", "network-lock", "network-unlock", "post-dump"}
+	restoreHookPhases    = []string{"pre-restore", "network-lock", "setup-namespaces", "post-setup-namespaces",
+		"post-restore", "network-unlock", "post-resume"}
+)
+
+// warnOnlyPhases are the phases whose failing hook only prints a warning:
+// once the tree is resumed there is nothing left to abort. A failing hook
+// of any other phase aborts the CRIU operation.
+var warnOnlyPhases = map[string]bool{
+	"PostResume": true,
+}
+
 type NotifyHandler struct {
-	PreDumpScript    string
-	PostDumpScript   string
-	PreRestoreScript string
-	LogPrefix        string
-	Verbose          bool
+	// Hooks maps a CRIU notification, e.g. "PreDump", to the scripts run
+	// at it, in order
+	Hooks map[string][]string
+	// LogPrefix starts the debug records of CRIU's notifications, which
+	// are only written with --verbose
+	LogPrefix   string
+	HookTimeout time.Duration
+	// PhaseHookTimeouts overrides HookTimeout for a CRIU notification
+	PhaseHookTimeouts map[string]time.Duration
+	// Hostname, if set, replaces the hostname in the restored UTS namespace
+	Hostname string
+	// MountNsPath, if set, is the mount namespace the restored tree must
+	// have joined
+	MountNsPath string
+
+	// Mode, PID, CheckpointDir and the container fields describe the
+	// operation to hook scripts; see setOperation
+	Mode          string
+	PID           int
+	CheckpointDir string
+	ContainerID   string
+	ContainerName string
+	Image         string
+	// restoredPID is the root of the restored tree, once CRIU reported it
+	restoredPID int32
+	// netLock, if set, blocks the tree's traffic between NetworkLock and
+	// NetworkUnlock; see prepareNetworkLock
+	netLock *networkLock
+	// timings, if set, gets the phases bounded by the notifications
+	timings *Timings
 }
 
-func NewNotifyHandler(verbose bool) *NotifyHandler {
+func NewNotifyHandler() *NotifyHandler {
 	return &NotifyHandler{
-		LogPrefix: "[CRIU Notify]",
-		Verbose:   verbose,
+		LogPrefix:   "[CRIU Notify]",
+		HookTimeout: defaultHookTimeout,
 	}
 }
 
 func (n *NotifyHandler) PreDump() error {
-	if n.Verbose {
-		log.Printf("%s PreDump called", n.LogPrefix)
+	n.notified("PreDump", "called")
+	n.timings.begin(phaseFreeze)
+
+	return n.runHook("PreDump")
+}
+
+func (n *NotifyHandler) PostDump() error {
+	n.notified("PostDump", "called")
+	n.timings.end(phaseFreeze)
+
+	return n.runHook("PostDump")
+}
+
+func (n *NotifyHandler) PreRestore() error {
+	n.notified("PreRestore", "called")
+	n.timings.begin(phaseTreeSetup)
+
+	return n.runHook("PreRestore")
+}
+
+func (n *NotifyHandler) PostRestore(pid int32) error {
+	n.notified("PostRestore", "called with PID %d", pid)
+	n.timings.end(phaseTreeSetup)
+	n.restoredPID = pid
+	setLogFields("pid", pid)
+	return n.runHook("PostRestore")
+}
+
+func (n *NotifyHandler) NetworkLock() error {
+	n.notified("NetworkLock", "called")
+	if n.netLock != nil {
+		if err := n.netLock.lock(); err != nil {
+			return err
+		}
 	}
+	return n.runHook("NetworkLock")
+}
 
-	if n.PreDumpScript != "" {
-		return n.executeScript(n.PreDumpScript, "PreDump")
+func (n *NotifyHandler) NetworkUnlock() error {
+	n.notified("NetworkUnlock", "called")
+	if n.netLock != nil {
+		if err := n.netLock.unlock(); err != nil {
+			return err
+		}
 	}
+	return n.runHook("NetworkUnlock")
+}
 
-	return nil
+// unlockNetwork removes whatever network lock rules are still in place,
+// e.g. after a dump that failed between NetworkLock and NetworkUnlock.
+func (n *NotifyHandler) unlockNetwork() {
+	if n.netLock == nil {
+		return
+	}
+	if err := n.netLock.unlock(); err != nil {
+		logWarnf("%v", err)
+	}
 }
 
-func (n *NotifyHandler) PostDump() error {
-	if n.Verbose {
-		log.Printf("%s PostDump called", n.LogPrefix)
+func (n *NotifyHandler) SetupNamespaces(pid int32) error {
+	n.notified("SetupNamespaces", "called for PID %d", pid)
+
+	if n.Hostname != "" {
+		if err := setHostnameInNamespace(int(pid), n.Hostname); err != nil {
+			return err
+		}
+		logInfof("Set hostname of restored process to %s", n.Hostname)
 	}
 
-	if n.PostDumpScript != "" {
-		return n.executeScript(n.PostDumpScript, "PostDump")
+	if n.MountNsPath != "" {
+		if err := checkMountNamespace(int(pid), n.MountNsPath); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return n.runHook("SetupNamespaces")
 }
 
-func (n *NotifyHandler) PreRestore() error {
-	if n.Verbose {
-		log.Printf("%s PreRestore called", n.LogPrefix)
+func (n *NotifyHandler) PostSetupNamespaces() error {
+	n.notified("PostSetupNamespaces", "called")
+	return n.runHook("PostSetupNamespaces")
+}
+
+func (n *NotifyHandler) PostResume() error {
+	n.notified("PostResume", "called")
+	return n.runHook("PostResume")
+}
+
+// notified reports a CRIU notification as a progress event, a span event
+// and a debug record.
+func (n *NotifyHandler) notified(phase, format string, args ...any) {
+	progress.emit(ProgressEvent{Type: eventNotify, Phase: phase})
+	tracing.event(phase)
+	n.debugf(phase, format, args...)
+}
+
+// debugf writes a debug record about phase, which is also its "phase"
+// field.
+func (n *NotifyHandler) debugf(phase, format string, args ...any) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
 	}
+	logger.With("phase", phase).Debug(fmt.Sprintf("%s %s "+format, append([]any{n.LogPrefix, phase}, args...)...))
+}
 
-	if n.PreRestoreScript != "" {
-		return n.executeScript(n.PreRestoreScript, "PreRestore")
+// setOperation records what the hook scripts operate on: mode is
+// "container" or "process", pid the dumped process (0 on restore, where it
+// is taken from the checkpoint). The container ID, name and image are read
+// from container.meta in checkpointDir, if there is one.
+func (n *NotifyHandler) setOperation(mode string, pid int, checkpointDir string) {
+	n.Mode = mode
+	n.PID = pid
+	n.CheckpointDir = checkpointDir
+	if abs, err := filepath.Abs(checkpointDir); err == nil {
+		n.CheckpointDir = abs
 	}
 
-	return nil
+	if metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta")); err == nil {
+		n.ContainerID = metadata["CONTAINER_ID"]
+		n.ContainerName = strings.TrimPrefix(metadata["CONTAINER_NAME"], "/")
+		n.Image = metadata["IMAGE"]
+	}
+	if n.PID == 0 {
+		if manifest, err := loadProcessManifest(checkpointDir); err == nil && manifest != nil {
+			if root := manifest.Root(); root != nil {
+				n.PID = root.PID
+			}
+		}
+	}
 }
 
-func (n *NotifyHandler) PostRestore(pid int32) error {
-	if n.Verbose {
-		log.Printf("%s PostRestore called with PID %d", n.LogPrefix, pid)
+// hookEnv returns the DOCKER_CR_* variables a hook script of phase runs
+// with. Values that are not known are exported empty.
+func (n *NotifyHandler) hookEnv(phase string) []string {
+	pid := ""
+	if n.PID != 0 {
+		pid = strconv.Itoa(n.PID)
 	}
-	return nil
+	env := []string{
+		"DOCKER_CR_PID=" + pid,
+		"DOCKER_CR_CONTAINER_ID=" + n.ContainerID,
+		"DOCKER_CR_CONTAINER_NAME=" + n.ContainerName,
+		"DOCKER_CR_IMAGE=" + n.Image,
+		"DOCKER_CR_CHECKPOINT_DIR=" + n.CheckpointDir,
+		"DOCKER_CR_HOOK_CHECKPOINT_DIR=" + n.CheckpointDir,
+		"DOCKER_CR_PHASE=" + phase,
+		"DOCKER_CR_MODE=" + n.Mode,
+	}
+	if n.restoredPID != 0 {
+		env = append(env, fmt.Sprintf("DOCKER_CR_RESTORED_PID=%d", n.restoredPID))
+	}
+	return env
 }
 
-func (n *NotifyHandler) NetworkLock() error {
-	if n.Verbose {
-		log.Printf("%s NetworkLock called", n.LogPrefix)
+// parseHooks turns --hook <phase>=<script> arguments and the --hooks-dir
+// directory, if set, into the Hooks of a NotifyHandler. phases are the
+// phase names the command accepts. The executables in hooksDir/<phase>/ run
+// after the --hook script of the phase, in lexical order, run-parts style:
+// hidden and non-executable files are skipped.
+func parseHooks(specs []string, hooksDir string, phases []string) (map[string][]string, error) {
+	hooks := make(map[string][]string)
+	for _, spec := range specs {
+		name, script, ok := strings.Cut(spec, "=")
+		if !ok || script == "" {
+			return nil, fmt.Errorf("--hook %q: want <phase>=<script>", spec)
+		}
+		known := false
+		for _, phase := range phases {
+			known = known || phase == name
+		}
+		if !known {
+			return nil, fmt.Errorf("--hook %q: phase must be one of %s", spec, strings.Join(phases, ", "))
+		}
+		phase := hookPhases[name]
+		if _, dup := hooks[phase]; dup {
+			return nil, fmt.Errorf("--hook: more than one script for %s", name)
+		}
+		if err := validateHookScript("hook "+name, script); err != nil {
+			return nil, err
+		}
+		hooks[phase] = []string{script}
 	}
-	return nil
+
+	if hooksDir == "" {
+		return hooks, nil
+	}
+	if info, err := os.Stat(hooksDir); err != nil {
+		return nil, fmt.Errorf("--hooks-dir: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("--hooks-dir: %s is not a directory", hooksDir)
+	}
+	for _, name := range phases {
+		entries, err := os.ReadDir(filepath.Join(hooksDir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("--hooks-dir: %w", err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			script := filepath.Join(hooksDir, name, entry.Name())
+			if info, err := os.Stat(script); err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+				continue
+			}
+			hooks[hookPhases[name]] = append(hooks[hookPhases[name]], script)
+		}
+	}
+	return hooks, nil
 }
 
-func (n *NotifyHandler) NetworkUnlock() error {
-	if n.Verbose {
-		log.Printf("%s NetworkUnlock called", n.LogPrefix)
+// runHook runs the hook scripts of phase in order. The first that fails
+// stops the others; its failure is returned, or only printed for a
+// warn-only phase.
+func (n *NotifyHandler) runHook(phase string) error {
+	for _, script := range n.Hooks[phase] {
+		started := time.Now()
+		err := n.executeScript(script, phase)
+		exitCode := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			exitCode = -1
+		}
+		logger.With("phase", phase).Debug(fmt.Sprintf("%s %s hook %s finished", n.LogPrefix, phase, script),
+			"exit_code", exitCode, "duration", time.Since(started))
+		if err == nil {
+			continue
+		}
+		if warnOnlyPhases[phase] {
+			logWarnf("%v", err)
+			return nil
+		}
+		return err
 	}
 	return nil
 }
 
-func (n *NotifyHandler) SetupNamespaces(pid int32) error {
-	if n.Verbose {
-		log.Printf("%s SetupNamespaces called for PID %d", n.LogPrefix, pid)
+// hookTimeouts is --hook-timeout: a duration for the scripts of every
+// phase, or <phase>=<duration> for those of one (repeatable). Phases are
+// kept as CRIU notifications, with "" for every phase; zero means no
+// timeout.
+type hookTimeouts map[string]time.Duration
+
+func (h *hookTimeouts) String() string {
+	var parts []string
+	for phase, d := range *h {
+		if phase == "" {
+			parts = append(parts, d.String())
+		} else {
+			parts = append(parts, phase+"="+d.String())
+		}
 	}
-	return nil
+	return strings.Join(parts, ",")
 }
 
-func (n *NotifyHandler) PostSetupNamespaces() error {
-	if n.Verbose {
-		log.Printf("%s PostSetupNamespaces called", n.LogPrefix)
+func (h *hookTimeouts) Set(value string) error {
+	phase, duration, ok := strings.Cut(value, "=")
+	if !ok {
+		phase, duration = "", value
+	} else if phase = hookPhases[phase]; phase == "" {
+		return fmt.Errorf("unknown hook phase in %q", value)
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid duration %q", duration)
+	}
+	if *h == nil {
+		*h = make(hookTimeouts)
 	}
+	(*h)[phase] = d
 	return nil
 }
 
-func (n *NotifyHandler) PostResume() error {
-	if n.Verbose {
-		log.Printf("%s PostResume called", n.LogPrefix)
+// setHookTimeouts applies --hook-timeout to the handler.
+func (n *NotifyHandler) setHookTimeouts(timeouts hookTimeouts) {
+	for phase, d := range timeouts {
+		if phase == "" {
+			n.HookTimeout = d
+			continue
+		}
+		if n.PhaseHookTimeouts == nil {
+			n.PhaseHookTimeouts = make(map[string]time.Duration)
+		}
+		n.PhaseHookTimeouts[phase] = d
+	}
+}
+
+// hookTimeout is how long the scripts of phase may run; zero means no
+// limit.
+func (n *NotifyHandler) hookTimeout(phase string) time.Duration {
+	if d, ok := n.PhaseHookTimeouts[phase]; ok {
+		return d
+	}
+	return n.HookTimeout
+}
+
+// validateHookScript checks, when the flags are parsed, that a hook script
+// given with flag exists and is executable, so that a typo fails at once
+// rather than in the middle of a dump.
+func validateHookScript(flag, script string) error {
+	if script == "" {
+		return nil
+	}
+	info, err := os.Stat(script)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", flag, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("--%s: %s is not an executable file", flag, script)
 	}
 	return nil
 }
 
+// executeScript runs a hook script in a process group of its own. A
+// script that fails, or runs past the phase's timeout and is killed with
+// its whole group, aborts the CRIU operation; the last line it wrote is
+// part of the error. Its output goes to the log rather than the terminal.
 func (n *NotifyHandler) executeScript(script string, phase string) error {
-	if _, err := os.Stat(script); os.IsNotExist(err) {
-		if n.Verbose {
-			log.Printf("%s %s script not found: %s", n.LogPrefix, phase, script)
-		}
-		return nil
+	if _, err := os.Stat(script); err != nil {
+		return fmt.Errorf("%s script %s: %w", phase, script, err)
 	}
 
-	if n.Verbose {
-		log.Printf("%s Executing %s script: %s", n.LogPrefix, phase, script)
+	n.debugf(phase, "executing script %s", script)
+
+	ctx := context.Background()
+	timeout := n.hookTimeout(phase)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	cmd := exec.Command("/bin/sh", script)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	output := &boundedBuffer{limit: hookOutputLimit}
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = append(os.Environ(), n.hookEnv(phase)...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// The script and whatever it started
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookKillGrace
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s script failed: %w", phase, err)
+	err := cmd.Run()
+	n.logHookOutput(phase, script, output)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s script %s: %w after %s; killed its process group", phase, script, ErrHookTimeout, timeout)
+		}
+		if last := output.lastLine(); last != "" {
+			return fmt.Errorf("%s script %s failed: %w: %s", phase, script, err, last)
+		}
+		return fmt.Errorf("%s script %s failed: %w", phase, script, err)
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// logHookOutput writes what a hook script printed to the log, a record
+// per line.
+func (n *NotifyHandler) logHookOutput(phase, script string, output *boundedBuffer) {
+	text := strings.TrimRight(output.buf.String(), "\n")
+	if text == "" {
+		return
+	}
+	hookLogger := logger.With("phase", phase, "hook", script)
+	for _, line := range strings.Split(text, "\n") {
+		hookLogger.Info(fmt.Sprintf("%s %s hook: %s", n.LogPrefix, phase, line))
+	}
+	if output.dropped > 0 {
+		hookLogger.Warn(fmt.Sprintf("%s %s hook: output truncated, first %d bytes dropped", n.LogPrefix, phase, output.dropped))
+	}
+}
+
+// boundedBuffer keeps the last limit bytes written to it, where a failing
+// script says why, and counts the bytes dropped before them.
+type boundedBuffer struct {
+	buf     bytes.Buffer
+	limit   int
+	dropped int64
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.buf.Write(p)
+	if excess := b.buf.Len() - b.limit; excess > 0 {
+		b.buf.Next(excess)
+		b.dropped += int64(excess)
+	}
+	return len(p), nil
+}
+
+// lastLine is the last non-empty line kept.
+func (b *boundedBuffer) lastLine() string {
+	text := strings.TrimSpace(b.buf.String())
+	return strings.TrimSpace(text[strings.LastIndex(text, "\n")+1:])
+}
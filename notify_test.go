@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHookTimeoutKillsProcessGroup runs a hook that starts a child and
+// then hangs, and checks both are gone once the phase's timeout expires.
+func TestHookTimeoutKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	pids := filepath.Join(dir, "pids")
+	script := filepath.Join(dir, "hang.sh")
+	body := "#!/bin/sh\nsleep 30 &\necho $$ $! > " + pids + "\nsleep 30\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNotifyHandler()
+	n.setHookTimeouts(hookTimeouts{"PreDump": 500 * time.Millisecond})
+
+	started := time.Now()
+	err := n.executeScript(script, "PreDump")
+	if !errors.Is(err, ErrHookTimeout) {
+		t.Fatalf("got error %v, want one wrapping ErrHookTimeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > hookKillGrace {
+		t.Errorf("the hook returned after %s, want about its 500ms timeout", elapsed)
+	}
+
+	data, err := os.ReadFile(pids)
+	if err != nil {
+		t.Fatalf("the hook did not record its PIDs: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		t.Fatalf("malformed PID file %q", data)
+	}
+	pgid, _ := strconv.Atoi(fields[0])
+	child, _ := strconv.Atoi(fields[1])
+
+	// The child is reparented when the script dies; allow for the reaping
+	deadline := time.Now().Add(time.Second)
+	for {
+		if groupGone(pgid) {
+			break
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			t.Fatalf("process group %d (child %d) is still running after the timeout", pgid, child)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// groupGone reports whether no live process is left in process group pgid;
+// zombies waiting for their new parent to reap them count as gone.
+func groupGone(pgid int) bool {
+	if err := syscall.Kill(-pgid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err == nil && stat.PGRP == pgid && stat.State != "Z" {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHookEnvCheckpointDir(t *testing.T) {
+	n := NewNotifyHandler()
+	n.setOperation("process", 0, "/var/lib/checkpoints/web")
+
+	env := n.hookEnv("PreDump")
+	for _, want := range []string{
+		"DOCKER_CR_CHECKPOINT_DIR=/var/lib/checkpoints/web",
+		"DOCKER_CR_HOOK_CHECKPOINT_DIR=/var/lib/checkpoints/web",
+	} {
+		found := false
+		for _, kv := range env {
+			found = found || kv == want
+		}
+		if !found {
+			t.Errorf("%s missing from %v", want, env)
+		}
+	}
+}
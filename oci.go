@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// runtimeBundleDirs are where containerd keeps the OCI bundle of a running
+// Docker container, for the dockerd-managed and the system containerd.
+var runtimeBundleDirs = []string{
+	"/run/docker/containerd/daemon/io.containerd.runtime.v2.task/moby",
+	"/run/containerd/io.containerd.runtime.v2.task/moby",
+}
+
+// exportOCIBundle lays out checkpointDir as a runc bundle in outDir:
+// config.json from the container's runtime spec, the CRIU images in
+// checkpoint/ and rootfs/ pointing at the container's merged filesystem.
+// It is then restored with
+//
+//	runc restore --bundle <outDir> --image-path <outDir>/checkpoint <id>
+func exportOCIBundle(containerID, checkpointDir, outDir string) error {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	info, err := dockerClient.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	merged := info.GraphDriver.Data["MergedDir"]
+	if merged == "" {
+		return fmt.Errorf("storage driver %s of %s exposes no merged directory for rootfs/", info.GraphDriver.Name, containerID)
+	}
+
+	spec, err := readRuntimeSpec(info.ID)
+	if err != nil {
+		return err
+	}
+	// The bundle's own rootfs/ replaces containerd's absolute path
+	root, _ := spec["root"].(map[string]interface{})
+	if root == nil {
+		root = make(map[string]interface{})
+		spec["root"] = root
+	}
+	root["path"] = "rootfs"
+
+	imagesDir := filepath.Join(outDir, "checkpoint")
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", imagesDir, err)
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "config.json"), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config.json: %w", err)
+	}
+
+	entries, err := os.ReadDir(checkpointDir)
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint directory: %w", err)
+	}
+	copied := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".img") {
+			continue
+		}
+		if err := copyRegularFile(filepath.Join(checkpointDir, entry.Name()), filepath.Join(imagesDir, entry.Name())); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	rootfs := filepath.Join(outDir, "rootfs")
+	os.Remove(rootfs)
+	if err := os.Symlink(merged, rootfs); err != nil {
+		return fmt.Errorf("failed to link rootfs: %w", err)
+	}
+
+	logInfof("Exported OCI bundle to %s (%d images, rootfs -> %s)", outDir, copied, merged)
+	logInfof("Restore with: runc restore --bundle %s --image-path %s %s", outDir, imagesDir, info.ID[:12])
+	return nil
+}
+
+// readRuntimeSpec returns the config.json containerd runs the container
+// with. Docker's API does not expose it.
+func readRuntimeSpec(containerID string) (map[string]interface{}, error) {
+	for _, dir := range runtimeBundleDirs {
+		data, err := os.ReadFile(filepath.Join(dir, containerID, "config.json"))
+		if err != nil {
+			continue
+		}
+		var spec map[string]interface{}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("failed to parse runtime spec of %s: %w", containerID, err)
+		}
+		return spec, nil
+	}
+	return nil, fmt.Errorf("no runtime spec found for %s; the container must be running", containerID)
+}
+
+func copyRegularFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
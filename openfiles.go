@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenFile is a file the dumped tree holds open. CRIU reopens it by path at
+// restore, so it must exist there.
+type OpenFile struct {
+	PID  int    `json:"pid"`
+	FD   int    `json:"fd"`
+	Path string `json:"path"`
+	// Mount and MountKind are as for MappedFile; "bind" is a host path
+	Mount     string `json:"mount"`
+	MountKind string `json:"mount_kind"`
+	// Risk says why the file may be missing at restore, if it may be
+	Risk string `json:"risk,omitempty"`
+}
+
+// analyzeOpenFiles lists the files the tree rooted at pid holds open and
+// what each depends on. Kernel filesystems (/dev, /proc, /sys) are recreated
+// by the runtime and left out; deleted files are in DeletedFiles.
+func analyzeOpenFiles(pid int) []OpenFile {
+	mounts := readMountInfo(pid)
+	inContainer := !sameNamespace(pid, "mnt")
+	upper := ""
+	if inContainer {
+		if layer, err := containerWritableLayer(pid); err == nil && !strings.HasPrefix(layer, "/proc/") {
+			upper = layer
+		}
+	}
+
+	var files []OpenFile
+	for _, p := range processTree(pid) {
+		fdDir := fmt.Sprintf("/proc/%d/fd", p)
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			target, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+			if err != nil || !strings.HasPrefix(target, "/") || strings.HasSuffix(target, " (deleted)") {
+				continue
+			}
+			if target == "/" || strings.HasPrefix(target, "/dev/") || strings.HasPrefix(target, "/proc/") || strings.HasPrefix(target, "/sys/") {
+				continue
+			}
+			fd, _ := strconv.Atoi(entry.Name())
+			of := OpenFile{PID: p, FD: fd, Path: target}
+			if m := mountFor(mounts, target); m != nil {
+				of.Mount = m.mountPoint
+				of.MountKind = classifyMount(m)
+			}
+			of.Risk = openFileRisk(of, inContainer, upper)
+			files = append(files, of)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].PID < files[j].PID
+	})
+	return files
+}
+
+// openFileRisk explains what restoring of has to rely on beyond the
+// checkpoint. A process is restored onto the host's filesystem as it is; a
+// container is recreated from its image, with empty tmpfs mounts and without
+// what was written to its writable layer, unless it is restored into the
+// existing container.
+func openFileRisk(of OpenFile, inContainer bool, upper string) string {
+	switch of.MountKind {
+	case "tmpfs":
+		return "tmpfs contents are not in the checkpoint"
+	case "volume":
+		return "the volume must exist where the checkpoint is restored"
+	case "bind":
+		return "the host path must exist where the checkpoint is restored"
+	case "rootfs":
+		if upper == "" {
+			return ""
+		}
+		if _, err := os.Lstat(filepath.Join(upper, of.Path)); err == nil {
+			return "written to the container's writable layer; a recreated container lacks it"
+		}
+	}
+	return ""
+}
+
+// printOpenFiles lists the open files of an analysis that carry a risk.
+func printOpenFiles(files []OpenFile) {
+	if len(files) == 0 {
+		return
+	}
+
+	fmt.Printf("  Open files: %d\n", len(files))
+	for _, of := range files {
+		note := of.MountKind
+		if of.Mount != "" && of.Mount != "/" {
+			note += " " + of.Mount
+		}
+		fmt.Printf("    %s (pid %d fd %d, %s)\n", of.Path, of.PID, of.FD, note)
+		if of.Risk != "" {
+			fmt.Printf("      ! %s\n", of.Risk)
+		}
+	}
+}
+
+// verifyOpenFiles checks, before CRIU runs, that every file the dumped tree
+// held open exists below root, and lists the ones that do not.
+func verifyOpenFiles(checkpointDir, root string) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var missing []string
+	for _, of := range info.OpenFiles {
+		if seen[of.Path] {
+			continue
+		}
+		seen[of.Path] = true
+		if _, err := os.Lstat(filepath.Join(root, of.Path)); err != nil {
+			line := fmt.Sprintf("%s (%s", of.Path, of.MountKind)
+			if of.Mount != "" && of.Mount != "/" {
+				line += " " + of.Mount
+			}
+			missing = append(missing, line+")")
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("files the process had open are missing at the destination:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
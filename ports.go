@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BoundPort is a local address a UDP or listening TCP socket of the process
+// is bound to.
+type BoundPort struct {
+	// Proto is the /proc/net table the socket was found in, e.g. "udp6"
+	Proto   string `json:"proto"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+
+	// inode identifies the socket, to find who holds a conflicting one
+	inode string
+}
+
+func (p BoundPort) String() string {
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(p.Address, strconv.Itoa(p.Port)), p.Proto)
+}
+
+// conflicts reports whether p and other cannot both be bound: same protocol
+// family and port, and the same address or a wildcard on either side.
+func (p BoundPort) conflicts(other BoundPort) bool {
+	if strings.TrimSuffix(p.Proto, "6") != strings.TrimSuffix(other.Proto, "6") || p.Port != other.Port {
+		return false
+	}
+	wildcard := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip == nil || ip.IsUnspecified()
+	}
+	return p.Address == other.Address || wildcard(p.Address) || wildcard(other.Address)
+}
+
+// socketInodes returns the inodes of the sockets pid has open.
+func socketInodes(pid int) map[string]bool {
+	inodes := make(map[string]bool)
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return inodes
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, entry.Name()))
+		if err == nil && strings.HasPrefix(target, "socket:[") {
+			inodes[strings.Trim(strings.TrimPrefix(target, "socket:"), "[]")] = true
+		}
+	}
+	return inodes
+}
+
+// treeSocketInodes returns the inodes of the sockets the tree rooted at pid
+// has open.
+func treeSocketInodes(pid int) map[string]bool {
+	inodes := make(map[string]bool)
+	for _, p := range processTree(pid) {
+		for inode := range socketInodes(p) {
+			inodes[inode] = true
+		}
+	}
+	return inodes
+}
+
+// readBoundPorts parses /proc/<pid>/net/<proto> and returns the local
+// addresses of its sockets; of TCP sockets only the listening ones. With
+// owned set, only sockets whose inode is in it are returned; otherwise every
+// socket of the network namespace is.
+func readBoundPorts(pid int, proto string, owned map[string]bool) []BoundPort {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/%s", pid, proto))
+	if err != nil {
+		return nil
+	}
+
+	var ports []BoundPort
+	for i, line := range strings.Split(string(data), "\n") {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 10 {
+			continue
+		}
+		if owned != nil && !owned[fields[9]] {
+			continue
+		}
+		if strings.HasPrefix(proto, "tcp") && tcpStates[fields[3]] != "LISTEN" {
+			continue
+		}
+		address, port, err := parseProcNetAddress(fields[1])
+		if err != nil || port == 0 {
+			continue
+		}
+		ports = append(ports, BoundPort{Proto: proto, Address: address, Port: port, inode: fields[9]})
+	}
+	return ports
+}
+
+// parseProcNetAddress decodes "0100007F:0035" as found in /proc/net/udp.
+// The address is written as 32-bit words in host (little endian) order.
+func parseProcNetAddress(s string) (string, int, error) {
+	hexAddr, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return "", 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q", s)
+	}
+	return net.IP(raw).String(), int(port), nil
+}
+
+// checkBoundSockets records the UDP and listening TCP sockets the tree
+// rooted at pid owns. The tables list the whole network namespace, so they
+// are matched against the tree's fds.
+func checkBoundSockets(pid int, info *ProcessInfo) {
+	owned := treeSocketInodes(pid)
+	for _, proto := range []string{"udp", "udp6", "tcp", "tcp6"} {
+		ports := readBoundPorts(pid, proto, owned)
+		if len(ports) > 0 && strings.HasPrefix(proto, "udp") {
+			info.HasUDP = true
+		}
+		info.BoundPorts = append(info.BoundPorts, ports...)
+	}
+}
+
+// recordBoundPorts adds a BOUND_PORTS line to container.meta, if the
+// checkpoint has one; analysis.json holds the ports either way.
+func recordBoundPorts(checkpointDir string, ports []BoundPort) error {
+	metadataFile := filepath.Join(checkpointDir, "container.meta")
+	if len(ports) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(metadataFile); err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(ports))
+	for _, p := range ports {
+		names = append(names, p.String())
+	}
+	sort.Strings(names)
+
+	file, err := os.OpenFile(metadataFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open metadata: %w", err)
+	}
+	fmt.Fprintf(file, "BOUND_PORTS=%s\n", strings.Join(names, ","))
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to record bound ports: %w", err)
+	}
+	return nil
+}
+
+// findPortConflicts returns the ports of the checkpoint that are already
+// taken in the network namespace of pid, each with the process holding it.
+func findPortConflicts(checkpointDir string, pid int) []string {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil || len(info.BoundPorts) == 0 {
+		return nil
+	}
+
+	var inUse []BoundPort
+	for _, proto := range []string{"udp", "udp6", "tcp", "tcp6"} {
+		inUse = append(inUse, readBoundPorts(pid, proto, nil)...)
+	}
+
+	var conflicts []string
+	for _, want := range info.BoundPorts {
+		for _, have := range inUse {
+			if want.conflicts(have) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (in use as %s by %s)", want, have, socketOwner(have.inode)))
+				break
+			}
+		}
+	}
+	return conflicts
+}
+
+// socketOwner names the process holding the socket with inode, found by
+// scanning every process's fds.
+func socketOwner(inode string) string {
+	link := "socket:[" + inode + "]"
+	procs, _ := os.ReadDir("/proc")
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fds, _ := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		for _, fd := range fds {
+			if target, _ := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name())); target == link {
+				return fmt.Sprintf("pid %d (%s)", pid, getProcessName(pid))
+			}
+		}
+	}
+	return "an unknown process"
+}
+
+// checkPortConflicts fails if a port the dumped process had bound is already
+// taken in the network namespace of pid, where the restore will happen. With
+// ignore set the conflicts are only printed.
+func checkPortConflicts(checkpointDir string, pid int, ignore bool) error {
+	conflicts := findPortConflicts(checkpointDir, pid)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if ignore {
+		for _, conflict := range conflicts {
+			logWarnf("port %s is already bound", conflict)
+		}
+		return nil
+	}
+	return fmt.Errorf("ports of the checkpoint are already bound (use --ignore-port-conflicts to restore anyway):\n  %s", strings.Join(conflicts, "\n  "))
+}
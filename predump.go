@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"github.com/checkpoint-restore/go-criu/v7/stats"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// preDumpDirPrefix names the directories of the --pre-dump-count
+	// rounds, pre-dump-1, pre-dump-2, ... inside the checkpoint directory
+	preDumpDirPrefix = "pre-dump-"
+	// metricsFile records how the dump was taken
+	metricsFile = "metrics.json"
+	// preDumpConvergence is the share of dirty pages below which further
+	// pre-dump rounds would gain little
+	preDumpConvergence = 0.01
+)
+
+// DumpMetrics is metrics.json: the pre-dump rounds taken before the dump.
+type DumpMetrics struct {
+	PreDumpCount  int            `json:"pre_dump_count"`
+	PreDumpRounds int            `json:"pre_dump_rounds"`
+	Converged     bool           `json:"converged"`
+	Rounds        []PreDumpRound `json:"rounds"`
+}
+
+// PreDumpRound is one pre-dump, with its page counts from stats-dump.
+type PreDumpRound struct {
+	Round        int     `json:"round"`
+	PagesScanned uint64  `json:"pages_scanned"`
+	PagesWritten uint64  `json:"pages_written"`
+	Seconds      float64 `json:"seconds"`
+}
+
+// runPreDumps copies the memory of the tree in up to cfg.PreDumpCount
+// rounds of CRIU pre-dump while it keeps running, each into its own
+// directory and relative to the round before. It stops early once a round
+// finds less than 1% of the scanned pages dirty. opts is then set up for
+// the final dump to write only the pages dirtied since the last round.
+func runPreDumps(criuClient criuRunner, opts *rpc.CriuOpts, checkpointDir string, cfg *CheckpointConfig) error {
+	defer cfg.timings.track(phasePreDump)()
+
+	metrics := &DumpMetrics{PreDumpCount: cfg.PreDumpCount}
+	for round := 1; round <= cfg.PreDumpCount; round++ {
+		dir := filepath.Join(checkpointDir, fmt.Sprintf("%s%d", preDumpDirPrefix, round))
+		started := time.Now()
+		st, err := preDumpRound(criuClient, opts, dir, round, cfg)
+		if err != nil {
+			return fmt.Errorf("pre-dump round %d failed: %w", round, err)
+		}
+
+		r := PreDumpRound{
+			Round:        round,
+			PagesScanned: st.GetPagesScanned(),
+			PagesWritten: st.GetPagesWritten(),
+			Seconds:      time.Since(started).Seconds(),
+		}
+		metrics.Rounds = append(metrics.Rounds, r)
+		metrics.PreDumpRounds = round
+
+		dirty := 1.0
+		if r.PagesScanned > 0 {
+			dirty = float64(r.PagesWritten) / float64(r.PagesScanned)
+		}
+		logInfof("Pre-dump round %d of %d: %d of %d pages written (%.1f%%) in %.2fs",
+			round, cfg.PreDumpCount, r.PagesWritten, r.PagesScanned, dirty*100, r.Seconds)
+		// The first round writes every page; later ones what changed since
+		if round > 1 && dirty < preDumpConvergence {
+			logInfof("Pre-dump converged after %d rounds", round)
+			metrics.Converged = true
+			break
+		}
+	}
+
+	opts.TrackMem = proto.Bool(true)
+	opts.ParentImg = proto.String(fmt.Sprintf("%s%d", preDumpDirPrefix, metrics.PreDumpRounds))
+	return writeDumpMetrics(checkpointDir, metrics)
+}
+
+// preDumpRound pre-dumps into dir, relative to the previous round, and
+// returns the statistics CRIU wrote there.
+func preDumpRound(criuClient criuRunner, opts *rpc.CriuOpts, dir string, round int, cfg *CheckpointConfig) (*stats.DumpStatsEntry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	imageDir, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	defer imageDir.Close()
+
+	roundOpts := proto.Clone(opts).(*rpc.CriuOpts)
+	roundOpts.ImagesDirFd = proto.Int32(int32(imageDir.Fd()))
+	roundOpts.LogFile = proto.String("pre-dump.log")
+	roundOpts.TrackMem = proto.Bool(true)
+	if round > 1 {
+		// Relative to the images directory of this round
+		roundOpts.ParentImg = proto.String(fmt.Sprintf("../%s%d", preDumpDirPrefix, round-1))
+	}
+
+	if len(cfg.CriuArgs) > 0 {
+		err = execCriu("pre-dump", roundOpts, dir, cfg.CriuArgs)
+	} else {
+		// The hooks and the network lock belong to the final dump
+		err = criuClient.PreDump(roundOpts, nil)
+	}
+	if err != nil {
+		if logData, readErr := os.ReadFile(filepath.Join(dir, "pre-dump.log")); readErr == nil {
+			fmt.Printf("CRIU log:\n%s\n", string(logData))
+		}
+		return nil, err
+	}
+
+	st, err := stats.CriuGetDumpStats(imageDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pre-dump statistics: %w", err)
+	}
+	return st, nil
+}
+
+func writeDumpMetrics(checkpointDir string, metrics *DumpMetrics) error {
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, metricsFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", metricsFile, err)
+	}
+	return nil
+}
+
+// isPreDumpDir reports whether name is the directory of a pre-dump round.
+func isPreDumpDir(name string) bool {
+	return strings.HasPrefix(name, preDumpDirPrefix)
+}
@@ -1,31 +1,94 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/checkpoint-restore/go-criu/v7/rpc"
 	"google.golang.org/protobuf/proto"
 )
 
+// ProcessInfo is the result of analyzing a process before a dump. It is
+// stored as analysis.json in the checkpoint; see analysis.go.
 type ProcessInfo struct {
-	PID             int
-	HasTCP          bool
-	HasUnixSockets  bool
-	HasPipes        bool
-	HasEventfd      bool
-	HasSignalfd     bool
-	HasTimerfd      bool
-	ProcessName     string
-	State           string
+	Version        int  `json:"version"`
+	PID            int  `json:"pid"`
+	HasTCP         bool `json:"has_tcp"`
+	HasUDP         bool `json:"has_udp"`
+	HasUnixSockets bool `json:"has_unix_sockets"`
+	HasPipes       bool `json:"has_pipes"`
+	HasEventfd     bool `json:"has_eventfd"`
+	HasSignalfd    bool `json:"has_signalfd"`
+	HasTimerfd     bool `json:"has_timerfd"`
+	HasBPF         bool `json:"has_bpf"`
+	HasInotify     bool `json:"has_inotify"`
+	HasFanotify    bool `json:"has_fanotify"`
+	BPFFdCount     int  `json:"bpf_fd_count"`
+	// FDCount is the number of open file descriptors, FDTypes the count of
+	// each kind; see fdKind
+	FDCount     int            `json:"fd_count"`
+	FDTypes     map[string]int `json:"fd_types,omitempty"`
+	ProcessName string         `json:"process_name"`
+	State       string         `json:"state"`
+	// The CRIU options the dump used, which restore must repeat
+	TCPEstablished bool `json:"tcp_established"`
+	ExtUnixSk      bool `json:"ext_unix_sk"`
+	ShellJob       bool `json:"shell_job"`
+	// MappedFiles lists the file-backed memory mappings
+	MappedFiles []MappedFile `json:"mapped_files,omitempty"`
+	// LockedMemory is the mlock()ed memory of the tree in bytes; CRIU
+	// restores it unlocked
+	HasLockedMemory bool  `json:"has_locked_memory"`
+	LockedMemory    int64 `json:"locked_memory,omitempty"`
+	// HugePages are the tree's hugetlb mappings
+	HasHugePages bool              `json:"has_huge_pages"`
+	HugePages    []HugePageMapping `json:"huge_pages,omitempty"`
+	// SharedMemory is the shared memory used by the process tree
+	SharedMemory *SharedMemory `json:"shared_memory,omitempty"`
+	// Watches are the inotify watches and fanotify marks
+	Watches []FSWatch `json:"watches,omitempty"`
+	// OpenFiles are the files the tree holds open, with the mount each is on
+	OpenFiles []OpenFile `json:"open_files,omitempty"`
+	// DeletedFiles are open files that have been unlinked
+	DeletedFiles []DeletedFile `json:"deleted_files,omitempty"`
+	// TCPConnections are the connected TCP sockets of the process tree;
+	// with --tcp-iface only those on TCPInterface
+	TCPConnections []TCPConnection `json:"tcp_connections,omitempty"`
+	TCPInterface   string          `json:"tcp_interface,omitempty"`
+	// BoundPorts are the local addresses of the tree's UDP and listening
+	// TCP sockets
+	BoundPorts []BoundPort `json:"bound_ports,omitempty"`
+	// NetlinkSockets are kept apart from HasUnixSockets
+	NetlinkSockets []NetlinkSocket `json:"netlink_sockets,omitempty"`
+	// Estimate predicts the checkpoint's size and duration
+	Estimate *Estimate `json:"estimate,omitempty"`
+	// UnsupportedFDs are io_uring, pidfd and other fds CRIU cannot dump,
+	// across the whole process tree
+	UnsupportedFDs []UnsupportedFD `json:"unsupported_fds,omitempty"`
+	// Session is the session and terminal of the process; ShellJob is
+	// derived from it
+	Session *SessionInfo `json:"session,omitempty"`
+	// MQNames are the POSIX message queues the tree holds open, by their
+	// name in /dev/mqueue
+	HasMQ   bool     `json:"has_mq"`
+	MQNames []string `json:"mq_names,omitempty"`
+	// Arch is the executable's machine and the dump host's CPU flags
+	Arch *ArchInfo `json:"arch,omitempty"`
+	// Tracers are the ptrace tracers of threads in the tree
+	Tracers []Tracer `json:"tracers,omitempty"`
+	// Assessment is the score and verdict of the analysis
+	Assessment *Assessment `json:"assessment,omitempty"`
 }
 
 func analyzeProcess(pid int) (*ProcessInfo, error) {
 	info := &ProcessInfo{
-		PID: pid,
+		Version: analysisVersion,
+		PID:     pid,
 	}
 
 	if err := validateProcessExists(pid); err != nil {
@@ -34,11 +97,26 @@ func analyzeProcess(pid int) (*ProcessInfo, error) {
 
 	info.State = getProcessState(pid)
 	info.ProcessName = getProcessName(pid)
+	info.Arch = analyzeArch(pid)
+	info.Tracers = findTracers(pid)
 
 	checkFileDescriptors(pid, info)
+	resolveWatchPaths(pid, info.Watches)
 
 	checkNetworkConnections(pid, info)
 
+	info.TCPEstablished = info.HasTCP
+	info.ExtUnixSk = info.HasUnixSockets
+	info.Session = analyzeSession(pid)
+	info.ShellJob = info.Session.NeedsShellJob()
+
+	if mapped, err := analyzeMappedFiles(pid); err == nil {
+		info.MappedFiles = mapped
+	}
+	info.SharedMemory = analyzeSharedMemory(pid)
+	analyzeLockedMemory(pid, info)
+	info.OpenFiles = analyzeOpenFiles(pid)
+
 	return info, nil
 }
 
@@ -112,6 +190,10 @@ func checkFileDescriptors(pid int, info *ProcessInfo) {
 	if err != nil {
 		return
 	}
+	netlink := readNetlinkTable(pid)
+	info.UnsupportedFDs = findUnsupportedFDs(pid)
+	info.FDCount = len(entries)
+	info.FDTypes = make(map[string]int)
 
 	for _, entry := range entries {
 		fdPath := fmt.Sprintf("%s/%s", fdDir, entry.Name())
@@ -119,53 +201,91 @@ func checkFileDescriptors(pid int, info *ProcessInfo) {
 		if err != nil {
 			continue
 		}
+		info.FDTypes[fdKind(linkTarget)]++
 
 		if strings.HasPrefix(linkTarget, "pipe:") {
 			info.HasPipes = true
 		} else if strings.HasPrefix(linkTarget, "socket:") {
-			info.HasUnixSockets = true
+			inode := strings.Trim(strings.TrimPrefix(linkTarget, "socket:"), "[]")
+			fd, _ := strconv.Atoi(entry.Name())
+			if sock := netlinkSocketFor(fdPath, fd, netlink[inode]); sock != nil {
+				info.NetlinkSockets = append(info.NetlinkSockets, *sock)
+			} else {
+				info.HasUnixSockets = true
+			}
 		} else if strings.HasPrefix(linkTarget, "anon_inode:[eventfd]") {
 			info.HasEventfd = true
 		} else if strings.HasPrefix(linkTarget, "anon_inode:[signalfd]") {
 			info.HasSignalfd = true
 		} else if strings.HasPrefix(linkTarget, "anon_inode:[timerfd]") {
 			info.HasTimerfd = true
+		} else if strings.HasPrefix(linkTarget, "anon_inode:bpf") {
+			// bpf-map, bpf-prog, bpf_link, ...
+			info.HasBPF = true
+			info.BPFFdCount++
+		} else if linkTarget == "anon_inode:inotify" {
+			info.HasInotify = true
+			fd, _ := strconv.Atoi(entry.Name())
+			info.Watches = append(info.Watches, readWatches(pid, fd, "inotify")...)
+		} else if linkTarget == "anon_inode:[fanotify]" {
+			info.HasFanotify = true
+			fd, _ := strconv.Atoi(entry.Name())
+			info.Watches = append(info.Watches, readWatches(pid, fd, "fanotify")...)
+		} else if strings.HasPrefix(linkTarget, "/dev/mqueue/") {
+			info.HasMQ = true
+			name := strings.TrimSuffix(strings.TrimPrefix(linkTarget, "/dev/mqueue/"), " (deleted)")
+			if !contains(info.MQNames, name) {
+				info.MQNames = append(info.MQNames, name)
+			}
+		} else if strings.HasSuffix(linkTarget, " (deleted)") {
+			fd, _ := strconv.Atoi(entry.Name())
+			if deleted := deletedFileFor(pid, fd, linkTarget); deleted != nil {
+				info.DeletedFiles = append(info.DeletedFiles, *deleted)
+			}
 		}
 	}
 }
 
-func checkNetworkConnections(pid int, info *ProcessInfo) {
-	checkTCPConnections(fmt.Sprintf("/proc/%d/net/tcp", pid), info)
-	checkTCPConnections(fmt.Sprintf("/proc/%d/net/tcp6", pid), info)
-
-	checkUnixSockets(fmt.Sprintf("/proc/%d/net/unix", pid), info)
+// fdKind classifies the target of a /proc/<pid>/fd link: socket, pipe,
+// file, or the kind of an anonymous inode, e.g. eventfd or eventpoll.
+func fdKind(linkTarget string) string {
+	switch {
+	case strings.HasPrefix(linkTarget, "socket:"):
+		return "socket"
+	case strings.HasPrefix(linkTarget, "pipe:"):
+		return "pipe"
+	case strings.HasPrefix(linkTarget, "anon_inode:"):
+		return strings.Trim(strings.TrimPrefix(linkTarget, "anon_inode:"), "[]")
+	case strings.HasPrefix(linkTarget, "/"):
+		return "file"
+	}
+	return "other"
 }
 
-func checkTCPConnections(path string, info *ProcessInfo) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return
+// formatFDTypes lists the kinds of file descriptors, most common first.
+func formatFDTypes(types map[string]int) string {
+	kinds := make([]string, 0, len(types))
+	for kind := range types {
+		kinds = append(kinds, kind)
 	}
-
-	lines := strings.Split(string(data), "\n")
-	for i, line := range lines {
-		if i == 0 || line == "" {
-			continue
+	sort.Slice(kinds, func(i, j int) bool {
+		if types[kinds[i]] != types[kinds[j]] {
+			return types[kinds[i]] > types[kinds[j]]
 		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", types[kind], kind)
+	}
+	return strings.Join(parts, ", ")
+}
 
-		fields := strings.Fields(line)
-		if len(fields) < 4 {
-			continue
-		}
+func checkNetworkConnections(pid int, info *ProcessInfo) {
+	checkTCPConnections(pid, info)
+	checkBoundSockets(pid, info)
 
-		stateStr := fields[3]
-		if state, err := strconv.ParseUint(stateStr, 16, 32); err == nil {
-			if state == 0x01 {
-				info.HasTCP = true
-				return
-			}
-		}
-	}
+	checkUnixSockets(fmt.Sprintf("/proc/%d/net/unix", pid), info)
 }
 
 func checkUnixSockets(path string, info *ProcessInfo) {
@@ -180,7 +300,24 @@ func checkUnixSockets(path string, info *ProcessInfo) {
 	}
 }
 
-func prepareProcessForDump(pid int, opts *rpc.CriuOpts) error {
+// applySocketOptions sets the CRIU options the tree's sockets call for.
+// owned are the connections of the network namespace that the tree holds,
+// as matched by checkTCPConnections; connections of other processes in a
+// shared namespace are not in it and do not turn on tcp-established.
+func applySocketOptions(opts *rpc.CriuOpts, owned []TCPConnection, hasUnixSockets bool) {
+	if len(owned) > 0 {
+		opts.TcpEstablished = proto.Bool(true)
+	}
+	if hasUnixSockets {
+		opts.ExtUnixSk = proto.Bool(true)
+	}
+}
+
+// prepareProcessForDump analyzes pid, sets the CRIU options the analysis
+// calls for and records it in checkpointDir for restore.
+func prepareProcessForDump(pid int, checkpointDir string, opts *rpc.CriuOpts, cfg *CheckpointConfig) error {
+	defer cfg.timings.track(phaseAnalysis)()
+
 	info, err := analyzeProcess(pid)
 	if err != nil {
 		return fmt.Errorf("failed to analyze process: %w", err)
@@ -189,69 +326,124 @@ func prepareProcessForDump(pid int, opts *rpc.CriuOpts) error {
 	if info.State == "zombie" {
 		return fmt.Errorf("cannot checkpoint zombie process")
 	}
+	if err := checkTracers(pid, info, cfg.DetachTracer); err != nil {
+		return err
+	}
 
-	fmt.Printf("Process analysis for PID %d:\n", pid)
-	fmt.Printf("  Name: %s\n", info.ProcessName)
-	fmt.Printf("  State: %s\n", info.State)
-	fmt.Printf("  TCP connections: %v\n", info.HasTCP)
-	fmt.Printf("  Unix sockets: %v\n", info.HasUnixSockets)
-	fmt.Printf("  Pipes: %v\n", info.HasPipes)
+	printProcessInfo(info)
 
-	if info.HasTCP {
-		opts.TcpEstablished = proto.Bool(true)
+	if cfg.FDLimit > 0 && info.FDCount > cfg.FDLimit {
+		// Every descriptor adds to the fd-info images
+		return fmt.Errorf("process %d has %d open file descriptors, more than --checkpoint-fd-limit %d (%s); close some or raise the limit",
+			pid, info.FDCount, cfg.FDLimit, formatFDTypes(info.FDTypes))
 	}
 
-	if info.HasUnixSockets {
-		opts.ExtUnixSk = proto.Bool(true)
+	container := ""
+	if metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta")); err == nil {
+		container = strings.TrimPrefix(metadata["CONTAINER_NAME"], "/")
 	}
-
-	if opts.ShellJob == nil {
-		if isShellJob(pid) {
-			opts.ShellJob = proto.Bool(true)
-		} else {
-			opts.ShellJob = proto.Bool(false)
+	throughput := cfg.AssumedThroughput
+	if throughput <= 0 {
+		throughput = defaultDumpThroughput
+	}
+	info.Estimate = estimateCheckpoint(pid, info, container, cfg.Compress, throughput)
+	printEstimate(info.Estimate)
+
+	info.Assessment = assessCheckpointability(info, cfg.CriuService)
+	printAssessment(info.Assessment)
+	if blocking := info.Assessment.blockingIssues(); len(blocking) > 0 {
+		if !cfg.Force {
+			return fmt.Errorf("%d blocking issue(s) found, starting with: %s (use --force to try anyway)", len(blocking), blocking[0].Problem)
 		}
+		logWarnf("%d blocking issue(s) found; continuing because of --force", len(blocking))
 	}
 
-	return nil
-}
+	warnSharedMemory(info.SharedMemory)
+	warnNetlinkSockets(info.NetlinkSockets)
+	if info.HasLockedMemory {
+		logWarnf("the process tree has %s of mlock()ed memory; it is restored unlocked and the application must lock it again", formatSize(info.LockedMemory))
+	}
 
-func isShellJob(pid int) bool {
-	pgid, err := syscall.Getpgid(pid)
-	if err != nil {
-		return false
+	if info.HasBPF {
+		// CRIU cannot dump eBPF maps/programs and does not always say so clearly
+		if !cfg.IgnoreBPF {
+			return fmt.Errorf("process holds %d eBPF file descriptor(s) which CRIU cannot checkpoint (use --ignore-bpf to try anyway)", info.BPFFdCount)
+		}
+		logWarnf("process holds %d eBPF file descriptor(s); the dump will likely fail or lose them", info.BPFFdCount)
 	}
 
-	// Get session ID using /proc filesystem since Getsid may not be available
-	statFile := fmt.Sprintf("/proc/%d/stat", pid)
-	data, err := os.ReadFile(statFile)
-	if err != nil {
-		return false
+	if info.HasFanotify {
+		// Most CRIU builds cannot restore fanotify marks
+		if !cfg.IgnoreFanotify {
+			return fmt.Errorf("process holds a fanotify file descriptor which CRIU usually cannot restore (use --ignore-fanotify to try anyway)")
+		}
+		logWarnf("process holds a fanotify file descriptor; the restore will likely fail")
+	}
+	if info.HasMQ {
+		logWarnf("process holds POSIX message queue(s) %s; like external unix sockets (--ext-unix-sk) they need handling "+
+			"outside the dump, and messages queued in the kernel may be lost across the restore", strings.Join(info.MQNames, ", "))
+	}
+	for _, w := range info.Watches {
+		if w.Kind == "inotify" && w.Path == "" {
+			logWarnf("inotify watch on inode %d (%s) could not be resolved to a path; restore cannot check it exists", w.Inode, w.Device)
+		}
 	}
 
-	// Parse session ID from stat file (field 6)
-	statStr := string(data)
-	startParen := strings.Index(statStr, "(")
-	endParen := strings.LastIndex(statStr, ")")
-	if startParen != -1 && endParen != -1 && endParen > startParen {
-		afterParen := statStr[endParen+2:]
-		fields := strings.Fields(afterParen)
-		if len(fields) > 3 {
-			sidStr := fields[3]
-			sid, err := strconv.Atoi(sidStr)
-			if err == nil {
-				return pgid == sid
-			}
+	applySocketOptions(opts, info.TCPConnections, info.HasUnixSockets)
+	if cfg.TCPIface != "" {
+		if err := selectTCPInterface(pid, info, cfg.TCPIface); err != nil {
+			return err
 		}
 	}
 
-	return false
+	if opts.ShellJob == nil {
+		opts.ShellJob = proto.Bool(info.ShellJob)
+	}
+
+	if cfg.workDir != nil {
+		opts.WorkDirFd = proto.Int32(int32(cfg.workDir.Fd()))
+	}
+
+	if cfg.GhostLimit > 0 {
+		opts.GhostLimit = proto.Uint32(uint32(cfg.GhostLimit))
+	}
+	applyMappedFileOptions(pid, info.MappedFiles, opts)
+	applyDeletedFileOptions(info.DeletedFiles, opts)
+
+	info.TCPEstablished = opts.GetTcpEstablished()
+	info.ExtUnixSk = opts.GetExtUnixSk()
+	info.ShellJob = opts.GetShellJob()
+
+	if err := checkDiskSpace(checkpointDir, info.Estimate); err != nil {
+		return err
+	}
+
+	if err := recordBoundPorts(checkpointDir, info.BoundPorts); err != nil {
+		logWarnf("%v", err)
+	}
+	if err := recordProcessManifest(pid, checkpointDir, cfg.RedactEnv); err != nil {
+		logWarnf("%v", err)
+	}
+
+	return saveAnalysis(checkpointDir, info)
 }
 
+// prepareProcessForRestore sets the options the dump was taken with from
+// analysis.json. Checkpoints without one get the old fixed defaults.
 func prepareProcessForRestore(checkpointDir string, opts *rpc.CriuOpts) error {
-	opts.TcpEstablished = proto.Bool(true)
-	opts.ExtUnixSk = proto.Bool(true)
-	opts.ShellJob = proto.Bool(false)
+	info, err := loadAnalysis(checkpointDir)
+	if errors.Is(err, os.ErrNotExist) {
+		opts.TcpEstablished = proto.Bool(true)
+		opts.ExtUnixSk = proto.Bool(true)
+		opts.ShellJob = proto.Bool(false)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	opts.TcpEstablished = proto.Bool(info.TCPEstablished)
+	opts.ExtUnixSk = proto.Bool(info.ExtUnixSk)
+	opts.ShellJob = proto.Bool(info.ShellJob)
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+)
+
+// netTCP is a /proc/net/tcp of a network namespace shared by two trees:
+// the dumped tree owns some of inodes 1001-1005, a busy neighbour 2001.
+const netTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 1002 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:0050 0100007F:C350 01 00000000:00000000 00:00000000 00000000  1000        0 2001 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:0050 0100007F:C351 08 00000000:00000000 00:00000000 00000000  1000        0 1005 1 0000000000000000 20 4 30 10 -1
+   4: 0100007F:1F91 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 1003 1 0000000000000000 100 0 0 10 0
+`
+
+const netTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1F90 00000000000000000000000001000000:D432 01 00000000:00000000 00:00000000 00000000  1000        0 1004 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestApplySocketOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		proto       string
+		table       string
+		owners      map[string]int
+		unixSockets bool
+		wantConns   int
+		wantTCP     bool
+		wantUnix    bool
+	}{
+		{
+			name:      "tree owns an established connection",
+			proto:     "tcp",
+			table:     netTCP,
+			owners:    map[string]int{"1001": 10, "1002": 11},
+			wantConns: 1,
+			wantTCP:   true,
+		},
+		{
+			name:   "only the neighbour has connections",
+			proto:  "tcp",
+			table:  netTCP,
+			owners: map[string]int{"1001": 10},
+		},
+		{
+			name:   "tree owns only a closed socket",
+			proto:  "tcp",
+			table:  netTCP,
+			owners: map[string]int{"1003": 10},
+		},
+		{
+			name:   "tree owns no sockets",
+			proto:  "tcp",
+			table:  netTCP,
+			owners: map[string]int{},
+		},
+		{
+			name:      "tree owns a half-closed connection",
+			proto:     "tcp",
+			table:     netTCP,
+			owners:    map[string]int{"1005": 12},
+			wantConns: 1,
+			wantTCP:   true,
+		},
+		{
+			name:      "tree owns an IPv6 connection",
+			proto:     "tcp6",
+			table:     netTCP6,
+			owners:    map[string]int{"1004": 10},
+			wantConns: 1,
+			wantTCP:   true,
+		},
+		{
+			name:        "unix sockets without TCP",
+			proto:       "tcp",
+			table:       netTCP,
+			owners:      map[string]int{"1001": 10},
+			unixSockets: true,
+			wantUnix:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conns := parseTCPConnections(tt.table, tt.proto, tt.owners)
+			if len(conns) != tt.wantConns {
+				t.Fatalf("got %d owned connections %v, want %d", len(conns), conns, tt.wantConns)
+			}
+			for _, conn := range conns {
+				if !ownedBy(tt.owners, conn.PID) {
+					t.Errorf("connection %v is not the tree's", conn)
+				}
+			}
+
+			opts := &rpc.CriuOpts{}
+			applySocketOptions(opts, conns, tt.unixSockets)
+			if opts.GetTcpEstablished() != tt.wantTCP {
+				t.Errorf("TcpEstablished = %v, want %v", opts.GetTcpEstablished(), tt.wantTCP)
+			}
+			if !tt.wantTCP && opts.TcpEstablished != nil {
+				t.Errorf("TcpEstablished set to false instead of left unset")
+			}
+			if opts.GetExtUnixSk() != tt.wantUnix {
+				t.Errorf("ExtUnixSk = %v, want %v", opts.GetExtUnixSk(), tt.wantUnix)
+			}
+		})
+	}
+}
+
+func TestParseTCPConnectionsAttributesOwner(t *testing.T) {
+	conns := parseTCPConnections(netTCP, "tcp", map[string]int{"1002": 42})
+	if len(conns) != 1 {
+		t.Fatalf("got %d connections, want 1", len(conns))
+	}
+	want := TCPConnection{PID: 42, Proto: "tcp", Local: "127.0.0.1:8080", Remote: "127.0.0.1:54321", State: "ESTABLISHED"}
+	if conns[0] != want {
+		t.Errorf("got %+v, want %+v", conns[0], want)
+	}
+}
+
+func ownedBy(owners map[string]int, pid int) bool {
+	for _, owner := range owners {
+		if owner == pid {
+			return true
+		}
+	}
+	return false
+}
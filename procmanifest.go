@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// processManifestFile records how every process of the dumped tree was
+// started, for audits and for restore to check the executables exist.
+const processManifestFile = "process-manifest.json"
+
+// redactedValue replaces the value of a redacted environment variable.
+const redactedValue = "REDACTED"
+
+// defaultRedactPatterns are the variable names whose values are scrubbed
+// when no --redact-env is given. They match case-insensitively.
+var defaultRedactPatterns = []string{"*PASSWORD*", "*PASSWD*", "*SECRET*", "*TOKEN*", "*KEY*", "*CREDENTIAL*", "*AUTH*"}
+
+// ProcessRecord is one process of the manifest.
+type ProcessRecord struct {
+	PID     int               `json:"pid"`
+	Exe     string            `json:"exe"`
+	Cwd     string            `json:"cwd"`
+	Cmdline []string          `json:"cmdline"`
+	Environ map[string]string `json:"environ,omitempty"`
+}
+
+// ProcessManifest is the content of process-manifest.json. The root
+// process comes first.
+type ProcessManifest struct {
+	Processes []ProcessRecord `json:"processes"`
+	// Redacted are the patterns whose matching variables were scrubbed
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// Root returns the record of the dumped process itself.
+func (m *ProcessManifest) Root() *ProcessRecord {
+	if len(m.Processes) == 0 {
+		return nil
+	}
+	return &m.Processes[0]
+}
+
+// recordProcessManifest writes process-manifest.json for the tree rooted at
+// pid. Variables matching redact, or defaultRedactPatterns if it is empty,
+// are written with their value replaced.
+func recordProcessManifest(pid int, checkpointDir string, redact []string) error {
+	if len(redact) == 0 {
+		redact = defaultRedactPatterns
+	}
+
+	manifest := &ProcessManifest{Redacted: redact}
+	for _, p := range processTree(pid) {
+		record := ProcessRecord{PID: p}
+		record.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", p))
+		record.Cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", p))
+		if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", p)); err == nil {
+			record.Cmdline = strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		}
+		if env, err := readProcessEnviron(p); err == nil {
+			redactEnviron(env, redact)
+			record.Environ = env
+		}
+		manifest.Processes = append(manifest.Processes, record)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, processManifestFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", processManifestFile, err)
+	}
+	return nil
+}
+
+// redactEnviron replaces the values of the variables matching a pattern.
+func redactEnviron(env map[string]string, patterns []string) {
+	for name := range env {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); matched {
+				env[name] = redactedValue
+				break
+			}
+		}
+	}
+}
+
+// loadProcessManifest reads process-manifest.json, nil if there is none.
+func loadProcessManifest(checkpointDir string) (*ProcessManifest, error) {
+	data, err := os.ReadFile(filepath.Join(checkpointDir, processManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", processManifestFile, err)
+	}
+	manifest := &ProcessManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", processManifestFile, err)
+	}
+	return manifest, nil
+}
+
+// verifyExecutables checks that the executable of every process in the
+// manifest exists below root. CRIU maps the executable from its path; an
+// executable that was already deleted at the dump is in the images.
+func verifyExecutables(checkpointDir, root string) error {
+	manifest, err := loadProcessManifest(checkpointDir)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var missing []string
+	for _, record := range manifest.Processes {
+		if record.Exe == "" || strings.HasSuffix(record.Exe, " (deleted)") || seen[record.Exe] {
+			continue
+		}
+		seen[record.Exe] = true
+		if _, err := os.Stat(filepath.Join(root, record.Exe)); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (pid %d)", record.Exe, record.PID))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("executables of the checkpointed processes are missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// printProcessRoot prints the command line and working directory of the
+// manifest's root process, with the given label width.
+func printProcessRoot(manifest *ProcessManifest, format string) {
+	root := manifest.Root()
+	if root == nil {
+		return
+	}
+	fmt.Printf(format, "Command:", strings.Join(root.Cmdline, " "))
+	fmt.Printf(format, "Cwd:", root.Cwd)
+	if len(manifest.Processes) > 1 {
+		fmt.Printf(format, "Processes:", fmt.Sprint(len(manifest.Processes)))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressNDJSON is the format of --progress: one JSON event per line.
+const progressNDJSON = "ndjson"
+
+// Types of progress events
+const (
+	eventStart      = "start"
+	eventPhaseStart = "phase-start"
+	eventPhaseEnd   = "phase-end"
+	eventNotify     = "notify"
+	eventBytes      = "bytes"
+	eventRetry      = "retry"
+	eventWarning    = "warning"
+	eventError      = "error"
+	eventDone       = "done"
+)
+
+// progressInterval is how often the bytes written are reported.
+const progressInterval = time.Second
+
+// ProgressEvent is one line of --progress=ndjson. Every event carries the
+// time, the ID of the operation and its type; the other fields depend on
+// the type.
+type ProgressEvent struct {
+	Time        time.Time `json:"time"`
+	OperationID string    `json:"operation_id"`
+	Operation   string    `json:"operation"`
+	Type        string    `json:"type"`
+	// Target is the container or PID, or the checkpoint restored (start)
+	Target string `json:"target,omitempty"`
+	// Phase is a timed phase (phase-start, phase-end) or a CRIU
+	// notification (notify)
+	Phase string `json:"phase,omitempty"`
+	// Seconds is the duration of a phase (phase-end) or of the operation
+	// (done)
+	Seconds float64 `json:"seconds,omitempty"`
+	// Bytes is the size of the checkpoint written so far (bytes)
+	Bytes int64 `json:"bytes,omitempty"`
+	// Message describes a retry, warning or error
+	Message string `json:"message,omitempty"`
+}
+
+// progressStream writes the events of one operation as NDJSON.
+type progressStream struct {
+	mu        sync.Mutex
+	enc       *json.Encoder
+	id        string
+	operation string
+	started   time.Time
+}
+
+// progress receives the events of the running operation; nil without
+// --progress.
+var progress *progressStream
+
+// validateProgress checks a --progress value; empty means none.
+func validateProgress(format string) error {
+	if format == "" || format == progressNDJSON {
+		return nil
+	}
+	return fmt.Errorf("--progress must be ndjson, not %q", format)
+}
+
+// startProgress starts writing the events of operation on target to stdout
+// if format is ndjson. Human-readable output moves to stderr, as for a
+// streamed checkpoint.
+func startProgress(format, operation, target string) error {
+	if format == "" {
+		return nil
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	progress = &progressStream{
+		enc:       json.NewEncoder(os.Stdout),
+		id:        id,
+		operation: operation,
+		started:   time.Now(),
+	}
+	os.Stdout = humanStderr()
+	progress.emit(ProgressEvent{Type: eventStart, Target: target})
+	return nil
+}
+
+// emit writes ev, filling in the time and the operation.
+func (p *progressStream) emit(ev ProgressEvent) {
+	if p == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.OperationID = p.id
+	ev.Operation = p.operation
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+// done reports that the operation succeeded.
+func (p *progressStream) done() {
+	if p == nil {
+		return
+	}
+	p.emit(ProgressEvent{Type: eventDone, Seconds: time.Since(p.started).Seconds()})
+}
+
+// retry reports that the operation is tried again another way after err.
+func (p *progressStream) retry(how string, err error) {
+	p.emit(ProgressEvent{Type: eventRetry, Message: fmt.Sprintf("%s after: %v", how, err)})
+}
+
+// watchBytes reports the size of dir every progressInterval, when it
+// changed, until the returned function is called, which reports it once
+// more.
+func (p *progressStream) watchBytes(dir string) func() {
+	if p == nil {
+		return func() {}
+	}
+	var last int64
+	report := func() {
+		if size, err := directorySize(dir); err == nil && size != last {
+			last = size
+			p.emit(ProgressEvent{Type: eventBytes, Bytes: size})
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		report()
+	}
+}
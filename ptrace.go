@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tracerDetachTimeout is how long --detach-tracer waits for the signalled
+// tracers to let go.
+const tracerDetachTimeout = 5 * time.Second
+
+// Tracer is a process ptrace-attached to a thread of the dumped tree, such
+// as a debugger, strace or a seccomp supervisor. CRIU cannot seize a thread
+// that is already traced.
+type Tracer struct {
+	// PID and TID are the traced process and thread
+	PID       int    `json:"pid"`
+	TID       int    `json:"tid"`
+	TracerPID int    `json:"tracer_pid"`
+	Name      string `json:"tracer_name"`
+}
+
+// findTracers reads TracerPid of every thread in the tree rooted at pid.
+// docker-cr's own --checkpoint-on-signal tracing has ended by the dump.
+func findTracers(pid int) []Tracer {
+	var tracers []Tracer
+	for _, p := range processTree(pid) {
+		tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", p))
+		if err != nil {
+			continue
+		}
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+			tracer := tracerPID(fmt.Sprintf("/proc/%d/task/%d/status", p, tid))
+			if tracer == 0 || tracer == os.Getpid() {
+				continue
+			}
+			tracers = append(tracers, Tracer{PID: p, TID: tid, TracerPID: tracer, Name: getProcessName(tracer)})
+		}
+	}
+	return tracers
+}
+
+// tracerPID returns the TracerPid field of a status file, 0 if untraced.
+func tracerPID(statusFile string) int {
+	data, err := os.ReadFile(statusFile)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "TracerPid:"); ok {
+			pid, _ := strconv.Atoi(strings.TrimSpace(value))
+			return pid
+		}
+	}
+	return 0
+}
+
+// parseTracerSignal parses --detach-tracer. Unlike --checkpoint-on-signal it
+// accepts KILL, the usual way to make a stuck debugger let go.
+func parseTracerSignal(s string) (syscall.Signal, error) {
+	if strings.TrimPrefix(strings.ToUpper(s), "SIG") == "KILL" {
+		return syscall.SIGKILL, nil
+	}
+	return parseSignal(s)
+}
+
+// checkTracers fails when the tree is traced, naming each tracer. With a
+// detach signal the tracers are sent it and the check passes once they
+// have all let go.
+func checkTracers(pid int, info *ProcessInfo, detachSignal string) error {
+	if len(info.Tracers) == 0 {
+		if info.State == "tracing stop" {
+			// The tracer went away between reading the state and TracerPid;
+			// CRIU would find the process still stopped
+			return fmt.Errorf("process %d is in tracing stop; resume it before the checkpoint", pid)
+		}
+		return nil
+	}
+
+	tracerPIDs := make(map[int]string)
+	var traced []string
+	for _, t := range info.Tracers {
+		tracerPIDs[t.TracerPID] = t.Name
+		traced = append(traced, fmt.Sprintf("thread %d of %d traced by %d (%s)", t.TID, t.PID, t.TracerPID, t.Name))
+	}
+
+	if detachSignal == "" {
+		var kills []string
+		for tracer := range tracerPIDs {
+			kills = append(kills, strconv.Itoa(tracer))
+		}
+		return fmt.Errorf("the process tree is being traced, which CRIU cannot checkpoint:\n  %s\nDetach the tracer (kill %s) or use --detach-tracer",
+			strings.Join(traced, "\n  "), strings.Join(kills, " "))
+	}
+
+	sig, err := parseTracerSignal(detachSignal)
+	if err != nil {
+		return err
+	}
+	for tracer, name := range tracerPIDs {
+		logInfof("Sending %v to tracer %d (%s)", sig, tracer, name)
+		if err := syscall.Kill(tracer, sig); err != nil {
+			return fmt.Errorf("failed to signal tracer %d: %w", tracer, err)
+		}
+	}
+
+	deadline := time.Now().Add(tracerDetachTimeout)
+	for {
+		remaining := findTracers(pid)
+		if len(remaining) == 0 {
+			info.Tracers = nil
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tracer %d still attached to %d after %v", remaining[0].TracerPID, remaining[0].TID, tracerDetachTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPushgatewayJob is the job label of pushed metrics.
+const defaultPushgatewayJob = "docker-cr"
+
+var pushgatewayClient = &http.Client{Timeout: 10 * time.Second}
+
+// metricDef is a metric docker-cr exposes; every one is a gauge labelled
+// with the container and the operation.
+type metricDef struct {
+	name string
+	help string
+}
+
+// The metrics of an operation. Anything that exports them uses these
+// definitions, so names and labels stay the same everywhere.
+var (
+	metricSuccess   = metricDef{"docker_cr_operation_success", "Whether the last operation succeeded (1) or failed (0)."}
+	metricDuration  = metricDef{"docker_cr_operation_duration_seconds", "Duration of the last operation."}
+	metricTimestamp = metricDef{"docker_cr_operation_last_run_timestamp_seconds", "Unix time the last operation ended."}
+	metricSize      = metricDef{"docker_cr_checkpoint_size_bytes", "Size of the checkpoint directory of the last operation."}
+	metricFreeze    = metricDef{"docker_cr_freeze_seconds", "Time the process tree was frozen by the last checkpoint."}
+)
+
+// metricLabels are the labels of every metric, in order.
+var metricLabels = []string{"container", "operation"}
+
+// pushgatewayTarget pushes the metrics of one checkpoint or restore to a
+// Prometheus Pushgateway when it ends. The group is keyed by job, instance,
+// container and operation, so every run replaces the metrics of the last
+// run of the same operation on the same container.
+type pushgatewayTarget struct {
+	url       string
+	job       string
+	instance  string
+	operation string
+	container string
+	// checkpointDir is measured for the size; empty if there is none
+	checkpointDir string
+	timings       *Timings
+	pushed        bool
+}
+
+// pushgateway receives the metrics of the running operation; nil without
+// --pushgateway.
+var pushgateway *pushgatewayTarget
+
+// startPushgateway arranges for the metrics of operation on container to
+// be pushed to gatewayURL when it ends. An empty instance is the hostname.
+func startPushgateway(gatewayURL, job, instance, operation, container, checkpointDir string, timings *Timings) {
+	if gatewayURL == "" {
+		return
+	}
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	pushgateway = &pushgatewayTarget{
+		url:           strings.TrimRight(gatewayURL, "/"),
+		job:           job,
+		instance:      instance,
+		operation:     operation,
+		container:     container,
+		checkpointDir: checkpointDir,
+		timings:       timings,
+	}
+}
+
+// push sends the result of the operation, once. A failed push is only a
+// warning: it never changes how the command exits.
+func (p *pushgatewayTarget) push(success bool) {
+	if p == nil || p.pushed {
+		return
+	}
+	p.pushed = true
+
+	var body bytes.Buffer
+	labels := p.labels()
+	result := 0.0
+	if success {
+		result = 1
+	}
+	writeMetric(&body, metricSuccess, labels, result)
+	if p.timings != nil {
+		writeMetric(&body, metricDuration, labels, time.Since(p.timings.started).Seconds())
+		if p.timings.FreezeSeconds > 0 {
+			writeMetric(&body, metricFreeze, labels, p.timings.FreezeSeconds)
+		}
+	}
+	writeMetric(&body, metricTimestamp, labels, float64(time.Now().Unix()))
+	if p.checkpointDir != "" {
+		if size, err := directorySize(p.checkpointDir); err == nil {
+			writeMetric(&body, metricSize, labels, float64(size))
+		}
+	}
+
+	if err := p.send(&body); err != nil {
+		logWarnf("failed to push metrics to %s: %v", p.url, err)
+		return
+	}
+	logInfof("Pushed metrics to %s", p.url)
+}
+
+// labels are the values of metricLabels.
+func (p *pushgatewayTarget) labels() []string {
+	return []string{p.container, p.operation}
+}
+
+// send replaces the metrics of the group with body.
+func (p *pushgatewayTarget) send(body *bytes.Buffer) error {
+	path := p.url + "/metrics" + groupingSegment("job", p.job) + groupingSegment("instance", p.instance)
+	for i, value := range p.labels() {
+		path += groupingSegment(metricLabels[i], value)
+	}
+	req, err := http.NewRequest(http.MethodPut, path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := pushgatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// writeMetric writes one gauge sample in the Prometheus text format.
+func writeMetric(b *bytes.Buffer, m metricDef, labels []string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s{", m.name, m.help, m.name, m.name)
+	for i, name := range metricLabels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=%s", name, strconv.Quote(labels[i]))
+	}
+	fmt.Fprintf(b, "} %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// groupingSegment is the URL path segment of one grouping label; values
+// a path cannot carry are base64 encoded, as the Pushgateway allows.
+func groupingSegment(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+		if encoded == "" {
+			encoded = "="
+		}
+		return "/" + name + "@base64/" + encoded
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// registryPath is the index every successful checkpoint is recorded in. It can
+// be moved with DOCKER_CR_REGISTRY, mostly for unprivileged testing.
+var registryPath = "/var/lib/docker-cr/registry.json"
+
+func init() {
+	if path := os.Getenv("DOCKER_CR_REGISTRY"); path != "" {
+		registryPath = path
+	}
+}
+
+// RegistryEntry describes one registered checkpoint.
+type RegistryEntry struct {
+	ID        int       `json:"id"`
+	Container string    `json:"container"`
+	Image     string    `json:"image,omitempty"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+	Mode      string    `json:"mode"`
+	Replicas  []string  `json:"replicas,omitempty"`
+	// DurationSeconds is how long the checkpoint took; estimates use it
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// Timings is the breakdown of DurationSeconds by phase
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+// Registry is the on-disk checkpoint index.
+type Registry struct {
+	NextID  int              `json:"next_id"`
+	Entries []*RegistryEntry `json:"entries"`
+}
+
+// Stale reports whether the checkpoint directory has been deleted since it
+// was registered.
+func (e *RegistryEntry) Stale() bool {
+	_, err := os.Stat(e.Path)
+	return err != nil
+}
+
+// updateRegistry loads the registry under an exclusive lock, applies fn and
+// writes the result back atomically.
+func updateRegistry(fn func(*Registry) error) error {
+	if err := os.MkdirAll(filepath.Dir(registryPath), 0755); err != nil {
+		return fmt.Errorf("failed to create registry directory: %w", err)
+	}
+
+	lock, err := os.OpenFile(registryPath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open registry lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock registry: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(reg); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := registryPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return os.Rename(tmpPath, registryPath)
+}
+
+func loadRegistry() (*Registry, error) {
+	reg := &Registry{NextID: 1}
+
+	data, err := os.ReadFile(registryPath)
+	if os.IsNotExist(err) {
+		return reg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read registry: %w", err)
+	}
+
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("failed to parse registry %s: %w", registryPath, err)
+	}
+
+	return reg, nil
+}
+
+// registerCheckpoint records a freshly created checkpoint of target in the
+// registry. Container name and image are taken from the checkpoint metadata
+// when present.
+func registerCheckpoint(target, checkpointDir string, duration time.Duration, timings *Timings) (*RegistryEntry, error) {
+	absDir, err := filepath.Abs(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &RegistryEntry{
+		Container:       target,
+		Path:            absDir,
+		Timestamp:       time.Now(),
+		Mode:            "container",
+		DurationSeconds: duration.Seconds(),
+		Timings:         timings,
+	}
+
+	if _, err := strconv.Atoi(target); err == nil {
+		entry.Mode = "process"
+	}
+
+	if metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta")); err == nil {
+		if name := strings.TrimPrefix(metadata["CONTAINER_NAME"], "/"); name != "" {
+			entry.Container = name
+		}
+		entry.Image = metadata["IMAGE"]
+	}
+	if _, err := os.Stat(filepath.Join(checkpointDir, "docker-checkpoint.info")); err == nil {
+		entry.Mode = "docker-native"
+	}
+
+	entry.Size, err = directorySize(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateRegistry(func(reg *Registry) error {
+		entry.ID = reg.NextID
+		reg.NextID++
+		reg.Entries = append(reg.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// latestCheckpointFor returns the newest checkpoint registered for the given
+// container name that can be restored here. If the original directory is
+// gone but a local replica exists, the returned entry points at the replica.
+func latestCheckpointFor(container string) (*RegistryEntry, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *RegistryEntry
+	staleCount := 0
+	for _, entry := range reg.Entries {
+		if entry.Container != container {
+			continue
+		}
+		path := entry.reachablePath()
+		if path == "" {
+			staleCount++
+			continue
+		}
+		if latest == nil || entry.Timestamp.After(latest.Timestamp) {
+			reachable := *entry
+			reachable.Path = path
+			latest = &reachable
+		}
+	}
+
+	if latest == nil {
+		if staleCount > 0 {
+			return nil, fmt.Errorf("all %d registered checkpoints of %s have been deleted from disk", staleCount, container)
+		}
+		return nil, fmt.Errorf("no registered checkpoints for %s", container)
+	}
+
+	return latest, nil
+}
+
+// findRegistryEntry looks an entry up by ID or checkpoint path.
+func findRegistryEntry(reg *Registry, key string) *RegistryEntry {
+	if id, err := strconv.Atoi(key); err == nil {
+		for _, entry := range reg.Entries {
+			if entry.ID == id {
+				return entry
+			}
+		}
+	}
+
+	absKey, _ := filepath.Abs(key)
+	for _, entry := range reg.Entries {
+		if entry.Path == absKey {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func listRegistry(container string) error {
+	entries, err := registryEntries(container)
+	if err != nil {
+		return err
+	}
+	printRegistryEntries(entries, (*RegistryEntry).Stale)
+	return nil
+}
+
+// registryEntries returns the registered checkpoints of container, or all
+// of them if it is empty, oldest first.
+func registryEntries(container string) ([]*RegistryEntry, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*RegistryEntry, 0, len(reg.Entries))
+	for _, entry := range reg.Entries {
+		if container == "" || entry.Container == container {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+	return entries, nil
+}
+
+// printRegistryEntries prints entries as a table, marking those stale
+// reports as deleted since.
+func printRegistryEntries(entries []*RegistryEntry, stale func(*RegistryEntry) bool) {
+	if len(entries) == 0 {
+		fmt.Println("No checkpoints registered")
+		return
+	}
+
+	fmt.Printf("%-5s %-20s %-14s %10s  %-19s  %s\n", "ID", "CONTAINER", "MODE", "SIZE", "CREATED", "PATH")
+	for _, entry := range entries {
+		path := entry.Path
+		if stale(entry) {
+			path += " (stale)"
+		}
+		fmt.Printf("%-5d %-20s %-14s %10s  %-19s  %s\n",
+			entry.ID, entry.Container, entry.Mode, formatSize(entry.Size),
+			entry.Timestamp.Format("2006-01-02 15:04:05"), path)
+	}
+}
+
+func showRegistryEntry(key string) error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+
+	entry := findRegistryEntry(reg, key)
+	if entry == nil {
+		return fmt.Errorf("no registered checkpoint matches %s", key)
+	}
+
+	fmt.Printf("ID:        %d\n", entry.ID)
+	fmt.Printf("Container: %s\n", entry.Container)
+	fmt.Printf("Image:     %s\n", entry.Image)
+	fmt.Printf("Mode:      %s\n", entry.Mode)
+	fmt.Printf("Path:      %s\n", entry.Path)
+	fmt.Printf("Size:      %s\n", formatSize(entry.Size))
+	fmt.Printf("Created:   %s\n", entry.Timestamp.Format(time.RFC3339))
+	if entry.DurationSeconds > 0 {
+		fmt.Printf("Duration:  %.3fs\n", entry.DurationSeconds)
+	}
+	fmt.Printf("Stale:     %v\n", entry.Stale())
+	if manifest, err := loadProcessManifest(entry.Path); err == nil && manifest != nil {
+		printProcessRoot(manifest, "%-10s %s\n")
+	}
+	for _, replica := range entry.Replicas {
+		fmt.Printf("Replica:   %s\n", replica)
+	}
+	if entry.Timings != nil {
+		fmt.Println()
+		entry.Timings.print("Checkpoint")
+	}
+
+	return nil
+}
+
+// pruneRegistry drops entries whose checkpoint directory no longer exists.
+func pruneRegistry() error {
+	return updateRegistry(func(reg *Registry) error {
+		kept := reg.Entries[:0]
+		for _, entry := range reg.Entries {
+			if entry.Stale() {
+				logInfof("Pruned stale checkpoint %d (%s)", entry.ID, entry.Path)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		reg.Entries = kept
+		return nil
+	})
+}
+
+func directorySize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// replicaResult is the outcome of copying a checkpoint to one destination.
+type replicaResult struct {
+	Dest string
+	Err  error
+}
+
+// replicateCheckpoint syncs checkpointDir to every destination concurrently
+// and prints the status of each. With requireAll every destination must
+// succeed; otherwise one success is enough. The destinations that now hold a
+// verified copy are returned even when the policy fails.
+func replicateCheckpoint(checkpointDir string, dests []string, parallel int, requireAll bool) ([]string, error) {
+	defer tracing.track(spanReplicate)()
+	results := make([]replicaResult, len(dests))
+
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		wg.Add(1)
+		go func(i int, dest string) {
+			defer wg.Done()
+			results[i] = replicaResult{Dest: dest, Err: replicateTo(checkpointDir, dest, parallel)}
+		}(i, dest)
+	}
+	wg.Wait()
+
+	var replicas []string
+	fmt.Println("Replication status:")
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("  FAILED %s: %v\n", r.Dest, r.Err)
+			continue
+		}
+		fmt.Printf("  ok     %s\n", r.Dest)
+		dest := r.Dest
+		if isLocalReplica(dest) {
+			if abs, err := filepath.Abs(dest); err == nil {
+				dest = abs
+			}
+		}
+		replicas = append(replicas, dest)
+	}
+
+	failed := len(dests) - len(replicas)
+	switch {
+	case requireAll && failed > 0:
+		return replicas, fmt.Errorf("%d of %d replicas failed", failed, len(dests))
+	case len(replicas) == 0:
+		return replicas, fmt.Errorf("all %d replicas failed", len(dests))
+	}
+
+	return replicas, nil
+}
+
+// replicateTo copies checkpointDir to one destination using the
+// incremental sync.
+func replicateTo(checkpointDir, dest string, parallel int) error {
+	if err := unsupportedReplica(dest); err != nil {
+		return err
+	}
+	return syncCheckpoint(checkpointDir, dest, parallel)
+}
+
+// unsupportedReplica reports destinations replicateTo cannot handle.
+func unsupportedReplica(dest string) error {
+	if i := strings.Index(dest, "://"); i > 0 {
+		return fmt.Errorf("%s destinations are not supported; use a local path or [user@]host:path", dest[:i])
+	}
+	return nil
+}
+
+// recordReplicas stores the replica locations of a registered checkpoint.
+func recordReplicas(id int, replicas []string) error {
+	return updateRegistry(func(reg *Registry) error {
+		for _, entry := range reg.Entries {
+			if entry.ID == id {
+				entry.Replicas = append(entry.Replicas, replicas...)
+				return nil
+			}
+		}
+		return fmt.Errorf("checkpoint %d is not registered", id)
+	})
+}
+
+// isLocalReplica reports whether a replica destination is a directory on
+// this host rather than an ssh target.
+func isLocalReplica(dest string) bool {
+	d, err := parseSyncDestination(dest)
+	if err != nil {
+		return false
+	}
+	_, ok := d.(*localDestination)
+	return ok
+}
+
+// reachablePath returns the checkpoint directory itself if it still exists,
+// otherwise the first local replica that does. It returns "" when no copy
+// can be restored from this host.
+func (e *RegistryEntry) reachablePath() string {
+	if !e.Stale() {
+		return e.Path
+	}
+	for _, replica := range e.Replicas {
+		if !isLocalReplica(replica) {
+			continue
+		}
+		if _, err := os.Stat(replica); err == nil {
+			return replica
+		}
+	}
+	return ""
+}
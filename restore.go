@@ -3,35 +3,112 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/checkpoint-restore/go-criu/v7"
 	"github.com/checkpoint-restore/go-criu/v7/rpc"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"google.golang.org/protobuf/proto"
 )
 
-func restoreContainer(containerID, checkpointDir string) error {
+// RestoreConfig holds the command-line options that change how a checkpoint
+// is restored.
+type RestoreConfig struct {
+	// CriuArgs are passed verbatim to a criu subprocess instead of using RPC
+	CriuArgs []string
+	// CriuService is the socket of a running "criu service" to use instead
+	// of spawning criu
+	CriuService string
+	// LogLevel is the CRIU log verbosity, 1 to 4; zero means 4
+	LogLevel int
+	// CgroupLeave restores the tree into its original cgroups
+	CgroupLeave bool
+	// IgnorePortConflicts restores even when ports the checkpoint had bound
+	// are taken
+	IgnorePortConflicts bool
+	// IntoExisting restores into a stopped container instead of recreating it
+	IntoExisting bool
+	// NewContainerName, if set, is the name of the container created for
+	// the restore instead of the original one, which is left alone
+	NewContainerName string
+	// JoinNamespacesOf is the PID whose net, ipc and uts namespaces the
+	// restored tree joins; zero lets CRIU create them
+	JoinNamespacesOf int
+	// ShowEnv prints the environment recorded with --checkpoint-env-file
+	ShowEnv bool
+	// PreserveCheckpoint restores from a temporary copy so the checkpoint
+	// directory is left exactly as it was
+	PreserveCheckpoint bool
+	// HookTimeouts bounds the hook scripts; phases left out use the default
+	HookTimeouts hookTimeouts
+	// Hooks maps the CRIU notifications of the restore to the scripts run
+	// at them; see parseHooks
+	Hooks map[string][]string
+	// Hostname, if set, replaces the checkpointed hostname
+	Hostname string
+	// RestorePID, if set, is the PID the restored process must get; it is
+	// checked against the dump and restored as a sibling of CRIU
+	RestorePID int
+	// MountNsFile, if set, is the mount namespace file, e.g.
+	// /proc/<pid>/ns/mnt, the restored tree joins
+	MountNsFile string
+	// StrictVersionCheck fails the restore when the Docker, API or
+	// containerd major version differs from the one at checkpoint time
+	StrictVersionCheck bool
+	// RedirectStdout and RedirectStderr replace the restored process's
+	// stdout and stderr with these files
+	RedirectStdout string
+	RedirectStderr string
+	// InheritFds are passed to CRIU with every restore
+	InheritFds []*rpc.InheritFd
+
+	// timings, if set, records how long each phase of the restore took
+	timings *Timings
+	// redirectFiles keeps the files behind InheritFds open
+	redirectFiles []*os.File
+}
+
+func restoreContainer(containerID, checkpointDir string, cfg *RestoreConfig) error {
+	if isFilesystemOnlyCheckpoint(checkpointDir) {
+		return restoreFilesystemOnly(containerID, checkpointDir)
+	}
+	cfg.timings.begin(phaseVerify)
+	if err := checkRuntimeVersions(checkpointDir, cfg.StrictVersionCheck); err != nil {
+		return err
+	}
+	if err := checkCPUCompatibility(checkpointDir); err != nil {
+		return err
+	}
+	cfg.timings.end(phaseVerify)
+
+	if cfg.IntoExisting {
+		return restoreContainerIntoExisting(containerID, checkpointDir, cfg)
+	}
+
 	// First try direct CRIU restore (our improved approach)
-	fmt.Println("Attempting direct CRIU restore...")
-	if err := restoreContainerDirect(containerID, checkpointDir); err == nil {
+	logInfof("Attempting direct CRIU restore...")
+	if err := restoreContainerDirect(containerID, checkpointDir, cfg); err == nil {
 		return nil
+	} else if cfg.NewContainerName != "" {
+		// The fallbacks restore into the original container
+		return err
 	} else {
-		fmt.Printf("Direct CRIU restore failed: %v\n", err)
-		fmt.Println("Trying Docker native restore...")
+		logWarnf("direct CRIU restore failed: %v", err)
+		logInfof("Trying Docker native restore...")
 	}
 
 	// Try Docker's native restore
 	if err := restoreDockerNative(containerID, checkpointDir); err == nil {
 		return nil
 	} else {
-		fmt.Printf("Docker native restore failed: %v\n", err)
-		fmt.Println("Falling back to manual restore...")
+		logWarnf("Docker native restore failed: %v", err)
+		logInfof("Falling back to manual restore...")
+		progress.retry("manual restore", err)
 	}
 
 	// Fall back to manual restore if all methods fail
@@ -54,14 +131,14 @@ func restoreContainer(containerID, checkpointDir string) error {
 		}
 	}
 
-	fmt.Printf("Original container image: %s\n", originalImage)
-	fmt.Printf("Original PID: %d\n", originalPID)
+	logInfof("Original container image: %s", originalImage)
+	logInfof("Original PID: %d", originalPID)
 
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err == nil {
 		defer dockerClient.Close()
 		if err := stopContainer(dockerClient, containerID); err != nil {
-			fmt.Printf("Warning: failed to stop existing container: %v\n", err)
+			logWarnf("failed to stop existing container: %v", err)
 		}
 	}
 
@@ -70,7 +147,7 @@ func restoreContainer(containerID, checkpointDir string) error {
 		return fmt.Errorf("failed to read checkpoint directory: %w", err)
 	}
 
-	fmt.Printf("Found %d checkpoint files\n", len(entries))
+	logInfof("Found %d checkpoint files", len(entries))
 	hasCheckpoint := false
 	for _, entry := range entries {
 		if !entry.IsDir() {
@@ -86,17 +163,17 @@ func restoreContainer(containerID, checkpointDir string) error {
 		return fmt.Errorf("no checkpoint images found in %s", checkpointDir)
 	}
 
-	return restoreProcess(checkpointDir)
+	return restoreProcess(checkpointDir, cfg)
 }
 
-func restoreProcess(checkpointDir string) error {
-	criuClient := criu.MakeCriu()
+func restoreProcess(checkpointDir string, cfg *RestoreConfig) error {
+	criuClient := newCriuClient(cfg.CriuService)
 
 	_, err := criuClient.GetCriuVersion()
 	if err != nil {
 		return fmt.Errorf("failed to get CRIU version: %w", err)
 	}
-	fmt.Printf("CRIU version check passed\n")
+	logInfof("CRIU version check passed")
 
 	if err := criuClient.Prepare(); err != nil {
 		return fmt.Errorf("failed to prepare CRIU: %w", err)
@@ -111,18 +188,29 @@ func restoreProcess(checkpointDir string) error {
 
 	opts := &rpc.CriuOpts{
 		ImagesDirFd: proto.Int32(int32(imageDir.Fd())),
-		LogLevel:    proto.Int32(4),
+		LogLevel:    criuLogLevel(cfg.LogLevel),
 		LogFile:     proto.String("restore.log"),
+		InheritFd:   cfg.InheritFds,
 	}
 
 	if err := prepareProcessForRestore(checkpointDir, opts); err != nil {
 		return fmt.Errorf("failed to prepare for restore: %w", err)
 	}
+	if cfg.CgroupLeave {
+		leaveCgroups(opts)
+	}
 
-	notify := NewNotifyHandler(true)
-
-	fmt.Println("Restoring process state with CRIU...")
-	err = criuClient.Restore(opts, notify)
+	notify := NewNotifyHandler()
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.Hostname = cfg.Hostname
+	notify.Hooks = cfg.Hooks
+	notify.timings = cfg.timings
+	notify.setOperation("container", 0, checkpointDir)
+
+	logInfof("Restoring process state with CRIU...")
+	stopTiming := cfg.timings.track(phaseRestore)
+	err = runRestore(criuClient, opts, notify, checkpointDir, cfg.CriuArgs)
+	stopTiming()
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "restore.log")
 		if logData, readErr := os.ReadFile(logPath); readErr == nil {
@@ -131,14 +219,18 @@ func restoreProcess(checkpointDir string) error {
 		return fmt.Errorf("CRIU restore failed: %w", err)
 	}
 
-	fmt.Println("CRIU restore completed successfully!")
+	logInfof("CRIU restore completed successfully!")
 
 	time.Sleep(2 * time.Second)
 
 	return nil
 }
 
-func restoreSimpleProcess(checkpointDir string) error {
+func restoreSimpleProcess(checkpointDir string, cfg *RestoreConfig) error {
+	if err := checkCPUCompatibility(checkpointDir); err != nil {
+		return err
+	}
+
 	entries, err := os.ReadDir(checkpointDir)
 	if err != nil {
 		return fmt.Errorf("failed to read checkpoint directory: %w", err)
@@ -156,13 +248,13 @@ func restoreSimpleProcess(checkpointDir string) error {
 		return fmt.Errorf("no checkpoint images found in %s", checkpointDir)
 	}
 
-	criuClient := criu.MakeCriu()
+	criuClient := newCriuClient(cfg.CriuService)
 
 	_, err = criuClient.GetCriuVersion()
 	if err != nil {
 		return fmt.Errorf("failed to get CRIU version: %w", err)
 	}
-	fmt.Printf("CRIU version check passed\n")
+	logInfof("CRIU version check passed")
 
 	if err := criuClient.Prepare(); err != nil {
 		return fmt.Errorf("failed to prepare CRIU: %w", err)
@@ -177,17 +269,77 @@ func restoreSimpleProcess(checkpointDir string) error {
 
 	opts := &rpc.CriuOpts{
 		ImagesDirFd:    proto.Int32(int32(imageDir.Fd())),
-		LogLevel:       proto.Int32(4),
+		LogLevel:       criuLogLevel(cfg.LogLevel),
 		LogFile:        proto.String("restore.log"),
 		TcpEstablished: proto.Bool(true),
 		ExtUnixSk:      proto.Bool(true),
 		ShellJob:       proto.Bool(false),
+		InheritFd:      cfg.InheritFds,
 	}
 
-	notify := NewNotifyHandler(true)
+	if err := prepareProcessForRestore(checkpointDir, opts); err != nil {
+		return fmt.Errorf("failed to prepare for restore: %w", err)
+	}
+	if cfg.CgroupLeave {
+		leaveCgroups(opts)
+	}
+	cfg.timings.begin(phaseVerify)
+	if err := verifyMappedFiles(checkpointDir, "/"); err != nil {
+		return err
+	}
+	if err := verifyOpenFiles(checkpointDir, "/"); err != nil {
+		return err
+	}
+	if err := verifyExecutables(checkpointDir, "/"); err != nil {
+		return err
+	}
+	if err := checkRestoreMemory(checkpointDir); err != nil {
+		return err
+	}
+	if err := verifyWatchedPaths(checkpointDir, "/"); err != nil {
+		return err
+	}
+	netnsPID := os.Getpid()
+	if cfg.JoinNamespacesOf != 0 {
+		netnsPID = cfg.JoinNamespacesOf
+		joinNamespacesOf(opts, cfg.JoinNamespacesOf)
+	}
+	if err := checkPortConflicts(checkpointDir, netnsPID, cfg.IgnorePortConflicts); err != nil {
+		return err
+	}
+	if err := checkTCPInterface(checkpointDir, netnsPID); err != nil {
+		return err
+	}
+	cfg.timings.end(phaseVerify)
+	if cfg.MountNsFile != "" {
+		if err := joinMountNamespace(opts, cfg.MountNsFile); err != nil {
+			return err
+		}
+	}
+	if cfg.RestorePID != 0 {
+		if err := checkRestorePID(checkpointDir, cfg.RestorePID); err != nil {
+			return err
+		}
+		// CRIU creates the root task with the PID pstree.img records, which
+		// checkRestorePID matched against the request; Pid names it in the
+		// request too. As a sibling the task is our child, not CRIU's.
+		opts.RstSibling = proto.Bool(true)
+		opts.Pid = proto.Int32(int32(cfg.RestorePID))
+		logWarnf("restoring onto PID %d depends on the kernel: it needs clone3 set_tid (Linux 5.5+) or a writable ns_last_pid, and CAP_SYS_ADMIN or CAP_CHECKPOINT_RESTORE", cfg.RestorePID)
+	}
 
-	fmt.Println("Restoring process...")
-	err = criuClient.Restore(opts, notify)
+	notify := NewNotifyHandler()
+	notify.setHookTimeouts(cfg.HookTimeouts)
+	notify.Hostname = cfg.Hostname
+	notify.MountNsPath = cfg.MountNsFile
+	notify.Hooks = cfg.Hooks
+	notify.timings = cfg.timings
+	notify.setOperation("process", 0, checkpointDir)
+
+	logInfof("Restoring process...")
+	stopTiming := cfg.timings.track(phaseRestore)
+	err = runRestore(criuClient, opts, notify, checkpointDir, cfg.CriuArgs)
+	stopTiming()
 	if err != nil {
 		logPath := filepath.Join(checkpointDir, "restore.log")
 		if logData, readErr := os.ReadFile(logPath); readErr == nil {
@@ -196,7 +348,7 @@ func restoreSimpleProcess(checkpointDir string) error {
 		return fmt.Errorf("restore failed: %w", err)
 	}
 
-	fmt.Println("Process restored successfully!")
+	logInfof("Process restored successfully!")
 	return nil
 }
 
@@ -209,7 +361,7 @@ func stopContainer(dockerClient *client.Client, containerID string) error {
 	}
 
 	if containerInfo.State.Running {
-		fmt.Printf("Stopping container %s...\n", containerID)
+		logInfof("Stopping container %s...", containerID)
 		timeout := 10
 		stopOptions := container.StopOptions{
 			Timeout: &timeout,
@@ -220,4 +372,83 @@ func stopContainer(dockerClient *client.Client, containerID string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// preserveCheckpoint copies checkpointDir to a temporary directory for CRIU
+// to work in. Restores otherwise write restore.log next to the images, and the
+// Docker native path copies them into Docker's checkpoint store. The returned
+// function removes the copy.
+func preserveCheckpoint(checkpointDir string) (string, func(), error) {
+	defer tracing.track(spanCopy)()
+	tmpDir, err := os.MkdirTemp("", "docker-cr-restore-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary restore directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	logInfof("Copying checkpoint to %s to preserve the original...", tmpDir)
+	if err := copyCheckpointFiles(checkpointDir, tmpDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to copy checkpoint: %w", err)
+	}
+
+	return tmpDir, cleanup, nil
+}
+
+// leaveCgroups makes CRIU put the restored tree back into the cgroups it was
+// dumped from, such as the limits of a Docker container, instead of leaving
+// it in docker-cr's own cgroup. Soft mode creates missing cgroups but does
+// not overwrite the settings of existing ones.
+func leaveCgroups(opts *rpc.CriuOpts) {
+	mode := rpc.CriuCgMode_SOFT
+	opts.ManageCgroups = proto.Bool(true)
+	opts.ManageCgroupsMode = &mode
+}
+
+// joinNamespacesOf makes CRIU restore the tree into the net, ipc and uts
+// namespaces of pid.
+func joinNamespacesOf(opts *rpc.CriuOpts, pid int) {
+	for _, ns := range []string{"net", "ipc", "uts"} {
+		opts.JoinNs = append(opts.JoinNs, &rpc.JoinNamespace{
+			Ns:     proto.String(ns),
+			NsFile: proto.String(fmt.Sprintf("/proc/%d/ns/%s", pid, ns)),
+		})
+	}
+}
+
+// readStdinPID reads the PID for --stdin-pid: stdin must hold a single
+// positive integer of a running process.
+func readStdinPID(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read PID from stdin: %w", err)
+	}
+	value := strings.TrimSpace(string(data))
+	pid, err := strconv.Atoi(value)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("stdin must hold a single PID, got %q", value)
+	}
+	if err := validateProcessExists(pid); err != nil {
+		return 0, err
+	}
+	return pid, nil
+}
+
+// resolveCheckpointDir accepts a checkpoint directory or a "latest" symlink
+// created by --checkpoint-dir-symlink and returns the real directory.
+func resolveCheckpointDir(checkpointDir string) (string, error) {
+	if strings.HasPrefix(checkpointDir, ephemeralPrefix) {
+		return resolveEphemeralRef(checkpointDir)
+	}
+	if filepath.Base(checkpointDir) != "latest" {
+		return checkpointDir, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(checkpointDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve latest checkpoint %s: %w", checkpointDir, err)
+	}
+
+	logInfof("Resolved %s to %s", checkpointDir, resolved)
+	return resolved, nil
+}
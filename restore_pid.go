@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkRestorePID validates --restore-pid before CRIU runs. CRIU has no
+// option to choose the PID of a restored task: it always recreates the PID
+// recorded in the dump, so the requested PID has to be that one and must be
+// free, or the restore fails late inside CRIU.
+func checkRestorePID(checkpointDir string, pid int) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil {
+		return fmt.Errorf("cannot check --restore-pid: %w", err)
+	}
+	if info.PID != pid {
+		return fmt.Errorf("the checkpoint is of PID %d; CRIU restores the original PID and cannot give it %d", info.PID, pid)
+	}
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+		return fmt.Errorf("PID %d is in use", pid)
+	}
+	return nil
+}
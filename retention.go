@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pinMarker protects a checkpoint directory from every retention policy.
+const pinMarker = ".pin"
+
+// RetentionRule keeps checkpoints younger than Window. With All set every
+// such checkpoint is kept; otherwise the newest PerBucket checkpoints of each
+// Bucket-sized time slot are kept.
+type RetentionRule struct {
+	Window    time.Duration
+	All       bool
+	PerBucket int
+	Bucket    time.Duration
+}
+
+// RetentionPolicy is an ordered set of rules parsed from a spec such as
+// "24h:all,7d:1/d,30d:1/w". Checkpoints older than the largest window are
+// removed.
+type RetentionPolicy struct {
+	Rules []RetentionRule
+}
+
+// parseRetentionPolicy parses a comma-separated list of <window>:<keep>
+// rules, where <keep> is "all" or "<n>/<unit>" with unit h, d or w.
+func parseRetentionPolicy(spec string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid retention rule %q: expected <window>:<keep>", part)
+		}
+
+		window, err := parseRetentionDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %w", part, err)
+		}
+		rule := RetentionRule{Window: window}
+
+		if fields[1] == "all" {
+			rule.All = true
+		} else {
+			keep := strings.SplitN(fields[1], "/", 2)
+			if len(keep) != 2 {
+				return nil, fmt.Errorf("invalid retention rule %q: keep must be 'all' or <n>/<unit>", part)
+			}
+			rule.PerBucket, err = strconv.Atoi(keep[0])
+			if err != nil || rule.PerBucket < 1 {
+				return nil, fmt.Errorf("invalid retention rule %q: bad count %q", part, keep[0])
+			}
+			rule.Bucket, err = parseRetentionDuration("1" + keep[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention rule %q: %w", part, err)
+			}
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	if len(policy.Rules) == 0 {
+		return nil, fmt.Errorf("empty retention policy")
+	}
+
+	sort.Slice(policy.Rules, func(i, j int) bool {
+		return policy.Rules[i].Window < policy.Rules[j].Window
+	})
+
+	return policy, nil
+}
+
+// parseRetentionDuration extends time.ParseDuration with d (day) and w (week)
+// units.
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	unit := s[len(s)-1]
+	if unit == 'd' || unit == 'w' {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		day := 24 * time.Hour
+		if unit == 'w' {
+			return time.Duration(n) * 7 * day, nil
+		}
+		return time.Duration(n) * day, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// formatRetentionDuration prints d in the largest whole unit of w, d or h.
+func formatRetentionDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d >= 7*day && d%(7*day) == 0:
+		return fmt.Sprintf("%dw", d/(7*day))
+	case d >= day && d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	case d >= day:
+		return fmt.Sprintf("%dd%dh", d/day, (d%day)/time.Hour)
+	default:
+		return d.Round(time.Minute).String()
+	}
+}
+
+// retentionCandidate is one checkpoint directory considered for pruning.
+type retentionCandidate struct {
+	Path    string
+	Created time.Time
+	Pinned  bool
+}
+
+// RetentionDecision records whether a checkpoint is kept and why.
+type RetentionDecision struct {
+	Path   string
+	Keep   bool
+	Reason string
+}
+
+// Apply decides the fate of every candidate relative to now.
+func (p *RetentionPolicy) Apply(candidates []retentionCandidate, now time.Time) []RetentionDecision {
+	// Newest first, so bucket slots are claimed by the most recent checkpoint
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Created.After(candidates[j].Created)
+	})
+
+	used := make(map[string]int)
+	decisions := make([]RetentionDecision, 0, len(candidates))
+
+	for _, c := range candidates {
+		d := RetentionDecision{Path: c.Path}
+		age := now.Sub(c.Created)
+
+		if c.Pinned {
+			d.Keep, d.Reason = true, "pinned"
+			decisions = append(decisions, d)
+			continue
+		}
+
+		var rule *RetentionRule
+		for i := range p.Rules {
+			if age <= p.Rules[i].Window {
+				rule = &p.Rules[i]
+				break
+			}
+		}
+
+		switch {
+		case rule == nil:
+			d.Reason = fmt.Sprintf("older than every retention window (age %s)", formatRetentionDuration(age))
+		case rule.All:
+			d.Keep, d.Reason = true, fmt.Sprintf("within %s, keeping all", formatRetentionDuration(rule.Window))
+		default:
+			slot := c.Created.UnixNano() / int64(rule.Bucket)
+			key := fmt.Sprintf("%d/%d", rule.Window, slot)
+			if used[key] < rule.PerBucket {
+				used[key]++
+				d.Keep = true
+				d.Reason = fmt.Sprintf("within %s, %d of %d for its %s slot",
+					formatRetentionDuration(rule.Window), used[key], rule.PerBucket, formatRetentionDuration(rule.Bucket))
+			} else {
+				d.Reason = fmt.Sprintf("within %s, but its %s slot already has %d newer",
+					formatRetentionDuration(rule.Window), formatRetentionDuration(rule.Bucket), rule.PerBucket)
+			}
+		}
+
+		decisions = append(decisions, d)
+	}
+
+	return decisions
+}
+
+// findCheckpointDirs returns the checkpoint directories directly below
+// parentDir. A directory counts as a checkpoint if it holds a manifest or any
+// CRIU image.
+func findCheckpointDirs(parentDir string) ([]retentionCandidate, error) {
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", parentDir, err)
+	}
+
+	var candidates []retentionCandidate
+	for _, entry := range entries {
+		// Skips the "latest" symlink along with regular files
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(parentDir, entry.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		isCheckpoint := false
+		for _, f := range files {
+			if f.Name() == manifestFile || strings.HasSuffix(f.Name(), ".img") {
+				isCheckpoint = true
+				break
+			}
+		}
+		if !isCheckpoint {
+			continue
+		}
+
+		// The manifest is written once at dump time; the directory mtime moves
+		// whenever a restore drops its log next to the images
+		info, err := os.Stat(filepath.Join(dir, manifestFile))
+		if err != nil {
+			if info, err = entry.Info(); err != nil {
+				continue
+			}
+		}
+
+		_, pinErr := os.Stat(filepath.Join(dir, pinMarker))
+		candidates = append(candidates, retentionCandidate{
+			Path:    dir,
+			Created: info.ModTime(),
+			Pinned:  pinErr == nil,
+		})
+	}
+
+	return candidates, nil
+}
+
+// keepDeltaParents overrides the removal of any checkpoint that a kept delta
+// checkpoint still depends on.
+func keepDeltaParents(decisions []RetentionDecision) {
+	byPath := make(map[string]*RetentionDecision, len(decisions))
+	for i := range decisions {
+		if abs, err := filepath.Abs(decisions[i].Path); err == nil {
+			byPath[abs] = &decisions[i]
+		}
+	}
+
+	// Decisions are newest first, so a rescued parent is visited after its
+	// child and can rescue its own parent in turn
+	for i := range decisions {
+		if !decisions[i].Keep || !isDeltaCheckpoint(decisions[i].Path) {
+			continue
+		}
+		ref, err := readMetadata(filepath.Join(decisions[i].Path, deltaRefFile))
+		if err != nil {
+			continue
+		}
+		if parent, ok := byPath[ref["PARENT"]]; ok && !parent.Keep {
+			parent.Keep = true
+			parent.Reason = "parent of delta " + filepath.Base(decisions[i].Path)
+		}
+	}
+}
+
+// applyRetention evaluates policy against the checkpoints in parentDir,
+// logging every decision and removing the rejected directories unless
+// dryRun is set.
+func applyRetention(parentDir string, policy *RetentionPolicy, dryRun bool) error {
+	candidates, err := findCheckpointDirs(parentDir)
+	if err != nil {
+		return err
+	}
+
+	decisions := policy.Apply(candidates, time.Now())
+	keepDeltaParents(decisions)
+
+	removed := 0
+	for _, d := range decisions {
+		if d.Keep {
+			fmt.Printf("  keep   %s: %s\n", d.Path, d.Reason)
+			continue
+		}
+
+		fmt.Printf("  remove %s: %s\n", d.Path, d.Reason)
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(d.Path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", d.Path, err)
+		}
+		removed++
+	}
+
+	if dryRun {
+		logInfof("Dry run: nothing was removed")
+	} else {
+		logInfof("Removed %d of %d checkpoints", removed, len(decisions))
+	}
+
+	return nil
+}
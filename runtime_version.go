@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// runtimeVersionKeys are the metadata keys recording the container runtime
+// a checkpoint was taken with, in the order they are written.
+var runtimeVersionKeys = []string{"DOCKER_VERSION", "DOCKER_API_VERSION", "CONTAINERD_VERSION"}
+
+// currentRuntimeVersions asks the daemon for its Docker, API and containerd
+// versions, keyed like the metadata.
+func currentRuntimeVersions(ctx context.Context, dockerClient *client.Client) (map[string]string, error) {
+	version, err := dockerClient.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Docker version: %w", err)
+	}
+
+	versions := map[string]string{
+		"DOCKER_VERSION":     version.Version,
+		"DOCKER_API_VERSION": version.APIVersion,
+	}
+	for _, component := range version.Components {
+		if strings.EqualFold(component.Name, "containerd") {
+			versions["CONTAINERD_VERSION"] = component.Version
+		}
+	}
+	return versions, nil
+}
+
+// recordRuntimeVersions appends the daemon's versions to the checkpoint's
+// metadata file, container.meta or, for Docker native checkpoints,
+// docker-checkpoint.info.
+func recordRuntimeVersions(checkpointDir string) error {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	versions, err := currentRuntimeVersions(context.Background(), dockerClient)
+	if err != nil {
+		return err
+	}
+
+	metadataFile := filepath.Join(checkpointDir, "container.meta")
+	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
+		metadataFile = filepath.Join(checkpointDir, "docker-checkpoint.info")
+	}
+
+	file, err := os.OpenFile(metadataFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open metadata: %w", err)
+	}
+	for _, key := range runtimeVersionKeys {
+		if versions[key] != "" {
+			fmt.Fprintf(file, "%s=%s\n", key, versions[key])
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to record runtime versions: %w", err)
+	}
+
+	logInfof("Recorded Docker %s (API %s), containerd %s",
+		versions["DOCKER_VERSION"], versions["DOCKER_API_VERSION"], versions["CONTAINERD_VERSION"])
+	return nil
+}
+
+// checkRuntimeVersions compares the versions recorded in a checkpoint with
+// the running daemon. A different major version is a warning, or an error
+// when strict is set. Checkpoints without recorded versions pass.
+func checkRuntimeVersions(checkpointDir string, strict bool) error {
+	metadata, err := readMetadata(filepath.Join(checkpointDir, "container.meta"))
+	if err != nil || metadata["DOCKER_VERSION"] == "" {
+		return nil
+	}
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	current, err := currentRuntimeVersions(context.Background(), dockerClient)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, key := range runtimeVersionKeys {
+		recorded, now := metadata[key], current[key]
+		if recorded == "" || now == "" || majorVersion(recorded) == majorVersion(now) {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("%s %s at checkpoint, %s now", key, recorded, now))
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	message := "container runtime major version differs: " + strings.Join(mismatches, "; ")
+	if strict {
+		return fmt.Errorf("%s (--strict-version-check)", message)
+	}
+	logWarnf("%s", message)
+	return nil
+}
+
+// majorVersion returns the part of a version before the first dot, without
+// a leading "v".
+func majorVersion(version string) string {
+	return strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0]
+}
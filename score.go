@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recommendedCRIUVersion is the oldest CRIU docker-cr is tested with, in
+// go-criu's encoding (3.17.0).
+const recommendedCRIUVersion = 31700
+
+// assessmentSchema is the version of the JSON form of an Assessment. CI
+// gates read it; fields are only ever added within a version.
+const assessmentSchema = 1
+
+// Issue severities, most severe first. They set the score.
+const (
+	severityBlocker = "blocker"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// Issue categories. A blocking issue makes the dump fail and no flag helps;
+// a needs-option issue is handled by the flag in Issue.Flag, which docker-cr
+// sets itself when Automatic.
+const (
+	categoryBlocking      = "blocking"
+	categoryNeedsOption   = "needs-option"
+	categoryInformational = "informational"
+)
+
+// Verdicts of an assessment.
+const (
+	verdictOK   = "OK"
+	verdictWarn = "WARN"
+	verdictFail = "FAIL"
+)
+
+// Issue is one finding of an assessment and what to do about it.
+type Issue struct {
+	Severity       string `json:"severity"`
+	Category       string `json:"category"`
+	Penalty        int    `json:"penalty"`
+	Problem        string `json:"problem"`
+	Recommendation string `json:"recommendation,omitempty"`
+	Flag           string `json:"flag,omitempty"`
+	Automatic      bool   `json:"automatic,omitempty"`
+}
+
+// Assessment scores how likely a checkpoint of the process is to succeed
+// and restore faithfully, from 0 (it will fail) to 100 (nothing found).
+// Verdict is FAIL with a blocking issue, WARN with one that needs an option
+// or is a warning, OK otherwise.
+type Assessment struct {
+	Schema      int     `json:"schema"`
+	Verdict     string  `json:"verdict"`
+	Score       int     `json:"score"`
+	CRIUVersion int     `json:"criu_version,omitempty"`
+	Issues      []Issue `json:"issues"`
+}
+
+func (a *Assessment) add(severity, category string, penalty int, problem, recommendation string) *Issue {
+	a.Issues = append(a.Issues, Issue{Severity: severity, Category: category, Penalty: penalty, Problem: problem, Recommendation: recommendation})
+	return &a.Issues[len(a.Issues)-1]
+}
+
+// needs records the flag that handles an issue.
+func (i *Issue) needs(flag string, automatic bool) {
+	i.Flag, i.Automatic = flag, automatic
+}
+
+// assessCheckpointability scores an analysis. It asks CRIU, through
+// criuService if set, for its version and for the features the unsupported
+// fds need, but dumps nothing.
+func assessCheckpointability(info *ProcessInfo, criuService string) *Assessment {
+	a := &Assessment{Schema: assessmentSchema, Issues: []Issue{}}
+
+	if info.State == "zombie" {
+		a.add(severityBlocker, categoryBlocking, 100, "the process is a zombie", "")
+	}
+	for _, t := range info.Tracers {
+		a.add(severityBlocker, categoryNeedsOption, 100, fmt.Sprintf("thread %d of %d is traced by %d (%s)", t.TID, t.PID, t.TracerPID, t.Name),
+			fmt.Sprintf("detach the tracer (kill %d) or use --detach-tracer", t.TracerPID)).needs("--detach-tracer", false)
+	}
+	if len(info.Tracers) == 0 && info.State == "tracing stop" {
+		a.add(severityBlocker, categoryBlocking, 100, "the process is in tracing stop", "resume it before the checkpoint")
+	}
+
+	version, err := newCriuClient(criuService).GetCriuVersion()
+	if err != nil {
+		a.add(severityBlocker, categoryBlocking, 100, fmt.Sprintf("CRIU is not usable: %v", err), "install CRIU and run docker-cr as root")
+	} else {
+		a.CRIUVersion = version
+		if version < recommendedCRIUVersion {
+			a.add(severityWarning, categoryInformational, 15, fmt.Sprintf("CRIU %s is older than %s", formatCRIUVersion(version), formatCRIUVersion(recommendedCRIUVersion)),
+				"upgrade CRIU")
+		}
+	}
+
+	if info.HasBPF {
+		a.add(severityBlocker, categoryNeedsOption, 50, fmt.Sprintf("%d eBPF file descriptor(s)", info.BPFFdCount),
+			"stop the eBPF user before the checkpoint, or try --ignore-bpf").needs("--ignore-bpf", false)
+	}
+	if len(info.UnsupportedFDs) > 0 {
+		if err := checkUnsupportedFDs(info.UnsupportedFDs); err != nil {
+			a.add(severityBlocker, categoryBlocking, 50, err.Error(), "close these fds before the checkpoint; search the CRIU issues for the feature")
+		}
+	}
+	if devices := gpuDevices(info.PID); len(devices) > 0 {
+		a.add(severityBlocker, categoryBlocking, 50, fmt.Sprintf("GPU devices open: %s", strings.Join(devices, ", ")),
+			"GPU state needs CRIU's cuda or amdgpu plugin installed")
+	}
+	if info.HasFanotify {
+		a.add(severityBlocker, categoryNeedsOption, 40, "a fanotify file descriptor",
+			"try --ignore-fanotify; the restore will likely fail").needs("--ignore-fanotify", false)
+	}
+
+	if info.HasTCP {
+		a.add(severityWarning, categoryNeedsOption, 10, "established TCP connections",
+			"restore on the same address or peers see the connections reset").needs("--tcp-established", true)
+	}
+	for _, sock := range info.NetlinkSockets {
+		if !sock.Restorable {
+			a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("%s netlink socket (fd %d): %s", sock.Name, sock.FD, sock.Reason), "")
+		}
+	}
+	if shm := info.SharedMemory; shm != nil {
+		if len(shm.SysV) > 0 {
+			a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("%d System V shared memory segment(s)", len(shm.SysV)),
+				"every process attached to them must be in the checkpointed tree")
+		}
+		if len(shm.POSIXFiles) > 0 {
+			a.add(severityInfo, categoryInformational, 5, fmt.Sprintf("%d POSIX shared memory file(s) in /dev/shm", len(shm.POSIXFiles)),
+				"/dev/shm must be restored with the same files")
+		}
+	}
+	if info.HasMQ {
+		a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("POSIX message queue(s): %s", strings.Join(info.MQNames, ", ")),
+			"queued messages may not survive the restore; drain the queues before the checkpoint")
+	}
+	if info.HasLockedMemory {
+		a.add(severityInfo, categoryInformational, 5, fmt.Sprintf("%s of mlock()ed memory", formatSize(info.LockedMemory)),
+			"the memory is restored unlocked; the application must mlock it again")
+	}
+	if info.HasHugePages {
+		var sizes []string
+		for pageSize, pages := range hugePagesNeeded(info.HugePages) {
+			sizes = append(sizes, fmt.Sprintf("%d x %s", pages, formatSize(pageSize)))
+		}
+		sort.Strings(sizes)
+		a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("hugetlb mappings using %s huge pages", strings.Join(sizes, ", ")),
+			"the restore host needs as many free huge pages")
+	}
+	for _, file := range info.DeletedFiles {
+		if file.Size > criuDefaultGhostLimit {
+			a.add(severityWarning, categoryNeedsOption, 15, fmt.Sprintf("deleted file %s is %s", file.Path, formatSize(file.Size)),
+				"").needs(fmt.Sprintf("--ghost-limit %d", file.Size), false)
+		}
+	}
+	for _, of := range info.OpenFiles {
+		if of.Risk != "" {
+			a.add(severityInfo, categoryInformational, 5, fmt.Sprintf("open file %s: %s", of.Path, of.Risk), "")
+		}
+	}
+	for _, w := range info.Watches {
+		if w.Kind == "inotify" && w.Path == "" {
+			a.add(severityInfo, categoryInformational, 5, fmt.Sprintf("inotify watch on inode %d has no path", w.Inode),
+				"restore cannot check the watched file exists")
+			break
+		}
+	}
+	if info.ShellJob {
+		a.add(severityInfo, categoryNeedsOption, 5, "the process is attached to a terminal",
+			"restore from a terminal too").needs("--shell-job", true)
+	}
+
+	if est := info.Estimate; est != nil {
+		if est.ImageSize > 4<<30 {
+			a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("the checkpoint will be about %s", formatSize(est.ImageSize)),
+				"take a --type pre checkpoint first to shorten the freeze")
+		}
+		if est.Duration > 10*time.Second {
+			a.add(severityWarning, categoryInformational, 10, fmt.Sprintf("the process will be frozen for about %s", est.Duration.Round(time.Second)),
+				"take a --type pre checkpoint first to shorten the freeze")
+		}
+	}
+
+	sort.SliceStable(a.Issues, func(i, j int) bool {
+		return a.Issues[i].Penalty > a.Issues[j].Penalty
+	})
+	a.Score = 100
+	a.Verdict = verdictOK
+	for _, issue := range a.Issues {
+		a.Score -= issue.Penalty
+		switch {
+		case issue.Category == categoryBlocking:
+			a.Verdict = verdictFail
+		case a.Verdict == verdictOK && (issue.Category == categoryNeedsOption || issue.Severity != severityInfo):
+			a.Verdict = verdictWarn
+		}
+	}
+	if a.Score < 0 {
+		a.Score = 0
+	}
+	return a
+}
+
+// blockingIssues returns the blocking issues of an assessment.
+func (a *Assessment) blockingIssues() []Issue {
+	var blocking []Issue
+	for _, issue := range a.Issues {
+		if issue.Category == categoryBlocking {
+			blocking = append(blocking, issue)
+		}
+	}
+	return blocking
+}
+
+// gpuDevices lists the GPU device nodes the tree rooted at pid holds open.
+func gpuDevices(pid int) []string {
+	seen := make(map[string]bool)
+	var devices []string
+	for _, p := range processTree(pid) {
+		fdDir := fmt.Sprintf("/proc/%d/fd", p)
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			target, err := os.Readlink(fmt.Sprintf("%s/%s", fdDir, entry.Name()))
+			if err != nil || seen[target] {
+				continue
+			}
+			if strings.HasPrefix(target, "/dev/nvidia") || strings.HasPrefix(target, "/dev/dri/") || target == "/dev/kfd" {
+				seen[target] = true
+				devices = append(devices, target)
+			}
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// formatCRIUVersion turns go-criu's major*10000+minor*100+sublevel into
+// "3.17.0".
+func formatCRIUVersion(version int) string {
+	return fmt.Sprintf("%d.%d.%d", version/10000, version/100%100, version%100)
+}
+
+// printAssessment prints the score and the issues, most severe first.
+func printAssessment(a *Assessment) {
+	fmt.Printf("Checkpoint-ability: %s, %d/100", a.Verdict, a.Score)
+	if a.CRIUVersion > 0 {
+		fmt.Printf(" (CRIU %s)", formatCRIUVersion(a.CRIUVersion))
+	}
+	fmt.Println()
+	if len(a.Issues) == 0 {
+		fmt.Println("  No issues found")
+		return
+	}
+	for i, issue := range a.Issues {
+		fmt.Printf("  %d. [%s] %s\n", i+1, issue.Category, issue.Problem)
+		switch {
+		case issue.Flag != "" && issue.Automatic:
+			fmt.Printf("     -> will set %s\n", issue.Flag)
+		case issue.Flag != "":
+			fmt.Printf("     -> needs %s\n", issue.Flag)
+		}
+		if issue.Recommendation != "" {
+			fmt.Printf("     -> %s\n", issue.Recommendation)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procStat holds the fields of /proc/<pid>/stat the analysis uses.
+type procStat struct {
+	State   string
+	PPID    int
+	PGRP    int
+	Session int
+	TTYNr   int
+}
+
+// parseProcStat parses a /proc/<pid>/stat line. The command name may hold
+// spaces and parentheses, so the fields are counted from the last ')'.
+func parseProcStat(data string) (*procStat, error) {
+	end := strings.LastIndex(data, ")")
+	if end == -1 || end+2 > len(data) {
+		return nil, fmt.Errorf("malformed stat line")
+	}
+	// state ppid pgrp session tty_nr ...
+	fields := strings.Fields(data[end+2:])
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("malformed stat line")
+	}
+
+	stat := &procStat{State: fields[0]}
+	for i, dst := range []*int{&stat.PPID, &stat.PGRP, &stat.Session, &stat.TTYNr} {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed stat field %q", fields[i+1])
+		}
+		*dst = n
+	}
+	return stat, nil
+}
+
+func readProcStat(pid int) (*procStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	return parseProcStat(string(data))
+}
+
+// SessionInfo describes the session and terminal of the dumped process.
+type SessionInfo struct {
+	PGID int `json:"pgid"`
+	SID  int `json:"sid"`
+	// TTY is the controlling terminal, e.g. "pts/3"; empty for none
+	TTY string `json:"tty,omitempty"`
+	// Leader is the name of the session leader, LeaderInTree whether it is
+	// part of the dump
+	Leader       string `json:"leader,omitempty"`
+	LeaderInTree bool   `json:"leader_in_tree"`
+}
+
+// NeedsShellJob reports whether CRIU needs --shell-job: the session leader
+// (typically the shell that started the process) is outside the dumped tree.
+// CRIU refuses to dump such a tree without it, terminal or not, and restores
+// the process into the restoring shell's session instead.
+func (s *SessionInfo) NeedsShellJob() bool {
+	return s != nil && !s.LeaderInTree
+}
+
+// analyzeSession reads the session facts of pid; nil if stat is unreadable.
+func analyzeSession(pid int) *SessionInfo {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return nil
+	}
+
+	session := &SessionInfo{
+		PGID: stat.PGRP,
+		SID:  stat.Session,
+		TTY:  ttyName(stat.TTYNr),
+	}
+	if stat.Session != 0 {
+		session.Leader = getProcessName(stat.Session)
+	}
+	for _, p := range processTree(pid) {
+		if p == stat.Session {
+			session.LeaderInTree = true
+		}
+	}
+	// Session 0 belongs to the kernel; nothing outside the tree leads it
+	if stat.Session == 0 {
+		session.LeaderInTree = true
+	}
+	return session
+}
+
+// ttyName decodes the tty_nr field of stat into a device name below /dev.
+func ttyName(nr int) string {
+	if nr == 0 {
+		return ""
+	}
+	major := (nr >> 8) & 0xfff
+	minor := (nr & 0xff) | ((nr >> 12) & 0xfff00)
+	switch {
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("pts/%d", (major-136)*256+minor)
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("tty%d", minor)
+	case major == 4:
+		return fmt.Sprintf("ttyS%d", minor-64)
+	case major == 5 && minor == 0:
+		return "tty"
+	}
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// printSession prints the session facts of an analysis.
+func printSession(s *SessionInfo) {
+	if s == nil {
+		return
+	}
+	tty, leader := s.TTY, s.Leader
+	if tty == "" {
+		tty = "none"
+	}
+	if leader == "" {
+		leader = "unknown"
+	}
+	fmt.Printf("  Session: %d (leader %s, in tree: %v), process group %d, terminal %s\n",
+		s.SID, leader, s.LeaderInTree, s.PGID, tty)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    procStat
+		wantErr bool
+	}{
+		{
+			name: "plain name",
+			data: "1234 (sleep) S 1200 1234 1100 34819 1234 4194304 100 0 0 0\n",
+			want: procStat{State: "S", PPID: 1200, PGRP: 1234, Session: 1100, TTYNr: 34819},
+		},
+		{
+			name: "name with spaces",
+			data: "1234 (my worker 1) R 1 1234 1234 0 -1 4194304\n",
+			want: procStat{State: "R", PPID: 1, PGRP: 1234, Session: 1234},
+		},
+		{
+			name: "name with parentheses",
+			data: "1234 (a) b (c)) S 7 8 9 1025 -1 0\n",
+			want: procStat{State: "S", PPID: 7, PGRP: 8, Session: 9, TTYNr: 1025},
+		},
+		{
+			name: "name that looks like fields",
+			data: "1234 (x) Z 1 2 3 4) T 10 20 30 0 -1\n",
+			want: procStat{State: "T", PPID: 10, PGRP: 20, Session: 30},
+		},
+		{
+			name:    "no closing parenthesis",
+			data:    "1234 (sleep S 1 2 3 0",
+			wantErr: true,
+		},
+		{
+			name:    "nothing after the name",
+			data:    "1234 (sleep)",
+			wantErr: true,
+		},
+		{
+			name:    "too few fields",
+			data:    "1234 (sleep) S 1 2 3\n",
+			wantErr: true,
+		},
+		{
+			name:    "field not a number",
+			data:    "1234 (sleep) S 1 two 3 0 -1\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProcStat(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTYName(t *testing.T) {
+	// tty_nr is major<<8 | minor&0xff | (minor&^0xff)<<12
+	tests := []struct {
+		nr   int
+		want string
+	}{
+		{0, ""},
+		{136<<8 | 3, "pts/3"},
+		{137<<8 | 44, "pts/300"},
+		{136<<8 | 300&0xff | (300&^0xff)<<12, "pts/300"},
+		{4<<8 | 1, "tty1"},
+		{4<<8 | 63, "tty63"},
+		{4<<8 | 64, "ttyS0"},
+		{4<<8 | 65, "ttyS1"},
+		{5 << 8, "tty"},
+		{188 << 8, "188:0"},
+	}
+
+	for _, tt := range tests {
+		if got := ttyName(tt.nr); got != tt.want {
+			t.Errorf("ttyName(%d) = %q, want %q", tt.nr, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsShellJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		session *SessionInfo
+		want    bool
+	}{
+		{"no session facts", nil, false},
+		{"leader in the tree", &SessionInfo{SID: 100, Leader: "app", LeaderInTree: true}, false},
+		{"leader is the shell outside the tree", &SessionInfo{SID: 100, Leader: "bash", TTY: "pts/0"}, true},
+		{"leader outside the tree without a terminal", &SessionInfo{SID: 100, Leader: "sshd"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.session.NeedsShellJob(); got != tt.want {
+				t.Errorf("NeedsShellJob() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeSessionLeader(t *testing.T) {
+	own, err := readProcStat(os.Getpid())
+	if err != nil {
+		t.Skipf("cannot read our stat: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		setsid       bool
+		wantInTree   bool
+		skipInKernel bool
+	}{
+		{name: "child leads its own session", setsid: true, wantInTree: true},
+		{name: "child in our session", setsid: false, wantInTree: false, skipInKernel: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.skipInKernel && own.Session == 0 {
+				t.Skip("we run in session 0, which counts as led from the tree")
+			}
+			cmd := exec.Command("sleep", "30")
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: tt.setsid}
+			if err := cmd.Start(); err != nil {
+				t.Skipf("cannot start sleep: %v", err)
+			}
+			defer func() {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}()
+
+			session := analyzeSession(cmd.Process.Pid)
+			if session == nil {
+				t.Fatal("no session facts")
+			}
+			if session.LeaderInTree != tt.wantInTree {
+				t.Errorf("LeaderInTree = %v, want %v (session %d)", session.LeaderInTree, tt.wantInTree, session.SID)
+			}
+			if session.NeedsShellJob() == tt.wantInTree {
+				t.Errorf("NeedsShellJob() = %v with the leader in the tree %v", session.NeedsShellJob(), tt.wantInTree)
+			}
+		})
+	}
+}
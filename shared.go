@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Coordination files used when a checkpoint directory lives on storage shared
+// between hosts. They are never part of the manifest.
+const (
+	inProgressLock = ".inprogress"
+	restoringLock  = ".restoring"
+	completeMarker = ".complete"
+)
+
+const (
+	// lockHeartbeat is how often a lock holder refreshes the lock mtime
+	lockHeartbeat = 5 * time.Second
+	// staleLockAge is how long a lock may go without a heartbeat before it
+	// counts as abandoned
+	staleLockAge = 6 * lockHeartbeat
+	// completePollInterval is how often --wait-for-complete checks for the marker
+	completePollInterval = 2 * time.Second
+)
+
+// isCoordinationFile reports whether name is a shared-dir lock or marker.
+func isCoordinationFile(name string) bool {
+	return name == inProgressLock || name == restoringLock || name == completeMarker
+}
+
+// sharedLock is an exclusive lock file held by this process. Its mtime is
+// refreshed periodically so other hosts can tell a live holder from a dead one.
+type sharedLock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockHolder is the identity recorded in a lock file.
+type lockHolder struct {
+	Host    string
+	PID     int
+	Started string
+}
+
+// acquireSharedLock creates the lock file name in dir. An existing lock is
+// only removed when breakStale is set and the lock is stale.
+func acquireSharedLock(dir, name string, breakStale bool) (*sharedLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	content := fmt.Sprintf("HOST=%s\nPID=%d\nSTARTED=%s\n", host, os.Getpid(), time.Now().Format(time.RFC3339))
+	lockPath := filepath.Join(dir, name)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, werr := file.WriteString(content)
+			cerr := file.Close()
+			if werr != nil || cerr != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("failed to write lock %s: %w", lockPath, errors.Join(werr, cerr))
+			}
+
+			lock := &sharedLock{path: lockPath, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock %s: %w", lockPath, err)
+		}
+
+		holder, stale, reason := inspectLock(lockPath)
+		if !stale {
+			return nil, fmt.Errorf("%s is locked by %s pid %d since %s", dir, holder.Host, holder.PID, holder.Started)
+		}
+		if !breakStale {
+			return nil, fmt.Errorf("%s has a stale lock from %s pid %d (%s); rerun with --break-stale-locks",
+				dir, holder.Host, holder.PID, reason)
+		}
+
+		logInfof("Breaking stale lock from %s pid %d (%s)", holder.Host, holder.PID, reason)
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to break stale lock: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to acquire lock %s", lockPath)
+}
+
+// inspectLock reads a lock file and decides whether its holder is gone. A
+// holder on this host is checked directly; a remote holder is presumed dead
+// once its heartbeat is older than staleLockAge.
+func inspectLock(lockPath string) (lockHolder, bool, string) {
+	var holder lockHolder
+
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		// Released while we looked; let the caller retry
+		return holder, true, "lock disappeared"
+	}
+
+	metadata, _ := readMetadata(lockPath)
+	holder.Host = metadata["HOST"]
+	holder.PID, _ = strconv.Atoi(metadata["PID"])
+	holder.Started = metadata["STARTED"]
+
+	host, _ := os.Hostname()
+	if holder.Host == host && holder.PID > 0 {
+		if err := syscall.Kill(holder.PID, 0); err == syscall.ESRCH {
+			return holder, true, "holder process is gone"
+		}
+	}
+
+	if age := time.Since(info.ModTime()); age > staleLockAge {
+		return holder, true, fmt.Sprintf("no heartbeat for %s", age.Round(time.Second))
+	}
+
+	return holder, false, ""
+}
+
+func (l *sharedLock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				logWarnf("failed to refresh lock %s: %v", l.path, err)
+			}
+		}
+	}
+}
+
+// Release stops the heartbeat and removes the lock file.
+func (l *sharedLock) Release() {
+	close(l.stop)
+	<-l.done
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		logWarnf("failed to remove lock %s: %v", l.path, err)
+	}
+}
+
+// manifestDigest returns the SHA-256 of the manifest file itself, which
+// identifies one exact checkpoint.
+func manifestDigest(dir string) (string, error) {
+	sum, err := hashFileSHA256(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to hash manifest: %w", err)
+	}
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// markComplete writes the completion marker holding the manifest digest.
+func markComplete(dir string) error {
+	digest, err := manifestDigest(dir)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, completeMarker+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(digest+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write completion marker: %w", err)
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, completeMarker))
+}
+
+// clearComplete removes a completion marker left by an earlier checkpoint
+// into the same directory.
+func clearComplete(dir string) error {
+	err := os.Remove(filepath.Join(dir, completeMarker))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old completion marker: %w", err)
+	}
+	return nil
+}
+
+// waitForComplete polls for the completion marker for up to timeout, then
+// checks that it names the current manifest and that the files match it. A
+// zero timeout checks once.
+func waitForComplete(dir string, timeout time.Duration) error {
+	markerPath := filepath.Join(dir, completeMarker)
+	deadline := time.Now().Add(timeout)
+
+	var data []byte
+	var err error
+	for announced := false; ; {
+		data, err = os.ReadFile(markerPath)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read completion marker: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("checkpoint in %s is not complete (no %s marker after %s)", dir, completeMarker, timeout)
+		}
+		if !announced {
+			logInfof("Waiting up to %s for %s to be completed...", timeout, dir)
+			announced = true
+		}
+		time.Sleep(completePollInterval)
+	}
+
+	digest, err := manifestDigest(dir)
+	if err != nil {
+		return err
+	}
+	if expected := strings.TrimSpace(string(data)); expected != digest {
+		return fmt.Errorf("completion marker does not match manifest in %s", dir)
+	}
+
+	logInfof("Verifying checkpoint against manifest...")
+	return verifyManifest(dir)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SharedMemory describes the shared memory a process tree uses. CRIU dumps
+// all three kinds, but state shared with processes outside the dump cannot
+// be captured consistently.
+type SharedMemory struct {
+	// POSIXFiles are files below /dev/shm mapped by the tree
+	POSIXFiles []string `json:"posix_files,omitempty"`
+	// Memfds counts the distinct memfds held open or mapped
+	Memfds int `json:"memfds,omitempty"`
+	// SysV lists the System V segments the tree has attached
+	SysV []SysVSegment `json:"sysv,omitempty"`
+}
+
+// SysVSegment is one attached System V shared memory segment.
+type SysVSegment struct {
+	Key  string `json:"key"`
+	ID   int    `json:"id"`
+	Size int64  `json:"size"`
+	// Attached is the kernel's attach count; AttachedInTree the number of
+	// processes of the dump tree mapping the segment
+	Attached       int `json:"attached"`
+	AttachedInTree int `json:"attached_in_tree"`
+}
+
+// SharedOutside reports whether something outside the dump tree has the
+// segment attached.
+func (s SysVSegment) SharedOutside() bool {
+	return s.Attached > s.AttachedInTree
+}
+
+// IsEmpty reports whether no shared memory was found.
+func (s *SharedMemory) IsEmpty() bool {
+	return len(s.POSIXFiles) == 0 && s.Memfds == 0 && len(s.SysV) == 0
+}
+
+// analyzeSharedMemory looks at every process in the tree rooted at pid for
+// /dev/shm mappings, memfds and attached System V segments.
+func analyzeSharedMemory(pid int) *SharedMemory {
+	shm := &SharedMemory{}
+
+	posix := make(map[string]bool)
+	memfds := make(map[uint64]bool) // by inode
+	attachedIn := make(map[int]int) // shmid -> processes of the tree
+	for _, p := range processTree(pid) {
+		sysvIDs := make(map[int]bool)
+		scanMaps(p, func(inode, path string) {
+			switch {
+			case strings.HasPrefix(path, "/dev/shm/"):
+				posix[strings.TrimSuffix(path, " (deleted)")] = true
+			case strings.HasPrefix(path, "/memfd:"):
+				if ino, err := strconv.ParseUint(inode, 10, 64); err == nil {
+					memfds[ino] = true
+				}
+			case strings.HasPrefix(path, "/SYSV"):
+				// The inode column of a SysV mapping is the shmid
+				if id, err := strconv.Atoi(inode); err == nil {
+					sysvIDs[id] = true
+				}
+			}
+		})
+		for id := range sysvIDs {
+			attachedIn[id]++
+		}
+
+		entries, _ := os.ReadDir(fmt.Sprintf("/proc/%d/fd", p))
+		for _, entry := range entries {
+			fdPath := fmt.Sprintf("/proc/%d/fd/%s", p, entry.Name())
+			target, err := os.Readlink(fdPath)
+			if err != nil || !strings.HasPrefix(target, "/memfd:") {
+				continue
+			}
+			if info, err := os.Stat(fdPath); err == nil {
+				memfds[info.Sys().(*syscall.Stat_t).Ino] = true
+			}
+		}
+	}
+
+	for path := range posix {
+		shm.POSIXFiles = append(shm.POSIXFiles, path)
+	}
+	sort.Strings(shm.POSIXFiles)
+	shm.Memfds = len(memfds)
+
+	if len(attachedIn) > 0 {
+		for _, seg := range readSysVSegments(pid) {
+			if n, ok := attachedIn[seg.ID]; ok {
+				seg.AttachedInTree = n
+				shm.SysV = append(shm.SysV, seg)
+			}
+		}
+	}
+
+	return shm
+}
+
+// scanMaps calls fn with the inode and path of every named mapping of pid.
+func scanMaps(pid int, fn func(inode, path string)) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		if path := strings.TrimSpace(fields[5]); path != "" {
+			fn(fields[4], path)
+		}
+	}
+}
+
+// processTree returns pid and all of its descendants.
+func processTree(pid int) []int {
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tasks, _ := os.ReadDir(fmt.Sprintf("/proc/%d/task", tree[i]))
+		for _, task := range tasks {
+			data, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", tree[i], task.Name()))
+			if err != nil {
+				continue
+			}
+			for _, field := range strings.Fields(string(data)) {
+				if child, err := strconv.Atoi(field); err == nil {
+					tree = append(tree, child)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+// readSysVSegments reads /proc/sysvipc/shm as seen from the IPC namespace of
+// pid. The file always shows the reader's namespace, so for a process in
+// another namespace it is read through nsenter.
+func readSysVSegments(pid int) []SysVSegment {
+	var data []byte
+	if sameNamespace(pid, "ipc") {
+		data, _ = os.ReadFile("/proc/sysvipc/shm")
+	} else {
+		data, _ = exec.Command("nsenter", "--target", strconv.Itoa(pid), "--ipc", "--", "cat", "/proc/sysvipc/shm").Output()
+	}
+
+	var segments []SysVSegment
+	for i, line := range strings.Split(string(data), "\n") {
+		// key shmid perms size cpid lpid nattch uid gid ...
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 7 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		attached, _ := strconv.Atoi(fields[6])
+		segments = append(segments, SysVSegment{Key: fields[0], ID: id, Size: size, Attached: attached})
+	}
+	return segments
+}
+
+// sameNamespace reports whether pid is in our namespace of the given type.
+func sameNamespace(pid int, ns string) bool {
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+	if err != nil {
+		return true
+	}
+	own, err := os.Readlink("/proc/self/ns/" + ns)
+	return err != nil || own == target
+}
+
+// printSharedMemory prints which kinds of shared memory were found.
+func printSharedMemory(shm *SharedMemory) {
+	if shm == nil || shm.IsEmpty() {
+		fmt.Println("  Shared memory: none")
+		return
+	}
+
+	fmt.Println("  Shared memory:")
+	if len(shm.POSIXFiles) > 0 {
+		fmt.Printf("    POSIX (/dev/shm): %s\n", strings.Join(shm.POSIXFiles, ", "))
+	}
+	if shm.Memfds > 0 {
+		fmt.Printf("    memfd: %d\n", shm.Memfds)
+	}
+	for _, seg := range shm.SysV {
+		where := "only within the dump tree"
+		if seg.SharedOutside() {
+			where = fmt.Sprintf("SHARED OUTSIDE the dump tree (%d of %d attaches)", seg.Attached-seg.AttachedInTree, seg.Attached)
+		}
+		fmt.Printf("    SysV segment %d key %s, %s: %s\n", seg.ID, seg.Key, formatSize(seg.Size), where)
+	}
+}
+
+// warnSharedMemory prints a warning for every SysV segment that processes
+// outside the dump tree also have attached.
+func warnSharedMemory(shm *SharedMemory) {
+	if shm == nil {
+		return
+	}
+	for _, seg := range shm.SysV {
+		if seg.SharedOutside() {
+			logWarnf("SysV shared memory segment %d is also attached outside the dump tree; its contents cannot be checkpointed consistently", seg.ID)
+		}
+	}
+}
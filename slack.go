@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// slackLogLines is how much of dump.log a failure notification quotes
+const slackLogLines = 20
+
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifySlackFailure posts a failed checkpoint of target to a Slack incoming
+// webhook. It must run before the partial checkpoint, and with it dump.log,
+// is cleaned up.
+func notifySlackFailure(webhook, target, checkpointDir string, dumpErr error) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, ":x: *Checkpoint of %s failed*\n", target)
+	writeSlackContext(&msg, checkpointDir)
+	fmt.Fprintf(&msg, "*Error:* %s\n", dumpErr)
+	if tail := tailFile(filepath.Join(checkpointDir, "dump.log"), slackLogLines); tail != "" {
+		fmt.Fprintf(&msg, "*Last lines of dump.log:*\n```\n%s\n```", tail)
+	} else {
+		msg.WriteString("_No dump.log was written_")
+	}
+	return postSlack(webhook, msg.String())
+}
+
+// notifySlackSuccess posts a successful checkpoint of target with its
+// duration and number of images.
+func notifySlackSuccess(webhook, target, checkpointDir string, duration time.Duration) error {
+	images := 0
+	if entries, err := os.ReadDir(checkpointDir); err == nil {
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".img") {
+				images++
+			}
+		}
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, ":white_check_mark: *Checkpoint of %s succeeded*\n", target)
+	writeSlackContext(&msg, checkpointDir)
+	fmt.Fprintf(&msg, "*Duration:* %s\n*Images:* %d", duration.Round(time.Millisecond), images)
+	return postSlack(webhook, msg.String())
+}
+
+// writeSlackContext adds the host, time and checkpoint directory lines
+// every notification has.
+func writeSlackContext(msg *strings.Builder, checkpointDir string) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	fmt.Fprintf(msg, "*Host:* %s\n*Time:* %s\n*Directory:* %s\n", host, time.Now().Format(time.RFC3339), checkpointDir)
+}
+
+func postSlack(webhook, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("failed to encode Slack message: %w", err)
+	}
+	resp, err := slackClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send Slack notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send Slack notification: webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// tailFile returns the last n lines of path, or "" if it cannot be read.
+func tailFile(path string, n int) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/checkpoint-restore/go-criu/v7/rpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// stdioFile records the CRIU inherit-fd key of the dumped process's standard
+// descriptors, in the same KEY=VALUE format as container.meta.
+const stdioFile = "stdio.info"
+
+// stdioNames maps the descriptors recorded in stdio.info to their keys there.
+var stdioNames = map[int]string{0: "STDIN", 1: "STDOUT", 2: "STDERR"}
+
+// inheritFdKey returns the key CRIU uses to identify what fd of pid refers
+// to: "pipe:[ino]" and "socket:[ino]" as the kernel reports them,
+// "tty[rdev:dev]" for terminals and the path without its leading slash for
+// files.
+func inheritFdKey(pid, fd int) (string, error) {
+	fdPath := fmt.Sprintf("/proc/%d/fd/%d", pid, fd)
+	target, err := os.Readlink(fdPath)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(target, "pipe:") || strings.HasPrefix(target, "socket:") {
+		return target, nil
+	}
+
+	if strings.HasPrefix(target, "/dev/pts/") || strings.HasPrefix(target, "/dev/tty") || target == "/dev/console" {
+		var st syscall.Stat_t
+		if err := syscall.Stat(fdPath, &st); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("tty[%x:%x]", st.Rdev, st.Dev), nil
+	}
+
+	return strings.TrimPrefix(target, "/"), nil
+}
+
+// recordStdio writes stdio.info for pid into checkpointDir.
+func recordStdio(pid int, checkpointDir string) error {
+	var b strings.Builder
+	for fd := 0; fd <= 2; fd++ {
+		key, err := inheritFdKey(pid, fd)
+		if err != nil {
+			// Closed descriptors are simply not recorded
+			continue
+		}
+		fmt.Fprintf(&b, "%s=%s\n", stdioNames[fd], key)
+	}
+
+	if err := os.WriteFile(filepath.Join(checkpointDir, stdioFile), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", stdioFile, err)
+	}
+	return nil
+}
+
+// openRedirects opens the --redirect-stdout/--redirect-stderr files and adds
+// inherit-fd entries that make CRIU attach them in place of the descriptors
+// recorded in stdio.info. Must run before the CRIU process is started: the
+// descriptors are left open across exec so that CRIU inherits them under the
+// same numbers.
+func openRedirects(checkpointDir string, cfg *RestoreConfig) error {
+	redirects := map[string]string{"STDOUT": cfg.RedirectStdout, "STDERR": cfg.RedirectStderr}
+	if cfg.RedirectStdout == "" && cfg.RedirectStderr == "" {
+		return nil
+	}
+
+	keys, err := readMetadata(filepath.Join(checkpointDir, stdioFile))
+	if err != nil {
+		return fmt.Errorf("checkpoint has no %s to redirect from: %w", stdioFile, err)
+	}
+
+	for _, name := range []string{"STDOUT", "STDERR"} {
+		path := redirects[name]
+		if path == "" {
+			continue
+		}
+		key := keys[name]
+		if key == "" {
+			return fmt.Errorf("%s of the checkpointed process was not recorded", strings.ToLower(name))
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_SETFD, 0); errno != 0 {
+			file.Close()
+			return fmt.Errorf("failed to clear close-on-exec on %s: %w", path, errno)
+		}
+
+		logInfof("Redirecting %s (%s) to %s", strings.ToLower(name), key, path)
+		cfg.redirectFiles = append(cfg.redirectFiles, file)
+		cfg.InheritFds = append(cfg.InheritFds, &rpc.InheritFd{
+			Key: proto.String(key),
+			Fd:  proto.Int32(int32(file.Fd())),
+		})
+	}
+
+	return nil
+}
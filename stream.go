@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// streamCheckpoint dumps target into a private temporary directory and
+// writes the result, including metadata and manifest, to w as a tar archive.
+// The temporary directory is removed whether or not the dump succeeds.
+func streamCheckpoint(target string, cfg *CheckpointConfig, w io.Writer, compress bool) error {
+	tmpDir, err := os.MkdirTemp("", "docker-cr-stream-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary checkpoint directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := createCheckpoint(target, tmpDir, cfg); err != nil {
+		return err
+	}
+
+	logInfof("Streaming checkpoint archive to stdout...")
+	defer cfg.timings.track(phaseCompress)()
+	return writeCheckpointTar(tmpDir, w, compress)
+}
+
+// writeCheckpointTar archives every file below checkpointDir to w, optionally
+// gzip-compressed. Paths in the archive are relative to checkpointDir.
+func writeCheckpointTar(checkpointDir string, w io.Writer, compress bool) error {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(checkpointDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == checkpointDir {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(checkpointDir, path)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint archive: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish checkpoint archive: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to finish compressed stream: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// extractCheckpointTar unpacks an archive written by writeCheckpointTar,
+// gzipped if compressed, into checkpointDir. Entries that would land
+// outside it are rejected.
+func extractCheckpointTar(r io.Reader, checkpointDir string, compressed bool) error {
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to read compressed archive: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read checkpoint archive: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q escapes the checkpoint directory", hdr.Name)
+		}
+		target := filepath.Join(checkpointDir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := spoolToFile(tr, target); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
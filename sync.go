@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// syncDestination is the receiving side of an incremental checkpoint sync.
+// Paths passed to it are slash-separated and relative to the destination root.
+type syncDestination interface {
+	ReadManifest() (map[string]string, error)
+	Put(srcPath, rel string) error
+	Remove(rel string) error
+	Verify() error
+	String() string
+}
+
+// syncCheckpoint mirrors srcDir to dest, transferring only files whose hash
+// differs from the destination manifest and deleting files that no longer
+// exist in the source. The destination is verified against the source
+// manifest once the transfer finishes.
+func syncCheckpoint(srcDir, dest string, parallel int) error {
+	defer tracing.track(spanSync)()
+	target, err := parseSyncDestination(dest)
+	if err != nil {
+		return err
+	}
+
+	if isDeltaCheckpoint(srcDir) {
+		return fmt.Errorf("%s is a delta checkpoint; flatten it before syncing", srcDir)
+	}
+
+	srcHashes, err := readManifest(filepath.Join(srcDir, manifestFile))
+	if os.IsNotExist(err) {
+		logInfof("No manifest in %s, generating one...", srcDir)
+		if srcHashes, err = writeManifest(srcDir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read source manifest: %w", err)
+	} else if err := verifyManifest(srcDir); err != nil {
+		// Never propagate a checkpoint that no longer matches its manifest
+		return fmt.Errorf("source %s: %w", srcDir, err)
+	}
+
+	dstHashes, err := target.ReadManifest()
+	if err != nil {
+		// A missing or unreadable manifest just means everything is sent
+		dstHashes = map[string]string{}
+	}
+
+	var changed, removed []string
+	for name, hash := range srcHashes {
+		if dstHashes[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range dstHashes {
+		if _, ok := srcHashes[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	logInfof("Syncing %s to %s: %d changed, %d removed, %d unchanged",
+		srcDir, target, len(changed), len(removed), len(srcHashes)-len(changed))
+
+	if err := runParallel(changed, parallel, func(name string) error {
+		if err := target.Put(filepath.Join(srcDir, filepath.FromSlash(name)), name); err != nil {
+			return fmt.Errorf("failed to transfer %s: %w", name, err)
+		}
+		fmt.Printf("  + %s\n", name)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		if err := target.Remove(name); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		fmt.Printf("  - %s\n", name)
+	}
+
+	// The manifest goes last so an interrupted sync is retried in full
+	if err := target.Put(filepath.Join(srcDir, manifestFile), manifestFile); err != nil {
+		return fmt.Errorf("failed to transfer manifest: %w", err)
+	}
+
+	if err := target.Verify(); err != nil {
+		return fmt.Errorf("destination verification failed: %w", err)
+	}
+
+	logInfof("Sync to %s verified", target)
+	return nil
+}
+
+// runParallel calls fn for every item using at most workers goroutines and
+// returns the first error encountered.
+func runParallel(items []string, workers int, fn func(string) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan string)
+	errs := make(chan error, len(items))
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				if err := fn(item); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, item := range items {
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// parseSyncDestination accepts a local path, an scp-style "[user@]host:path"
+// ssh target or a gs://bucket/path Google Cloud Storage location.
+func parseSyncDestination(dest string) (syncDestination, error) {
+	if dest == "" {
+		return nil, fmt.Errorf("empty sync destination")
+	}
+
+	if strings.HasPrefix(dest, gcsScheme) {
+		d, err := parseGCSDestination(dest)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	if idx := strings.Index(dest, ":"); idx > 0 && !strings.ContainsRune(dest[:idx], '/') {
+		host, dir := dest[:idx], dest[idx+1:]
+		if dir == "" {
+			return nil, fmt.Errorf("ssh destination %s has no path", dest)
+		}
+		return &sshDestination{host: host, dir: dir}, nil
+	}
+
+	return &localDestination{dir: dest}, nil
+}
+
+type localDestination struct {
+	dir string
+}
+
+func (d *localDestination) String() string { return d.dir }
+
+func (d *localDestination) ReadManifest() (map[string]string, error) {
+	return readManifest(filepath.Join(d.dir, manifestFile))
+}
+
+func (d *localDestination) Put(srcPath, rel string) error {
+	dstPath := filepath.Join(d.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Write to a temporary name so readers never see a half-copied image
+	tmpPath := dstPath + ".partial"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, dstPath)
+}
+
+func (d *localDestination) Remove(rel string) error {
+	err := os.Remove(filepath.Join(d.dir, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *localDestination) Verify() error {
+	return verifyManifest(d.dir)
+}
+
+// sshDestination talks to a remote host through the ssh client binary so the
+// user's ssh configuration, agent and known_hosts apply unchanged.
+type sshDestination struct {
+	host string
+	dir  string
+}
+
+func (d *sshDestination) String() string { return d.host + ":" + d.dir }
+
+func (d *sshDestination) run(stdin io.Reader, script string) ([]byte, error) {
+	cmd := exec.Command("ssh", d.host, script)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("ssh %s: %w: %s", d.host, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (d *sshDestination) remotePath(rel string) string {
+	return path.Join(d.dir, rel)
+}
+
+func (d *sshDestination) ReadManifest() (map[string]string, error) {
+	out, err := d.run(nil, "cat "+shellQuote(d.remotePath(manifestFile)))
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(bytes.NewReader(out))
+}
+
+func (d *sshDestination) Put(srcPath, rel string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := d.remotePath(rel)
+	tmp := dst + ".partial"
+	script := fmt.Sprintf("mkdir -p %s && cat > %s && mv -f %s %s",
+		shellQuote(path.Dir(dst)), shellQuote(tmp), shellQuote(tmp), shellQuote(dst))
+	_, err = d.run(src, script)
+	return err
+}
+
+func (d *sshDestination) Remove(rel string) error {
+	_, err := d.run(nil, "rm -f -- "+shellQuote(d.remotePath(rel)))
+	return err
+}
+
+func (d *sshDestination) Verify() error {
+	script := fmt.Sprintf("cd %s && sha256sum --quiet -c %s", shellQuote(d.dir), manifestFile)
+	_, err := d.run(nil, script)
+	return err
+}
+
+// shellQuote quotes s for use in a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
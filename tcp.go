@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcpStates names the st column of /proc/net/tcp (include/net/tcp_states.h).
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+// TCPConnection is a connected TCP socket held by the process tree.
+type TCPConnection struct {
+	PID    int    `json:"pid"`
+	Proto  string `json:"proto"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	State  string `json:"state"`
+	// Interface has the local address, in the process's network namespace
+	Interface string `json:"interface,omitempty"`
+}
+
+func (c TCPConnection) String() string {
+	if c.Interface != "" {
+		return fmt.Sprintf("%s -> %s %s on %s (pid %d)", c.Local, c.Remote, c.State, c.Interface, c.PID)
+	}
+	return fmt.Sprintf("%s -> %s %s (pid %d)", c.Local, c.Remote, c.State, c.PID)
+}
+
+// checkTCPConnections records the TCP connections the tree rooted at pid
+// owns. /proc/<pid>/net/tcp lists the whole network namespace, so its inode
+// column is matched against the sockets in the tree's fds: a process sharing
+// a namespace with a busy one must not get tcp-established forced on.
+// Listening and closed sockets need no tcp-established and are left out.
+func checkTCPConnections(pid int, info *ProcessInfo) {
+	owners := make(map[string]int)
+	for _, p := range processTree(pid) {
+		for inode := range socketInodes(p) {
+			if _, seen := owners[inode]; !seen {
+				owners[inode] = p
+			}
+		}
+	}
+
+	for _, proto := range []string{"tcp", "tcp6"} {
+		info.TCPConnections = append(info.TCPConnections, readTCPConnections(pid, proto, owners)...)
+	}
+	annotateTCPInterfaces(pid, info.TCPConnections)
+	info.HasTCP = len(info.TCPConnections) > 0
+}
+
+// readTCPConnections parses /proc/<pid>/net/<proto> and returns the
+// connections whose socket inode is in owners, attributed to its owner.
+func readTCPConnections(pid int, proto string, owners map[string]int) []TCPConnection {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/%s", pid, proto))
+	if err != nil {
+		return nil
+	}
+	return parseTCPConnections(string(data), proto, owners)
+}
+
+// parseTCPConnections returns the connections of a /proc/net/tcp{,6} table
+// whose socket inode is in owners.
+func parseTCPConnections(table, proto string, owners map[string]int) []TCPConnection {
+	var conns []TCPConnection
+	for i, line := range strings.Split(table, "\n") {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 10 {
+			continue
+		}
+		owner, ok := owners[fields[9]]
+		if !ok {
+			continue
+		}
+		state := tcpStates[fields[3]]
+		if state == "LISTEN" || state == "CLOSE" {
+			continue
+		}
+		localAddr, localPort, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteAddr, remotePort, err := parseProcNetAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		conns = append(conns, TCPConnection{
+			PID:    owner,
+			Proto:  proto,
+			Local:  net.JoinHostPort(localAddr, strconv.Itoa(localPort)),
+			Remote: net.JoinHostPort(remoteAddr, strconv.Itoa(remotePort)),
+			State:  state,
+		})
+	}
+	return conns
+}
@@ -0,0 +1,37 @@
+#!/bin/bash
+# Hook script that checks docker-cr passed the operation context, e.g.
+#   sudo ./docker-cr checkpoint --pre-dump-script ./test_hook_env.sh test-criu /tmp/test-checkpoint
+# It exits non-zero, aborting the operation, if a variable is missing.
+
+status=0
+for var in DOCKER_CR_PID DOCKER_CR_CONTAINER_ID DOCKER_CR_CONTAINER_NAME \
+	DOCKER_CR_IMAGE DOCKER_CR_CHECKPOINT_DIR DOCKER_CR_HOOK_CHECKPOINT_DIR \
+	DOCKER_CR_PHASE DOCKER_CR_MODE; do
+	if [ -z "${!var+set}" ]; then
+		echo "test_hook_env: $var is not set" >&2
+		status=1
+	fi
+done
+
+# These are known for every operation
+for var in DOCKER_CR_PHASE DOCKER_CR_MODE DOCKER_CR_CHECKPOINT_DIR DOCKER_CR_HOOK_CHECKPOINT_DIR; do
+	if [ -z "${!var}" ]; then
+		echo "test_hook_env: $var is empty" >&2
+		status=1
+	fi
+done
+if [ "$DOCKER_CR_CHECKPOINT_DIR" != "$DOCKER_CR_HOOK_CHECKPOINT_DIR" ]; then
+	echo "test_hook_env: DOCKER_CR_CHECKPOINT_DIR and DOCKER_CR_HOOK_CHECKPOINT_DIR differ" >&2
+	status=1
+fi
+if [ "$DOCKER_CR_MODE" = "container" ] && [ -z "$DOCKER_CR_CONTAINER_ID" ]; then
+	echo "test_hook_env: DOCKER_CR_CONTAINER_ID is empty in container mode" >&2
+	status=1
+fi
+if [ "$DOCKER_CR_PHASE" = "PostRestore" ] && [ -z "$DOCKER_CR_RESTORED_PID" ]; then
+	echo "test_hook_env: DOCKER_CR_RESTORED_PID is not set after restore" >&2
+	status=1
+fi
+
+[ $status -eq 0 ] && echo "test_hook_env: $DOCKER_CR_PHASE ($DOCKER_CR_MODE) pid=$DOCKER_CR_PID dir=$DOCKER_CR_CHECKPOINT_DIR"
+exit $status
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Phases of the timing breakdown of a checkpoint or restore
+const (
+	phaseInspect   = "docker-inspect"
+	phaseAnalysis  = "analysis"
+	phasePreDump   = "criu-pre-dump"
+	phaseDump      = "criu-dump"
+	phaseFreeze    = "freeze"
+	phaseMetadata  = "metadata"
+	phaseVerify    = "verification"
+	phaseCompress  = "archive"
+	phaseRecreate  = "container-recreation"
+	phaseRestore   = "criu-restore"
+	phaseTreeSetup = "tree-restore"
+)
+
+// phaseNotes say where the less obvious phases start and end.
+var phaseNotes = map[string]string{
+	phaseFreeze:    "PreDump to PostDump",
+	phaseTreeSetup: "PreRestore to PostRestore",
+	phaseCompress:  "tar stream, gzipped with --compress",
+}
+
+// Timings is the per-phase breakdown of a checkpoint or restore. The phases
+// bounded by CRIU notifications are timed by the NotifyHandler and lie
+// within the CRIU call. A nil *Timings records nothing.
+type Timings struct {
+	Phases []PhaseTiming `json:"phases"`
+	// FreezeSeconds is the time from PreDump to PostDump, during which the
+	// dumped tree is frozen and its images are written: the downtime
+	FreezeSeconds float64 `json:"freeze_seconds,omitempty"`
+	TotalSeconds  float64 `json:"total_seconds"`
+
+	started time.Time
+	open    map[string]time.Time
+}
+
+// PhaseTiming is one timed phase; Start is its offset from the start of
+// the operation.
+type PhaseTiming struct {
+	Name    string  `json:"name"`
+	Start   float64 `json:"start"`
+	Seconds float64 `json:"seconds"`
+}
+
+func newTimings() *Timings {
+	return &Timings{started: time.Now(), open: make(map[string]time.Time)}
+}
+
+// begin starts timing phase.
+func (t *Timings) begin(phase string) {
+	if t == nil {
+		return
+	}
+	t.open[phase] = time.Now()
+	tracing.begin(phase)
+	progress.emit(ProgressEvent{Type: eventPhaseStart, Phase: phase})
+}
+
+// end stops timing phase. A phase that runs again, e.g. the dump of a
+// fallback, adds to its first entry.
+func (t *Timings) end(phase string) {
+	if t == nil {
+		return
+	}
+	began, ok := t.open[phase]
+	if !ok {
+		return
+	}
+	delete(t.open, phase)
+	tracing.end(phase)
+	seconds := time.Since(began).Seconds()
+	progress.emit(ProgressEvent{Type: eventPhaseEnd, Phase: phase, Seconds: seconds})
+	if phase == phaseFreeze {
+		t.FreezeSeconds += seconds
+	}
+	for i := range t.Phases {
+		if t.Phases[i].Name == phase {
+			t.Phases[i].Seconds += seconds
+			return
+		}
+	}
+	t.Phases = append(t.Phases, PhaseTiming{Name: phase, Start: began.Sub(t.started).Seconds(), Seconds: seconds})
+}
+
+// track times phase until the returned function is called.
+func (t *Timings) track(phase string) func() {
+	t.begin(phase)
+	return func() { t.end(phase) }
+}
+
+// finish sets the total and orders the phases by their start.
+func (t *Timings) finish() {
+	if t == nil {
+		return
+	}
+	t.TotalSeconds = time.Since(t.started).Seconds()
+	sort.SliceStable(t.Phases, func(i, j int) bool { return t.Phases[i].Start < t.Phases[j].Start })
+}
+
+// report prints the breakdown at the end of an operation; with
+// --log-format=json it is also a record.
+func (t *Timings) report(operation string) {
+	if t == nil || len(t.Phases) == 0 {
+		return
+	}
+	t.print(operation)
+	if logFormat != logFormatJSON {
+		return
+	}
+	phases := make([]any, 0, len(t.Phases))
+	for _, p := range t.Phases {
+		phases = append(phases, slog.Duration(p.Name, seconds(p.Seconds)))
+	}
+	logger.Info(operation+" timings", "total", seconds(t.TotalSeconds),
+		"freeze", seconds(t.FreezeSeconds), slog.Group("phases", phases...))
+}
+
+// print writes the breakdown as a table, a phase that lies within the one
+// before it indented, and the freeze window on a line of its own.
+func (t *Timings) print(operation string) {
+	if t == nil || len(t.Phases) == 0 {
+		return
+	}
+	fmt.Printf("%s timings:\n", operation)
+	for i, p := range t.Phases {
+		label := p.Name
+		if i > 0 && p.Start+p.Seconds <= t.Phases[i-1].Start+t.Phases[i-1].Seconds {
+			label = "  " + label
+		}
+		if note := phaseNotes[p.Name]; note != "" {
+			label += " (" + note + ")"
+		}
+		fmt.Printf("  %-44s %9.3fs\n", label, p.Seconds)
+	}
+	fmt.Printf("  %-44s %9.3fs\n", "total", t.TotalSeconds)
+	if t.FreezeSeconds > 0 {
+		fmt.Printf("Freeze window: %.3fs\n", t.FreezeSeconds)
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
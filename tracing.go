@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans besides the timed phases
+const (
+	spanCopy      = "checkpoint-copy"
+	spanSync      = "sync"
+	spanReplicate = "replicate"
+)
+
+// traceFlushTimeout bounds the export of the spans when the operation ends.
+const traceFlushTimeout = 5 * time.Second
+
+// operationTrace exports the spans of one checkpoint or restore over OTLP:
+// a root span for the operation, a child span for every timed phase and
+// every copy or transfer, and the CRIU notifications as events of the
+// innermost open span. A nil *operationTrace records nothing, so without
+// an endpoint no span is ever created.
+type operationTrace struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	root     trace.Span
+
+	mu sync.Mutex
+	// open are the spans begun and not yet ended, innermost last
+	open  []openSpan
+	ended bool
+}
+
+type openSpan struct {
+	name string
+	span trace.Span
+	ctx  context.Context
+}
+
+// tracing traces the running operation; nil without an OTLP endpoint.
+var tracing *operationTrace
+
+// envCarrier reads an incoming trace context from TRACEPARENT and
+// TRACESTATE, as set by a traced parent process.
+type envCarrier struct{}
+
+func (envCarrier) Get(key string) string {
+	switch key {
+	case "traceparent":
+		return os.Getenv("TRACEPARENT")
+	case "tracestate":
+		return os.Getenv("TRACESTATE")
+	}
+	return ""
+}
+
+func (envCarrier) Set(string, string) {}
+func (envCarrier) Keys() []string     { return []string{"traceparent", "tracestate"} }
+
+// startTracing starts tracing operation on target if endpoint, or else
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, names
+// an OTLP/HTTP collector. The root span continues the trace of TRACEPARENT
+// if it is set.
+func startTracing(endpoint, operation, target string) error {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "docker-cr")),
+		resource.WithFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+
+	t := &operationTrace{provider: provider, tracer: provider.Tracer("docker-cr")}
+	ctx = propagation.TraceContext{}.Extract(ctx, envCarrier{})
+	ctx, t.root = t.tracer.Start(ctx, operation, trace.WithAttributes(attribute.String("docker_cr.target", target)))
+	t.open = []openSpan{{name: operation, span: t.root, ctx: ctx}}
+	tracing = t
+	logDebugf("Tracing %s as trace %s", operation, t.root.SpanContext().TraceID())
+	return nil
+}
+
+// begin starts a span for name within the innermost open span.
+func (t *operationTrace) begin(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return
+	}
+	ctx, span := t.tracer.Start(t.open[len(t.open)-1].ctx, name)
+	t.open = append(t.open, openSpan{name: name, span: span, ctx: ctx})
+}
+
+// end ends the innermost open span for name.
+func (t *operationTrace) end(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.open) - 1; i > 0; i-- {
+		if t.open[i].name == name {
+			t.open[i].span.End()
+			t.open = append(t.open[:i], t.open[i+1:]...)
+			return
+		}
+	}
+}
+
+// track spans name until the returned function is called.
+func (t *operationTrace) track(name string) func() {
+	t.begin(name)
+	return func() { t.end(name) }
+}
+
+// event adds an event, e.g. a CRIU notification, to the innermost open
+// span.
+func (t *operationTrace) event(name string, attrs ...attribute.KeyValue) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return
+	}
+	t.open[len(t.open)-1].span.AddEvent(name, trace.WithAttributes(attrs...))
+}
+
+// warn adds a warning to the innermost open span.
+func (t *operationTrace) warn(msg string) {
+	t.event("warning", attribute.String("message", msg))
+}
+
+// finish ends every open span, marking the root failed with msg if it is
+// not empty, and exports them. Records of the operation's failure come
+// right before it exits, so the first error finishes the trace.
+func (t *operationTrace) finish(msg string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.ended {
+		t.mu.Unlock()
+		return
+	}
+	t.ended = true
+	if msg != "" {
+		t.root.SetStatus(codes.Error, msg)
+	}
+	for i := len(t.open) - 1; i >= 0; i-- {
+		t.open[i].span.End()
+	}
+	t.open = nil
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		logWarnf("failed to export trace: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// requiredImages are the CRIU images without which no restore can succeed.
+var requiredImages = []string{"inventory.img", "pstree.img"}
+
+// verifyCheckpoint checks that checkpointDir is restorable as far as can be
+// told without restoring it: the required images are present, at least one
+// task has a core image, every file matches the manifest and, for a delta
+// checkpoint, every parent in the chain is intact.
+func verifyCheckpoint(checkpointDir string) error {
+	if checkpointType := partialCheckpointType(checkpointDir); checkpointType != "" {
+		return fmt.Errorf("%s is a partial (%s) checkpoint and cannot be restored", checkpointDir, checkpointType)
+	}
+	if isFilesystemOnlyCheckpoint(checkpointDir) {
+		for _, name := range []string{fsOnlyArchive, fsOnlyConfig} {
+			if _, err := os.Stat(filepath.Join(checkpointDir, name)); err != nil {
+				return fmt.Errorf("filesystem-only checkpoint is missing %s", name)
+			}
+		}
+		return verifyManifest(checkpointDir)
+	}
+
+	chain := []string{checkpointDir}
+	if isDeltaCheckpoint(checkpointDir) {
+		var err error
+		if chain, err = resolveDeltaChain(checkpointDir); err != nil {
+			return err
+		}
+	}
+
+	// Delta checkpoints may take any image from a parent
+	present := func(pattern string) bool {
+		for _, dir := range chain {
+			if matches, _ := filepath.Glob(filepath.Join(dir, pattern)); len(matches) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, name := range requiredImages {
+		if !present(name) {
+			return fmt.Errorf("required image %s is missing", name)
+		}
+	}
+	if !present("core-*.img") {
+		return fmt.Errorf("no core-*.img task images found")
+	}
+
+	if _, err := os.Stat(filepath.Join(checkpointDir, manifestFile)); err != nil {
+		return fmt.Errorf("no %s to verify against: %w", manifestFile, err)
+	}
+	return verifyManifest(checkpointDir)
+}
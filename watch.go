@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Ptrace requests and events missing from package syscall.
+const (
+	ptraceSeize     = 0x4206
+	ptraceListen    = 0x4208
+	ptraceEventStop = 128
+)
+
+// signalNames are the signals accepted by --checkpoint-on-signal besides
+// plain numbers. SIGKILL and SIGSTOP cannot be intercepted.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"URG":   syscall.SIGURG,
+	"WINCH": syscall.SIGWINCH,
+	"PWR":   syscall.SIGPWR,
+}
+
+// parseSignal accepts "SIGUSR2", "USR2" or "12".
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || n > 64 || syscall.Signal(n) == syscall.SIGKILL || syscall.Signal(n) == syscall.SIGSTOP {
+			return 0, fmt.Errorf("cannot watch for signal %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown or unwatchable signal %q", s)
+	}
+	return sig, nil
+}
+
+// watchForSignal attaches to pid with PTRACE_SEIZE and blocks until the
+// process is about to receive sig. Every other signal is passed through
+// unchanged. On return the tracer has detached and sig has been delivered, so
+// CRIU (which needs to ptrace the process itself) can dump it.
+func watchForSignal(pid int, sig syscall.Signal) error {
+	// All ptrace requests must come from the thread that attached
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, ptraceSeize, uintptr(pid), 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to attach to %d: %w", pid, errno)
+	}
+
+	for {
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WALL, nil); err != nil {
+			return fmt.Errorf("failed to wait for %d: %w", pid, err)
+		}
+
+		switch {
+		case status.Exited() || status.Signaled():
+			return fmt.Errorf("process %d exited before receiving %s", pid, sig)
+
+		case !status.Stopped():
+			continue
+
+		case status.TrapCause() == ptraceEventStop:
+			// Group-stop: leave the process stopped until it is continued
+			if _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, ptraceListen, uintptr(pid), 0, 0, 0, 0); errno != 0 {
+				return fmt.Errorf("failed to listen on %d: %w", pid, errno)
+			}
+
+		case status.StopSignal() == sig:
+			// Deliver the signal on detach so the application still sees it
+			if _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_DETACH, uintptr(pid), 0, uintptr(sig), 0, 0); errno != 0 {
+				return fmt.Errorf("failed to detach from %d: %w", pid, errno)
+			}
+			return nil
+
+		default:
+			if err := syscall.PtraceCont(pid, int(status.StopSignal())); err != nil {
+				return fmt.Errorf("failed to resume %d: %w", pid, err)
+			}
+		}
+	}
+}
+
+// watchAndCheckpoint waits for target to receive sig and then checkpoints it
+// into checkpointDir.
+func watchAndCheckpoint(target, checkpointDir string, sig syscall.Signal, cfg *CheckpointConfig) error {
+	pid, err := resolveTargetPID(target)
+	if err != nil {
+		return err
+	}
+
+	logInfof("Watching PID %d for %s...", pid, sig)
+	if err := watchForSignal(pid, sig); err != nil {
+		return err
+	}
+
+	logInfof("Received %s, checkpointing %s", sig, target)
+	return createCheckpoint(target, checkpointDir, cfg)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxWatchSearch bounds how many directory entries are examined when looking
+// up the path of a watched inode.
+const maxWatchSearch = 100000
+
+// FSWatch is one inotify watch or fanotify mark. The kernel only reports the
+// inode and device (or the mount ID of a fanotify mount mark), so Path is
+// looked up afterwards and may stay empty.
+type FSWatch struct {
+	// Kind is "inotify" or "fanotify"
+	Kind  string `json:"kind"`
+	FD    int    `json:"fd"`
+	Inode uint64 `json:"inode,omitempty"`
+	// Device is the major:minor of the watched filesystem
+	Device  string `json:"device,omitempty"`
+	MountID int    `json:"mount_id,omitempty"`
+	// Path is the watched path inside the process's mount namespace
+	Path string `json:"path,omitempty"`
+}
+
+// readWatches parses /proc/<pid>/fdinfo/<fd> of an inotify or fanotify fd.
+//
+//	inotify wd:1 ino:1a2b sdev:800001 mask:... ignored_mask:0 ...
+//	fanotify ino:1a2b sdev:800001 mflags:0 mask:... ignored_mask:0 ...
+//	fanotify mnt_id:1d mflags:0 mask:... ignored_mask:0
+func readWatches(pid, fd int, kind string) []FSWatch {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", pid, fd))
+	if err != nil {
+		return nil
+	}
+
+	var watches []FSWatch
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, kind+" ") {
+			continue
+		}
+		w := FSWatch{Kind: kind, FD: fd}
+		for _, field := range strings.Fields(line)[1:] {
+			key, value, _ := strings.Cut(field, ":")
+			switch key {
+			case "ino":
+				w.Inode, _ = strconv.ParseUint(value, 16, 64)
+			case "sdev":
+				// The kernel's dev_t: 12 bits major, 20 bits minor
+				if dev, err := strconv.ParseUint(value, 16, 32); err == nil {
+					w.Device = fmt.Sprintf("%d:%d", dev>>20, dev&0xfffff)
+				}
+			case "mnt_id":
+				id, _ := strconv.ParseInt(value, 16, 32)
+				w.MountID = int(id)
+			}
+		}
+		// The fanotify group line has flags but no mark
+		if w.Inode != 0 || w.MountID != 0 {
+			watches = append(watches, w)
+		}
+	}
+	return watches
+}
+
+// resolveWatchPaths fills in the Path of each watch. Mount marks resolve to
+// their mount point; inode watches are searched for below the mounts of
+// their device, which is bounded by maxWatchSearch.
+func resolveWatchPaths(pid int, watches []FSWatch) {
+	mounts := readMountInfo(pid)
+	root := fmt.Sprintf("/proc/%d/root", pid)
+
+	for _, m := range mounts {
+		wanted := make(map[uint64]bool)
+		for _, w := range watches {
+			if w.MountID != 0 && w.MountID == m.id {
+				continue
+			}
+			if w.Path == "" && w.Inode != 0 && w.Device == m.dev {
+				wanted[w.Inode] = true
+			}
+		}
+
+		var found map[uint64]string
+		if len(wanted) > 0 {
+			found = findInodes(root, m.mountPoint, wanted)
+		}
+		for i := range watches {
+			w := &watches[i]
+			if w.MountID != 0 && w.MountID == m.id {
+				w.Path = m.mountPoint
+			} else if path, ok := found[w.Inode]; ok && w.Path == "" && w.Device == m.dev {
+				w.Path = path
+			}
+		}
+	}
+}
+
+// findInodes searches breadth first below mountPoint, without leaving its
+// filesystem, for the wanted inodes and returns their paths relative to
+// root. Watched directories tend to be near the top, so breadth first finds
+// them long before maxWatchSearch entries have been looked at.
+func findInodes(root, mountPoint string, wanted map[uint64]bool) map[uint64]string {
+	start := filepath.Join(root, mountPoint)
+	startInfo, err := os.Stat(start)
+	if err != nil {
+		return nil
+	}
+	startStat := startInfo.Sys().(*syscall.Stat_t)
+
+	found := make(map[uint64]string)
+	if wanted[startStat.Ino] {
+		found[startStat.Ino] = mountPoint
+	}
+
+	queue := []string{mountPoint}
+	visited := 0
+	for len(queue) > 0 && len(found) < len(wanted) && visited < maxWatchSearch {
+		dir := queue[0]
+		queue = queue[1:]
+
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			visited++
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if stat.Dev != startStat.Dev {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if wanted[stat.Ino] {
+				found[stat.Ino] = path
+			}
+			if entry.IsDir() {
+				queue = append(queue, path)
+			}
+		}
+	}
+	return found
+}
+
+// printWatches lists the inotify watches and fanotify marks.
+func printWatches(watches []FSWatch) {
+	if len(watches) == 0 {
+		return
+	}
+
+	fmt.Printf("  Filesystem watches: %d\n", len(watches))
+	for _, w := range watches {
+		target := w.Path
+		switch {
+		case target == "" && w.MountID != 0:
+			target = fmt.Sprintf("(mount %d, unresolved)", w.MountID)
+		case target == "":
+			target = fmt.Sprintf("(inode %d on %s, unresolved)", w.Inode, w.Device)
+		case w.MountID != 0:
+			target += " (mount)"
+		}
+		fmt.Printf("    %-8s fd %-4d %s\n", w.Kind, w.FD, target)
+	}
+}
+
+// verifyWatchedPaths checks, before CRIU runs, that the paths the dumped
+// process watched with inotify exist below root. CRIU reopens them by path
+// and fails late and obscurely when one is gone.
+func verifyWatchedPaths(checkpointDir, root string) error {
+	info, err := loadAnalysis(checkpointDir)
+	if err != nil {
+		return nil
+	}
+
+	var missing []string
+	for _, w := range info.Watches {
+		if w.Path == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root, w.Path)); err != nil {
+			missing = append(missing, w.Path)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("watched paths do not exist:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openWorkDirFd wraps an inherited directory fd for --work-dir-fd. The
+// directory was opened by whoever started docker-cr, which may have had
+// privileges docker-cr no longer has.
+func openWorkDirFd(fd int) (*os.File, error) {
+	if fd < 3 {
+		return nil, fmt.Errorf("--work-dir-fd must be an inherited fd of 3 or more, not %d", fd)
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return nil, fmt.Errorf("invalid --work-dir-fd %d: %w", fd, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, fmt.Errorf("--work-dir-fd %d is not a directory", fd)
+	}
+
+	return os.NewFile(uintptr(fd), "work-dir"), nil
+}